@@ -0,0 +1,480 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// catColumn describes a column of a _cat table. Aliases are accepted by h and s parameters, numeric columns are
+// aligned to the right
+type catColumn struct {
+	name    string
+	aliases []string
+	numeric bool
+}
+
+// catTable is a result of a _cat request. Values of rows are strings, int64, float64 percents or catSize
+type catTable struct {
+	columns []catColumn
+	rows    [][]interface{}
+}
+
+// catSize is a size in bytes which is formatted according to bytes parameter
+type catSize int64
+
+// Size units accepted by bytes parameter
+var catSizeUnits = map[string]int64{
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+	"p":  1 << 50,
+	"pb": 1 << 50,
+}
+
+var catIndicesColumns = []catColumn{
+	{"health", []string{"h"}, false},
+	{"status", []string{"s"}, false},
+	{"index", []string{"i", "idx"}, false},
+	{"pri", []string{"p", "shards.primary", "shardsPrimary"}, true},
+	{"rep", []string{"r", "shards.replica", "shardsReplica"}, true},
+	{"docs.count", []string{"dc", "docsCount"}, true},
+	{"docs.deleted", []string{"dd", "docsDeleted"}, true},
+	{"store.size", []string{"ss", "storeSize"}, true},
+	{"pri.store.size", nil, true},
+}
+
+var catCountColumns = []catColumn{
+	{"epoch", []string{"t", "time"}, true},
+	{"timestamp", []string{"ts", "hms", "hhmmss"}, false},
+	{"count", []string{"dc", "docs.count", "docsCount"}, true},
+}
+
+var catHealthColumns = []catColumn{
+	{"epoch", []string{"t", "time"}, true},
+	{"timestamp", []string{"ts", "hms", "hhmmss"}, false},
+	{"cluster", []string{"cl"}, false},
+	{"status", []string{"st"}, false},
+	{"node.total", []string{"nt", "nodeTotal"}, true},
+	{"node.data", []string{"nd", "nodeData"}, true},
+	{"shards", []string{"sh", "shards.total", "shardsTotal"}, true},
+	{"pri", []string{"p", "shards.primary", "shardsPrimary"}, true},
+	{"relo", []string{"r", "shards.relocating", "shardsRelocating"}, true},
+	{"init", []string{"i", "shards.initializing", "shardsInitializing"}, true},
+	{"unassign", []string{"u", "shards.unassigned", "shardsUnassigned"}, true},
+	{"pending_tasks", []string{"pt", "pendingTasks"}, true},
+	{"max_task_wait_time", []string{"mtwt", "maxTaskWaitTime"}, true},
+	{"active_shards_percent", []string{"asp", "activeShardsPercent"}, true},
+}
+
+var catAliasesColumns = []catColumn{
+	{"alias", []string{"a"}, false},
+	{"index", []string{"i", "idx"}, false},
+	{"filter", []string{"f", "fi"}, false},
+	{"routing.index", []string{"ri", "routingIndex"}, false},
+	{"routing.search", []string{"rs", "routingSearch"}, false},
+	{"is_write_index", []string{"w", "isWriteIndex"}, false},
+}
+
+var catTemplatesColumns = []catColumn{
+	{"name", []string{"n"}, false},
+	{"index_patterns", []string{"t"}, false},
+	{"order", []string{"o", "p"}, true},
+	{"version", []string{"v"}, true},
+	{"composed_of", []string{"c"}, false},
+}
+
+var catIndicesHandlerPattern = regexp.MustCompile("^/_cat/indices/?(?P<index>[^/]*)")
+var catCountHandlerPattern = regexp.MustCompile("^/_cat/count/?(?P<index>[^/]*)")
+var catAliasesHandlerPattern = regexp.MustCompile("^/_cat/aliases/?(?P<alias>[^/]*)")
+
+// CatHandler lists available _cat endpoints
+func CatHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	text := "=^.^=\n" +
+		"/_cat/aliases\n/_cat/aliases/{alias}\n" +
+		"/_cat/count\n/_cat/count/{index}\n" +
+		"/_cat/health\n" +
+		"/_cat/indices\n/_cat/indices/{index}\n" +
+		"/_cat/templates\n"
+	return server.TextOutput{ContentType: "text/plain; charset=UTF-8", Text: text}, nil
+}
+
+// CatIndicesHandler lists indices with numbers of documents and sizes of their tables
+func CatIndicesHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	client := s.GetDBClient()
+	indices, err := resolveIndices(patternOrAll(catIndicesHandlerPattern.ReplaceAllString(endpoint, "${index}")), client)
+	if err != nil {
+		return nil, err
+	}
+	health, err := getClusterHealth(s, strings.Join(indices, ","), true)
+	if err != nil {
+		return nil, err
+	}
+	table := catTable{columns: catIndicesColumns}
+	for _, index := range indices {
+		statistics, err := indexStatistics(index, client)
+		if err != nil {
+			return nil, err
+		}
+		status, replicas, copies := "red", int64(0), int64(1)
+		if indexHealth, ok := health.Indices[index]; ok {
+			status, replicas, copies = indexHealth.Status, int64(indexHealth.NumberOfReplicas), int64(indexHealth.ActiveShards)
+		}
+		// Active replicas store the same tables, so they are counted in the total size
+		table.rows = append(table.rows, []interface{}{status, "open", index, int64(1), replicas, statistics.Documents,
+			statistics.DeletedDocuments, catSize(statistics.Size * copies), catSize(statistics.Size)})
+	}
+	return table.render(r.URL.Query())
+}
+
+// CatCountHandler returns number of documents in indices
+func CatCountHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	client := s.GetDBClient()
+	indices, err := resolveIndices(patternOrAll(catCountHandlerPattern.ReplaceAllString(endpoint, "${index}")), client)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	for _, index := range indices {
+		statistics, err := indexStatistics(index, client)
+		if err != nil {
+			return nil, err
+		}
+		count += statistics.Documents
+	}
+	now := time.Now()
+	table := catTable{columns: catCountColumns}
+	table.rows = append(table.rows, []interface{}{now.Unix(), now.Format("15:04:05"), count})
+	return table.render(r.URL.Query())
+}
+
+// CatHealthHandler returns health of the cluster as a table
+func CatHealthHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	health, err := getClusterHealth(s, "*", false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	table := catTable{columns: catHealthColumns}
+	table.rows = append(table.rows, []interface{}{now.Unix(), now.Format("15:04:05"), health.Name, health.Status,
+		int64(health.NumberOfNodes), int64(health.NumberOfDataNodes), int64(health.ActiveShards),
+		int64(health.ActivePrimaryShards), int64(health.RelocatingShards), int64(health.InitializingShards),
+		int64(health.UnassignedShards), int64(health.PendingTasks), "-", float64(health.ActiveShardsPercent)})
+	return table.render(r.URL.Query())
+}
+
+// CatAliasesHandler lists aliases defined in "aliases" section of options of indices
+func CatAliasesHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	client := s.GetDBClient()
+	indices, err := client.FindIndices("*")
+	if err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	patterns := strings.Split(patternOrAll(catAliasesHandlerPattern.ReplaceAllString(endpoint, "${alias}")), ",")
+	table := catTable{columns: catAliasesColumns}
+	for _, index := range indices {
+		indexRecord, err := client.GetIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		options, err := utils.ParseOptions(indexRecord.Options)
+		if err != nil {
+			return nil, err
+		}
+		aliases, _ := options["aliases"].(map[string]interface{})
+		for alias, definition := range aliases {
+			if !matchAnyCatPattern(patterns, alias) {
+				continue
+			}
+			definitionMap, _ := definition.(map[string]interface{})
+			filter := "-"
+			if _, ok := definitionMap["filter"]; ok {
+				filter = "*"
+			}
+			routingIndex, routingSearch := "-", "-"
+			if routing, ok := definitionMap["routing"]; ok {
+				routingIndex, routingSearch = fmt.Sprint(routing), fmt.Sprint(routing)
+			}
+			if routing, ok := definitionMap["index_routing"]; ok {
+				routingIndex = fmt.Sprint(routing)
+			}
+			if routing, ok := definitionMap["search_routing"]; ok {
+				routingSearch = fmt.Sprint(routing)
+			}
+			writeIndex := "-"
+			if isWriteIndex, ok := definitionMap["is_write_index"]; ok {
+				writeIndex = fmt.Sprint(isWriteIndex)
+			}
+			table.rows = append(table.rows, []interface{}{alias, index, filter, routingIndex, routingSearch, writeIndex})
+		}
+	}
+	sort.SliceStable(table.rows, func(i, j int) bool {
+		if table.rows[i][0] != table.rows[j][0] {
+			return table.rows[i][0].(string) < table.rows[j][0].(string)
+		}
+		return table.rows[i][1].(string) < table.rows[j][1].(string)
+	})
+	return table.render(r.URL.Query())
+}
+
+// CatTemplatesHandler lists index templates. Index templates are not supported, so the table is always empty
+func CatTemplatesHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	table := catTable{columns: catTemplatesColumns}
+	return table.render(r.URL.Query())
+}
+
+// Get statistics of an index as a sum of statistics of tables of its types
+func indexStatistics(index string, client *db.Client) (*db.TableStatistics, error) {
+	types, err := client.FindTypes(index, "*")
+	if err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	result := &db.TableStatistics{}
+	for _, typeName := range types {
+		statistics, err := client.GetTableStatistics(index, typeName)
+		if err != nil {
+			return nil, err
+		}
+		result.Documents += statistics.Documents
+		result.DeletedDocuments += statistics.DeletedDocuments
+		result.Size += statistics.Size
+	}
+	return result, nil
+}
+
+// Check if the name matches any of patterns with * wildcards
+func matchAnyCatPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		expression := "^" + strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1) + "$"
+		if regexp.MustCompile(expression).MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Render the table according to v, h, s, bytes and format parameters. Tables are rendered as text with aligned
+// columns or as a JSON array of objects
+func (table *catTable) render(params url.Values) (interface{}, error) {
+	columns, err := table.selectColumns(params.Get("h"))
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Get("s")) > 0 {
+		if err = table.sortRows(params.Get("s")); err != nil {
+			return nil, err
+		}
+	}
+	unit := params.Get("bytes")
+	if _, ok := catSizeUnits[unit]; len(unit) > 0 && !ok {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[cat] unknown bytes unit [%s]", unit))
+	}
+	values := make([][]string, len(table.rows))
+	for i, row := range table.rows {
+		for _, column := range columns {
+			values[i] = append(values[i], formatCatValue(row[column], unit))
+		}
+	}
+	switch params.Get("format") {
+	case "json":
+		result := make([]map[string]string, 0, len(values))
+		for _, row := range values {
+			object := make(map[string]string)
+			for i, column := range columns {
+				object[table.columns[column].name] = row[i]
+			}
+			result = append(result, object)
+		}
+		return result, nil
+	case "", "text", "txt":
+	default:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[cat] unknown format [%s]", params.Get("format")))
+	}
+	verbose := false
+	if v, ok := params["v"]; ok {
+		verbose = len(v) == 0 || (v[0] != "false" && v[0] != "0")
+	}
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		if verbose {
+			widths[i] = utf8.RuneCountInString(table.columns[column].name)
+		}
+		for _, row := range values {
+			if width := utf8.RuneCountInString(row[i]); width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	writeLine := func(line []string) {
+		var cells []string
+		for i, value := range line {
+			padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value))
+			if table.columns[columns[i]].numeric {
+				cells = append(cells, padding+value)
+			} else {
+				cells = append(cells, value+padding)
+			}
+		}
+		buffer.WriteString(strings.TrimRight(strings.Join(cells, " "), " ") + "\n")
+	}
+	if verbose {
+		var names []string
+		for _, column := range columns {
+			names = append(names, table.columns[column].name)
+		}
+		writeLine(names)
+	}
+	for _, row := range values {
+		writeLine(row)
+	}
+	return server.TextOutput{ContentType: "text/plain; charset=UTF-8", Text: buffer.String()}, nil
+}
+
+// Select columns listed in comma separated h parameter by names, aliases or wildcards. All columns are selected if
+// the parameter is empty
+func (table *catTable) selectColumns(h string) ([]int, error) {
+	var result []int
+	if len(h) == 0 {
+		for i := range table.columns {
+			result = append(result, i)
+		}
+		return result, nil
+	}
+	for _, name := range strings.Split(h, ",") {
+		name = strings.TrimSpace(name)
+		if strings.Contains(name, "*") {
+			for i, column := range table.columns {
+				if matchAnyCatPattern([]string{name}, column.name) {
+					result = append(result, i)
+				}
+			}
+			continue
+		}
+		column, ok := table.findColumn(name)
+		if !ok {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[cat] unknown column [%s]", name))
+		}
+		result = append(result, column)
+	}
+	return result, nil
+}
+
+// Find a column by its name or alias
+func (table *catTable) findColumn(name string) (int, bool) {
+	for i, column := range table.columns {
+		if column.name == name {
+			return i, true
+		}
+		for _, alias := range column.aliases {
+			if alias == name {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Sort rows by comma separated list of columns of s parameter. Each column could be suffixed by :asc or :desc
+func (table *catTable) sortRows(s string) error {
+	type sortKey struct {
+		column     int
+		descending bool
+	}
+	var keys []sortKey
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		column, ok := table.findColumn(parts[0])
+		if !ok {
+			return utils.NewIllegalQueryError(fmt.Sprintf("[cat] unable to sort by unknown column [%s]", parts[0]))
+		}
+		key := sortKey{column: column}
+		if len(parts) > 1 {
+			switch parts[1] {
+			case "asc":
+			case "desc":
+				key.descending = true
+			default:
+				return utils.NewIllegalQueryError(fmt.Sprintf("[cat] unknown sort order [%s]", parts[1]))
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.SliceStable(table.rows, func(i, j int) bool {
+		for _, key := range keys {
+			comparison := compareCatValues(table.rows[i][key.column], table.rows[j][key.column])
+			if comparison != 0 {
+				return (comparison < 0) != key.descending
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// Compare values of a column. Numbers and sizes are compared by value, other values as strings
+func compareCatValues(a, b interface{}) int {
+	var x, y float64
+	switch a := a.(type) {
+	case int64:
+		x, y = float64(a), float64(b.(int64))
+	case catSize:
+		x, y = float64(a), float64(b.(catSize))
+	case float64:
+		x, y = a, b.(float64)
+	default:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Format a value of a table. Sizes are formatted in the unit or in a human readable form if the unit is empty
+func formatCatValue(value interface{}, unit string) string {
+	switch value := value.(type) {
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', 1, 64) + "%"
+	case catSize:
+		if len(unit) > 0 {
+			return strconv.FormatInt(int64(value)/catSizeUnits[unit], 10)
+		}
+		return formatHumanSize(int64(value))
+	}
+	return fmt.Sprint(value)
+}
+
+// Format a size in bytes with the largest unit which keeps the value above one
+func formatHumanSize(size int64) string {
+	units := []string{"b", "kb", "mb", "gb", "tb", "pb"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	formatted := strconv.FormatFloat(value, 'f', 1, 64)
+	return strings.TrimSuffix(formatted, ".0") + units[unit]
+}
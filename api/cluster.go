@@ -1,33 +1,454 @@
 package api
 
 import (
+	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/db"
 	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 // ClusterHealth describes JSON schema for _cluster/health requests
 type clusterHealth struct {
-	Name                        string  `json:"cluster_name"`
-	Status                      string  `json:"status"`
-	TimedOut                    bool    `json:"timed_out"`
-	NumberOfNodes               int     `json:"number_of_nodes"`
-	ActivePrimaryShards         int     `json:"active_primary_shards"`
-	ActiveShards                int     `json:"active_shards"`
-	RelocatingShards            int     `json:"relocating_shards"`
-	InitializingShards          int     `json:"initializing_shards"`
-	UnassignedShards            int     `json:"unassigned_shards"`
-	DelayedUnassignedShards     int     `json:"delayed_unassigned_shards"`
-	PendingTasks                int     `json:"number_of_pending_tasks"`
-	InFlightFetch               int     `json:"number_of_in_flight_fetch"`
-	TaskMaxWaitingInQueueMillis int     `json:"task_max_waiting_in_queue_millis"`
-	ActiveShardsPercent         float32 `json:"active_shards_percent_as_number"`
-}
-
-// HealthHandler process a health-check response
-func HealthHandler(endpoint string, r *http.Request, server server.PGElasticServer) (interface{}, error) {
-	health := clusterHealth{}
-	health.Name = "pg_elastic_cluster"
-	health.Status = "yellow"
-	health.NumberOfNodes = 1
+	Name                        string                  `json:"cluster_name"`
+	Status                      string                  `json:"status"`
+	TimedOut                    bool                    `json:"timed_out"`
+	NumberOfNodes               int                     `json:"number_of_nodes"`
+	NumberOfDataNodes           int                     `json:"number_of_data_nodes"`
+	ActivePrimaryShards         int                     `json:"active_primary_shards"`
+	ActiveShards                int                     `json:"active_shards"`
+	RelocatingShards            int                     `json:"relocating_shards"`
+	InitializingShards          int                     `json:"initializing_shards"`
+	UnassignedShards            int                     `json:"unassigned_shards"`
+	DelayedUnassignedShards     int                     `json:"delayed_unassigned_shards"`
+	PendingTasks                int                     `json:"number_of_pending_tasks"`
+	InFlightFetch               int                     `json:"number_of_in_flight_fetch"`
+	TaskMaxWaitingInQueueMillis int                     `json:"task_max_waiting_in_queue_millis"`
+	ActiveShardsPercent         float32                 `json:"active_shards_percent_as_number"`
+	Indices                     map[string]*indexHealth `json:"indices,omitempty"`
+}
+
+// indexHealth describes health of an index. Each index is a single primary shard, streaming standby servers are its
+// active replicas and disconnected standby servers are its unassigned replicas
+type indexHealth struct {
+	Status              string `json:"status"`
+	NumberOfShards      int    `json:"number_of_shards"`
+	NumberOfReplicas    int    `json:"number_of_replicas"`
+	ActivePrimaryShards int    `json:"active_primary_shards"`
+	ActiveShards        int    `json:"active_shards"`
+	RelocatingShards    int    `json:"relocating_shards"`
+	InitializingShards  int    `json:"initializing_shards"`
+	UnassignedShards    int    `json:"unassigned_shards"`
+}
+
+type clusterStats struct {
+	Timestamp int64                `json:"timestamp"`
+	Name      string               `json:"cluster_name"`
+	Status    string               `json:"status"`
+	Indices   clusterIndicesStats  `json:"indices"`
+	Nodes     clusterNodesStats    `json:"nodes"`
+	Postgres  postgresDatabaseInfo `json:"postgres"`
+}
+
+type clusterIndicesStats struct {
+	Count  int               `json:"count"`
+	Types  int               `json:"types"`
+	Shards clusterShardStats `json:"shards"`
+	Docs   docsStats         `json:"docs"`
+	Store  storeStats        `json:"store"`
+}
+
+type clusterShardStats struct {
+	Total       int     `json:"total"`
+	Primaries   int     `json:"primaries"`
+	Replication float64 `json:"replication"`
+}
+
+type docsStats struct {
+	Count   int64 `json:"count"`
+	Deleted int64 `json:"deleted"`
+}
+
+type storeStats struct {
+	SizeInBytes int64 `json:"size_in_bytes"`
+}
+
+type clusterNodesStats struct {
+	Count   map[string]int `json:"count"`
+	OS      nodeOSInfo     `json:"os"`
+	Runtime runtimeStats   `json:"runtime"`
+}
+
+// postgresDatabaseInfo describes the database which stores documents. Statistics are taken from pg_stat_database
+type postgresDatabaseInfo struct {
+	Address        string     `json:"address"`
+	Database       string     `json:"database"`
+	Version        string     `json:"version"`
+	InRecovery     bool       `json:"in_recovery"`
+	MaxConnections int        `json:"max_connections"`
+	Backends       int        `json:"backends"`
+	Commits        int64      `json:"xact_commit"`
+	Rollbacks      int64      `json:"xact_rollback"`
+	BlocksRead     int64      `json:"blks_read"`
+	BlocksHit      int64      `json:"blks_hit"`
+	CacheHitRatio  float64    `json:"cache_hit_ratio"`
+	TuplesReturned int64      `json:"tup_returned"`
+	TuplesFetched  int64      `json:"tup_fetched"`
+	TuplesInserted int64      `json:"tup_inserted"`
+	TuplesUpdated  int64      `json:"tup_updated"`
+	TuplesDeleted  int64      `json:"tup_deleted"`
+	Conflicts      int64      `json:"conflicts"`
+	Deadlocks      int64      `json:"deadlocks"`
+	SizeInBytes    int64      `json:"size_in_bytes"`
+	StatsReset     *time.Time `json:"stats_reset,omitempty"`
+	Pool           poolStats  `json:"pool"`
+}
+
+type poolStats struct {
+	Size       int   `json:"size"`
+	Total      int   `json:"total"`
+	Idle       int   `json:"idle"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Timeouts   int64 `json:"timeouts"`
+	StaleConns int64 `json:"stale_conns"`
+}
+
+type clusterState struct {
+	Name         string               `json:"cluster_name"`
+	MasterNode   string               `json:"master_node,omitempty"`
+	Nodes        map[string]stateNode `json:"nodes,omitempty"`
+	Metadata     *stateMetadata       `json:"metadata,omitempty"`
+	RoutingTable *stateRoutingTable   `json:"routing_table,omitempty"`
+}
+
+type stateNode struct {
+	Name             string `json:"name"`
+	TransportAddress string `json:"transport_address"`
+}
+
+type stateMetadata struct {
+	Indices map[string]stateIndexMetadata `json:"indices"`
+}
+
+type stateIndexMetadata struct {
+	State    string                            `json:"state"`
+	Settings map[string]interface{}            `json:"settings"`
+	Mappings map[string]map[string]interface{} `json:"mappings"`
+	Aliases  []string                          `json:"aliases"`
+}
+
+type stateRoutingTable struct {
+	Indices map[string]stateIndexRouting `json:"indices"`
+}
+
+type stateIndexRouting struct {
+	Shards map[string][]shardRouting `json:"shards"`
+}
+
+type shardRouting struct {
+	State   string `json:"state"`
+	Primary bool   `json:"primary"`
+	Node    string `json:"node"`
+	Shard   int    `json:"shard"`
+	Index   string `json:"index"`
+}
+
+// Name of the cluster reported by all APIs
+const clusterName = "pg_elastic_cluster"
+
+// Default time to wait for a status of the cluster and interval between checks of the health
+const (
+	defaultHealthTimeout = 30 * time.Second
+	healthCheckInterval  = 200 * time.Millisecond
+)
+
+// Statuses of health ordered from the best to the worst
+var healthStatuses = map[string]int{"green": 0, "yellow": 1, "red": 2}
+
+// Metrics of the cluster state which could be requested
+var clusterStateMetrics = []string{"master_node", "nodes", "metadata", "routing_table"}
+
+var healthHandlerPattern = regexp.MustCompile("^/_cluster/health/?(?P<index>[^/]*)")
+var clusterStateHandlerPattern = regexp.MustCompile("^/_cluster/state/?(?P<metrics>[^/]*)/?(?P<index>[^/]*)")
+
+// HealthHandler process a health-check response. With wait_for_status the health is checked until the cluster
+// reaches the status or the timeout expires
+func HealthHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	params := r.URL.Query()
+	indexPattern := patternOrAll(healthHandlerPattern.ReplaceAllString(endpoint, "${index}"))
+	level := params.Get("level")
+	if len(level) > 0 && level != "cluster" && level != "indices" {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[level] unsupported value [%s]", level))
+	}
+	waitForStatus := params.Get("wait_for_status")
+	if _, ok := healthStatuses[waitForStatus]; len(waitForStatus) > 0 && !ok {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[wait_for_status] unknown status [%s]", waitForStatus))
+	}
+	timeout := defaultHealthTimeout
+	if len(params.Get("timeout")) > 0 {
+		var err error
+		if timeout, err = search.ParseDuration(params.Get("timeout")); err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		health, err := getClusterHealth(s, indexPattern, level == "indices")
+		if err != nil {
+			return nil, err
+		}
+		if len(waitForStatus) == 0 || healthStatuses[health.Status] <= healthStatuses[waitForStatus] {
+			return health, nil
+		}
+		if !time.Now().Before(deadline) {
+			health.TimedOut = true
+			return server.StatusOutput{StatusCode: http.StatusRequestTimeout, Output: health}, nil
+		}
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+// ClusterStatsHandler returns statistics of indices, the node and the database
+func ClusterStatsHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	health, err := getClusterHealth(s, "*", false)
+	if err != nil {
+		return nil, err
+	}
+	client := s.GetDBClient()
+	indices, err := client.FindIndices("*")
+	if err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	stats := clusterStats{Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Name: clusterName, Status: health.Status}
+	stats.Indices.Count = len(indices)
+	for _, index := range indices {
+		types, err := client.FindTypes(index, "*")
+		if err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+		stats.Indices.Types += len(types)
+		statistics, err := indexStatistics(index, client)
+		if err != nil {
+			return nil, err
+		}
+		stats.Indices.Docs.Count += statistics.Documents
+		stats.Indices.Docs.Deleted += statistics.DeletedDocuments
+		stats.Indices.Store.SizeInBytes += statistics.Size
+	}
+	stats.Indices.Shards.Primaries = health.ActivePrimaryShards
+	stats.Indices.Shards.Total = health.ActiveShards
+	if health.ActivePrimaryShards > 0 {
+		stats.Indices.Shards.Replication = float64(health.ActiveShards-health.ActivePrimaryShards) / float64(health.ActivePrimaryShards)
+	}
+	stats.Nodes.Count = map[string]int{"total": health.NumberOfNodes, "data": health.NumberOfDataNodes, "master": 1, "ingest": 1}
+	stats.Nodes.OS = getNodeOSInfo()
+	stats.Nodes.Runtime = getRuntimeStats()
+	if stats.Postgres, err = getPostgresDatabaseInfo(s); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ClusterStateHandler returns metadata and routing of indices. The response could be limited to comma separated
+// metrics and indices matching patterns
+func ClusterStateHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	metrics := patternOrAll(clusterStateHandlerPattern.ReplaceAllString(endpoint, "${metrics}"))
+	requested := make(map[string]bool)
+	for _, metric := range strings.Split(metrics, ",") {
+		switch metric {
+		case "*":
+			for _, name := range clusterStateMetrics {
+				requested[name] = true
+			}
+		case "master_node", "nodes", "metadata", "routing_table":
+			requested[metric] = true
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[_cluster/state] unknown metric [%s]", metric))
+		}
+	}
+	client := s.GetDBClient()
+	indices, err := resolveIndices(patternOrAll(clusterStateHandlerPattern.ReplaceAllString(endpoint, "${index}")), client)
+	if err != nil {
+		return nil, err
+	}
+	id := nodeID(s)
+	state := clusterState{Name: clusterName}
+	if requested["master_node"] {
+		state.MasterNode = id
+	}
+	if requested["nodes"] {
+		state.Nodes = map[string]stateNode{id: {Name: nodeName(), TransportAddress: nodeAddress(s)}}
+	}
+	if requested["metadata"] {
+		state.Metadata = &stateMetadata{Indices: make(map[string]stateIndexMetadata)}
+		for _, index := range indices {
+			metadata, err := getIndexMetadata(index, client)
+			if err != nil {
+				return nil, err
+			}
+			state.Metadata.Indices[index] = *metadata
+		}
+	}
+	if requested["routing_table"] {
+		health, err := getClusterHealth(s, strings.Join(indices, ","), true)
+		if err != nil {
+			return nil, err
+		}
+		state.RoutingTable = &stateRoutingTable{Indices: make(map[string]stateIndexRouting)}
+		for _, index := range indices {
+			routing := []shardRouting{{State: "STARTED", Primary: true, Node: id, Index: index}}
+			if indexHealth, ok := health.Indices[index]; ok {
+				for i := 0; i < indexHealth.NumberOfReplicas; i++ {
+					replica := shardRouting{State: "STARTED", Index: index}
+					if i >= indexHealth.ActiveShards-indexHealth.ActivePrimaryShards {
+						replica.State = "UNASSIGNED"
+					}
+					routing = append(routing, replica)
+				}
+			}
+			state.RoutingTable.Indices[index] = stateIndexRouting{Shards: map[string][]shardRouting{"0": routing}}
+		}
+	}
+	return state, nil
+}
+
+// Get health of the cluster and indices matching patterns. The cluster is red if the database doesn't respond and
+// yellow if some standby servers don't stream changes or all connections of the pool are busy
+func getClusterHealth(s server.PGElasticServer, indexPatterns string, indicesLevel bool) (clusterHealth, error) {
+	health := clusterHealth{Name: clusterName, Status: "green", NumberOfNodes: 1, ActiveShardsPercent: 100}
+	client := s.GetDBClient()
+	if err := client.Ping(); err != nil {
+		health.Status = "red"
+		health.ActiveShardsPercent = 0
+		return health, nil
+	}
+	health.NumberOfDataNodes = 1
+	replication, err := client.GetReplicationStatus()
+	if err != nil {
+		return health, err
+	}
+	indices, err := resolveIndices(indexPatterns, client)
+	if err != nil {
+		return health, err
+	}
+	replicas := replication.Replicas + replication.InactiveSlots
+	activeReplicas := replication.StreamingReplicas
+	if indicesLevel {
+		health.Indices = make(map[string]*indexHealth)
+	}
+	for _, index := range indices {
+		result := &indexHealth{
+			Status:              "green",
+			NumberOfShards:      1,
+			NumberOfReplicas:    replicas,
+			ActivePrimaryShards: 1,
+			ActiveShards:        1 + activeReplicas,
+			UnassignedShards:    replicas - activeReplicas,
+		}
+		if result.UnassignedShards > 0 {
+			result.Status = "yellow"
+		}
+		health.ActivePrimaryShards += result.ActivePrimaryShards
+		health.ActiveShards += result.ActiveShards
+		health.UnassignedShards += result.UnassignedShards
+		if indicesLevel {
+			health.Indices[index] = result
+		}
+	}
+	if total := health.ActiveShards + health.UnassignedShards; total > 0 {
+		health.ActiveShardsPercent = float32(100 * float64(health.ActiveShards) / float64(total))
+	}
+	pool := client.GetPoolStatistics()
+	saturated := pool.Total-pool.Idle >= pool.Size
+	if health.UnassignedShards > 0 || (replication.InRecovery && !replication.Receiving) || saturated {
+		health.Status = "yellow"
+	}
 	return health, nil
 }
+
+// Get information and statistics of the database of the server
+func getPostgresDatabaseInfo(s server.PGElasticServer) (postgresDatabaseInfo, error) {
+	config := s.GetConfiguration().PostgresConfig
+	info := postgresDatabaseInfo{Address: config.ServerAddress, Database: config.DBName}
+	client := s.GetDBClient()
+	pool := client.GetPoolStatistics()
+	info.Pool = poolStats{pool.Size, pool.Total, pool.Idle, pool.Hits, pool.Misses, pool.Timeouts, pool.StaleConns}
+	statistics, err := client.GetDatabaseStatistics()
+	if err != nil {
+		return info, err
+	}
+	replication, err := client.GetReplicationStatus()
+	if err != nil {
+		return info, err
+	}
+	info.Version = statistics.Version
+	info.InRecovery = replication.InRecovery
+	info.MaxConnections = statistics.MaxConnections
+	info.Backends = statistics.Backends
+	info.Commits = statistics.Commits
+	info.Rollbacks = statistics.Rollbacks
+	info.BlocksRead = statistics.BlocksRead
+	info.BlocksHit = statistics.BlocksHit
+	if blocks := statistics.BlocksRead + statistics.BlocksHit; blocks > 0 {
+		info.CacheHitRatio = float64(statistics.BlocksHit) / float64(blocks)
+	}
+	info.TuplesReturned = statistics.TuplesReturned
+	info.TuplesFetched = statistics.TuplesFetched
+	info.TuplesInserted = statistics.TuplesInserted
+	info.TuplesUpdated = statistics.TuplesUpdated
+	info.TuplesDeleted = statistics.TuplesDeleted
+	info.Conflicts = statistics.Conflicts
+	info.Deadlocks = statistics.Deadlocks
+	info.SizeInBytes = statistics.Size
+	info.StatsReset = statistics.StatsReset
+	return info, nil
+}
+
+// Get settings, mappings of types and aliases of an index
+func getIndexMetadata(index string, client *db.Client) (*stateIndexMetadata, error) {
+	indexRecord, err := client.GetIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	options, err := utils.ParseOptions(indexRecord.Options)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &stateIndexMetadata{
+		State:    "open",
+		Settings: utils.ExtractIndexSettings(options),
+		Mappings: make(map[string]map[string]interface{}),
+		Aliases:  []string{},
+	}
+	types, err := client.FindTypes(index, "*")
+	if err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	for _, typeName := range types {
+		docType, err := client.GetType(index, typeName)
+		if err != nil {
+			return nil, err
+		}
+		ctx, err := search.NewQueryContext(indexRecord, docType, client)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Mappings[typeName] = ctx.Mapping
+		if ctx.Mapping == nil {
+			metadata.Mappings[typeName] = make(map[string]interface{})
+		}
+	}
+	if aliases, ok := options["aliases"].(map[string]interface{}); ok {
+		for alias := range aliases {
+			metadata.Aliases = append(metadata.Aliases, alias)
+		}
+		sort.Strings(metadata.Aliases)
+	}
+	return metadata, nil
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/asp437/pg_elastic/api/search"
 	"github.com/asp437/pg_elastic/db"
 	"github.com/asp437/pg_elastic/server"
@@ -21,10 +22,20 @@ type shardInfo struct {
 
 type searchHits struct {
 	MaxScore float32                  `json:"max_score"`
-	Total    int                      `json:"total"`
+	Total    interface{}              `json:"total,omitempty"`
 	Hits     []documentSearchResponse `json:"hits"`
 }
 
+type totalHits struct {
+	Value    int    `json:"value"`
+	Relation string `json:"relation"`
+}
+
+type countResponse struct {
+	Count  int       `json:"count"`
+	Shards shardInfo `json:"_shards"`
+}
+
 type documentPutResponse struct {
 	Shards  shardInfo `json:"_shards"`
 	Index   string    `json:"_index"`
@@ -41,31 +52,50 @@ type documentGetResponse struct {
 	ID       string      `json:"_id"`
 	Version  int         `json:"_version"`
 	Found    bool        `json:"found"`
-	Document interface{} `json:"_source"`
+	Document interface{} `json:"_source,omitempty"`
+	Fields   interface{} `json:"fields,omitempty"`
+}
+
+type multiGetResponse struct {
+	Docs []documentGetResponse `json:"docs"`
 }
 
 type documentSearchResponse struct {
-	Index    string      `json:"_index"`
-	Type     string      `json:"_type"`
-	ID       string      `json:"_id"`
-	Score    float32     `json:"_score"`
-	Document interface{} `json:"_source"`
+	Index     string      `json:"_index"`
+	Type      string      `json:"_type"`
+	ID        string      `json:"_id"`
+	Score     float32     `json:"_score"`
+	Document  interface{} `json:"_source,omitempty"`
+	Sort      interface{} `json:"sort,omitempty"`
+	InnerHits interface{} `json:"inner_hits,omitempty"`
+	Highlight interface{} `json:"highlight,omitempty"`
+	Fields    interface{} `json:"fields,omitempty"`
 }
 
 type searchResponse struct {
-	Took     int        `json:"took"`
-	TimedOut bool       `json:"timed_out"`
-	Shards   shardInfo  `json:"_shards"`
-	Hits     searchHits `json:"hits"`
+	PitID           string                           `json:"pit_id,omitempty"`
+	Took            int                              `json:"took"`
+	TimedOut        bool                             `json:"timed_out"`
+	TerminatedEarly *bool                            `json:"terminated_early,omitempty"`
+	Shards          shardInfo                        `json:"_shards"`
+	Hits            searchHits                       `json:"hits"`
+	Aggregations    map[string]interface{}           `json:"aggregations,omitempty"`
+	Suggest         map[string][]search.SuggestEntry `json:"suggest,omitempty"`
+	ExplainSQL      *sqlExplanation                  `json:"explain_sql,omitempty"`
+}
+
+type sqlExplanation struct {
+	SQL  string      `json:"sql"`
+	Plan interface{} `json:"plan"`
 }
 
-func formatDocumentSearchResponse(index, typeName string, doc db.ElasticSearchDocument) documentSearchResponse {
+func formatDocumentSearchResponse(hit db.SearchHit) documentSearchResponse {
 	return documentSearchResponse{
-		Index:    index,
-		Type:     typeName,
-		ID:       doc.ID,
-		Score:    1.0,
-		Document: doc.Document,
+		Index:    hit.Index,
+		Type:     hit.Type,
+		ID:       hit.ID,
+		Score:    float32(hit.Score),
+		Document: hit.Document,
 	}
 }
 
@@ -117,31 +147,164 @@ func PutDocumentHandler(index, typeName, endpoint string, r *http.Request, s ser
 
 // GetDocumentHandler handles request to get document from storage
 func GetDocumentHandler(index, typeName, endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
-	documentID := endpoint
-	documentObject, err := s.GetDBClient().GetDocument(index, typeName, documentID)
+	params := r.URL.Query()
+	var storedFields interface{}
+	if fields := params.Get("stored_fields"); len(fields) > 0 {
+		storedFields = fields
+	}
+	docs, err := getDocuments(index, typeName, []string{endpoint}, search.URISource(params, nil), storedFields, s)
 	if err != nil {
 		return nil, err
 	}
-	if documentObject != nil {
-		response = documentGetResponse{
-			Index:    index,
-			Type:     typeName,
-			ID:       documentObject.ID,
-			Version:  documentObject.Version,
-			Found:    true,
-			Document: documentObject.Document,
+	return docs[0], nil
+}
+
+// MultiGetDocumentHandler handles request to get several documents by their IDs. Documents are listed in docs section
+// of the body with their own index, type, _source and stored_fields or in ids section for the type of the request
+func MultiGetDocumentHandler(index, typeName, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	var rawBody map[string]interface{}
+	if err = json.Unmarshal(body, &rawBody); err != nil {
+		return nil, utils.NewJSONWrongFormatError(err.Error())
+	}
+	params := r.URL.Query()
+	source := search.URISource(params, nil)
+	var storedFields interface{}
+	if fields := params.Get("stored_fields"); len(fields) > 0 {
+		storedFields = fields
+	}
+	response := multiGetResponse{Docs: []documentGetResponse{}}
+	if rawIds, ok := rawBody["ids"].([]interface{}); ok {
+		if len(index) == 0 {
+			return nil, utils.NewIllegalQueryError("[ids] require index to be specified in request path")
 		}
-	} else {
-		response = documentGetResponse{
-			Index: index,
-			Type:  typeName,
-			Found: false,
+		var ids []string
+		for _, id := range rawIds {
+			ids = append(ids, fmt.Sprint(id))
 		}
-
+		docs, err := getDocuments(index, typeName, ids, source, storedFields, s)
+		if err != nil {
+			return nil, err
+		}
+		response.Docs = docs
+		return response, nil
+	}
+	rawDocs, ok := rawBody["docs"].([]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[mget] requires 'docs' or 'ids' to be specified")
+	}
+	for _, rawDoc := range rawDocs {
+		doc, ok := rawDoc.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[docs] must be an array of objects")
+		}
+		docIndex, docType, docSource, docStoredFields := index, typeName, source, storedFields
+		if v, ok := doc["_index"].(string); ok {
+			docIndex = v
+		}
+		if v, ok := doc["_type"].(string); ok {
+			docType = v
+		}
+		if v, ok := doc["_source"]; ok {
+			docSource = v
+		}
+		if v, ok := doc["stored_fields"]; ok {
+			docStoredFields = v
+		}
+		id, ok := doc["_id"]
+		if !ok || len(docIndex) == 0 {
+			return nil, utils.NewIllegalQueryError("[docs] require '_index' and '_id' to be specified")
+		}
+		docs, err := getDocuments(docIndex, docType, []string{fmt.Sprint(id)}, docSource, docStoredFields, s)
+		if err != nil {
+			return nil, err
+		}
+		response.Docs = append(response.Docs, docs...)
 	}
 	return response, nil
 }
 
+// MultiGetIndexDocumentHandler handles request to get several documents of the index
+func MultiGetIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_mget")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return MultiGetDocumentHandler(indexName, "", endpoint, r, s)
+}
+
+// MultiGetAllDocumentHandler handles request to get several documents of any index
+func MultiGetAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return MultiGetDocumentHandler("", "", endpoint, r, s)
+}
+
+// Get documents by IDs in the order of IDs. Documents are looked for in all types of the index if type is not
+// specified. Stored fields are returned in fields section and disable _source unless it is requested explicitly
+func getDocuments(index, typeName string, ids []string, source, storedFields interface{}, s server.PGElasticServer) ([]documentGetResponse, error) {
+	client := s.GetDBClient()
+	if storedFields != nil && source == nil {
+		source = false
+	}
+	sourceExpression, err := search.SourceFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	types := []string{typeName}
+	if len(typeName) == 0 {
+		if types, err = client.FindTypes(index, "*"); err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+	}
+	found := make(map[string]documentGetResponse)
+	for _, docTypeName := range types {
+		var fields string
+		if storedFields != nil {
+			indexRecord, err := client.GetIndex(index)
+			if err != nil {
+				return nil, err
+			}
+			docType, err := client.GetType(index, docTypeName)
+			if err != nil {
+				return nil, err
+			}
+			ctx, err := search.NewQueryContext(indexRecord, docType, client)
+			if err != nil {
+				return nil, err
+			}
+			if fields, err = ctx.FieldsExpression(listParameter(storedFields)); err != nil {
+				return nil, err
+			}
+		}
+		hits, err := client.GetDocuments(index, docTypeName, ids, sourceExpression, fields)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range hits {
+			if _, ok := found[hit.ID]; !ok {
+				found[hit.ID] = documentGetResponse{
+					Index:    hit.Index,
+					Type:     hit.Type,
+					ID:       hit.ID,
+					Version:  hit.Version,
+					Found:    true,
+					Document: hit.Document,
+					Fields:   hit.Fields,
+				}
+			}
+		}
+	}
+	var docs []documentGetResponse
+	for _, id := range ids {
+		doc, ok := found[id]
+		if !ok {
+			doc = documentGetResponse{Index: index, Type: typeName, ID: id, Found: false}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
 // DeleteDocumentHandler handles request to delete document from storage
 func DeleteDocumentHandler(index, typeName, endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
 	documentID := endpoint
@@ -172,70 +335,46 @@ func DeleteDocumentHandler(index, typeName, endpoint string, r *http.Request, s
 // FindDocumentHandler handles request to find document on storage
 func FindDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
 	startTime := time.Now()
-	var parsedQuery interface{}
-	indices, err := s.GetDBClient().FindIndices(indexPattern)
+	request, err := parseSearchRequest(r)
 	if err != nil {
-		return nil, utils.NewInternalError(err.Error())
+		return nil, err
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	result, err := executeSearch(indexPattern, typePattern, request, s)
 	if err != nil {
-		return nil, utils.NewInternalIOError(err.Error())
+		return nil, err
 	}
+	result.Took = (int)(time.Since(startTime).Nanoseconds() / 1000000.0)
+	return result, nil
+}
 
-	err = json.Unmarshal(body, &parsedQuery)
+// CountDocumentHandler handles request to count documents matching a query
+func CountDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	request, err := parseSearchRequest(r)
 	if err != nil {
-		return nil, utils.NewJSONWrongFormatError(err.Error())
+		return nil, err
 	}
-
-	for _, index := range indices {
-		types, err := s.GetDBClient().FindTypes(index, typePattern)
-		if err != nil {
-			return nil, utils.NewInternalError(err.Error())
-		}
-		for _, typeName := range types {
-			for k, v := range parsedQuery.(map[string]interface{}) {
-				switch k {
-				case "query":
-					var typeMapping map[string]interface{}
-
-					// Get type mapping from system type record
-					docType, err := s.GetDBClient().GetType(index, typeName)
-					if err != nil {
-						return nil, err
-					}
-					json.Unmarshal([]byte(docType.Options), &typeMapping)
-
-					query := s.GetDBClient().NewQuery(index, typeName)
-					search.ParseSearchQuery(v.(map[string]interface{}), query, typeMapping)
-					docs, err := s.GetDBClient().ProcessSearchQuery(index, typeName, query)
-					if err != nil {
-						return nil, err
-					}
-					response := searchResponse{
-						Took:     1,
-						TimedOut: false,
-						Shards:   shardInfo{1, 0, 1},
-						Hits: searchHits{
-							MaxScore: 0,
-							Total:    0,
-							Hits:     []documentSearchResponse{},
-						},
-					}
-					for _, doc := range docs {
-						docResponse := formatDocumentSearchResponse(index, typeName, doc)
-						response.Hits.Hits = append(response.Hits.Hits, docResponse)
-						if response.Hits.MaxScore < docResponse.Score {
-							response.Hits.MaxScore = docResponse.Score
-						}
-						response.Hits.Total += 1
-					}
-					response.Took = (int)(time.Since(startTime).Nanoseconds() / 1000000.0)
-					return response, nil
-				}
-			}
-		}
+	client := s.GetDBClient()
+	query, _, err := buildSearchQuery(indexPattern, typePattern, request, client)
+	if err != nil {
+		return nil, err
 	}
-	return nil, utils.NewIllegalQueryError("Illegal search query")
+	count, err := client.CountSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return countResponse{Count: count, Shards: shardInfo{1, 0, 1}}, nil
+}
+
+// CountIndexDocumentHandler handles request to count documents of any type
+func CountIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_count")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return CountDocumentHandler(indexName, "*", endpoint, r, s)
+}
+
+// CountAllDocumentHandler handles request to count documents of any index
+func CountAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return CountDocumentHandler("*", "*", endpoint, r, s)
 }
 
 // FindIndexDocumentHandler handles request to find document of any type on storage
@@ -244,3 +383,8 @@ func FindIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElast
 	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
 	return FindDocumentHandler(indexName, "*", endpoint, r, s)
 }
+
+// FindAllDocumentHandler handles request to find document of any index on storage
+func FindAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return FindDocumentHandler("*", "*", endpoint, r, s)
+}
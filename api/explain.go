@@ -0,0 +1,182 @@
+package api
+
+import (
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type validateResponse struct {
+	Valid        bool                  `json:"valid"`
+	Shards       shardInfo             `json:"_shards"`
+	Error        string                `json:"error,omitempty"`
+	Explanations []validateExplanation `json:"explanations,omitempty"`
+}
+
+type validateExplanation struct {
+	Index       string `json:"index"`
+	Type        string `json:"type"`
+	Valid       bool   `json:"valid"`
+	Explanation string `json:"explanation,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type explainResponse struct {
+	Index       string              `json:"_index"`
+	Type        string              `json:"_type"`
+	ID          string              `json:"_id"`
+	Matched     bool                `json:"matched"`
+	Explanation *search.Explanation `json:"explanation,omitempty"`
+}
+
+var explainHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_explain/(?P<id>[^/]+)")
+
+// ValidateQueryDocumentHandler handles request to validate a query without execution. A query is valid if it could be
+// converted into SQL and the statement could be planned by the database. SQL statements of all searched types are
+// returned with explain parameter
+func ValidateQueryDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	params := r.URL.Query()
+	explain := params.Get("explain") == "true"
+	response := validateResponse{Valid: true, Shards: shardInfo{1, 0, 1}}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	explanations, err := validateQuery(indexPattern, typePattern, body, r, s)
+	for _, explanation := range explanations {
+		response.Valid = response.Valid && explanation.Valid
+		if explain {
+			response.Explanations = append(response.Explanations, explanation)
+		}
+	}
+	if err != nil {
+		response.Valid = false
+		if explain {
+			response.Error = errorReason(err)
+		}
+	}
+	return response, nil
+}
+
+// Convert a query into SQL and validate statements of all searched types by the database
+func validateQuery(indexPattern, typePattern string, body []byte, r *http.Request, s server.PGElasticServer) ([]validateExplanation, error) {
+	request, err := parseSearchBody(body, r.URL.Query(), r.Header.Get("Accept"))
+	if err != nil {
+		return nil, err
+	}
+	if request.Query == nil {
+		return nil, utils.NewIllegalQueryError("[validate] requires query to be specified")
+	}
+	// Only the query is validated
+	validated := &searchRequest{Query: request.Query}
+	client := s.GetDBClient()
+	query, _, err := buildSearchQuery(indexPattern, typePattern, validated, client)
+	if err != nil {
+		return nil, err
+	}
+	var explanations []validateExplanation
+	for _, source := range query.Sources {
+		statement := source.SQL()
+		explanation := validateExplanation{Index: source.Index, Type: source.Type, Valid: true, Explanation: statement}
+		if _, err := client.ExplainSQL(statement); err != nil {
+			explanation.Valid = false
+			explanation.Error = errorReason(err)
+		}
+		explanations = append(explanations, explanation)
+	}
+	return explanations, nil
+}
+
+// ValidateQueryIndexDocumentHandler handles request to validate a query over documents of the index
+func ValidateQueryIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_validate/query")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return ValidateQueryDocumentHandler(indexName, "*", endpoint, r, s)
+}
+
+// ValidateQueryAllDocumentHandler handles request to validate a query over documents of any index
+func ValidateQueryAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return ValidateQueryDocumentHandler("*", "*", endpoint, r, s)
+}
+
+// ExplainDocumentHandler handles request to explain whether and why a document matches a query. Endpoint is
+// "<id>/_explain". Explanation contains scores of all subqueries of compound queries
+func ExplainDocumentHandler(index, typeName, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	id := strings.TrimSuffix(endpoint, "/_explain")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	request, err := parseSearchBody(body, r.URL.Query(), r.Header.Get("Accept"))
+	if err != nil {
+		return nil, err
+	}
+	if request.Query == nil {
+		return nil, utils.NewIllegalQueryError("[explain] requires query to be specified")
+	}
+	client := s.GetDBClient()
+	indexRecord, err := client.GetIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	response := explainResponse{Index: index, Type: typeName, ID: id}
+	if indexRecord == nil {
+		return response, nil
+	}
+	// Document is looked for in all types of the index if type is not specified
+	types := []string{typeName}
+	if len(typeName) == 0 {
+		if types, err = client.FindTypes(index, "*"); err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+	}
+	for _, docTypeName := range types {
+		docType, err := client.GetType(index, docTypeName)
+		if err != nil {
+			return nil, err
+		}
+		if docType == nil {
+			continue
+		}
+		ctx, err := search.NewQueryContext(indexRecord, docType, client)
+		if err != nil {
+			return nil, err
+		}
+		explanation, err := search.ExplainQuery(request.Query, ctx)
+		if err != nil {
+			return nil, err
+		}
+		values, err := client.EvaluateDocument(index, docTypeName, id, explanation.Expressions())
+		if err != nil {
+			return nil, err
+		}
+		if values == nil {
+			continue
+		}
+		explanation.Evaluate(values)
+		response.Type = docTypeName
+		response.Matched = explanation.Matched
+		response.Explanation = explanation
+		break
+	}
+	return response, nil
+}
+
+// ExplainIndexDocumentHandler handles request to explain a query over a document of any type of the index
+func ExplainIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	indexName := explainHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	id := explainHandlerPattern.ReplaceAllString(endpoint, "${id}")
+	return ExplainDocumentHandler(indexName, "", id+"/_explain", r, s)
+}
+
+// Get reason of an error to be reported inside a response
+func errorReason(err error) string {
+	if elasticError, ok := err.(utils.ElasticError); ok {
+		return elasticError.Reason()
+	}
+	return err.Error()
+}
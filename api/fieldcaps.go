@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type fieldCapsResponse struct {
+	Indices []string                                   `json:"indices"`
+	Fields  map[string]map[string]*fieldCapsTypeResult `json:"fields"`
+}
+
+// fieldCapsTypeResult describes a field of one type in all indices. Indices are listed only if the field has several
+// types, non-searchable and non-aggregatable indices are listed only if they differ from other indices
+type fieldCapsTypeResult struct {
+	Type                   string   `json:"type"`
+	MetadataField          bool     `json:"metadata_field"`
+	Searchable             bool     `json:"searchable"`
+	Aggregatable           bool     `json:"aggregatable"`
+	Indices                []string `json:"indices,omitempty"`
+	NonSearchableIndices   []string `json:"non_searchable_indices,omitempty"`
+	NonAggregatableIndices []string `json:"non_aggregatable_indices,omitempty"`
+	searchable             map[string]bool
+	aggregatable           map[string]bool
+}
+
+var fieldCapsHandlerPattern = regexp.MustCompile("^/(?P<index>[^/]+)/_field_caps")
+
+// FieldCapsAllHandler handles request for capabilities of fields of all indices
+func FieldCapsAllHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	return fieldCapabilities("*", r, s)
+}
+
+// FieldCapsIndexHandler handles request for capabilities of fields of indices matching the comma separated patterns
+func FieldCapsIndexHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	return fieldCapabilities(fieldCapsHandlerPattern.ReplaceAllString(endpoint, "${index}"), r, s)
+}
+
+// Collect capabilities of fields matching patterns of fields parameter over all types of the indices. Fields of
+// different types in different indices are reported for each type. Indices which don't have a field are reported
+// with "unmapped" type if include_unmapped is set
+func fieldCapabilities(indexPatterns string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	params := r.URL.Query()
+	var fields []string
+	if len(params.Get("fields")) > 0 {
+		fields = strings.Split(params.Get("fields"), ",")
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, utils.NewInternalIOError(err.Error())
+		}
+		if len(body) > 0 {
+			var request struct {
+				Fields []string `json:"fields"`
+			}
+			if err = json.Unmarshal(body, &request); err != nil {
+				return nil, utils.NewJSONWrongFormatError(err.Error())
+			}
+			fields = request.Fields
+		}
+	}
+	if len(fields) == 0 {
+		return nil, utils.NewIllegalQueryError("[field_caps] specified fields can't be null or empty")
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	client := s.GetDBClient()
+	indices, err := resolveIndices(indexPatterns, client)
+	if err != nil {
+		return nil, err
+	}
+	response := fieldCapsResponse{Indices: indices, Fields: make(map[string]map[string]*fieldCapsTypeResult)}
+	for _, index := range response.Indices {
+		types, err := client.FindTypes(index, "*")
+		if err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+		indexRecord, err := client.GetIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		for _, typeName := range types {
+			docType, err := client.GetType(index, typeName)
+			if err != nil {
+				return nil, err
+			}
+			ctx, err := search.NewQueryContext(indexRecord, docType, client)
+			if err != nil {
+				return nil, err
+			}
+			capabilities, err := ctx.FieldCapabilities(fields)
+			if err != nil {
+				return nil, err
+			}
+			for name, capability := range capabilities {
+				response.addCapability(name, index, capability)
+			}
+		}
+	}
+	if params.Get("include_unmapped") == "true" {
+		for name, types := range response.Fields {
+			mapped := make(map[string]bool)
+			for _, result := range types {
+				for index := range result.searchable {
+					mapped[index] = true
+				}
+			}
+			for _, index := range response.Indices {
+				if !mapped[index] {
+					response.addCapability(name, index, search.FieldCapability{Type: "unmapped"})
+				}
+			}
+		}
+	}
+	for _, types := range response.Fields {
+		for _, result := range types {
+			result.summarize(len(types) > 1)
+		}
+	}
+	return response, nil
+}
+
+// Add capabilities of a field of a type of the index
+func (response *fieldCapsResponse) addCapability(name, index string, capability search.FieldCapability) {
+	types, ok := response.Fields[name]
+	if !ok {
+		types = make(map[string]*fieldCapsTypeResult)
+		response.Fields[name] = types
+	}
+	result, ok := types[capability.Type]
+	if !ok {
+		result = &fieldCapsTypeResult{
+			Type:          capability.Type,
+			MetadataField: search.IsMetaField(name),
+			searchable:    make(map[string]bool),
+			aggregatable:  make(map[string]bool),
+		}
+		types[capability.Type] = result
+	}
+	// A field is searchable in an index only if it is searchable in all types of the index
+	if previous, ok := result.searchable[index]; ok {
+		result.searchable[index] = previous && capability.Searchable
+		result.aggregatable[index] = result.aggregatable[index] && capability.Aggregatable
+	} else {
+		result.searchable[index] = capability.Searchable
+		result.aggregatable[index] = capability.Aggregatable
+	}
+}
+
+// Calculate capabilities of a field type over all indices. Indices of the type are listed if the field has conflicting
+// types
+func (result *fieldCapsTypeResult) summarize(conflict bool) {
+	var indices, nonSearchable, nonAggregatable []string
+	for index, searchable := range result.searchable {
+		indices = append(indices, index)
+		if !searchable {
+			nonSearchable = append(nonSearchable, index)
+		}
+		if !result.aggregatable[index] {
+			nonAggregatable = append(nonAggregatable, index)
+		}
+	}
+	result.Searchable = len(nonSearchable) == 0
+	result.Aggregatable = len(nonAggregatable) == 0
+	if conflict {
+		sort.Strings(indices)
+		result.Indices = indices
+	}
+	if len(nonSearchable) > 0 && len(nonSearchable) < len(indices) {
+		sort.Strings(nonSearchable)
+		result.NonSearchableIndices = nonSearchable
+	}
+	if len(nonAggregatable) > 0 && len(nonAggregatable) < len(indices) {
+		sort.Strings(nonAggregatable)
+		result.NonAggregatableIndices = nonAggregatable
+	}
+}
@@ -2,11 +2,15 @@ package api
 
 import (
 	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/db"
 	"github.com/asp437/pg_elastic/server"
 	"github.com/asp437/pg_elastic/utils"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 type indexPutResponse struct {
@@ -30,6 +34,11 @@ func PutIndexHandler(endpoint string, r *http.Request, server server.PGElasticSe
 	}
 	options := string(optionsBytes)
 
+	err = validateIndexOptions(options, server)
+	if err != nil {
+		return nil, err
+	}
+
 	_, err = server.GetDBClient().CreateIndex(indexName, options)
 	if err != nil {
 		return nil, err
@@ -59,6 +68,11 @@ func PutTypeMapping(endpoint string, r *http.Request, server server.PGElasticSer
 	}
 	options := string(optionsBytes)
 
+	err = validateTypeOptions(indexName, typeName, options, server)
+	if err != nil {
+		return nil, err
+	}
+
 	typeObject, err := server.GetDBClient().GetType(indexName, typeName)
 	if err != nil {
 		return nil, err
@@ -75,3 +89,87 @@ func PutTypeMapping(endpoint string, r *http.Request, server server.PGElasticSer
 	}
 	return typePutResponse{true}, nil
 }
+
+// Find indices matching any of comma separated patterns. Patterns without wildcards should match existing indices.
+// Returns sorted names of indices
+func resolveIndices(indexPatterns string, client *db.Client) ([]string, error) {
+	result := []string{}
+	found := make(map[string]bool)
+	for _, pattern := range strings.Split(indexPatterns, ",") {
+		indices, err := client.FindIndices(pattern)
+		if err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+		if len(indices) == 0 && !strings.ContainsAny(pattern, "*?") {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("no such index [%s]", pattern))
+		}
+		for _, index := range indices {
+			if !found[index] {
+				found[index] = true
+				result = append(result, index)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Get a pattern of indices from a path of a request. Empty pattern and _all match all indices
+func patternOrAll(pattern string) string {
+	if len(pattern) == 0 || pattern == "_all" {
+		return "*"
+	}
+	return pattern
+}
+
+// Check analysis settings and mappings of a new index
+func validateIndexOptions(options string, server server.PGElasticServer) error {
+	parsedOptions, err := utils.ParseOptions(options)
+	if err != nil {
+		return err
+	}
+	registry := search.NewAnalyzerRegistry(utils.ExtractIndexSettings(parsedOptions), server.GetDBClient().Features().HasTextSearchConfig)
+	err = registry.Validate()
+	if err != nil {
+		return err
+	}
+	for _, mapping := range utils.ExtractTypeMappings(parsedOptions) {
+		err = registry.ValidateMapping(mapping)
+		if err != nil {
+			return err
+		}
+		err = db.ValidateMapping(mapping)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check a type mapping against analysis settings of its index
+func validateTypeOptions(indexName, typeName, options string, server server.PGElasticServer) error {
+	parsedOptions, err := utils.ParseOptions(options)
+	if err != nil {
+		return err
+	}
+	indexOptions := make(map[string]interface{})
+	indexRecord, err := server.GetDBClient().GetIndex(indexName)
+	if err != nil {
+		return err
+	}
+	if indexRecord != nil {
+		indexOptions, err = utils.ParseOptions(indexRecord.Options)
+		if err != nil {
+			return err
+		}
+	}
+	registry := search.NewAnalyzerRegistry(utils.ExtractIndexSettings(indexOptions), server.GetDBClient().Features().HasTextSearchConfig)
+	if mapping, ok := utils.ExtractTypeMapping(parsedOptions, typeName); ok {
+		err = registry.ValidateMapping(mapping)
+		if err != nil {
+			return err
+		}
+		return db.ValidateMapping(mapping)
+	}
+	return nil
+}
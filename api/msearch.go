@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type multiSearchResponse struct {
+	Took      int           `json:"took"`
+	Responses []interface{} `json:"responses"`
+}
+
+type multiSearchItemResponse struct {
+	*searchResponse
+	Status int `json:"status"`
+}
+
+// multiSearchItem is a search of a multi search request with index and type patterns of its header
+type multiSearchItem struct {
+	indexPattern string
+	typePattern  string
+	body         []byte
+	err          error
+}
+
+// MultiSearchDocumentHandler handles request to execute several searches. Searches are given in NDJSON format as pairs
+// of header and body lines and executed concurrently, at most max_concurrent_searches of them at once. An error of a
+// search is returned as its response and doesn't fail other searches
+func MultiSearchDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	return multiSearch(indexPattern, typePattern, r, s, false)
+}
+
+// Execute searches of a multi search request. Bodies of searches are search template requests if template is set
+func multiSearch(indexPattern, typePattern string, r *http.Request, s server.PGElasticServer, template bool) (interface{}, error) {
+	startTime := time.Now()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	items, err := parseMultiSearch(body, indexPattern, typePattern)
+	if err != nil {
+		return nil, err
+	}
+	params := r.URL.Query()
+	maxConcurrentSearches := s.GetDBClient().PoolSize()
+	if value := params.Get("max_concurrent_searches"); len(value) > 0 {
+		if maxConcurrentSearches, err = intParameter("max_concurrent_searches", value); err != nil {
+			return nil, err
+		}
+		if maxConcurrentSearches < 1 {
+			return nil, utils.NewIllegalQueryError("[max_concurrent_searches] must be positive")
+		}
+	}
+	// Parameters of the whole request like rest_total_hits_as_int apply to every search
+	params.Del("max_concurrent_searches")
+	accept := r.Header.Get("Accept")
+
+	response := multiSearchResponse{Responses: make([]interface{}, len(items))}
+	slots := make(chan struct{}, maxConcurrentSearches)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, item multiSearchItem) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			searchStartTime := time.Now()
+			body, err := item.body, item.err
+			if err == nil && template {
+				body, err = renderSearchTemplate(body, s)
+			}
+			if err == nil {
+				var request *searchRequest
+				if request, err = parseSearchBody(body, params, accept); err == nil {
+					var result *searchResponse
+					if result, err = executeSearch(item.indexPattern, item.typePattern, request, s); err == nil {
+						result.Took = (int)(time.Since(searchStartTime).Nanoseconds() / 1000000.0)
+						response.Responses[i] = multiSearchItemResponse{result, http.StatusOK}
+						return
+					}
+				}
+			}
+			if _, ok := err.(utils.ElasticError); !ok {
+				err = utils.NewInternalError(err.Error())
+			}
+			response.Responses[i] = err.(utils.ElasticError).FormatErrorResponse()
+		}(i, item)
+	}
+	wg.Wait()
+	response.Took = (int)(time.Since(startTime).Nanoseconds() / 1000000.0)
+	return response, nil
+}
+
+// MultiSearchIndexDocumentHandler handles request to execute several searches over documents of the index
+func MultiSearchIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_msearch")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return MultiSearchDocumentHandler(indexName, "*", endpoint, r, s)
+}
+
+// MultiSearchAllDocumentHandler handles request to execute several searches over documents of any index
+func MultiSearchAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return MultiSearchDocumentHandler("*", "*", endpoint, r, s)
+}
+
+// Split a multi search request into searches. Index and type of a header default to the patterns of request path.
+// A malformed header fails only its own search
+func parseMultiSearch(body []byte, indexPattern, typePattern string) ([]multiSearchItem, error) {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines)%2 != 0 {
+		return nil, utils.NewIllegalQueryError("[msearch] every search header must be followed by a body line")
+	}
+	var items []multiSearchItem
+	for i := 0; i < len(lines); i += 2 {
+		item := multiSearchItem{indexPattern: indexPattern, typePattern: typePattern, body: lines[i+1]}
+		var header map[string]interface{}
+		if err := json.Unmarshal(lines[i], &header); err != nil {
+			item.err = utils.NewJSONWrongFormatError(err.Error())
+		} else {
+			if index, ok := header["index"]; ok {
+				item.indexPattern, item.err = headerPattern("index", index)
+			}
+			if docType, ok := header["type"]; ok && item.err == nil {
+				item.typePattern, item.err = headerPattern("type", docType)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Get a pattern of a multi search header given as a string or as an array of a single string
+func headerPattern(name string, value interface{}) (string, error) {
+	var patterns []string
+	for _, item := range listParameter(value) {
+		pattern, ok := item.(string)
+		if !ok {
+			return "", utils.NewIllegalQueryError("[" + name + "] of a search header must be a string")
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) != 1 {
+		return "", utils.NewIllegalQueryError("[" + name + "] of a search header supports a single pattern only, got [" + strings.Join(patterns, ",") + "]")
+	}
+	return patterns[0], nil
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+type nodesResponse struct {
+	Summary nodesSummary           `json:"_nodes"`
+	Name    string                 `json:"cluster_name"`
+	Nodes   map[string]interface{} `json:"nodes"`
+}
+
+type nodesSummary struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+type nodeInfo struct {
+	Name        string               `json:"name"`
+	Host        string               `json:"host"`
+	HTTPAddress string               `json:"http_address"`
+	Roles       []string             `json:"roles"`
+	OS          nodeOSInfo           `json:"os"`
+	Process     nodeProcessInfo      `json:"process"`
+	Runtime     nodeRuntimeInfo      `json:"runtime"`
+	Postgres    postgresDatabaseInfo `json:"postgres"`
+}
+
+type nodeOSInfo struct {
+	Name                string `json:"name"`
+	Arch                string `json:"arch"`
+	AvailableProcessors int    `json:"available_processors"`
+	AllocatedProcessors int    `json:"allocated_processors"`
+}
+
+type nodeProcessInfo struct {
+	ID                int   `json:"id"`
+	StartTimeInMillis int64 `json:"start_time_in_millis"`
+	UptimeInMillis    int64 `json:"uptime_in_millis"`
+}
+
+type nodeRuntimeInfo struct {
+	Version string `json:"version"`
+}
+
+type nodeStats struct {
+	Name      string               `json:"name"`
+	Host      string               `json:"host"`
+	Timestamp int64                `json:"timestamp"`
+	Roles     []string             `json:"roles"`
+	Indices   nodeIndicesStats     `json:"indices"`
+	Process   nodeProcessInfo      `json:"process"`
+	Runtime   runtimeStats         `json:"runtime"`
+	Postgres  postgresDatabaseInfo `json:"postgres"`
+}
+
+type nodeIndicesStats struct {
+	Docs  docsStats  `json:"docs"`
+	Store storeStats `json:"store"`
+}
+
+// runtimeStats describes memory and goroutines of the server process
+type runtimeStats struct {
+	Version                 string `json:"version"`
+	Goroutines              int    `json:"goroutines"`
+	HeapUsedInBytes         uint64 `json:"heap_used_in_bytes"`
+	HeapCommittedInBytes    uint64 `json:"heap_committed_in_bytes"`
+	SysInBytes              uint64 `json:"sys_in_bytes"`
+	TotalAllocatedInBytes   uint64 `json:"total_allocated_in_bytes"`
+	GCCount                 uint32 `json:"gc_count"`
+	GCPauseTotalInMillis    uint64 `json:"gc_pause_total_in_millis"`
+	LastGCTimestampInMillis uint64 `json:"last_gc_timestamp_in_millis"`
+	NextGCHeapTargetInBytes uint64 `json:"next_gc_heap_target_in_bytes"`
+	HeapObjects             uint64 `json:"heap_objects"`
+	StackInUseInBytes       uint64 `json:"stack_in_use_in_bytes"`
+	MaxProcs                int    `json:"max_procs"`
+	CgoCalls                int64  `json:"cgo_calls"`
+}
+
+// Roles of the node. The server stores data, coordinates requests and processes documents before indexing
+var nodeRoles = []string{"master", "data", "ingest"}
+
+// Time when the server process was started
+var startTime = time.Now()
+
+// NodesHandler returns information about the node and its database
+func NodesHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	info := nodeInfo{
+		Name:        nodeName(),
+		Host:        nodeName(),
+		HTTPAddress: nodeAddress(s),
+		Roles:       nodeRoles,
+		OS:          getNodeOSInfo(),
+		Process:     getNodeProcessInfo(),
+		Runtime:     nodeRuntimeInfo{Version: runtime.Version()},
+	}
+	var err error
+	if info.Postgres, err = getPostgresDatabaseInfo(s); err != nil {
+		return nil, err
+	}
+	return nodesResponse{
+		Summary: nodesSummary{Total: 1, Successful: 1},
+		Name:    clusterName,
+		Nodes:   map[string]interface{}{nodeID(s): info},
+	}, nil
+}
+
+// NodesStatsHandler returns statistics of indices, the server process and the database of the node
+func NodesStatsHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	client := s.GetDBClient()
+	indices, err := client.FindIndices("*")
+	if err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	stats := nodeStats{
+		Name:      nodeName(),
+		Host:      nodeName(),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Roles:     nodeRoles,
+		Process:   getNodeProcessInfo(),
+		Runtime:   getRuntimeStats(),
+	}
+	for _, index := range indices {
+		statistics, err := indexStatistics(index, client)
+		if err != nil {
+			return nil, err
+		}
+		stats.Indices.Docs.Count += statistics.Documents
+		stats.Indices.Docs.Deleted += statistics.DeletedDocuments
+		stats.Indices.Store.SizeInBytes += statistics.Size
+	}
+	if stats.Postgres, err = getPostgresDatabaseInfo(s); err != nil {
+		return nil, err
+	}
+	return nodesResponse{
+		Summary: nodesSummary{Total: 1, Successful: 1},
+		Name:    clusterName,
+		Nodes:   map[string]interface{}{nodeID(s): stats},
+	}, nil
+}
+
+// Get identifier of the node. The identifier is derived from the host name and the port, so it is stable between
+// restarts of the server
+func nodeID(s server.PGElasticServer) string {
+	hash := sha1.Sum([]byte(nodeAddress(s)))
+	return base64.RawURLEncoding.EncodeToString(hash[:])[:22]
+}
+
+// Get name of the node, which is the host name of the server
+func nodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// Get address of the node as host name and port of the server
+func nodeAddress(s server.PGElasticServer) string {
+	return fmt.Sprintf("%s:%d", nodeName(), s.GetConfiguration().ServerPort)
+}
+
+// Get information about operating system and processors of the node
+func getNodeOSInfo() nodeOSInfo {
+	return nodeOSInfo{
+		Name:                runtime.GOOS,
+		Arch:                runtime.GOARCH,
+		AvailableProcessors: runtime.NumCPU(),
+		AllocatedProcessors: runtime.GOMAXPROCS(0),
+	}
+}
+
+// Get information about the server process
+func getNodeProcessInfo() nodeProcessInfo {
+	return nodeProcessInfo{
+		ID:                os.Getpid(),
+		StartTimeInMillis: startTime.UnixNano() / int64(time.Millisecond),
+		UptimeInMillis:    int64(time.Since(startTime) / time.Millisecond),
+	}
+}
+
+// Get memory, garbage collection and goroutines statistics of the server process
+func getRuntimeStats() runtimeStats {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	return runtimeStats{
+		Version:                 runtime.Version(),
+		Goroutines:              runtime.NumGoroutine(),
+		HeapUsedInBytes:         memory.HeapAlloc,
+		HeapCommittedInBytes:    memory.HeapSys,
+		SysInBytes:              memory.Sys,
+		TotalAllocatedInBytes:   memory.TotalAlloc,
+		GCCount:                 memory.NumGC,
+		GCPauseTotalInMillis:    memory.PauseTotalNs / uint64(time.Millisecond),
+		LastGCTimestampInMillis: memory.LastGC / uint64(time.Millisecond),
+		NextGCHeapTargetInBytes: memory.NextGC,
+		HeapObjects:             memory.HeapObjects,
+		StackInUseInBytes:       memory.StackInuse,
+		MaxProcs:                runtime.GOMAXPROCS(0),
+		CgoCalls:                runtime.NumCgoCall(),
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type pitOpenResponse struct {
+	ID string `json:"id"`
+}
+
+type pitCloseResponse struct {
+	Succeeded bool `json:"succeeded"`
+	NumFreed  int  `json:"num_freed"`
+}
+
+var pitHandlerPattern = regexp.MustCompile("^/(?P<index>[^/]+)/_pit")
+
+// OpenPointInTimeHandler handles request to open a point in time over indices matching the pattern. Searches with the
+// point in time see documents as they were on its creation
+func OpenPointInTimeHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	indexPattern := pitHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	keepAlive := r.URL.Query().Get("keep_alive")
+	if len(keepAlive) == 0 {
+		return nil, utils.NewIllegalQueryError("[keep_alive] is required to open a point in time")
+	}
+	duration, err := parsePitKeepAlive(keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.GetDBClient().OpenPointInTime(indexPattern, duration)
+	if err != nil {
+		return nil, err
+	}
+	return pitOpenResponse{id}, nil
+}
+
+// Parse keep alive of a point in time. Keep alive could not be longer than the maximal one
+func parsePitKeepAlive(keepAlive interface{}) (time.Duration, error) {
+	duration, err := search.ParseDuration(keepAlive)
+	if err != nil {
+		return 0, err
+	}
+	if duration > db.MaxPointInTimeKeepAlive {
+		return 0, utils.NewIllegalQueryError(fmt.Sprintf("Keep alive for request (%s) is too large. It must be less than (%s)", duration, db.MaxPointInTimeKeepAlive))
+	}
+	return duration, nil
+}
+
+// ClosePointInTimeHandler handles request to close a point in time and release its snapshot
+func ClosePointInTimeHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	var request struct {
+		ID string `json:"id"`
+	}
+	if err = json.Unmarshal(body, &request); err != nil {
+		return nil, utils.NewJSONWrongFormatError(err.Error())
+	}
+	if len(request.ID) == 0 {
+		return nil, utils.NewIllegalQueryError("[id] of a point in time is required")
+	}
+	found, err := s.GetDBClient().ClosePointInTime(request.ID)
+	if err != nil {
+		return nil, err
+	}
+	response := pitCloseResponse{Succeeded: true}
+	if found {
+		response.NumFreed = 1
+	}
+	return response, nil
+}
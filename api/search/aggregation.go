@@ -0,0 +1,450 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aggregationBuilder converts aggregations into SQL. Each aggregation is a jsonb expression over a relation of
+// documents with _index, _type, id, root, document and score columns. Buckets are relations of their documents, so
+// sub-aggregations are built in the same way
+type aggregationBuilder struct {
+	ctx        *QueryContext
+	background string
+	aliases    int
+}
+
+// Aggregations which return an array of buckets
+var multiBucketAggregations = map[string]bool{
+	"terms": true, "significant_terms": true, "composite": true, "filters": true, "date_range": true,
+	"geo_distance": true, "geohash_grid": true,
+}
+
+// ParseAggregations parses aggregations of a search request and builds SQL expression of jsonb object with results of
+// all aggregations. Documents is a name of relation of matching documents, background set of significant terms is
+// db.AggregationBackground relation
+func ParseAggregations(rawAggregations interface{}, documents string, ctx *QueryContext) (string, error) {
+	builder := &aggregationBuilder{ctx: ctx, background: db.AggregationBackground}
+	return builder.aggregations(rawAggregations, documents)
+}
+
+// Build jsonb object with results of aggregations over the documents
+func (b *aggregationBuilder) aggregations(rawAggregations interface{}, documents string) (string, error) {
+	aggregations, ok := rawAggregations.(map[string]interface{})
+	if !ok {
+		return "", utils.NewIllegalQueryError("[aggs] must be an object")
+	}
+	var names []string
+	for name := range aggregations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		body, ok := aggregations[name].(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("Expected [START_OBJECT] under [%s]", name))
+		}
+		expression, err := b.aggregation(name, body, documents)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, utils.QuoteLiteral(name), expression)
+	}
+	if len(args) == 0 {
+		return "'{}'::jsonb", nil
+	}
+	return fmt.Sprintf("jsonb_build_object(%s)", strings.Join(args, ", ")), nil
+}
+
+// Build jsonb expression of a single aggregation
+func (b *aggregationBuilder) aggregation(name string, body map[string]interface{}, documents string) (string, error) {
+	var typeName string
+	var params map[string]interface{}
+	var subAggregations interface{}
+	for k, v := range body {
+		switch k {
+		case "aggs", "aggregations":
+			subAggregations = v
+		case "meta":
+		default:
+			if len(typeName) > 0 {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("Found two aggregation type definitions in [%s]: [%s] and [%s]", name, typeName, k))
+			}
+			var ok bool
+			if params, ok = v.(map[string]interface{}); !ok {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("Expected [START_OBJECT] under [%s], but got a value", k))
+			}
+			typeName = k
+		}
+	}
+	if len(typeName) == 0 {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("Missing definition for aggregation [%s]", name))
+	}
+
+	// Sub-aggregations are calculated over documents of a bucket, pipeline aggregations over the calculated buckets
+	subAggregations, pipelines := splitPipelineAggregations(subAggregations)
+	subAggregationsOf := func(bucketDocuments string) (string, error) {
+		if subAggregations == nil {
+			return "'{}'::jsonb", nil
+		}
+		return b.aggregations(subAggregations, bucketDocuments)
+	}
+	var expression string
+	var err error
+	switch typeName {
+	case "avg", "sum", "min", "max", "value_count", "cardinality", "stats", "extended_stats", "percentiles", "percentile_ranks", "top_hits":
+		if subAggregations != nil {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("Aggregator [%s] of type [%s] cannot accept sub-aggregations", name, typeName))
+		}
+		switch typeName {
+		case "percentiles", "percentile_ranks":
+			expression, err = b.percentilesAggregation(typeName, params, documents)
+		case "top_hits":
+			expression, err = b.topHitsAggregation(params, documents)
+		default:
+			expression, err = b.metricAggregation(typeName, params, documents)
+		}
+	case "terms":
+		expression, err = b.termsAggregation(params, documents, subAggregationsOf)
+	case "significant_terms":
+		expression, err = b.significantTermsAggregation(params, documents, subAggregationsOf)
+	case "composite":
+		expression, err = b.compositeAggregation(params, documents, subAggregationsOf)
+	case "filter":
+		expression, err = b.filterAggregation(params, documents, subAggregationsOf)
+	case "filters":
+		expression, err = b.filtersAggregation(params, documents, subAggregationsOf)
+	case "missing":
+		expression, err = b.missingAggregation(params, documents, subAggregationsOf)
+	case "date_range":
+		expression, err = b.dateRangeAggregation(params, documents, subAggregationsOf)
+	case "nested":
+		expression, err = b.nestedAggregation(params, documents, subAggregationsOf)
+	case "reverse_nested":
+		expression, err = b.reverseNestedAggregation(params, documents, subAggregationsOf)
+	case "geo_distance":
+		expression, err = b.geoDistanceAggregation(params, documents, subAggregationsOf)
+	case "geohash_grid":
+		expression, err = b.geohashGridAggregation(params, documents, subAggregationsOf)
+	case "bucket_sort", "bucket_script", "derivative", "cumulative_sum":
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] aggregation [%s] must be declared inside of a multi-bucket aggregation", typeName, name))
+	default:
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown aggregation type [%s] found in [%s]", typeName, name))
+	}
+	if err != nil || pipelines == nil {
+		return expression, err
+	}
+	// Buckets of keyed aggregations are not ordered, so pipelines are applied to arrays of buckets only
+	if keyedBuckets(typeName, params) || !multiBucketAggregations[typeName] {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("Pipeline aggregations of [%s] require an unkeyed multi-bucket aggregation", name))
+	}
+	return b.pipelineAggregations(pipelines, expression)
+}
+
+// Build a metric aggregation over numeric values of a field
+func (b *aggregationBuilder) metricAggregation(typeName string, params map[string]interface{}, documents string) (string, error) {
+	field, err := aggregationField(typeName, params)
+	if err != nil {
+		return "", err
+	}
+	values := fmt.Sprintf("%s AS d, %s", documents, fieldValues(field))
+	number := b.numericValue(field)
+	switch typeName {
+	case "value_count":
+		return fmt.Sprintf("(SELECT jsonb_build_object('value', count(*)) FROM %s WHERE v.value <> 'null'::jsonb)", values), nil
+	case "cardinality":
+		return fmt.Sprintf("(SELECT jsonb_build_object('value', count(DISTINCT v.value)) FROM %s WHERE v.value <> 'null'::jsonb)", values), nil
+	case "stats":
+		return fmt.Sprintf("(SELECT jsonb_build_object('count', count(m.x), 'min', min(m.x), 'max', max(m.x), 'avg', avg(m.x), 'sum', coalesce(sum(m.x), 0)) FROM (SELECT %s AS x FROM %s) AS m)",
+			number, values), nil
+	case "extended_stats":
+		sigma := 2.0
+		if rawSigma, ok := params["sigma"]; ok {
+			if sigma, err = parseFloat(rawSigma, "sigma"); err != nil {
+				return "", err
+			}
+		}
+		if sigma < 0 {
+			return "", utils.NewIllegalQueryError("[sigma] must be greater than or equal to 0")
+		}
+		return fmt.Sprintf("(SELECT jsonb_build_object('count', count(m.x), 'min', min(m.x), 'max', max(m.x), 'avg', avg(m.x), 'sum', coalesce(sum(m.x), 0), "+
+			"'sum_of_squares', sum(m.x * m.x), 'variance', var_pop(m.x), 'std_deviation', stddev_pop(m.x), "+
+			"'std_deviation_bounds', jsonb_build_object('upper', avg(m.x) + %[3]s * stddev_pop(m.x), 'lower', avg(m.x) - %[3]s * stddev_pop(m.x))) "+
+			"FROM (SELECT %[1]s AS x FROM %[2]s) AS m)", number, values, utils.FormatFloat(sigma)), nil
+	case "sum":
+		return fmt.Sprintf("(SELECT jsonb_build_object('value', coalesce(sum(m.x), 0)) FROM (SELECT %s AS x FROM %s) AS m)", number, values), nil
+	}
+	result := fmt.Sprintf("jsonb_build_object('value', %s(m.x))", typeName)
+	if b.ctx.fieldType(field) == "date" && typeName != "avg" {
+		result += fmt.Sprintf(" || jsonb_strip_nulls(jsonb_build_object('value_as_string', %s))", formatEpochMillis(fmt.Sprintf("%s(m.x)", typeName)))
+	}
+	return fmt.Sprintf("(SELECT %s FROM (SELECT %s AS x FROM %s) AS m)", result, number, values), nil
+}
+
+// Build terms aggregation which creates a bucket for each distinct value of a field
+func (b *aggregationBuilder) termsAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("terms", params)
+	if err != nil {
+		return "", err
+	}
+	size, minDocCount := 10, 1
+	orders := []string{"count(*) DESC", "k.key ASC"}
+	missing := ""
+	for k, v := range params {
+		switch k {
+		case "size":
+			size, err = parseInt(v, k)
+		case "min_doc_count":
+			minDocCount, err = parseInt(v, k)
+		case "order":
+			orders, err = parseTermsOrder(v)
+		case "missing":
+			missing = quoteJSON(v)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Keys of a document are distinct values of the field, documents without values get missing key if it is set
+	keys := fmt.Sprintf("(SELECT DISTINCT v.value AS key FROM %s WHERE v.value <> 'null'::jsonb)", fieldValues(field))
+	if len(missing) > 0 {
+		keys = fmt.Sprintf("(SELECT DISTINCT v.value AS key FROM %[1]s WHERE v.value <> 'null'::jsonb UNION SELECT %[2]s WHERE NOT %[3]s)", fieldValues(field), missing, existsCondition(field))
+	}
+	bucket := b.alias("b")
+	subAggregations, err := subAggregationsOf(keyBucketDocuments(documents, keys, bucket))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('doc_count_error_upper_bound', 0, "+
+		"'sum_other_doc_count', coalesce(sum(%[1]s.doc_count) FILTER (WHERE %[1]s.rank > %[2]d), 0), "+
+		"'buckets', coalesce(jsonb_agg(jsonb_build_object('key', %[1]s.key, 'doc_count', %[1]s.doc_count) || %[3]s ORDER BY %[1]s.rank) FILTER (WHERE %[1]s.rank <= %[2]d), '[]'::jsonb)) "+
+		"FROM %[4]s AS %[1]s)",
+		bucket, size, subAggregations, keyBuckets(documents, keys, orders, minDocCount)), nil
+}
+
+// SQL relation of buckets with key, doc_count and rank columns. Keys is a lateral subquery of keys of a document d
+// with key column, a document belongs to buckets of all its keys
+func keyBuckets(documents, keys string, orders []string, minDocCount int) string {
+	return fmt.Sprintf("(SELECT k.key, count(*) AS doc_count, row_number() OVER (ORDER BY %s) AS rank FROM %s AS d, LATERAL %s AS k GROUP BY k.key HAVING count(*) >= %d)",
+		strings.Join(orders, ", "), documents, keys, minDocCount)
+}
+
+// SQL relation of documents of a bucket of keyBuckets with the alias
+func keyBucketDocuments(documents, keys, bucket string) string {
+	return fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE EXISTS (SELECT 1 FROM %s AS k WHERE k.key = %s.key))", documents, keys, bucket)
+}
+
+// Build geo_distance aggregation which creates buckets of documents within distance ranges from an origin
+func (b *aggregationBuilder) geoDistanceAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("geo_distance", params)
+	if err != nil {
+		return "", err
+	}
+	rawOrigin, ok := params["origin"]
+	if !ok {
+		return "", utils.NewIllegalQueryError("Missing [origin] in geo_distance aggregator")
+	}
+	origin, err := parseGeoPoint(rawOrigin)
+	if err != nil {
+		return "", err
+	}
+	unit := "m"
+	if rawUnit, ok := params["unit"]; ok {
+		unit = fmt.Sprint(rawUnit)
+	}
+	unitMeters, ok := distanceUnits[unit]
+	if !ok {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("unknown distance unit [%s]", unit))
+	}
+	rawRanges, ok := params["ranges"].([]interface{})
+	if !ok || len(rawRanges) == 0 {
+		return "", utils.NewIllegalQueryError("No [ranges] specified for the [geo_distance] aggregation")
+	}
+	keyed, _ := params["keyed"].(bool)
+
+	var buckets []string
+	for _, rawRange := range rawRanges {
+		rangeObject, ok := rawRange.(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError("[ranges] of geo_distance aggregation must be objects")
+		}
+		var conditions []string
+		var bucket []string
+		fromKey, toKey := "*", "*"
+		for _, bound := range []string{"from", "to"} {
+			rawBound, ok := rangeObject[bound]
+			if !ok || rawBound == nil {
+				continue
+			}
+			value, err := parseFloat(rawBound, bound)
+			if err != nil {
+				return "", err
+			}
+			operator := ">="
+			if bound == "from" {
+				fromKey = formatRangeBound(value)
+			} else {
+				operator = "<"
+				toKey = formatRangeBound(value)
+			}
+			conditions = append(conditions, fmt.Sprintf("%s %s %s", geoDistance([]*geoPoint{origin}), operator, utils.FormatFloat(value*unitMeters)))
+			bucket = append(bucket, utils.QuoteLiteral(bound), utils.FormatFloat(value))
+		}
+		key := fromKey + "-" + toKey
+		if rawKey, ok := rangeObject["key"]; ok {
+			key = fmt.Sprint(rawKey)
+		}
+		condition := "TRUE"
+		if len(conditions) > 0 {
+			condition = strings.Join(conditions, " AND ")
+		}
+		bucketDocuments := fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE %s)", documents, anyGeoPoint(field, condition))
+		subAggregations, err := subAggregationsOf(bucketDocuments)
+		if err != nil {
+			return "", err
+		}
+		bucket = append(bucket, "'doc_count'", fmt.Sprintf("(SELECT count(*) FROM %s AS d)", bucketDocuments))
+		expression := fmt.Sprintf("jsonb_build_object(%s) || %s", strings.Join(bucket, ", "), subAggregations)
+		if keyed {
+			buckets = append(buckets, utils.QuoteLiteral(key), expression)
+		} else {
+			buckets = append(buckets, fmt.Sprintf("jsonb_build_object('key', %s) || %s", utils.QuoteLiteral(key), expression))
+		}
+	}
+	if keyed {
+		return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_object(%s))", strings.Join(buckets, ", ")), nil
+	}
+	return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_array(%s))", strings.Join(buckets, ", ")), nil
+}
+
+// Build geohash_grid aggregation which creates a bucket for each geohash cell of the given precision
+func (b *aggregationBuilder) geohashGridAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("geohash_grid", params)
+	if err != nil {
+		return "", err
+	}
+	precision, size := 5, 10000
+	for k, v := range params {
+		switch k {
+		case "precision":
+			precision, err = parseInt(v, k)
+		case "size":
+			size, err = parseInt(v, k)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if precision < 1 || precision > 12 {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("Invalid geohash aggregation precision of %d. Must be between 1 and 12.", precision))
+	}
+
+	keys := fmt.Sprintf("(SELECT DISTINCT to_jsonb(pg_elastic_geohash(p.point, %d)) AS key FROM %s)", precision, geoPoints(field))
+	bucket := b.alias("b")
+	subAggregations, err := subAggregationsOf(keyBucketDocuments(documents, keys, bucket))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('buckets', coalesce(jsonb_agg(jsonb_build_object('key', %[1]s.key, 'doc_count', %[1]s.doc_count) || %[2]s ORDER BY %[1]s.rank) FILTER (WHERE %[1]s.rank <= %[3]d), '[]'::jsonb)) "+
+		"FROM %[4]s AS %[1]s)", bucket, subAggregations, size, keyBuckets(documents, keys, []string{"count(*) DESC", "k.key ASC"}, 1)), nil
+}
+
+// Format a bound of a range as a part of bucket key like "100.0"
+func formatRangeBound(value float64) string {
+	text := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.ContainsAny(text, ".eE") {
+		text += ".0"
+	}
+	return text
+}
+
+// Parse order of terms aggregation. Buckets could be ordered by _count and _key (_term), ordering by sub-aggregations
+// is not supported
+func parseTermsOrder(rawOrder interface{}) ([]string, error) {
+	var rawOrders []interface{}
+	if list, ok := rawOrder.([]interface{}); ok {
+		rawOrders = list
+	} else {
+		rawOrders = []interface{}{rawOrder}
+	}
+	var orders []string
+	for _, rawOrder := range rawOrders {
+		object, ok := rawOrder.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[order] must be an object or an array of objects")
+		}
+		for k, v := range object {
+			direction := strings.ToUpper(fmt.Sprint(v))
+			if direction != "ASC" && direction != "DESC" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Unknown terms order direction [%v]", v))
+			}
+			switch k {
+			case "_count":
+				orders = append(orders, "count(*) "+direction)
+			case "_key", "_term":
+				orders = append(orders, "k.key "+direction)
+			default:
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Invalid terms aggregation order path [%s]", k))
+			}
+		}
+	}
+	// Ties are broken by key to make results stable
+	return append(orders, "k.key ASC"), nil
+}
+
+// Build nested aggregation which aggregates nested objects under the path as separate documents
+func (b *aggregationBuilder) nestedAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	path, ok := params["path"].(string)
+	if !ok {
+		return "", utils.NewIllegalQueryError("Missing [path] field for nested aggregation")
+	}
+	nestedDocuments := fmt.Sprintf("(SELECT d._index, d._type, d.id, d.root, nd.document, d.score FROM %s AS d, LATERAL %s AS nd)", documents, nestedDocuments(path))
+	return singleBucketAggregation(nestedDocuments, subAggregationsOf)
+}
+
+// Build reverse_nested aggregation which returns from nested objects to their root documents
+func (b *aggregationBuilder) reverseNestedAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	if _, ok := params["path"]; ok {
+		return "", utils.NewIllegalQueryError("[reverse_nested] aggregation supports only root documents, [path] is not supported")
+	}
+	rootDocuments := fmt.Sprintf("(SELECT DISTINCT ON (d._index, d._type, d.id) d._index, d._type, d.id, d.root, d.root AS document, d.score FROM %s AS d)", documents)
+	return singleBucketAggregation(rootDocuments, subAggregationsOf)
+}
+
+// Get field parameter of an aggregation. Scripts are not supported
+func aggregationField(typeName string, params map[string]interface{}) (string, error) {
+	if _, ok := params["script"]; ok {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] aggregation doesn't support scripts", typeName))
+	}
+	field, ok := params["field"].(string)
+	if !ok {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("Required [field] parameter is missing for [%s] aggregation", typeName))
+	}
+	return field, nil
+}
+
+// SQL expression of a numeric value of v.value column. Dates are converted into milliseconds since epoch, values
+// which are not numbers are NULL
+func (b *aggregationBuilder) numericValue(field string) string {
+	if b.ctx.fieldType(field) == "date" {
+		return "extract(epoch FROM pg_elastic_timestamp(v.value)) * 1000"
+	}
+	return "CASE WHEN jsonb_typeof(v.value) = 'number' THEN (v.value)::float8 END"
+}
+
+// Get a unique alias of a relation in SQL of aggregations
+func (b *aggregationBuilder) alias(prefix string) string {
+	b.aliases++
+	return fmt.Sprintf("%s%d", prefix, b.aliases)
+}
+
+// SQL expression which formats milliseconds since epoch as ISO 8601 date in UTC
+func formatEpochMillis(millis string) string {
+	return fmt.Sprintf(`to_char(to_timestamp((%s) / 1000.0) AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"')`, millis)
+}
@@ -0,0 +1,386 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// Analyzer describes how a text is split into terms on PostgreSQL side. An analyzer is either based on a text search
+// configuration or on a custom tokenization strategy when there is no appropriate configuration
+type Analyzer struct {
+	Name string
+	// Config is a PostgreSQL text search configuration used by the analyzer
+	Config    string
+	tokenizer tokenizer
+	lowercase bool
+}
+
+// tokenizer builds SQL expression which splits text expression into an array of tokens
+type tokenizer func(text string) string
+
+// DefaultAnalyzer is a name of analyzer used for fields without explicit analyzer
+const DefaultAnalyzer = "standard"
+
+// Tokenization strategies for analyzers without appropriate text search configuration
+var (
+	letterTokenizer = func(text string) string {
+		return fmt.Sprintf("regexp_split_to_array(%s, '[^[:alpha:]]+')", text)
+	}
+	alphanumTokenizer = func(text string) string {
+		return fmt.Sprintf("regexp_split_to_array(%s, '[^[:alnum:]_]+')", text)
+	}
+	whitespaceTokenizer = func(text string) string {
+		return fmt.Sprintf("regexp_split_to_array(%s, '[[:space:]]+')", text)
+	}
+	keywordTokenizer = func(text string) string {
+		return fmt.Sprintf("ARRAY[%s]", text)
+	}
+	// English stop words are detected by snowball dictionary which returns no lexemes for them
+	stopTokenizer = func(text string) string {
+		return fmt.Sprintf("ARRAY(SELECT CASE WHEN ts_lexize('english_stem', t.token) = '{}' THEN '' ELSE t.token END "+
+			"FROM unnest(%s) WITH ORDINALITY AS t(token, position) ORDER BY t.position)", letterTokenizer(text))
+	}
+	fingerprintTokenizer = func(text string) string {
+		return fmt.Sprintf("ARRAY[array_to_string(ARRAY(SELECT DISTINCT t FROM unnest(regexp_split_to_array(%s, '[^[:alnum:]]+')) AS t "+
+			"WHERE t <> '' ORDER BY t), ' ')]", text)
+	}
+	// CJK text is split into overlapping bigrams
+	bigramTokenizer = func(text string) string {
+		return fmt.Sprintf("ARRAY(SELECT substr(s.text, i, 2) FROM (SELECT regexp_replace(%s, '[[:space:][:punct:]]+', '', 'g') AS text) AS s, "+
+			"generate_series(1, greatest(length(s.text) - 1, 1)) AS i ORDER BY i)", text)
+	}
+)
+
+// Build a tokenizer which splits text by regular expression
+func patternTokenizer(pattern string) tokenizer {
+	return func(text string) string {
+		return fmt.Sprintf("regexp_split_to_array(%s, %s)", text, utils.QuoteLiteral(pattern))
+	}
+}
+
+// Language analyzers of ElasticSearch and corresponding text search configurations of PostgreSQL. Languages without
+// a configuration fall back to "simple" configuration which works like standard analyzer
+var languageConfigs = map[string]string{
+	"arabic":     "arabic",
+	"armenian":   "armenian",
+	"basque":     "basque",
+	"bengali":    "simple",
+	"brazilian":  "portuguese",
+	"bulgarian":  "simple",
+	"catalan":    "catalan",
+	"czech":      "simple",
+	"danish":     "danish",
+	"dutch":      "dutch",
+	"english":    "english",
+	"estonian":   "simple",
+	"finnish":    "finnish",
+	"french":     "french",
+	"galician":   "simple",
+	"german":     "german",
+	"greek":      "greek",
+	"hindi":      "hindi",
+	"hungarian":  "hungarian",
+	"indonesian": "indonesian",
+	"irish":      "irish",
+	"italian":    "italian",
+	"latvian":    "simple",
+	"lithuanian": "lithuanian",
+	"norwegian":  "norwegian",
+	"persian":    "simple",
+	"portuguese": "portuguese",
+	"romanian":   "romanian",
+	"russian":    "russian",
+	"sorani":     "simple",
+	"spanish":    "spanish",
+	"swedish":    "swedish",
+	"thai":       "simple",
+	"turkish":    "turkish",
+}
+
+// Built-in analyzers which are not language specific
+var builtinAnalyzers = map[string]Analyzer{
+	"standard":    {Name: "standard", Config: "simple"},
+	"simple":      {Name: "simple", Config: "simple", tokenizer: letterTokenizer, lowercase: true},
+	"whitespace":  {Name: "whitespace", Config: "simple", tokenizer: whitespaceTokenizer},
+	"stop":        {Name: "stop", Config: "simple", tokenizer: stopTokenizer, lowercase: true},
+	"keyword":     {Name: "keyword", Config: "simple", tokenizer: keywordTokenizer},
+	"pattern":     {Name: "pattern", Config: "simple", tokenizer: patternTokenizer("\\W+"), lowercase: true},
+	"fingerprint": {Name: "fingerprint", Config: "simple", tokenizer: fingerprintTokenizer, lowercase: true},
+	"cjk":         {Name: "cjk", Config: "simple", tokenizer: bigramTokenizer, lowercase: true},
+}
+
+// Vector returns SQL expression which converts a text expression into tsvector
+func (a *Analyzer) Vector(text string) string {
+	if a.tokenizer == nil {
+		return fmt.Sprintf("to_tsvector(%s, %s)", utils.QuoteLiteral(a.Config), text)
+	}
+	if a.lowercase {
+		text = fmt.Sprintf("lower(%s)", text)
+	}
+	return fmt.Sprintf("pg_elastic_tsvector(%s)", a.tokenizer(text))
+}
+
+// AnalyzerRegistry resolves analyzer names into analyzers. It contains built-in analyzers and custom analyzers
+// defined in index settings
+type AnalyzerRegistry struct {
+	custom  map[string]interface{}
+	filters map[string]interface{}
+	tokens  map[string]interface{}
+	configs func(string) bool
+}
+
+// NewAnalyzerRegistry creates a registry for index with specified settings. Function configs reports availability of
+// text search configurations on the server, unavailable configurations are replaced with "simple". It could be nil
+func NewAnalyzerRegistry(settings map[string]interface{}, configs func(string) bool) *AnalyzerRegistry {
+	registry := &AnalyzerRegistry{configs: configs}
+	if analysis, ok := settings["analysis"].(map[string]interface{}); ok {
+		registry.custom, _ = analysis["analyzer"].(map[string]interface{})
+		registry.filters, _ = analysis["filter"].(map[string]interface{})
+		registry.tokens, _ = analysis["tokenizer"].(map[string]interface{})
+	}
+	return registry
+}
+
+// Lookup returns an analyzer with specified name
+func (r *AnalyzerRegistry) Lookup(name string) (*Analyzer, error) {
+	if definition, ok := r.custom[name].(map[string]interface{}); ok {
+		return r.customAnalyzer(name, definition)
+	}
+	if name == "default" {
+		return r.Lookup(DefaultAnalyzer)
+	}
+	return r.builtinAnalyzer(name)
+}
+
+// Default returns an analyzer used for fields without explicit analyzer
+func (r *AnalyzerRegistry) Default() *Analyzer {
+	if _, ok := r.custom["default"]; ok {
+		if analyzer, err := r.Lookup("default"); err == nil {
+			return analyzer
+		}
+	}
+	analyzer, _ := r.builtinAnalyzer(DefaultAnalyzer)
+	return analyzer
+}
+
+// Validate checks that all custom analyzers defined in index settings could be resolved
+func (r *AnalyzerRegistry) Validate() error {
+	for name := range r.custom {
+		if _, err := r.Lookup(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateMapping checks that all analyzers used by type mapping are known
+func (r *AnalyzerRegistry) ValidateMapping(mapping map[string]interface{}) error {
+	return r.validateProperties(mapping, "")
+}
+
+// Validate analyzers of object properties and multi-fields recursively
+func (r *AnalyzerRegistry) validateProperties(mapping map[string]interface{}, prefix string) error {
+	for _, section := range []string{"properties", "fields"} {
+		properties, ok := mapping[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for fieldName, config := range properties {
+			configMap, ok := config.(map[string]interface{})
+			if !ok {
+				return utils.NewMapperParsingError(fmt.Sprintf("Expected map for property [%s] but got %v", prefix+fieldName, config))
+			}
+			for _, key := range []string{"analyzer", "search_analyzer", "search_quote_analyzer"} {
+				if name, ok := configMap[key].(string); ok {
+					if _, err := r.Lookup(name); err != nil {
+						return utils.NewMapperParsingError(fmt.Sprintf("%s for field [%s]", err.(utils.ElasticError).Reason(), prefix+fieldName))
+					}
+				}
+			}
+			err := r.validateProperties(configMap, prefix+fieldName+".")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve a built-in analyzer by its name
+func (r *AnalyzerRegistry) builtinAnalyzer(name string) (*Analyzer, error) {
+	if analyzer, ok := builtinAnalyzers[name]; ok {
+		return &analyzer, nil
+	}
+	if config, ok := languageConfigs[name]; ok {
+		return &Analyzer{Name: name, Config: r.availableConfig(config)}, nil
+	}
+	return nil, utils.NewMapperParsingError(fmt.Sprintf("analyzer [%s] not found", name))
+}
+
+// Check text search configuration availability and fall back to "simple" configuration
+func (r *AnalyzerRegistry) availableConfig(config string) string {
+	if r.configs != nil && !r.configs(config) {
+		return "simple"
+	}
+	return config
+}
+
+// Resolve an analyzer defined in index settings
+func (r *AnalyzerRegistry) customAnalyzer(name string, definition map[string]interface{}) (*Analyzer, error) {
+	analyzerType, _ := definition["type"].(string)
+	switch analyzerType {
+	case "", "custom":
+	case "pattern":
+		analyzer := &Analyzer{Name: name, Config: "simple", tokenizer: patternTokenizer("\\W+"), lowercase: true}
+		if pattern, ok := definition["pattern"].(string); ok {
+			analyzer.tokenizer = patternTokenizer(pattern)
+		}
+		if lowercase, ok := definition["lowercase"].(bool); ok {
+			analyzer.lowercase = lowercase
+		}
+		return analyzer, nil
+	default:
+		analyzer, err := r.builtinAnalyzer(analyzerType)
+		if err != nil {
+			return nil, utils.NewMapperParsingError(fmt.Sprintf("Unknown analyzer type [%s] for [%s]", analyzerType, name))
+		}
+		analyzer.Name = name
+		return analyzer, nil
+	}
+
+	tokenizerName, ok := definition["tokenizer"].(string)
+	if !ok {
+		return nil, utils.NewMapperParsingError(fmt.Sprintf("analyzer [%s] must specify either an analyzer type, or a tokenizer", name))
+	}
+	analyzer := &Analyzer{Name: name, Config: "simple"}
+	language := ""
+	for _, filter := range stringList(definition["filter"]) {
+		filterType, filterLanguage := r.resolveFilter(filter)
+		switch filterType {
+		case "lowercase":
+			analyzer.lowercase = true
+		case "porter_stem", "kstem":
+			language = "english"
+		case "stemmer", "snowball":
+			language = stemmerLanguage(filterLanguage)
+		}
+	}
+
+	tokenizerType := tokenizerName
+	tokenizerDefinition, _ := r.tokens[tokenizerName].(map[string]interface{})
+	if tokenizerDefinition != nil {
+		tokenizerType, _ = tokenizerDefinition["type"].(string)
+	}
+	switch tokenizerType {
+	case "standard", "classic", "uax_url_email", "icu_tokenizer":
+		if language != "" {
+			if config, ok := languageConfigs[language]; ok {
+				analyzer.Config = r.availableConfig(config)
+				return analyzer, nil
+			}
+		}
+		if !analyzer.lowercase {
+			analyzer.tokenizer = alphanumTokenizer
+		}
+	case "letter":
+		analyzer.tokenizer = letterTokenizer
+	case "lowercase":
+		analyzer.tokenizer = letterTokenizer
+		analyzer.lowercase = true
+	case "whitespace":
+		analyzer.tokenizer = whitespaceTokenizer
+	case "keyword":
+		analyzer.tokenizer = keywordTokenizer
+	case "pattern":
+		analyzer.tokenizer = patternTokenizer("\\W+")
+		if pattern, ok := tokenizerDefinition["pattern"].(string); ok {
+			analyzer.tokenizer = patternTokenizer(pattern)
+		}
+	default:
+		return nil, utils.NewMapperParsingError(fmt.Sprintf("Custom Analyzer [%s] failed to find tokenizer under name [%s]", name, tokenizerName))
+	}
+	return analyzer, nil
+}
+
+// Resolve a token filter type and its language. Filter could be defined in index settings
+func (r *AnalyzerRegistry) resolveFilter(name string) (string, string) {
+	if definition, ok := r.filters[name].(map[string]interface{}); ok {
+		filterType, _ := definition["type"].(string)
+		language, _ := definition["language"].(string)
+		if language == "" {
+			language, _ = definition["name"].(string)
+		}
+		return filterType, language
+	}
+	return name, ""
+}
+
+// Convert a stemmer language name of ElasticSearch into language analyzer name
+func stemmerLanguage(language string) string {
+	language = strings.ToLower(language)
+	for _, prefix := range []string{"light_", "minimal_", "possessive_", "lovins", "porter2", "porter"} {
+		if strings.HasPrefix(language, prefix) {
+			language = strings.TrimPrefix(language, prefix)
+			if language == "" {
+				language = "english"
+			}
+		}
+	}
+	if language == "" {
+		return "english"
+	}
+	return language
+}
+
+// Convert a JSON string or an array of strings into a slice
+func stringList(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var result []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Quote a term as tsquery lexeme
+func quoteLexeme(term string) string {
+	term = strings.Replace(term, "\\", "\\\\", -1)
+	return "'" + strings.Replace(term, "'", "''", -1) + "'"
+}
+
+// Build SQL literal of tsquery which matches terms as a phrase. Tokens should be ordered by positions, terms sharing
+// a position are alternatives. If prefix is set the last term matches as a prefix
+func phraseTSQuery(tokens []db.Token, prefix bool) string {
+	var parts []string
+	for i := 0; i < len(tokens); {
+		position := tokens[i].Position
+		var alternatives []string
+		j := i
+		for ; j < len(tokens) && tokens[j].Position == position; j++ {
+			lexeme := quoteLexeme(tokens[j].Term)
+			if prefix && tokens[len(tokens)-1].Position == position {
+				lexeme += ":*"
+			}
+			alternatives = append(alternatives, lexeme)
+		}
+		part := strings.Join(alternatives, " | ")
+		if len(alternatives) > 1 {
+			part = "(" + part + ")"
+		}
+		if i > 0 {
+			part = fmt.Sprintf("<%d> %s", position-tokens[i-1].Position, part)
+		}
+		parts = append(parts, part)
+		i = j
+	}
+	return utils.QuoteLiteral(strings.Join(parts, " ")) + "::tsquery"
+}
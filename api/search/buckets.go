@@ -0,0 +1,390 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"sort"
+	"strings"
+)
+
+// Build filter aggregation which creates a single bucket of documents matching a query
+func (b *aggregationBuilder) filterAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	clause, err := parseQuery(params, b.ctx)
+	if err != nil {
+		return "", err
+	}
+	return singleBucketAggregation(fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE %s)", documents, clause.Condition), subAggregationsOf)
+}
+
+// Build missing aggregation which creates a single bucket of documents without values of a field
+func (b *aggregationBuilder) missingAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("missing", params)
+	if err != nil {
+		return "", err
+	}
+	return singleBucketAggregation(fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE NOT %s)", documents, existsCondition(field)), subAggregationsOf)
+}
+
+// Build jsonb expression of a single bucket aggregation over documents of the bucket
+func singleBucketAggregation(bucketDocuments string, subAggregationsOf func(string) (string, error)) (string, error) {
+	subAggregations, err := subAggregationsOf(bucketDocuments)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(jsonb_build_object('doc_count', (SELECT count(*) FROM %s AS d)) || %s)", bucketDocuments, subAggregations), nil
+}
+
+// Build filters aggregation which creates a bucket for each query. Named queries create keyed buckets unless keyed is
+// false, anonymous queries create an array of buckets. Other bucket collects documents which match no query
+func (b *aggregationBuilder) filtersAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	var names []string
+	var rawFilters []interface{}
+	switch value := params["filters"].(type) {
+	case map[string]interface{}:
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rawFilters = append(rawFilters, value[name])
+		}
+	case []interface{}:
+		rawFilters = value
+	default:
+		return "", utils.NewIllegalQueryError("[filters] requires 'filters' to be an object or an array")
+	}
+	keyed := keyedBuckets("filters", params)
+	otherKey := ""
+	if otherBucket, _ := params["other_bucket"].(bool); otherBucket {
+		otherKey = "_other_"
+	}
+	if key, ok := params["other_bucket_key"]; ok {
+		otherKey = fmt.Sprint(key)
+	}
+
+	var conditions, buckets []string
+	addBucket := func(key, condition string) error {
+		bucket, err := singleBucketAggregation(fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE %s)", documents, condition), subAggregationsOf)
+		if err != nil {
+			return err
+		}
+		switch {
+		case keyed:
+			buckets = append(buckets, utils.QuoteLiteral(key), bucket)
+		case len(names) > 0:
+			buckets = append(buckets, fmt.Sprintf("jsonb_build_object('key', %s) || %s", utils.QuoteLiteral(key), bucket))
+		default:
+			buckets = append(buckets, bucket)
+		}
+		return nil
+	}
+	for i, rawFilter := range rawFilters {
+		query, ok := rawFilter.(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError("[filters] queries must be objects")
+		}
+		clause, err := parseQuery(query, b.ctx)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, fmt.Sprintf("NOT coalesce((%s), false)", clause.Condition))
+		key := ""
+		if len(names) > 0 {
+			key = names[i]
+		}
+		if err = addBucket(key, clause.Condition); err != nil {
+			return "", err
+		}
+	}
+	if len(otherKey) > 0 {
+		if err := addBucket(otherKey, joinConditions(conditions, "AND")); err != nil {
+			return "", err
+		}
+	}
+	if keyed {
+		return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_object(%s))", strings.Join(buckets, ", ")), nil
+	}
+	return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_array(%s))", strings.Join(buckets, ", ")), nil
+}
+
+// Check if buckets of a multi-bucket aggregation are returned as an object keyed by bucket keys
+func keyedBuckets(typeName string, params map[string]interface{}) bool {
+	keyed, ok := params["keyed"].(bool)
+	if !ok && typeName == "filters" {
+		_, keyed = params["filters"].(map[string]interface{})
+	}
+	return keyed
+}
+
+// Build date_range aggregation which creates buckets of documents with dates within ranges. Bounds could be dates or
+// date math expressions, from is inclusive and to is exclusive
+func (b *aggregationBuilder) dateRangeAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("date_range", params)
+	if err != nil {
+		return "", err
+	}
+	rawRanges, ok := params["ranges"].([]interface{})
+	if !ok || len(rawRanges) == 0 {
+		return "", utils.NewIllegalQueryError("No [ranges] specified for the [date_range] aggregation")
+	}
+	keyed := keyedBuckets("date_range", params)
+
+	var buckets []string
+	for _, rawRange := range rawRanges {
+		rangeObject, ok := rawRange.(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError("[ranges] of date_range aggregation must be objects")
+		}
+		var conditions, bucket []string
+		fromKey, toKey := "'*'", "'*'"
+		for _, bound := range []string{"from", "to"} {
+			rawBound, ok := rangeObject[bound]
+			if !ok || rawBound == nil {
+				continue
+			}
+			value, err := dateMath(rawBound, false)
+			if err != nil {
+				return "", err
+			}
+			millis := fmt.Sprintf("(extract(epoch FROM %s) * 1000)::float8", value)
+			operator := ">="
+			if bound == "from" {
+				fromKey = formatEpochMillis(millis)
+			} else {
+				operator = "<"
+				toKey = formatEpochMillis(millis)
+			}
+			conditions = append(conditions, fmt.Sprintf("pg_elastic_timestamp(v.value) %s %s", operator, value))
+			bucket = append(bucket, utils.QuoteLiteral(bound), millis, utils.QuoteLiteral(bound+"_as_string"), formatEpochMillis(millis))
+		}
+		key := fmt.Sprintf("%s || '-' || %s", fromKey, toKey)
+		if rawKey, ok := rangeObject["key"]; ok {
+			key = utils.QuoteLiteral(fmt.Sprint(rawKey))
+		}
+		bucketDocuments := fmt.Sprintf("(SELECT d.* FROM %s AS d WHERE %s)", documents, anyValue(field, joinConditions(conditions, "AND")))
+		subAggregations, err := subAggregationsOf(bucketDocuments)
+		if err != nil {
+			return "", err
+		}
+		bucket = append(bucket, "'doc_count'", fmt.Sprintf("(SELECT count(*) FROM %s AS d)", bucketDocuments))
+		expression := fmt.Sprintf("jsonb_build_object(%s) || %s", strings.Join(bucket, ", "), subAggregations)
+		if keyed {
+			buckets = append(buckets, key, expression)
+		} else {
+			buckets = append(buckets, fmt.Sprintf("jsonb_build_object('key', %s) || %s", key, expression))
+		}
+	}
+	if keyed {
+		return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_object(%s))", strings.Join(buckets, ", ")), nil
+	}
+	return fmt.Sprintf("jsonb_build_object('buckets', jsonb_build_array(%s))", strings.Join(buckets, ", ")), nil
+}
+
+// Build composite aggregation which creates a bucket for each combination of values of its sources. Buckets are
+// ordered by their keys, the next page of buckets starts after the after key. Sources are terms, histogram and
+// date_histogram
+func (b *aggregationBuilder) compositeAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	size := 10
+	var after map[string]interface{}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "size":
+			size, err = parseInt(v, k)
+		case "after":
+			var ok bool
+			if after, ok = v.(map[string]interface{}); !ok {
+				return "", utils.NewIllegalQueryError("[after] must be an object")
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	rawSources, ok := params["sources"].([]interface{})
+	if !ok || len(rawSources) == 0 {
+		return "", utils.NewIllegalQueryError("Composite [sources] cannot be null or empty")
+	}
+
+	var names, values, orders, equal, disjuncts []string
+	for i, rawSource := range rawSources {
+		source, ok := rawSource.(map[string]interface{})
+		if !ok || len(source) != 1 {
+			return "", utils.NewIllegalQueryError("[sources] must contain objects with a single named source")
+		}
+		for name, rawValues := range source {
+			sourceValues, direction, err := b.compositeSource(name, rawValues)
+			if err != nil {
+				return "", err
+			}
+			names = append(names, name)
+			values = append(values, fmt.Sprintf("%s AS s%d", sourceValues, i))
+			column := fmt.Sprintf("key->%s", utils.QuoteLiteral(name))
+			orders = append(orders, fmt.Sprintf("k.%s %s", column, direction))
+			if after == nil {
+				continue
+			}
+			value, ok := after[name]
+			if !ok {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("[after] has no value for source [%s]", name))
+			}
+			operator := ">"
+			if direction == "DESC" {
+				operator = "<"
+			}
+			disjuncts = append(disjuncts, joinConditions(append(equal[:len(equal):len(equal)], fmt.Sprintf("c.%s %s %s", column, operator, quoteJSON(value))), "AND"))
+			equal = append(equal, fmt.Sprintf("c.%s = %s", column, quoteJSON(value)))
+		}
+	}
+
+	// Keys of a document are all combinations of values of sources
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, utils.QuoteLiteral(name), fmt.Sprintf("s%d.value", i))
+	}
+	keys := fmt.Sprintf("(SELECT jsonb_build_object(%s) AS key FROM %s)", strings.Join(pairs, ", "), strings.Join(values, ", "))
+	if after != nil {
+		keys = fmt.Sprintf("(SELECT c.key FROM %s AS c WHERE %s)", keys, joinConditions(disjuncts, "OR"))
+	}
+	bucket := b.alias("b")
+	subAggregations, err := subAggregationsOf(keyBucketDocuments(documents, keys, bucket))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('buckets', coalesce(jsonb_agg(jsonb_build_object('key', %[1]s.key, 'doc_count', %[1]s.doc_count) || %[2]s ORDER BY %[1]s.rank) FILTER (WHERE %[1]s.rank <= %[3]d), '[]'::jsonb)) || "+
+		"CASE WHEN count(*) > 0 THEN jsonb_build_object('after_key', (array_agg(%[1]s.key ORDER BY %[1]s.rank DESC) FILTER (WHERE %[1]s.rank <= %[3]d))[1]) ELSE '{}'::jsonb END "+
+		"FROM %[4]s AS %[1]s)",
+		bucket, subAggregations, size, keyBuckets(documents, keys, orders, 1)), nil
+}
+
+// Build SQL subquery of distinct values of a composite source with value column and get its SQL ordering. Documents
+// without values get null value if missing_bucket is set
+func (b *aggregationBuilder) compositeSource(name string, rawSource interface{}) (string, string, error) {
+	source, ok := rawSource.(map[string]interface{})
+	if !ok || len(source) != 1 {
+		return "", "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] source must contain a single source type", name))
+	}
+	for typeName, rawParams := range source {
+		params, ok := rawParams.(map[string]interface{})
+		if !ok {
+			return "", "", utils.NewIllegalQueryError(fmt.Sprintf("Expected [START_OBJECT] under [%s]", typeName))
+		}
+		field, err := aggregationField(typeName, params)
+		if err != nil {
+			return "", "", err
+		}
+		direction := "ASC"
+		if order, ok := params["order"]; ok {
+			direction = strings.ToUpper(fmt.Sprint(order))
+			if direction != "ASC" && direction != "DESC" {
+				return "", "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown order [%v] of source [%s]", order, name))
+			}
+		}
+		var value string
+		switch typeName {
+		case "terms":
+			value = "nullif(v.value, 'null'::jsonb)"
+		case "histogram":
+			interval, err := parseFloat(params["interval"], "interval")
+			if err != nil {
+				return "", "", err
+			}
+			if interval <= 0 {
+				return "", "", utils.NewIllegalQueryError("[interval] must be greater than 0 for histogram source")
+			}
+			value = fmt.Sprintf("to_jsonb(floor((%[1]s) / %[2]s) * %[2]s)", b.numericValue(field), utils.FormatFloat(interval))
+		case "date_histogram":
+			if value, err = dateHistogramKey(params); err != nil {
+				return "", "", err
+			}
+		default:
+			return "", "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown source type [%s] of composite aggregation", typeName))
+		}
+		values := fmt.Sprintf("SELECT DISTINCT %s AS value FROM %s", value, fieldValues(field))
+		if missingBucket, _ := params["missing_bucket"].(bool); missingBucket {
+			values = fmt.Sprintf("SELECT * FROM (%s) AS m WHERE m.value IS NOT NULL UNION ALL SELECT 'null'::jsonb WHERE NOT %s", values, existsCondition(field))
+		} else {
+			values = fmt.Sprintf("SELECT * FROM (%s) AS m WHERE m.value IS NOT NULL", values)
+		}
+		return "(" + values + ")", direction, nil
+	}
+	return "", "", nil
+}
+
+// Build jsonb expression of the key of a date of v.value column in a date histogram. It is the start of the interval
+// in milliseconds since epoch. Calendar intervals are units like "month" or "1M", fixed intervals are time values
+func dateHistogramKey(params map[string]interface{}) (string, error) {
+	timestamp := "pg_elastic_timestamp(v.value)"
+	rawInterval, calendar := params["calendar_interval"]
+	if !calendar {
+		if rawInterval, calendar = params["interval"]; calendar {
+			_, calendar = calendarUnits[fmt.Sprint(rawInterval)]
+		}
+	}
+	if calendar {
+		unit, ok := calendarUnits[fmt.Sprint(rawInterval)]
+		if !ok {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("The supplied interval [%v] could not be parsed as a calendar interval.", rawInterval))
+		}
+		return fmt.Sprintf("to_jsonb(extract(epoch FROM date_trunc('%s', %s AT TIME ZONE 'UTC') AT TIME ZONE 'UTC') * 1000)", unit, timestamp), nil
+	}
+	rawInterval, ok := params["fixed_interval"]
+	if !ok {
+		if rawInterval, ok = params["interval"]; !ok {
+			return "", utils.NewIllegalQueryError("Required one of fields [fixed_interval, calendar_interval], but none were specified.")
+		}
+	}
+	millis, err := parseTimeValue(rawInterval)
+	if err != nil {
+		return "", err
+	}
+	if millis <= 0 {
+		return "", utils.NewIllegalQueryError("[fixed_interval] must be greater than 0")
+	}
+	return fmt.Sprintf("to_jsonb(floor(extract(epoch FROM %[1]s) * 1000 / %[2]s) * %[2]s)", timestamp, utils.FormatFloat(millis)), nil
+}
+
+// Units of calendar intervals of date histograms
+var calendarUnits = map[string]string{
+	"minute": "minute", "1m": "minute", "hour": "hour", "1h": "hour", "day": "day", "1d": "day", "week": "week", "1w": "week",
+	"month": "month", "1M": "month", "quarter": "quarter", "1q": "quarter", "year": "year", "1y": "year",
+}
+
+// Build significant_terms aggregation which creates buckets of terms which are more frequent in matching documents
+// than in all documents of searched types. Terms are scored by JLH score
+func (b *aggregationBuilder) significantTermsAggregation(params map[string]interface{}, documents string, subAggregationsOf func(string) (string, error)) (string, error) {
+	field, err := aggregationField("significant_terms", params)
+	if err != nil {
+		return "", err
+	}
+	size, minDocCount := 10, 3
+	for k, v := range params {
+		switch k {
+		case "size":
+			size, err = parseInt(v, k)
+		case "min_doc_count":
+			minDocCount, err = parseInt(v, k)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	keys := fmt.Sprintf("(SELECT DISTINCT v.value AS key FROM %s WHERE v.value <> 'null'::jsonb)", fieldValues(field))
+	orders := []string{"count(*) DESC", "k.key ASC"}
+	foreground, background := "(f.doc_count::float8 / fs.total)", "(g.doc_count::float8 / bs.total)"
+	scored := fmt.Sprintf("(SELECT s.*, row_number() OVER (ORDER BY s.score DESC, s.key) AS rank FROM "+
+		"(SELECT f.key, f.doc_count, g.doc_count AS bg_count, CASE WHEN %[1]s > %[2]s THEN (%[1]s - %[2]s) * (%[1]s / %[2]s) ELSE 0 END AS score "+
+		"FROM %[3]s AS f JOIN %[4]s AS g ON g.key = f.key, (SELECT count(*) AS total FROM %[5]s AS d) AS fs, (SELECT count(*) AS total FROM %[6]s AS d) AS bs) AS s "+
+		"WHERE s.score > 0)",
+		foreground, background, keyBuckets(documents, keys, orders, minDocCount), keyBuckets(b.background, keys, orders, 1), documents, b.background)
+	bucket := b.alias("b")
+	subAggregations, err := subAggregationsOf(keyBucketDocuments(documents, keys, bucket))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('doc_count', (SELECT count(*) FROM %[1]s AS d), 'bg_count', (SELECT count(*) FROM %[2]s AS d), "+
+		"'buckets', coalesce(jsonb_agg(jsonb_build_object('key', %[3]s.key, 'doc_count', %[3]s.doc_count, 'score', %[3]s.score, 'bg_count', %[3]s.bg_count) || %[4]s ORDER BY %[3]s.rank) FILTER (WHERE %[3]s.rank <= %[5]d), '[]'::jsonb)) "+
+		"FROM %[6]s AS %[3]s)",
+		documents, b.background, bucket, subAggregations, size, scored), nil
+}
@@ -0,0 +1,94 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// Collapse describes collapsing of search hits by values of a field. Each group is represented by its top hit,
+// InnerHits describe documents of the group returned together with it
+type Collapse struct {
+	Field     string
+	InnerHits []CollapseInnerHits
+}
+
+// CollapseInnerHits describes documents of a collapsed group. They are sorted by relevance unless Sort is specified
+type CollapseInnerHits struct {
+	Name string
+	From int
+	Size int
+	Sort []SortField
+}
+
+// ParseCollapse parses collapse of a search request like {"field": "user", "inner_hits": {"name": "recent"}}. Inner
+// hits could be an array of objects with different names
+func ParseCollapse(rawCollapse interface{}) (*Collapse, error) {
+	params, ok := rawCollapse.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[collapse] malformed, must start with start_object")
+	}
+	field, ok := params["field"].(string)
+	if !ok || len(field) == 0 {
+		return nil, utils.NewIllegalQueryError("[collapse] requires 'field' to be specified")
+	}
+	collapse := &Collapse{Field: field}
+	var rawInnerHits []interface{}
+	switch value := params["inner_hits"].(type) {
+	case nil:
+	case []interface{}:
+		rawInnerHits = value
+	default:
+		rawInnerHits = []interface{}{value}
+	}
+	names := make(map[string]bool)
+	for _, rawHits := range rawInnerHits {
+		innerHits, err := parseCollapseInnerHits(rawHits, field)
+		if err != nil {
+			return nil, err
+		}
+		if names[innerHits.Name] {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[inner_hits] already contains an entry for key [%s]", innerHits.Name))
+		}
+		names[innerHits.Name] = true
+		collapse.InnerHits = append(collapse.InnerHits, *innerHits)
+	}
+	return collapse, nil
+}
+
+// Parse inner hits of collapsed groups. They are named by the field by default
+func parseCollapseInnerHits(rawInnerHits interface{}, field string) (*CollapseInnerHits, error) {
+	params, ok := rawInnerHits.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[inner_hits] must be an object")
+	}
+	innerHits := &CollapseInnerHits{Name: field, Size: 3, Sort: DefaultSort()}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "name":
+			innerHits.Name = fmt.Sprint(v)
+		case "from":
+			innerHits.From, err = parseInt(v, k)
+		case "size":
+			innerHits.Size, err = parseInt(v, k)
+		case "sort":
+			innerHits.Sort, err = ParseSort(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if innerHits.From < 0 || innerHits.Size < 0 {
+		return nil, utils.NewIllegalQueryError("[inner_hits] from and size cannot be negative")
+	}
+	return innerHits, nil
+}
+
+// CollapseExpression builds jsonb expression of the key which documents are collapsed by. Documents are collapsed by
+// the first value of the field, documents without it form a single group. Analyzed text fields could not be collapsed
+func (ctx *QueryContext) CollapseExpression(fieldName string) (string, error) {
+	if ctx.isTextField(fieldName) {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[collapse] cannot collapse on field [%s] of type [text]", fieldName))
+	}
+	return fmt.Sprintf("(SELECT nullif(v.value, 'null'::jsonb) FROM %s LIMIT 1)", fieldValues(fieldName)), nil
+}
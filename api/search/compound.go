@@ -0,0 +1,87 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+)
+
+func parseConstantScoreQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	rawFilter, ok := rawQuery["filter"].(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[constant_score] requires a 'filter' element")
+	}
+	filter, err := parseQuery(rawFilter, ctx)
+	if err != nil {
+		return nil, err
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &Clause{Condition: filter.Condition, Score: utils.FormatFloat(boost)}, nil
+}
+
+func parseDisMaxQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	rawQueries, ok := rawQuery["queries"]
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[dis_max] requires 'queries' field")
+	}
+	clauses, err := parseQueryList(rawQueries, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(clauses) == 0 {
+		return falseClause(), nil
+	}
+	tieBreaker := 0.0
+	if value, ok := rawQuery["tie_breaker"]; ok {
+		if tieBreaker, err = parseFloat(value, "tie_breaker"); err != nil {
+			return nil, err
+		}
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return boostClause(disjunctionMax(clauses, tieBreaker), boost), nil
+}
+
+func parseBoostingQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	rawPositive, ok := rawQuery["positive"].(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[boosting] query requires 'positive' query to be set'")
+	}
+	rawNegative, ok := rawQuery["negative"].(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[boosting] query requires 'negative' query to be set'")
+	}
+	rawNegativeBoost, ok := rawQuery["negative_boost"]
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[boosting] query requires 'negative_boost' to be set to be a positive value'")
+	}
+	negativeBoost, err := parseFloat(rawNegativeBoost, "negative_boost")
+	if err != nil {
+		return nil, err
+	}
+	if negativeBoost < 0 {
+		return nil, utils.NewIllegalQueryError("[boosting] query requires 'negative_boost' to be set to be a positive value'")
+	}
+	positive, err := parseQuery(rawPositive, ctx)
+	if err != nil {
+		return nil, err
+	}
+	negative, err := parseQuery(rawNegative, ctx)
+	if err != nil {
+		return nil, err
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	// Documents matching the negative query are demoted but not excluded
+	clause := &Clause{
+		Condition: positive.Condition,
+		Score:     fmt.Sprintf("CASE WHEN coalesce(%s, FALSE) THEN (%s) * %s ELSE %s END", negative.Condition, positive.Score, utils.FormatFloat(negativeBoost), positive.Score),
+	}
+	return boostClause(clause, boost), nil
+}
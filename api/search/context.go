@@ -0,0 +1,106 @@
+package search
+
+import (
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// QueryContext describes a document type which a search query is parsed for. InnerHits are collected from nested
+// queries during parsing, as well as analyzed terms of full-text queries for highlighting
+type QueryContext struct {
+	Index          string
+	Type           string
+	Mapping        map[string]interface{}
+	Analyzers      *AnalyzerRegistry
+	InnerHits      []*InnerHits
+	client         *db.Client
+	highlightTerms map[string][]string
+}
+
+// NewQueryContext creates a context for the type. Mapping is taken from type options or from mappings section of index
+// options if type has no own mapping
+func NewQueryContext(index *db.IndexRecord, docType *db.TypeRecord, client *db.Client) (*QueryContext, error) {
+	ctx := &QueryContext{Mapping: make(map[string]interface{}), client: client}
+	indexOptions := make(map[string]interface{})
+	if index != nil {
+		var err error
+		ctx.Index = index.Name
+		indexOptions, err = utils.ParseOptions(index.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if docType != nil {
+		ctx.Type = docType.Name
+		typeOptions, err := utils.ParseOptions(docType.Options)
+		if err != nil {
+			return nil, err
+		}
+		if mapping, ok := utils.ExtractTypeMapping(typeOptions, docType.Name); ok {
+			ctx.Mapping = mapping
+		} else if mapping, ok := utils.ExtractTypeMapping(indexOptions, docType.Name); ok {
+			ctx.Mapping = mapping
+		}
+	}
+	ctx.Analyzers = NewAnalyzerRegistry(utils.ExtractIndexSettings(indexOptions), client.Features().HasTextSearchConfig)
+	return ctx, nil
+}
+
+// Get a mapping type of the field. Fields without mapping are treated as text fields
+func (ctx *QueryContext) fieldType(fieldName string) string {
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, fieldName)
+	if !ok || len(fieldMapping.TypeName) == 0 {
+		return "text"
+	}
+	return fieldMapping.TypeName
+}
+
+// Check if the field is explicitly mapped as analyzed text. Such fields are searched by terms of their vectors
+func (ctx *QueryContext) isTextField(fieldName string) bool {
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, fieldName)
+	return ok && fieldMapping.TypeName == "text"
+}
+
+// Check if mapping type is a numeric type
+func isNumericType(typeName string) bool {
+	switch typeName {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+		return true
+	}
+	return false
+}
+
+// Get an analyzer used for searching in the field
+func (ctx *QueryContext) searchAnalyzer(fieldName string) (*Analyzer, error) {
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, fieldName)
+	if ok {
+		switch {
+		case len(fieldMapping.SearchAnalyzer) > 0:
+			return ctx.Analyzers.Lookup(fieldMapping.SearchAnalyzer)
+		case len(fieldMapping.Analyzer) > 0:
+			return ctx.Analyzers.Lookup(fieldMapping.Analyzer)
+		case fieldMapping.TypeName == "keyword":
+			return ctx.Analyzers.Lookup("keyword")
+		}
+	}
+	return ctx.Analyzers.Default(), nil
+}
+
+// Get an analyzer used for indexing of the field
+func (ctx *QueryContext) indexAnalyzer(fieldName string) (*Analyzer, error) {
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, fieldName)
+	if ok {
+		switch {
+		case len(fieldMapping.Analyzer) > 0:
+			return ctx.Analyzers.Lookup(fieldMapping.Analyzer)
+		case fieldMapping.TypeName == "keyword":
+			return ctx.Analyzers.Lookup("keyword")
+		}
+	}
+	return ctx.Analyzers.Default(), nil
+}
+
+// Split a text into terms with the analyzer
+func (ctx *QueryContext) analyze(analyzer *Analyzer, text string) ([]db.Token, error) {
+	return ctx.client.Analyze(analyzer.Vector(utils.QuoteLiteral(text)))
+}
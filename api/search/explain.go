@@ -0,0 +1,112 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Explanation explains whether and why a document matches a query. Details explain subqueries of compound queries.
+// Clause is SQL representation of the query, Value and Matched are set by Evaluate
+type Explanation struct {
+	Value       float64        `json:"value"`
+	Description string         `json:"description"`
+	Details     []*Explanation `json:"details"`
+	Matched     bool           `json:"-"`
+	Clause      *Clause        `json:"-"`
+}
+
+// Subqueries of compound queries which are explained separately. Queries of nested query are evaluated over nested
+// objects, so they are not explained
+var explainedSubqueries = map[string][]string{
+	"bool":           {"must", "filter", "should", "must_not"},
+	"constant_score": {"filter"},
+	"dis_max":        {"queries"},
+	"boosting":       {"positive", "negative"},
+	"function_score": {"query"},
+	"script_score":   {"query"},
+}
+
+// ExplainQuery parses a query into a tree of explanations
+func ExplainQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Explanation, error) {
+	clause, err := parseQuery(rawQuery, ctx)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &Explanation{Clause: clause, Details: []*Explanation{}}
+	var names []string
+	for name := range rawQuery {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 1 {
+		// Several queries of an object should match all
+		explanation.Description = "all of:"
+		for _, name := range names {
+			detail, err := ExplainQuery(map[string]interface{}{name: rawQuery[name]}, ctx)
+			if err != nil {
+				return nil, err
+			}
+			explanation.Details = append(explanation.Details, detail)
+		}
+		return explanation, nil
+	}
+	name := names[0]
+	text, _ := json.Marshal(rawQuery[name])
+	explanation.Description = fmt.Sprintf("%s %s", name, text)
+	body, _ := rawQuery[name].(map[string]interface{})
+	for _, occur := range explainedSubqueries[name] {
+		var rawSubqueries []interface{}
+		switch value := body[occur].(type) {
+		case []interface{}:
+			rawSubqueries = value
+		case map[string]interface{}:
+			rawSubqueries = []interface{}{value}
+		}
+		for _, rawSubquery := range rawSubqueries {
+			subquery, ok := rawSubquery.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			detail, err := ExplainQuery(subquery, ctx)
+			if err != nil {
+				return nil, err
+			}
+			detail.Description = occur + ": " + detail.Description
+			explanation.Details = append(explanation.Details, detail)
+		}
+	}
+	return explanation, nil
+}
+
+// Expressions returns SQL expressions of conditions and scores of the query and all its subqueries. They are ordered
+// like Evaluate expects their values
+func (explanation *Explanation) Expressions() []string {
+	expressions := []string{
+		fmt.Sprintf("coalesce((%s)::boolean, false)", explanation.Clause.Condition),
+		fmt.Sprintf("coalesce((%s)::float8, 0)", explanation.Clause.Score),
+	}
+	for _, detail := range explanation.Details {
+		expressions = append(expressions, detail.Expressions()...)
+	}
+	return expressions
+}
+
+// Evaluate sets results of the query and its subqueries from values of their expressions. Score of a query which
+// doesn't match is zero. Returns values of the next queries
+func (explanation *Explanation) Evaluate(values []interface{}) []interface{} {
+	if len(values) < 2 {
+		return values
+	}
+	explanation.Matched, _ = values[0].(bool)
+	if explanation.Matched {
+		explanation.Value, _ = values[1].(float64)
+	} else {
+		explanation.Description = "no match on " + explanation.Description
+	}
+	values = values[2:]
+	for _, detail := range explanation.Details {
+		values = detail.Evaluate(values)
+	}
+	return values
+}
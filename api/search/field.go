@@ -0,0 +1,63 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// Build jsonpath which selects all values of the field. Dotted names are paths into objects. Arrays are unwrapped on
+// every step in lax mode, so values inside arrays of objects and elements of arrays are selected as separate values
+func fieldPath(fieldName string) string {
+	path := "$"
+	for _, key := range strings.Split(fieldName, ".") {
+		path += "." + jsonPathValue(key)
+	}
+	return path + "[*]"
+}
+
+// Format a scalar value as jsonpath literal
+func jsonPathValue(value interface{}) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// SQL condition which matches documents where any value of the field satisfies jsonpath filter expression like
+// "@ == 1". Such conditions could use GIN index over document column
+func anyValueMatches(fieldName, filter string) string {
+	return fmt.Sprintf("document @? %s", utils.QuoteLiteral(fmt.Sprintf("%s ? (%s)", fieldPath(fieldName), filter)))
+}
+
+// SQL condition which matches documents where any value of the field satisfies SQL condition over v.value column
+func anyValue(fieldName, condition string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s)", fieldValues(fieldName), condition)
+}
+
+// SQL source of all values of the field as v.value column
+func fieldValues(fieldName string) string {
+	return fmt.Sprintf("jsonb_path_query(document, %s) AS v(value)", utils.QuoteLiteral(fieldPath(fieldName)))
+}
+
+// SQL condition which matches documents where any value of the field equals to the scalar value
+func valueCondition(fieldName string, value interface{}) string {
+	return anyValueMatches(fieldName, "@ == "+jsonPathValue(value))
+}
+
+// Build a condition which checks that the field is present in a document and has a value. Null values and empty
+// arrays are treated as missing values
+func existsCondition(fieldName string) string {
+	return anyValueMatches(fieldName, "@ != null")
+}
+
+// SQL expression of all text of the field used for full-text search. Plain names keep document->'field' form, so
+// expression indexes over such fields could be used
+func fieldText(fieldName string) string {
+	switch {
+	case fieldName == "*":
+		return "pg_elastic_text(document)"
+	case strings.Contains(fieldName, "."):
+		return fmt.Sprintf("pg_elastic_text(jsonb_path_query_array(document, %s))", utils.QuoteLiteral(fieldPath(fieldName)))
+	}
+	return fmt.Sprintf("pg_elastic_text(document->%s)", utils.QuoteLiteral(fieldName))
+}
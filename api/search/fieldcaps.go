@@ -0,0 +1,82 @@
+package search
+
+import (
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// FieldCapability describes how a field of a type could be used in queries and aggregations
+type FieldCapability struct {
+	Type         string
+	Searchable   bool
+	Aggregatable bool
+}
+
+// Meta fields of all documents with their capabilities
+var metaFieldCapabilities = map[string]FieldCapability{
+	"_id":     {"_id", true, true},
+	"_index":  {"_index", true, true},
+	"_type":   {"_type", true, true},
+	"_source": {"_source", false, false},
+}
+
+// FieldCapabilities returns capabilities of fields of the context which match any of the wildcard patterns. Types of
+// fields are taken from the mapping, types of documents without mapping are inferred from their values
+func (ctx *QueryContext) FieldCapabilities(patterns []string) (map[string]FieldCapability, error) {
+	fields := utils.MappedFields(ctx.Mapping)
+	if len(fields) == 0 && len(ctx.Index) > 0 && len(ctx.Type) > 0 {
+		inferred, err := ctx.client.InferFieldTypes(ctx.Index, ctx.Type)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range inferred {
+			fields[field.Path] = field.Type
+		}
+	}
+	result := make(map[string]FieldCapability)
+	for name, typeName := range fields {
+		if matchAnyWildcard(patterns, name) {
+			result[name] = ctx.fieldCapability(name, typeName)
+		}
+	}
+	for name, capability := range metaFieldCapabilities {
+		if matchAnyWildcard(patterns, name) {
+			result[name] = capability
+		}
+	}
+	return result, nil
+}
+
+// IsMetaField checks if the field is a meta field of documents
+func IsMetaField(name string) bool {
+	_, ok := metaFieldCapabilities[name]
+	return ok
+}
+
+// Get capabilities of a field of the type. Text is searched by terms and could not be aggregated, fields with disabled
+// index are not searchable
+func (ctx *QueryContext) fieldCapability(name, typeName string) FieldCapability {
+	capability := FieldCapability{Type: typeName, Searchable: true, Aggregatable: true}
+	switch typeName {
+	case "text", "completion", "search_as_you_type":
+		capability.Aggregatable = false
+	case "binary":
+		capability.Searchable = false
+		capability.Aggregatable = false
+	case "dense_vector":
+		capability.Aggregatable = false
+	}
+	if fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, name); ok && !fieldMapping.Indexed {
+		capability.Searchable = false
+	}
+	return capability
+}
+
+// Check if the name matches any of the wildcard patterns
+func matchAnyWildcard(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
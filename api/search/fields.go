@@ -0,0 +1,54 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// FieldsExpression builds SQL expression of jsonb object with values of requested fields of a found document. Fields
+// of fields, docvalue_fields and stored_fields parameters are names or wildcard patterns of mapped fields given as
+// strings or as objects {field, format}. Values of each field are returned as an array, fields without values are
+// omitted. Empty expression means no fields are requested
+func (ctx *QueryContext) FieldsExpression(rawFields []interface{}) (string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, rawField := range rawFields {
+		var pattern string
+		switch rawField := rawField.(type) {
+		case string:
+			pattern = rawField
+		case map[string]interface{}:
+			field, ok := rawField["field"].(string)
+			if !ok {
+				return "", utils.NewIllegalQueryError("[fields] requires 'field' to be specified")
+			}
+			pattern = field
+		default:
+			return "", utils.NewIllegalQueryError("[fields] should be a field name or an object")
+		}
+		// Metadata fields are returned in hits themselves
+		if pattern == "_none_" || strings.HasPrefix(pattern, "_") {
+			continue
+		}
+		matched := []string{pattern}
+		if strings.Contains(pattern, "*") {
+			matched = matchMappedFields(ctx.Mapping, pattern)
+		}
+		for _, name := range matched {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	var args []string
+	for _, name := range names {
+		values := fmt.Sprintf("(SELECT jsonb_agg(v.value) FROM %s WHERE v.value <> 'null'::jsonb AND jsonb_typeof(v.value) <> 'object')", fieldValues(name))
+		args = append(args, utils.QuoteLiteral(name), values)
+	}
+	return fmt.Sprintf("nullif(jsonb_strip_nulls(jsonb_build_object(%s)), '{}')", strings.Join(args, ", ")), nil
+}
@@ -0,0 +1,332 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"strconv"
+	"strings"
+)
+
+// matchOptions contains parameters of a match query
+type matchOptions struct {
+	query              string
+	operator           string
+	minimumShouldMatch string
+	analyzer           string
+	zeroTermsQuery     string
+	lenient            bool
+	boost              float64
+	slop               int
+	fuzzy              *fuzzyOptions
+}
+
+func parseMatchQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	return parseFieldQueries(rawQuery, ctx, matchClause)
+}
+
+func parseMatchPhraseQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	return parseFieldQueries(rawQuery, ctx, func(fieldName string, options *matchOptions, ctx *QueryContext) (*Clause, error) {
+		return phraseClause(fieldName, options, ctx, false)
+	})
+}
+
+func parseMatchPhrasePrefixQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	return parseFieldQueries(rawQuery, ctx, func(fieldName string, options *matchOptions, ctx *QueryContext) (*Clause, error) {
+		return phraseClause(fieldName, options, ctx, true)
+	})
+}
+
+// Parse a full-text query which is specified as {field: options}. Clauses of all fields should match
+func parseFieldQueries(rawQuery map[string]interface{}, ctx *QueryContext, build func(string, *matchOptions, *QueryContext) (*Clause, error)) (*Clause, error) {
+	var clauses []*Clause
+	for k, v := range rawQuery {
+		fieldName := k
+		options, err := parseMatchOptions(v)
+		if err != nil {
+			return nil, err
+		}
+		clause, err := build(fieldName, options, ctx)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return nil, utils.NewIllegalQueryError("query doesn't contain a field")
+	}
+	return conjunction(clauses), nil
+}
+
+// Parse short (field: text) or full (field: {query: text, ...}) form of a full-text query
+func parseMatchOptions(rawQuery interface{}) (*matchOptions, error) {
+	options := &matchOptions{operator: "or", zeroTermsQuery: "none", boost: 1}
+	rawOptions, ok := rawQuery.(map[string]interface{})
+	if !ok {
+		options.query = fmt.Sprint(rawQuery)
+		return options, nil
+	}
+	var err error
+	for k, v := range rawOptions {
+		switch k {
+		case "query":
+			if v == nil {
+				return nil, utils.NewIllegalQueryError("No text specified for text query")
+			}
+			options.query = fmt.Sprint(v)
+		case "operator":
+			options.operator = strings.ToLower(fmt.Sprint(v))
+			if options.operator != "or" && options.operator != "and" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Unsupported operator [%v]", v))
+			}
+		case "minimum_should_match":
+			options.minimumShouldMatch = fmt.Sprint(v)
+		case "analyzer":
+			options.analyzer = fmt.Sprint(v)
+		case "zero_terms_query":
+			options.zeroTermsQuery = strings.ToLower(fmt.Sprint(v))
+			if options.zeroTermsQuery != "none" && options.zeroTermsQuery != "all" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Unsupported zero_terms_query value [%v]", v))
+			}
+		case "lenient":
+			if options.lenient, err = parseBool(v, k); err != nil {
+				return nil, err
+			}
+		case "boost":
+			if options.boost, err = parseFloat(v, k); err != nil {
+				return nil, err
+			}
+		case "slop":
+			if options.slop, err = parseInt(v, k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := rawOptions["query"]; !ok {
+		return nil, utils.NewIllegalQueryError("No text specified for text query")
+	}
+	options.fuzzy, err = parseFuzzyOptions(rawOptions)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// Build a clause of match query. Query text of full-text fields is analyzed and terms are combined with operator,
+// other fields are compared with the query value
+func matchClause(fieldName string, options *matchOptions, ctx *QueryContext) (*Clause, error) {
+	fieldType := ctx.fieldType(fieldName)
+	if isNumericType(fieldType) || fieldType == "boolean" {
+		return valueClause(fieldName, fieldType, options)
+	}
+	return textClause(fieldName, options, ctx, func(vector string, tokens []db.Token) (*Clause, error) {
+		return termsClause(vector, distinctTerms(tokens), options, ctx, vectorRank(vector))
+	})
+}
+
+// Build a clause of match_phrase or match_phrase_prefix query. Positions of terms are not checked for sloppy phrases,
+// all terms of such phrase should match
+func phraseClause(fieldName string, options *matchOptions, ctx *QueryContext, prefix bool) (*Clause, error) {
+	return textClause(fieldName, options, ctx, func(vector string, tokens []db.Token) (*Clause, error) {
+		if options.slop > 0 && !prefix {
+			return termsClause(vector, distinctTerms(tokens), &matchOptions{operator: "and"}, ctx, vectorRank(vector))
+		}
+		tsquery := phraseTSQuery(tokens, prefix)
+		return &Clause{Condition: fmt.Sprintf("%s @@ %s", vector, tsquery), Score: vectorRank(vector)(tsquery)}, nil
+	})
+}
+
+// Build a clause which matches analyzed terms against tsvector. Terms are combined according to operator and
+// minimum_should_match options, each term could be expanded by fuzzy matching. Score is calculated by rank for tsquery
+// which matches any of terms
+func termsClause(vector string, terms []string, options *matchOptions, ctx *QueryContext, rank func(string) string) (*Clause, error) {
+	alternatives := make([][]string, len(terms))
+	for i, term := range terms {
+		alternatives[i] = []string{term}
+	}
+	if options.fuzzy != nil {
+		var err error
+		alternatives, err = ctx.expandFuzzy(vector, terms, options.fuzzy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups := make([]string, len(alternatives))
+	for i, group := range alternatives {
+		var lexemes []string
+		for _, term := range group {
+			lexemes = append(lexemes, quoteLexeme(term))
+		}
+		groups[i] = strings.Join(lexemes, " | ")
+		if len(lexemes) > 1 {
+			groups[i] = "(" + groups[i] + ")"
+		}
+	}
+
+	required := len(groups)
+	if options.operator == "or" {
+		required = 1
+		if len(options.minimumShouldMatch) > 0 {
+			var err error
+			required, err = minimumShouldMatch(options.minimumShouldMatch, len(groups))
+			if err != nil {
+				return nil, err
+			}
+			if required < 1 {
+				required = 1
+			}
+		}
+	}
+	if required > len(groups) {
+		return falseClause(), nil
+	}
+	operator := " | "
+	if required == len(groups) {
+		operator = " & "
+	}
+	tsquery := utils.QuoteLiteral(strings.Join(groups, operator)) + "::tsquery"
+	clause := &Clause{
+		Condition: fmt.Sprintf("%s @@ %s", vector, tsquery),
+		Score:     rank(utils.QuoteLiteral(strings.Join(groups, " | ")) + "::tsquery"),
+	}
+	if required > 1 && required < len(groups) {
+		// Only some of terms are required. Vector is matched against all terms to filter documents, then number of
+		// matched terms is counted
+		var counters []string
+		for _, group := range groups {
+			counters = append(counters, fmt.Sprintf("(s.vector @@ %s::tsquery)::int", utils.QuoteLiteral(group)))
+		}
+		clause.Condition += fmt.Sprintf(" AND (SELECT %s FROM (SELECT %s AS vector) AS s) >= %d", strings.Join(counters, " + "), vector, required)
+	}
+	return clause, nil
+}
+
+// Build a function which ranks the vector against tsquery
+func vectorRank(vector string) func(string) string {
+	return func(tsquery string) string {
+		return fmt.Sprintf("ts_rank(%s, %s)", vector, tsquery)
+	}
+}
+
+// Build a clause which matches the field against query text. Field is processed by its index analyzer into tsvector,
+// query text is split into terms by the search analyzer. Both are passed to build
+func textClause(fieldName string, options *matchOptions, ctx *QueryContext, build func(string, []db.Token) (*Clause, error)) (*Clause, error) {
+	indexAnalyzer, err := ctx.indexAnalyzer(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := ctx.analyzeQuery(fieldName, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		if options.zeroTermsQuery == "all" {
+			return matchAllClause(options.boost), nil
+		}
+		return falseClause(), nil
+	}
+	clause, err := build(indexAnalyzer.Vector(fieldText(fieldName)), tokens)
+	if err != nil {
+		return nil, err
+	}
+	ctx.addHighlightTerms(fieldName, distinctTerms(tokens))
+	return boostClause(clause, options.boost), nil
+}
+
+// Split query text into terms by the search analyzer of the field or by analyzer specified in the query
+func (ctx *QueryContext) analyzeQuery(fieldName string, options *matchOptions) ([]db.Token, error) {
+	searchAnalyzer, err := ctx.searchAnalyzer(fieldName)
+	if len(options.analyzer) > 0 {
+		searchAnalyzer, err = ctx.Analyzers.Lookup(options.analyzer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ctx.analyze(searchAnalyzer, options.query)
+}
+
+// Build a clause which compares non-text field with the query value. Values which can't be converted into field type
+// are ignored by lenient queries
+func valueClause(fieldName, fieldType string, options *matchOptions) (*Clause, error) {
+	var value interface{}
+	var err error
+	text := strings.TrimSpace(options.query)
+	if fieldType == "boolean" {
+		value, err = strconv.ParseBool(text)
+	} else {
+		value, err = strconv.ParseFloat(text, 64)
+	}
+	if err != nil {
+		if options.lenient {
+			return falseClause(), nil
+		}
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("failed to create query: field [%s] of type [%s] can't parse value [%s]", fieldName, fieldType, options.query))
+	}
+	return &Clause{
+		Condition: valueCondition(fieldName, value),
+		Score:     utils.FormatFloat(options.boost),
+	}, nil
+}
+
+// Calculate number of optional clauses which should match according to minimum_should_match specification. Supports
+// integers, percentages, negative values and conditional specifications like "3<90%"
+func minimumShouldMatch(spec string, optionalCount int) (int, error) {
+	spec = strings.TrimSpace(spec)
+	result := optionalCount
+	if strings.Contains(spec, "<") {
+		for _, condition := range strings.Fields(strings.Replace(strings.Replace(spec, " <", "<", -1), "< ", "<", -1)) {
+			parts := strings.SplitN(condition, "<", 2)
+			upperBound, err := strconv.Atoi(parts[0])
+			if err != nil || len(parts) != 2 {
+				return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse minimum_should_match [%s]", spec))
+			}
+			if optionalCount <= upperBound {
+				return result, nil
+			}
+			result, err = minimumShouldMatch(parts[1], optionalCount)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return result, nil
+	}
+	if strings.HasSuffix(spec, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(spec, "%"))
+		if err != nil {
+			return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse minimum_should_match [%s]", spec))
+		}
+		calc := float64(result*percent) / 100
+		if calc < 0 {
+			result = result + int(calc)
+		} else {
+			result = int(calc)
+		}
+	} else {
+		calc, err := strconv.Atoi(spec)
+		if err != nil {
+			return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse minimum_should_match [%s]", spec))
+		}
+		if calc < 0 {
+			result = result + calc
+		} else {
+			result = calc
+		}
+	}
+	if result < 0 {
+		return 0, nil
+	}
+	return result, nil
+}
+
+// Get unique terms of tokens keeping order of their first occurrence
+func distinctTerms(tokens []db.Token) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if !seen[token.Term] {
+			seen[token.Term] = true
+			terms = append(terms, token.Term)
+		}
+	}
+	return terms
+}
@@ -0,0 +1,415 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scoreFunction is a function of function_score query. Condition selects documents the function is applied to and
+// Value is SQL expression of the function multiplied by its weight
+type scoreFunction struct {
+	Condition string
+	Value     string
+	Weight    float64
+}
+
+// Names of functions which could be used in function_score query
+var scoreFunctionNames = []string{"field_value_factor", "random_score", "gauss", "linear", "exp"}
+
+func parseFunctionScoreQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	query := matchAllClause(1)
+	var err error
+	if rawInner, ok := rawQuery["query"]; ok {
+		innerMap, ok := rawInner.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[function_score] query malformed, must start with start_object")
+		}
+		if query, err = parseQuery(innerMap, ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Functions are specified by an array or by a single function at the top level
+	var functions []*scoreFunction
+	if rawFunctions, ok := rawQuery["functions"]; ok {
+		list, ok := rawFunctions.([]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[function_score] malformed query, expected a [START_ARRAY] while parsing functions")
+		}
+		for _, rawFunction := range list {
+			functionMap, ok := rawFunction.(map[string]interface{})
+			if !ok {
+				return nil, utils.NewIllegalQueryError("[function_score] malformed query, expected a [START_OBJECT] while parsing functions")
+			}
+			function, err := parseScoreFunction(functionMap, ctx)
+			if err != nil {
+				return nil, err
+			}
+			functions = append(functions, function)
+		}
+	} else {
+		topLevel := make(map[string]interface{})
+		for _, name := range append(scoreFunctionNames, "weight") {
+			if value, ok := rawQuery[name]; ok {
+				topLevel[name] = value
+			}
+		}
+		if len(topLevel) > 0 {
+			function, err := parseScoreFunction(topLevel, ctx)
+			if err != nil {
+				return nil, err
+			}
+			functions = append(functions, function)
+		}
+	}
+
+	scoreMode, boostMode := "multiply", "multiply"
+	var maxBoost, minScore interface{}
+	for k, v := range rawQuery {
+		switch k {
+		case "score_mode":
+			scoreMode = strings.ToLower(fmt.Sprint(v))
+		case "boost_mode":
+			boostMode = strings.ToLower(fmt.Sprint(v))
+		case "max_boost":
+			maxBoost, err = parseFloat(v, k)
+		case "min_score":
+			minScore, err = parseFloat(v, k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	score := fmt.Sprintf("coalesce((%s)::float8, 0)", query.Score)
+	if len(functions) > 0 {
+		combined, err := combineScoreFunctions(functions, scoreMode)
+		if err != nil {
+			return nil, err
+		}
+		if maxBoost != nil {
+			combined = fmt.Sprintf("least(%s, %s)", combined, utils.FormatFloat(maxBoost.(float64)))
+		}
+		switch boostMode {
+		case "multiply":
+			score = fmt.Sprintf("%s * %s", score, combined)
+		case "replace":
+			score = combined
+		case "sum":
+			score = fmt.Sprintf("%s + %s", score, combined)
+		case "avg":
+			score = fmt.Sprintf("(%s + %s) / 2", score, combined)
+		case "max":
+			score = fmt.Sprintf("greatest(%s, %s)", score, combined)
+		case "min":
+			score = fmt.Sprintf("least(%s, %s)", score, combined)
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[function_score] illegal boost_mode [%s]", boostMode))
+		}
+	}
+	clause := &Clause{Condition: query.Condition, Score: score}
+	if minScore != nil {
+		clause.Condition = fmt.Sprintf("(%s) AND (%s) >= %s", clause.Condition, score, utils.FormatFloat(minScore.(float64)))
+	}
+	return boostClause(clause, boost), nil
+}
+
+// Parse a function of function_score query. Function without a name is a constant weight
+func parseScoreFunction(rawFunction map[string]interface{}, ctx *QueryContext) (*scoreFunction, error) {
+	function := &scoreFunction{Condition: "TRUE", Value: "1", Weight: 1}
+	var err error
+	if rawWeight, ok := rawFunction["weight"]; ok {
+		if function.Weight, err = parseFloat(rawWeight, "weight"); err != nil {
+			return nil, err
+		}
+	}
+	if rawFilter, ok := rawFunction["filter"]; ok {
+		filterMap, ok := rawFilter.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[function_score] filter malformed, must start with start_object")
+		}
+		filter, err := parseQuery(filterMap, ctx)
+		if err != nil {
+			return nil, err
+		}
+		function.Condition = filter.Condition
+	}
+	var name string
+	for _, functionName := range scoreFunctionNames {
+		if _, ok := rawFunction[functionName]; !ok {
+			continue
+		}
+		if len(name) > 0 {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse [function_score] query. already found function [%s], now encountering [%s]", name, functionName))
+		}
+		name = functionName
+	}
+	if len(name) > 0 {
+		params, ok := rawFunction[name].(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] function malformed, must start with start_object", name))
+		}
+		switch name {
+		case "field_value_factor":
+			function.Value, err = fieldValueFactor(params, ctx)
+		case "random_score":
+			function.Value, err = randomScore(params)
+		default:
+			function.Value, err = decayFunction(name, params, ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if function.Weight != 1 {
+		function.Value = fmt.Sprintf("(%s) * %s", function.Value, utils.FormatFloat(function.Weight))
+	}
+	return function, nil
+}
+
+// Combine values of functions according to score_mode. Functions which don't match a document are skipped, score is 1
+// if there are no matching functions
+func combineScoreFunctions(functions []*scoreFunction, scoreMode string) (string, error) {
+	var values, weights, conditions, cases []string
+	for _, f := range functions {
+		conditions = append(conditions, f.Condition)
+		values = append(values, fmt.Sprintf("CASE WHEN %s THEN coalesce((%s)::float8, 1) END", f.Condition, f.Value))
+		weights = append(weights, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", f.Condition, utils.FormatFloat(f.Weight)))
+		cases = append(cases, fmt.Sprintf("WHEN %s THEN coalesce((%s)::float8, 1)", f.Condition, f.Value))
+	}
+	var combined string
+	switch scoreMode {
+	case "multiply":
+		var factors []string
+		for _, value := range values {
+			factors = append(factors, fmt.Sprintf("coalesce(%s, 1)", value))
+		}
+		return strings.Join(factors, " * "), nil
+	case "sum":
+		var terms []string
+		for _, value := range values {
+			terms = append(terms, fmt.Sprintf("coalesce(%s, 0)", value))
+		}
+		combined = strings.Join(terms, " + ")
+	case "avg":
+		var terms []string
+		for _, value := range values {
+			terms = append(terms, fmt.Sprintf("coalesce(%s, 0)", value))
+		}
+		combined = fmt.Sprintf("(%s) / nullif(%s, 0)", strings.Join(terms, " + "), strings.Join(weights, " + "))
+	case "first":
+		combined = fmt.Sprintf("CASE %s END", strings.Join(cases, " "))
+	case "max":
+		combined = fmt.Sprintf("greatest(%s)", strings.Join(values, ", "))
+	case "min":
+		combined = fmt.Sprintf("least(%s)", strings.Join(values, ", "))
+	default:
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[function_score] illegal score_mode [%s]", scoreMode))
+	}
+	return fmt.Sprintf("CASE WHEN %s THEN coalesce(%s, 1) ELSE 1 END", joinConditions(conditions, "OR"), combined), nil
+}
+
+// Build field_value_factor function which calculates score from a numeric field. Results of modifiers which are not
+// defined for the value are NULL, such documents get score 1
+func fieldValueFactor(params map[string]interface{}, ctx *QueryContext) (string, error) {
+	field, ok := params["field"].(string)
+	if !ok {
+		return "", utils.NewIllegalQueryError("[field_value_factor] required field 'field' missing")
+	}
+	factor := 1.0
+	modifier := "none"
+	value := fmt.Sprintf("(SELECT (v.value)::float8 FROM %s WHERE jsonb_typeof(v.value) = 'number' LIMIT 1)", fieldValues(field))
+	var err error
+	for k, v := range params {
+		switch k {
+		case "factor":
+			factor, err = parseFloat(v, k)
+		case "modifier":
+			modifier = strings.ToLower(fmt.Sprint(v))
+		case "missing":
+			var missing float64
+			if missing, err = parseFloat(v, k); err == nil {
+				value = fmt.Sprintf("coalesce(%s, %s)", value, utils.FormatFloat(missing))
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	x := value
+	if factor != 1 {
+		x = fmt.Sprintf("%s * %s", value, utils.FormatFloat(factor))
+	}
+	switch modifier {
+	case "none":
+		return x, nil
+	case "log":
+		return fmt.Sprintf("log(nullif(greatest(%s, 0), 0))", x), nil
+	case "log1p":
+		return fmt.Sprintf("log(nullif(greatest(%s + 1, 0), 0))", x), nil
+	case "log2p":
+		return fmt.Sprintf("log(nullif(greatest(%s + 2, 0), 0))", x), nil
+	case "ln":
+		return fmt.Sprintf("ln(nullif(greatest(%s, 0), 0))", x), nil
+	case "ln1p":
+		return fmt.Sprintf("ln(nullif(greatest(%s + 1, 0), 0))", x), nil
+	case "ln2p":
+		return fmt.Sprintf("ln(nullif(greatest(%s + 2, 0), 0))", x), nil
+	case "square":
+		return fmt.Sprintf("power(%s, 2)", x), nil
+	case "sqrt":
+		return fmt.Sprintf("sqrt(greatest(%s, 0))", x), nil
+	case "reciprocal":
+		return fmt.Sprintf("1 / nullif(%s, 0)", x), nil
+	}
+	return "", utils.NewIllegalQueryError(fmt.Sprintf("[field_value_factor] illegal modifier [%s]", modifier))
+}
+
+// Build random_score function. Scores are reproducible if seed is specified, they are calculated from document id or
+// from the field value
+func randomScore(params map[string]interface{}) (string, error) {
+	seed, ok := params["seed"]
+	if !ok {
+		return "random()", nil
+	}
+	source := "id"
+	if field, ok := params["field"].(string); ok && field != "_id" && field != "_seq_no" {
+		source = fmt.Sprintf("(jsonb_path_query_first(document, %s) #>> '{}')", utils.QuoteLiteral(fieldPath(field)))
+	}
+	return fmt.Sprintf("(hashtext(concat(%s, %s)) & 2147483647)::float8 / 2147483648", source, utils.QuoteLiteral(fmt.Sprint(seed))), nil
+}
+
+// Build a decay function which decreases score with distance of a numeric or date value from the origin
+func decayFunction(name string, params map[string]interface{}, ctx *QueryContext) (string, error) {
+	var field string
+	var settings map[string]interface{}
+	multiValueMode := "min"
+	for k, v := range params {
+		switch k {
+		case "multi_value_mode":
+			multiValueMode = strings.ToLower(fmt.Sprint(v))
+		default:
+			object, ok := v.(map[string]interface{})
+			if !ok {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] malformed score function score, expected an object for field [%s]", name, k))
+			}
+			field, settings = k, object
+		}
+	}
+	if len(field) == 0 {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] function requires a field", name))
+	}
+	rawScale, ok := settings["scale"]
+	if !ok {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] must contain [scale]", name))
+	}
+	isDate := ctx.fieldType(field) == "date"
+	if _, ok := rawScale.(string); ok && !isDate {
+		_, err := strconv.ParseFloat(rawScale.(string), 64)
+		isDate = err != nil
+	}
+
+	// Values, origin, scale and offset are numbers, dates are converted into milliseconds since epoch
+	var value, origin string
+	var scale, offset float64
+	var err error
+	if isDate {
+		value = "extract(epoch FROM pg_elastic_timestamp(v.value)) * 1000"
+		rawOrigin, ok := settings["origin"]
+		if !ok {
+			rawOrigin = "now"
+		}
+		timestamp, err := dateMath(rawOrigin, false)
+		if err != nil {
+			return "", err
+		}
+		origin = fmt.Sprintf("extract(epoch FROM %s) * 1000", timestamp)
+		if scale, err = parseTimeValue(rawScale); err != nil {
+			return "", err
+		}
+		if rawOffset, ok := settings["offset"]; ok {
+			if offset, err = parseTimeValue(rawOffset); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		value = "CASE WHEN jsonb_typeof(v.value) = 'number' THEN (v.value)::float8 END"
+		rawOrigin, ok := settings["origin"]
+		if !ok {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] must contain [origin] for numeric field [%s]", name, field))
+		}
+		number, err := parseFloat(rawOrigin, "origin")
+		if err != nil {
+			return "", err
+		}
+		origin = utils.FormatFloat(number)
+		if scale, err = parseFloat(rawScale, "scale"); err != nil {
+			return "", err
+		}
+		if rawOffset, ok := settings["offset"]; ok {
+			if offset, err = parseFloat(rawOffset, "offset"); err != nil {
+				return "", err
+			}
+		}
+	}
+	decay := 0.5
+	if rawDecay, ok := settings["decay"]; ok {
+		if decay, err = parseFloat(rawDecay, "decay"); err != nil {
+			return "", err
+		}
+	}
+	if scale <= 0 || decay <= 0 || decay >= 1 {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] requires positive [scale] and [decay] between 0 and 1", name))
+	}
+
+	var aggregate string
+	switch multiValueMode {
+	case "min", "max", "avg", "sum":
+		aggregate = multiValueMode
+	default:
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] illegal multi_value_mode [%s]", name, multiValueMode))
+	}
+	distance := fmt.Sprintf("(SELECT %s(greatest(abs((%s) - (%s)) - %s, 0)) FROM %s)", aggregate, value, origin, utils.FormatFloat(offset), fieldValues(field))
+	switch name {
+	case "gauss":
+		return fmt.Sprintf("exp(%s * power(%s, 2) / %s)", utils.FormatFloat(math.Log(decay)), distance, utils.FormatFloat(scale*scale)), nil
+	case "exp":
+		return fmt.Sprintf("exp(%s * %s / %s)", utils.FormatFloat(math.Log(decay)), distance, utils.FormatFloat(scale)), nil
+	}
+	width := scale / (1 - decay)
+	return fmt.Sprintf("greatest((%[1]s - %[2]s) / %[1]s, 0)", utils.FormatFloat(width), distance), nil
+}
+
+var timeValuePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(nanos|micros|ms|s|m|h|d|w)?$`)
+
+var timeUnitMillis = map[string]float64{
+	"nanos": 0.000001, "micros": 0.001, "ms": 1, "": 1, "s": 1000, "m": 60000, "h": 3600000, "d": 86400000, "w": 604800000,
+}
+
+// ParseDuration parses a time value like "1m" into a duration
+func ParseDuration(value interface{}) (time.Duration, error) {
+	millis, err := parseTimeValue(value)
+	return time.Duration(millis * float64(time.Millisecond)), err
+}
+
+// Parse a time value like "10d" or "1.5h" into milliseconds. Numbers are milliseconds
+func parseTimeValue(value interface{}) (float64, error) {
+	if number, ok := value.(float64); ok {
+		return number, nil
+	}
+	match := timeValuePattern.FindStringSubmatch(strings.TrimSpace(fmt.Sprint(value)))
+	if match == nil {
+		return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse time value [%v]", value))
+	}
+	number, _ := strconv.ParseFloat(match[1], 64)
+	return number * timeUnitMillis[match[2]], nil
+}
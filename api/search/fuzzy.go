@@ -0,0 +1,221 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// fuzzyOptions contains parameters of fuzzy matching of terms
+type fuzzyOptions struct {
+	fuzziness      string
+	prefixLength   int
+	maxExpansions  int
+	transpositions bool
+}
+
+// Create fuzzy options with ElasticSearch defaults
+func newFuzzyOptions(fuzziness string) *fuzzyOptions {
+	return &fuzzyOptions{fuzziness: fuzziness, prefixLength: 0, maxExpansions: 50, transpositions: true}
+}
+
+// Parse fuzzy parameters of a query
+func parseFuzzyOptions(rawQuery map[string]interface{}) (*fuzzyOptions, error) {
+	fuzziness, ok := rawQuery["fuzziness"]
+	if !ok {
+		return nil, nil
+	}
+	options := newFuzzyOptions(fmt.Sprint(fuzziness))
+	var err error
+	if value, ok := rawQuery["prefix_length"]; ok {
+		if options.prefixLength, err = parseInt(value, "prefix_length"); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := rawQuery["max_expansions"]; ok {
+		if options.maxExpansions, err = parseInt(value, "max_expansions"); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := rawQuery["fuzzy_transpositions"]; ok {
+		if options.transpositions, err = parseBool(value, "fuzzy_transpositions"); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := rawQuery["transpositions"]; ok {
+		if options.transpositions, err = parseBool(value, "transpositions"); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// Get maximal edit distance allowed for the term
+func (options *fuzzyOptions) distance(term string) (int, error) {
+	spec := strings.ToUpper(strings.TrimSpace(options.fuzziness))
+	length := utf8.RuneCountInString(term)
+	if strings.HasPrefix(spec, "AUTO") {
+		low, high := 3, 6
+		if bounds := strings.TrimPrefix(spec, "AUTO"); len(bounds) > 0 {
+			parts := strings.Split(strings.TrimPrefix(bounds, ":"), ",")
+			if len(parts) != 2 {
+				return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to find low and high distance values for fuzziness [%s]", options.fuzziness))
+			}
+			var err error
+			if low, err = strconv.Atoi(parts[0]); err != nil {
+				return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse fuzziness [%s]", options.fuzziness))
+			}
+			if high, err = strconv.Atoi(parts[1]); err != nil {
+				return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse fuzziness [%s]", options.fuzziness))
+			}
+		}
+		switch {
+		case length < low:
+			return 0, nil
+		case length < high:
+			return 1, nil
+		default:
+			return 2, nil
+		}
+	}
+	value, err := strconv.ParseFloat(spec, 64)
+	if err != nil {
+		return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse fuzziness [%s]", options.fuzziness))
+	}
+	distance := int(value)
+	if distance > 2 {
+		distance = 2
+	}
+	if distance < 0 {
+		distance = 0
+	}
+	return distance, nil
+}
+
+// Expand terms into terms of the field vocabulary within allowed edit distance. Result contains a list of
+// alternatives for each term ordered by distance and document frequency. A term which has no alternatives
+// in vocabulary is kept as is
+func (ctx *QueryContext) expandFuzzy(vector string, terms []string, options *fuzzyOptions) ([][]string, error) {
+	distances := make([]int, len(terms))
+	var conditions []string
+	for i, term := range terms {
+		distance, err := options.distance(term)
+		if err != nil {
+			return nil, err
+		}
+		distances[i] = distance
+		if distance == 0 {
+			continue
+		}
+		length := utf8.RuneCountInString(term)
+		condition := fmt.Sprintf("length(word) BETWEEN %d AND %d", length-distance, length+distance)
+		if options.prefixLength > 0 {
+			condition += fmt.Sprintf(" AND left(word, %d) = left(%s, %d)", options.prefixLength, utils.QuoteLiteral(term), options.prefixLength)
+		}
+		conditions = append(conditions, "("+condition+")")
+	}
+
+	result := make([][]string, len(terms))
+	for i, term := range terms {
+		result[i] = []string{term}
+	}
+	if len(conditions) == 0 {
+		return result, nil
+	}
+	statistics, err := ctx.client.TermStatistics(ctx.Index, ctx.Type, vector, strings.Join(conditions, " OR "))
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		word      string
+		distance  int
+		frequency int
+	}
+	for i, term := range terms {
+		if distances[i] == 0 {
+			continue
+		}
+		var candidates []candidate
+		for _, statistic := range statistics {
+			if !hasCommonPrefix(statistic.Word, term, options.prefixLength) {
+				continue
+			}
+			distance := editDistance(term, statistic.Word, options.transpositions)
+			if distance <= distances[i] {
+				candidates = append(candidates, candidate{statistic.Word, distance, statistic.Ndoc})
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			if candidates[a].distance != candidates[b].distance {
+				return candidates[a].distance < candidates[b].distance
+			}
+			if candidates[a].frequency != candidates[b].frequency {
+				return candidates[a].frequency > candidates[b].frequency
+			}
+			return candidates[a].word < candidates[b].word
+		})
+		if options.maxExpansions > 0 && len(candidates) > options.maxExpansions {
+			candidates = candidates[:options.maxExpansions]
+		}
+		result[i] = nil
+		for _, c := range candidates {
+			result[i] = append(result[i], c.word)
+		}
+	}
+	return result, nil
+}
+
+// Check that two words share a prefix of specified length in runes
+func hasCommonPrefix(a, b string, length int) bool {
+	ra, rb := []rune(a), []rune(b)
+	for i := 0; i < length; i++ {
+		if i >= len(ra) || i >= len(rb) {
+			return len(ra) == len(rb)
+		}
+		if ra[i] != rb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Calculate Levenshtein distance between two strings. Transposition of two adjacent characters counts as one edit
+// if transpositions are enabled (optimal string alignment distance)
+func editDistance(a, b string, transpositions bool) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = minInt(rows[i-1][j]+1, minInt(rows[i][j-1]+1, rows[i-1][j-1]+cost))
+			if transpositions && i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = minInt(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
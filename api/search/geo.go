@@ -0,0 +1,374 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// geoPoint is a location given in a query
+type geoPoint struct {
+	lat float64
+	lon float64
+}
+
+var geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+var wktPointPattern = regexp.MustCompile(`(?i)^POINT\s*\(\s*(\S+)\s+(\S+)\s*\)$`)
+
+var wktEnvelopePattern = regexp.MustCompile(`(?i)^(?:BBOX|ENVELOPE)\s*\(\s*([^,]+),([^,]+),([^,]+),([^,]+)\)$`)
+
+var distancePattern = regexp.MustCompile(`^(-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?)\s*([a-zA-Z]*)$`)
+
+// Meters in distance units
+var distanceUnits = map[string]float64{
+	"": 1, "m": 1, "meters": 1, "km": 1000, "kilometers": 1000, "cm": 0.01, "centimeters": 0.01, "mm": 0.001,
+	"millimeters": 0.001, "mi": 1609.344, "miles": 1609.344, "yd": 0.9144, "yards": 0.9144, "ft": 0.3048, "feet": 0.3048,
+	"in": 0.0254, "inch": 0.0254, "nmi": 1852, "NM": 1852,
+}
+
+func parseGeoDistanceQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	var field string
+	var rawPoint, rawDistance interface{}
+	for k, v := range rawQuery {
+		switch k {
+		case "distance":
+			rawDistance = v
+		case "distance_type", "validation_method", "ignore_unmapped", "boost", "_name":
+		default:
+			field, rawPoint = k, v
+		}
+	}
+	if rawDistance == nil {
+		return nil, utils.NewIllegalQueryError("[geo_distance] requires 'distance' to be specified")
+	}
+	if len(field) == 0 {
+		return nil, utils.NewIllegalQueryError("[geo_distance] requires a field with a point")
+	}
+	distance, err := parseDistance(rawDistance, "m")
+	if err != nil {
+		return nil, err
+	}
+	point, err := parseGeoPoint(rawPoint)
+	if err != nil {
+		return nil, err
+	}
+	condition := anyGeoPoint(field, fmt.Sprintf("pg_elastic_geo_distance(p.point, %s) <= %s", point.sql(), utils.FormatFloat(distance)))
+	return geoClause(condition, rawQuery)
+}
+
+func parseGeoBoundingBoxQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	var field string
+	var box map[string]interface{}
+	for k, v := range rawQuery {
+		switch k {
+		case "type", "validation_method", "ignore_unmapped", "boost", "_name":
+		default:
+			object, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[geo_bbox] failed to parse bounding box of field [%s]", k))
+			}
+			field, box = k, object
+		}
+	}
+	if len(field) == 0 {
+		return nil, utils.NewIllegalQueryError("[geo_bbox] requires a field with a bounding box")
+	}
+	top, left, bottom, right, err := parseBoundingBox(box)
+	if err != nil {
+		return nil, err
+	}
+	// Box which crosses the dateline has left side greater than right side
+	lonCondition := fmt.Sprintf("p.point[0] BETWEEN %s AND %s", utils.FormatFloat(left), utils.FormatFloat(right))
+	if left > right {
+		lonCondition = fmt.Sprintf("(p.point[0] >= %s OR p.point[0] <= %s)", utils.FormatFloat(left), utils.FormatFloat(right))
+	}
+	condition := anyGeoPoint(field, fmt.Sprintf("p.point[1] BETWEEN %s AND %s AND %s", utils.FormatFloat(bottom), utils.FormatFloat(top), lonCondition))
+	return geoClause(condition, rawQuery)
+}
+
+func parseGeoPolygonQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	var field string
+	var rawPoints []interface{}
+	for k, v := range rawQuery {
+		switch k {
+		case "validation_method", "ignore_unmapped", "boost", "_name":
+		default:
+			object, _ := v.(map[string]interface{})
+			points, ok := object["points"].([]interface{})
+			if !ok {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[geo_polygon] query requires points of field [%s]", k))
+			}
+			field, rawPoints = k, points
+		}
+	}
+	if len(rawPoints) < 3 {
+		return nil, utils.NewIllegalQueryError("[geo_polygon] too few points defined for geo_polygon query")
+	}
+	var vertices []string
+	for _, rawPoint := range rawPoints {
+		point, err := parseGeoPoint(rawPoint)
+		if err != nil {
+			return nil, err
+		}
+		vertices = append(vertices, fmt.Sprintf("(%s,%s)", utils.FormatFloat(point.lon), utils.FormatFloat(point.lat)))
+	}
+	polygon := utils.QuoteLiteral("("+strings.Join(vertices, ",")+")") + "::polygon"
+	return geoClause(anyGeoPoint(field, fmt.Sprintf("p.point <@ %s", polygon)), rawQuery)
+}
+
+// Build a clause of geo query with constant score
+func geoClause(condition string, rawQuery map[string]interface{}) (*Clause, error) {
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &Clause{Condition: condition, Score: utils.FormatFloat(boost)}, nil
+}
+
+// Parse a bounding box given by corners, by sides or as WKT envelope. Returns top, left, bottom and right sides
+func parseBoundingBox(box map[string]interface{}) (float64, float64, float64, float64, error) {
+	if wkt, ok := box["wkt"].(string); ok {
+		match := wktEnvelopePattern.FindStringSubmatch(strings.TrimSpace(wkt))
+		if match == nil {
+			return 0, 0, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("[geo_bbox] failed to parse WKT [%s]", wkt))
+		}
+		var values [4]float64
+		for i := range values {
+			value, err := strconv.ParseFloat(strings.TrimSpace(match[i+1]), 64)
+			if err != nil {
+				return 0, 0, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("[geo_bbox] failed to parse WKT [%s]", wkt))
+			}
+			values[i] = value
+		}
+		// WKT envelope is (minLon, maxLon, maxLat, minLat)
+		return values[2], values[0], values[3], values[1], nil
+	}
+	sides := make(map[string]float64)
+	corners := map[string][2]string{
+		"top_left": {"top", "left"}, "bottom_right": {"bottom", "right"},
+		"top_right": {"top", "right"}, "bottom_left": {"bottom", "left"},
+	}
+	for k, v := range box {
+		if names, ok := corners[k]; ok {
+			point, err := parseGeoPoint(v)
+			if err != nil {
+				return 0, 0, 0, 0, err
+			}
+			sides[names[0]], sides[names[1]] = point.lat, point.lon
+			continue
+		}
+		switch k {
+		case "top", "left", "bottom", "right":
+			value, err := parseFloat(v, k)
+			if err != nil {
+				return 0, 0, 0, 0, err
+			}
+			sides[k] = value
+		}
+	}
+	for _, side := range []string{"top", "left", "bottom", "right"} {
+		if _, ok := sides[side]; !ok {
+			return 0, 0, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("[geo_bbox] bounding box is missing [%s] side", side))
+		}
+	}
+	return sides["top"], sides["left"], sides["bottom"], sides["right"], nil
+}
+
+// Parse a point given in any format of geo_point field: object with lat and lon, array [lon, lat], string "lat,lon",
+// WKT point or geohash
+func parseGeoPoint(rawPoint interface{}) (*geoPoint, error) {
+	var point *geoPoint
+	var err error
+	switch rawPoint := rawPoint.(type) {
+	case map[string]interface{}:
+		if coordinates, ok := rawPoint["coordinates"]; ok {
+			return parseGeoPoint(coordinates)
+		}
+		point = &geoPoint{}
+		if point.lat, err = parseFloat(rawPoint["lat"], "lat"); err != nil {
+			return nil, err
+		}
+		if point.lon, err = parseFloat(rawPoint["lon"], "lon"); err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		if len(rawPoint) < 2 {
+			return nil, utils.NewIllegalQueryError("[geo_point] array should contain [lon, lat]")
+		}
+		point = &geoPoint{}
+		if point.lon, err = parseFloat(rawPoint[0], "lon"); err != nil {
+			return nil, err
+		}
+		if point.lat, err = parseFloat(rawPoint[1], "lat"); err != nil {
+			return nil, err
+		}
+	case string:
+		text := strings.TrimSpace(rawPoint)
+		if match := wktPointPattern.FindStringSubmatch(text); match != nil {
+			return parseGeoPoint([]interface{}{match[1], match[2]})
+		}
+		if parts := strings.Split(text, ","); len(parts) == 2 {
+			return parseGeoPoint([]interface{}{strings.TrimSpace(parts[1]), strings.TrimSpace(parts[0])})
+		}
+		if point, err = decodeGeohash(text); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[geo_point] failed to parse point [%v]", rawPoint))
+	}
+	if point.lat < -90 || point.lat > 90 || point.lon < -180 || point.lon > 180 {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[geo_point] illegal point [%v, %v]", point.lat, point.lon))
+	}
+	return point, nil
+}
+
+// Decode a geohash into the center of its cell
+func decodeGeohash(hash string) (*geoPoint, error) {
+	if len(hash) == 0 {
+		return nil, utils.NewIllegalQueryError("[geo_point] empty geohash")
+	}
+	minLat, maxLat, minLon, maxLon := -90.0, 90.0, -180.0, 180.0
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		bits := strings.IndexRune(geohashAlphabet, c)
+		if bits < 0 {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[geo_point] unsupported symbol [%c] in geohash [%s]", c, hash))
+		}
+		for j := 4; j >= 0; j-- {
+			bit := (bits >> uint(j)) & 1
+			if even {
+				if bit == 1 {
+					minLon = (minLon + maxLon) / 2
+				} else {
+					maxLon = (minLon + maxLon) / 2
+				}
+			} else {
+				if bit == 1 {
+					minLat = (minLat + maxLat) / 2
+				} else {
+					maxLat = (minLat + maxLat) / 2
+				}
+			}
+			even = !even
+		}
+	}
+	return &geoPoint{lat: (minLat + maxLat) / 2, lon: (minLon + maxLon) / 2}, nil
+}
+
+// Parse a distance like "12km" or a number of default units into meters
+func parseDistance(rawDistance interface{}, defaultUnit string) (float64, error) {
+	if number, ok := rawDistance.(float64); ok {
+		return number * distanceUnits[defaultUnit], nil
+	}
+	match := distancePattern.FindStringSubmatch(strings.TrimSpace(fmt.Sprint(rawDistance)))
+	if match == nil {
+		return 0, utils.NewIllegalQueryError(fmt.Sprintf("failed to parse distance [%v]", rawDistance))
+	}
+	unit := match[2]
+	if len(unit) == 0 {
+		unit = defaultUnit
+	}
+	meters, ok := distanceUnits[unit]
+	if !ok {
+		return 0, utils.NewIllegalQueryError(fmt.Sprintf("unknown distance unit [%s]", unit))
+	}
+	number, _ := strconv.ParseFloat(match[1], 64)
+	return number * meters, nil
+}
+
+// SQL expression of the point
+func (point *geoPoint) sql() string {
+	return fmt.Sprintf("point(%s, %s)", utils.FormatFloat(point.lon), utils.FormatFloat(point.lat))
+}
+
+// SQL source of all points of a geo_point field as p.point column. Arrays of two numbers are single points
+func geoPoints(fieldName string) string {
+	return fmt.Sprintf("jsonb_path_query(document, %s) AS g(value), pg_elastic_geo_points(g.value) AS p(point)",
+		utils.QuoteLiteral(strings.TrimSuffix(fieldPath(fieldName), "[*]")))
+}
+
+// SQL condition which matches documents where any point of the field satisfies SQL condition over p.point column
+func anyGeoPoint(fieldName, condition string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s)", geoPoints(fieldName), condition)
+}
+
+// SQL expression of distance in meters from the nearest of origins to a point of p.point column
+func geoDistance(origins []*geoPoint) string {
+	var distances []string
+	for _, origin := range origins {
+		distances = append(distances, fmt.Sprintf("pg_elastic_geo_distance(p.point, %s)", origin.sql()))
+	}
+	if len(distances) == 1 {
+		return distances[0]
+	}
+	return fmt.Sprintf("least(%s)", strings.Join(distances, ", "))
+}
+
+// Parse _geo_distance sort which orders documents by distance from the nearest of points
+func parseGeoDistanceSort(rawSort interface{}) (SortField, error) {
+	field := SortField{Field: "_geo_distance", Order: "asc", Missing: "_last", Mode: "min", unit: "m"}
+	params, ok := rawSort.(map[string]interface{})
+	if !ok {
+		return field, utils.NewIllegalQueryError("[_geo_distance] sort must be an object")
+	}
+	for k, v := range params {
+		switch k {
+		case "order":
+			field.Order = strings.ToLower(fmt.Sprint(v))
+		case "unit":
+			field.unit = fmt.Sprint(v)
+			if _, ok := distanceUnits[field.unit]; !ok {
+				return field, utils.NewIllegalQueryError(fmt.Sprintf("unknown distance unit [%s]", field.unit))
+			}
+		case "mode":
+			field.Mode = strings.ToLower(fmt.Sprint(v))
+		case "distance_type", "ignore_unmapped", "validation_method", "nested":
+		default:
+			// Points could be given as a single point or an array of points
+			rawPoints, ok := v.([]interface{})
+			if !ok || len(rawPoints) == 0 || !isGeoPointList(rawPoints) {
+				rawPoints = []interface{}{v}
+			}
+			for _, rawPoint := range rawPoints {
+				point, err := parseGeoPoint(rawPoint)
+				if err != nil {
+					return field, err
+				}
+				field.points = append(field.points, point)
+			}
+			field.geoField = k
+		}
+	}
+	if len(field.geoField) == 0 {
+		return field, utils.NewIllegalQueryError("[_geo_distance] sort requires a field with points")
+	}
+	if field.Order != "asc" && field.Order != "desc" {
+		return field, utils.NewIllegalQueryError(fmt.Sprintf("[_geo_distance] unknown order [%s]", field.Order))
+	}
+	switch field.Mode {
+	case "min", "max", "avg", "median":
+	default:
+		return field, utils.NewIllegalQueryError(fmt.Sprintf("[_geo_distance] unsupported mode [%s]", field.Mode))
+	}
+	return field, nil
+}
+
+// Check if an array is a list of points rather than a single point [lon, lat]
+func isGeoPointList(values []interface{}) bool {
+	_, isNumber := values[0].(float64)
+	return !isNumber
+}
+
+// SQL expression of distance in units of the sort field between the field and points of the sort
+func (field SortField) geoDistanceExpression() string {
+	aggregate := field.Mode
+	if aggregate == "median" {
+		aggregate = "percentile_cont(0.5) WITHIN GROUP (ORDER BY %s)"
+	} else {
+		aggregate += "(%s)"
+	}
+	return fmt.Sprintf("(SELECT to_jsonb(%s / %s) FROM %s)", fmt.Sprintf(aggregate, geoDistance(field.points)), utils.FormatFloat(distanceUnits[field.unit]), geoPoints(field.geoField))
+}
@@ -0,0 +1,227 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"sort"
+	"strings"
+)
+
+// highlightOptions are parameters of highlighting of a field. Options of a field override global options
+type highlightOptions struct {
+	preTag            string
+	postTag           string
+	fragmentSize      int
+	numberOfFragments int
+	noMatchSize       int
+	requireFieldMatch bool
+	terms             map[string][]string
+}
+
+// Markers of highlighted terms and fragments in output of ts_headline. They are replaced by tags and used for
+// splitting into fragments, so they should not appear in texts
+const (
+	highlightStart     = "\x02"
+	highlightStop      = "\x03"
+	highlightDelimiter = "\x1e"
+)
+
+// Add analyzed terms of a full-text query of the field. They are highlighted in found documents
+func (ctx *QueryContext) addHighlightTerms(fieldName string, terms []string) {
+	if ctx.highlightTerms == nil {
+		ctx.highlightTerms = make(map[string][]string)
+	}
+	ctx.highlightTerms[fieldName] = append(ctx.highlightTerms[fieldName], terms...)
+}
+
+// HighlightExpression parses highlight section of a search request and builds SQL expression of jsonb object with
+// highlighted fragments of fields of a found document. Terms are taken from full-text queries parsed by the context.
+// Empty expression means there is nothing to highlight
+func (ctx *QueryContext) HighlightExpression(rawHighlight interface{}) (string, error) {
+	if rawHighlight == nil {
+		return "", nil
+	}
+	params, ok := rawHighlight.(map[string]interface{})
+	if !ok {
+		return "", utils.NewIllegalQueryError("[highlight] must be an object")
+	}
+	defaults := &highlightOptions{preTag: "<em>", postTag: "</em>", fragmentSize: 100, numberOfFragments: 5, requireFieldMatch: true, terms: ctx.highlightTerms}
+	options, err := ctx.parseHighlightOptions(params, defaults)
+	if err != nil {
+		return "", err
+	}
+
+	// Fields could be an object or an array of objects to keep their order
+	var rawFields []interface{}
+	switch fields := params["fields"].(type) {
+	case map[string]interface{}:
+		rawFields = []interface{}{fields}
+	case []interface{}:
+		rawFields = fields
+	default:
+		return "", utils.NewIllegalQueryError("[highlight] requires 'fields' to be an object or an array")
+	}
+	var args []string
+	for _, rawField := range rawFields {
+		fields, ok := rawField.(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError("[highlight] field definitions must be objects")
+		}
+		var patterns []string
+		for pattern := range fields {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			fieldParams, _ := fields[pattern].(map[string]interface{})
+			fieldOptions, err := ctx.parseHighlightOptions(fieldParams, options)
+			if err != nil {
+				return "", err
+			}
+			for _, fieldName := range ctx.highlightFields(pattern, fieldOptions) {
+				expression, err := ctx.highlightField(fieldName, fieldOptions)
+				if err != nil {
+					return "", err
+				}
+				if len(expression) > 0 {
+					args = append(args, utils.QuoteLiteral(fieldName), expression)
+				}
+			}
+		}
+	}
+	if len(args) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("nullif(jsonb_strip_nulls(jsonb_build_object(%s)), '{}')", strings.Join(args, ", ")), nil
+}
+
+// Parse highlight options of the request or of a field. Unspecified options are taken from defaults
+func (ctx *QueryContext) parseHighlightOptions(params map[string]interface{}, defaults *highlightOptions) (*highlightOptions, error) {
+	options := *defaults
+	var err error
+	for k, v := range params {
+		switch k {
+		case "pre_tags":
+			if tags := stringList(v); len(tags) > 0 {
+				options.preTag = tags[0]
+			}
+		case "post_tags":
+			if tags := stringList(v); len(tags) > 0 {
+				options.postTag = tags[0]
+			}
+		case "tags_schema":
+			if v == "styled" {
+				options.preTag, options.postTag = `<em class="hlt1">`, "</em>"
+			}
+		case "fragment_size":
+			options.fragmentSize, err = parseInt(v, k)
+		case "number_of_fragments":
+			options.numberOfFragments, err = parseInt(v, k)
+		case "no_match_size":
+			options.noMatchSize, err = parseInt(v, k)
+		case "require_field_match":
+			options.requireFieldMatch, err = parseBool(v, k)
+		case "highlight_query":
+			rawQuery, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, utils.NewIllegalQueryError("[highlight_query] must be an object")
+			}
+			// Terms of the highlight query replace terms of the search query
+			queryCtx := *ctx
+			queryCtx.highlightTerms = nil
+			queryCtx.InnerHits = nil
+			if _, err = parseQuery(rawQuery, &queryCtx); err == nil {
+				options.terms = queryCtx.highlightTerms
+			}
+		case "type", "fragmenter", "order", "encoder", "boundary_scanner", "phrase_limit", "fields", "max_analyzed_offset":
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[highlight] unknown field [%s]", k))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.fragmentSize < 1 || options.numberOfFragments < 0 {
+		return nil, utils.NewIllegalQueryError("[highlight] fragment_size must be positive and number_of_fragments must not be negative")
+	}
+	return &options, nil
+}
+
+// Get names of fields matching the pattern. Wildcard patterns match mapped fields and fields of full-text queries
+func (ctx *QueryContext) highlightFields(pattern string, options *highlightOptions) []string {
+	if !strings.Contains(pattern, "*") {
+		return []string{pattern}
+	}
+	names := make(map[string]bool)
+	for _, fieldName := range matchMappedFields(ctx.Mapping, pattern) {
+		if ctx.fieldType(fieldName) == "text" || ctx.fieldType(fieldName) == "keyword" {
+			names[fieldName] = true
+		}
+	}
+	for fieldName := range options.terms {
+		if fieldName != "*" && matchWildcard(pattern, fieldName) {
+			names[fieldName] = true
+		}
+	}
+	var result []string
+	for fieldName := range names {
+		result = append(result, fieldName)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Build SQL expression of jsonb array of highlighted fragments of the field. Fragments are produced by ts_headline with
+// text search configuration of the field analyzer. Documents without matching terms get NULL or the beginning of the
+// field if no_match_size is set
+func (ctx *QueryContext) highlightField(fieldName string, options *highlightOptions) (string, error) {
+	var terms []string
+	if options.requireFieldMatch {
+		terms = append(terms, options.terms[fieldName]...)
+		terms = append(terms, options.terms["*"]...)
+	} else {
+		for _, fieldTerms := range options.terms {
+			terms = append(terms, fieldTerms...)
+		}
+	}
+	var lexemes []string
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			lexemes = append(lexemes, quoteLexeme(term))
+		}
+	}
+	sort.Strings(lexemes)
+	noMatch := "NULL"
+	if options.noMatchSize > 0 {
+		noMatch = fmt.Sprintf("jsonb_build_array(left(h.text, %d))", options.noMatchSize)
+	}
+	if len(lexemes) == 0 {
+		if options.noMatchSize == 0 {
+			return "", nil
+		}
+		return fmt.Sprintf("(SELECT %s FROM (SELECT %s AS text) AS h WHERE h.text <> '')", noMatch, fieldText(fieldName)), nil
+	}
+	analyzer, err := ctx.indexAnalyzer(fieldName)
+	if err != nil {
+		return "", err
+	}
+	config := utils.QuoteLiteral(analyzer.Config) + "::regconfig"
+	tsquery := utils.QuoteLiteral(strings.Join(lexemes, " | ")) + "::tsquery"
+
+	// Fragment size is given in characters while ts_headline counts words
+	maxWords := options.fragmentSize / 6
+	if maxWords < 2 {
+		maxWords = 2
+	}
+	headlineOptions := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=%d, MinWords=%d, MaxFragments=%d, FragmentDelimiter=%s",
+		highlightStart, highlightStop, maxWords, maxWords/2, options.numberOfFragments, highlightDelimiter)
+	if options.numberOfFragments == 0 {
+		headlineOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, HighlightAll=true", highlightStart, highlightStop)
+	}
+	headline := fmt.Sprintf("replace(replace(ts_headline(%s, h.text, %s, %s), %s, %s), %s, %s)", config, tsquery, utils.QuoteLiteral(headlineOptions),
+		utils.QuoteLiteral(highlightStart), utils.QuoteLiteral(options.preTag), utils.QuoteLiteral(highlightStop), utils.QuoteLiteral(options.postTag))
+	return fmt.Sprintf("(SELECT CASE WHEN to_tsvector(%s, h.text) @@ %s THEN to_jsonb(string_to_array(%s, %s)) ELSE %s END FROM (SELECT %s AS text) AS h)",
+		config, tsquery, headline, utils.QuoteLiteral(highlightDelimiter), noMatch, fieldText(fieldName)), nil
+}
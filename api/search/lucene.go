@@ -0,0 +1,772 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Occurrence of a clause in a sequence of Lucene query
+const (
+	occurDefault = iota
+	occurMust
+	occurMustNot
+)
+
+// luceneClause is a clause of Lucene query with its occurrence
+type luceneClause struct {
+	occur int
+	query map[string]interface{}
+}
+
+// luceneParser converts query_string (Lucene) and simple_query_string syntax into query DSL
+type luceneParser struct {
+	input   []rune
+	pos     int
+	fields  []string
+	options *queryStringOptions
+	ctx     *QueryContext
+}
+
+func newLuceneParser(options *queryStringOptions, ctx *QueryContext) *luceneParser {
+	return &luceneParser{input: []rune(options.query), fields: options.fields, options: options, ctx: ctx}
+}
+
+// Parse a query in Lucene syntax
+func (p *luceneParser) parse() (map[string]interface{}, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return matchNoneQuery(), nil
+	}
+	query, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, p.error()
+	}
+	return query, nil
+}
+
+// Parse clauses separated by OR operator
+func (p *luceneParser) parseOr() (map[string]interface{}, error) {
+	var queries []interface{}
+	for {
+		query, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+		if !p.consumeOperator("OR", "||") {
+			break
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0].(map[string]interface{}), nil
+	}
+	return boolQuery("should", queries), nil
+}
+
+// Parse clauses separated by AND operator
+func (p *luceneParser) parseAnd() (map[string]interface{}, error) {
+	var queries []interface{}
+	for {
+		query, err := p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+		if !p.consumeOperator("AND", "&&") {
+			break
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0].(map[string]interface{}), nil
+	}
+	return boolQuery("must", queries), nil
+}
+
+// Parse clauses which are not separated by operators. Clauses without modifiers are combined by default operator
+func (p *luceneParser) parseSequence() (map[string]interface{}, error) {
+	var clauses []luceneClause
+	for {
+		p.skipSpaces()
+		if p.eof() || p.peek() == ')' || p.atOperator("AND", "&&") || p.atOperator("OR", "||") {
+			break
+		}
+		occur := occurDefault
+		switch {
+		case p.peek() == '+':
+			occur = occurMust
+			p.pos++
+		case p.peek() == '-' || p.peek() == '!':
+			occur = occurMustNot
+			p.pos++
+		case p.atOperator("NOT", ""):
+			occur = occurMustNot
+			p.pos += 3
+		}
+		query, err := p.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, luceneClause{occur, query})
+	}
+	if len(clauses) == 0 {
+		return nil, p.error()
+	}
+	if len(clauses) == 1 && clauses[0].occur != occurMustNot {
+		return clauses[0].query, nil
+	}
+	body := make(map[string]interface{})
+	for _, clause := range clauses {
+		key := "should"
+		switch {
+		case clause.occur == occurMustNot:
+			key = "must_not"
+		case clause.occur == occurMust || p.options.defaultOperator == "and":
+			key = "must"
+		}
+		queries, _ := body[key].([]interface{})
+		body[key] = append(queries, clause.query)
+	}
+	return map[string]interface{}{"bool": body}, nil
+}
+
+// Parse a clause which could be prefixed with field name
+func (p *luceneParser) parseClause() (map[string]interface{}, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.error()
+	}
+	if p.peek() == '(' {
+		return p.parseGroup(p.fields)
+	}
+	start := p.pos
+	if term := p.readTerm(); len(term) > 0 && !p.eof() && p.peek() == ':' {
+		p.pos++
+		field := unescapeTerm(term)
+		if field == "_exists_" {
+			p.skipSpaces()
+			name := unescapeTerm(p.readTerm())
+			if len(name) == 0 {
+				return nil, p.error()
+			}
+			boost, err := p.parseBoost()
+			if err != nil {
+				return nil, err
+			}
+			return boostQuery(p.eachField([]string{name}, existsQuery), boost), nil
+		}
+		return p.parseValue([]string{field})
+	}
+	p.pos = start
+	return p.parseValue(p.fields)
+}
+
+// Parse a group of clauses in parentheses. Clauses of the group are searched in specified fields
+func (p *luceneParser) parseGroup(fields []string) (map[string]interface{}, error) {
+	p.pos++
+	outerFields := p.fields
+	p.fields = fields
+	query, err := p.parseOr()
+	p.fields = outerFields
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.eof() || p.peek() != ')' {
+		return nil, p.error()
+	}
+	p.pos++
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	return boostQuery(query, boost), nil
+}
+
+// Parse a value of a clause: a term, a phrase, a range, a comparison, a regular expression or a group
+func (p *luceneParser) parseValue(fields []string) (map[string]interface{}, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.error()
+	}
+	switch c := p.peek(); {
+	case c == '(':
+		return p.parseGroup(fields)
+	case c == '"':
+		return p.parsePhrase(fields)
+	case c == '[' || c == '{':
+		return p.parseRange(fields)
+	case c == '>' || c == '<':
+		return p.parseComparison(fields)
+	case c == '/' && p.regexpEnd() > 0:
+		return p.parseRegexp(fields)
+	}
+	term := p.readTerm()
+	if len(term) == 0 {
+		return nil, p.error()
+	}
+	fuzziness := ""
+	if !p.eof() && p.peek() == '~' {
+		p.pos++
+		if fuzziness = p.readNumber(); len(fuzziness) == 0 {
+			fuzziness = p.options.fuzziness
+		}
+	}
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	return p.termQuery(term, fields, fuzziness, boost), nil
+}
+
+// Parse a phrase in quotes with optional slop and boost
+func (p *luceneParser) parsePhrase(fields []string) (map[string]interface{}, error) {
+	p.pos++
+	var text []rune
+	for ; !p.eof() && p.peek() != '"'; p.pos++ {
+		if p.peek() == '\\' && p.pos+1 < len(p.input) {
+			p.pos++
+		}
+		text = append(text, p.peek())
+	}
+	if p.eof() {
+		return nil, p.error()
+	}
+	p.pos++
+	slop := p.options.phraseSlop
+	if !p.eof() && p.peek() == '~' {
+		p.pos++
+		if number := p.readNumber(); len(number) > 0 {
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return nil, p.error()
+			}
+			slop = int(value)
+		}
+	}
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	params := p.matchParams(string(text), boost)
+	params["slop"] = slop
+	return p.fullTextQuery("match_phrase", params, fields, "phrase"), nil
+}
+
+// Parse a range like [a TO b], {a TO b] or [* TO b}
+func (p *luceneParser) parseRange(fields []string) (map[string]interface{}, error) {
+	includeLower := p.peek() == '['
+	p.pos++
+	p.skipSpaces()
+	lower := p.readRangeValue()
+	p.skipSpaces()
+	if !p.atOperator("TO", "") {
+		return nil, p.error()
+	}
+	p.pos += 2
+	p.skipSpaces()
+	upper := p.readRangeValue()
+	p.skipSpaces()
+	if p.eof() || (p.peek() != ']' && p.peek() != '}') {
+		return nil, p.error()
+	}
+	includeUpper := p.peek() == ']'
+	p.pos++
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]interface{}{"boost": boost}
+	if lower != "*" {
+		params[map[bool]string{true: "gte", false: "gt"}[includeLower]] = lower
+	}
+	if upper != "*" {
+		params[map[bool]string{true: "lte", false: "lt"}[includeUpper]] = upper
+	}
+	return p.rangeQuery(fields, params), nil
+}
+
+// Parse a one-sided range like >=10 or <2015-01-01
+func (p *luceneParser) parseComparison(fields []string) (map[string]interface{}, error) {
+	operator := map[rune]string{'>': "gt", '<': "lt"}[p.peek()]
+	p.pos++
+	if !p.eof() && p.peek() == '=' {
+		operator += "e"
+		p.pos++
+	}
+	value := p.readRangeValue()
+	if len(value) == 0 {
+		return nil, p.error()
+	}
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	return p.rangeQuery(fields, map[string]interface{}{operator: value, "boost": boost}), nil
+}
+
+// Parse a regular expression between slashes
+func (p *luceneParser) parseRegexp(fields []string) (map[string]interface{}, error) {
+	end := p.regexpEnd()
+	pattern := strings.Replace(string(p.input[p.pos+1:end]), "\\/", "/", -1)
+	p.pos = end + 1
+	boost, err := p.parseBoost()
+	if err != nil {
+		return nil, err
+	}
+	return p.eachField(fields, func(field string) map[string]interface{} {
+		return map[string]interface{}{"regexp": map[string]interface{}{field: map[string]interface{}{"value": pattern, "boost": boost}}}
+	}), nil
+}
+
+// Find a closing slash of regular expression. Slashes which are not followed by a separator are treated as a part of
+// a term, so paths like /api/* are not regular expressions
+func (p *luceneParser) regexpEnd() int {
+	for i := p.pos + 1; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '\\':
+			i++
+		case '/':
+			if i+1 == len(p.input) || unicode.IsSpace(p.input[i+1]) || p.input[i+1] == ')' || p.input[i+1] == '^' {
+				return i
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// Parse an optional boost like ^2
+func (p *luceneParser) parseBoost() (float64, error) {
+	if p.eof() || p.peek() != '^' {
+		return 1, nil
+	}
+	p.pos++
+	boost, err := strconv.ParseFloat(p.readNumber(), 64)
+	if err != nil {
+		return 0, p.error()
+	}
+	return boost, nil
+}
+
+// Build a query for a term. Terms with wildcards produce prefix or wildcard queries, other terms are analyzed
+func (p *luceneParser) termQuery(term string, fields []string, fuzziness string, boost float64) map[string]interface{} {
+	if hasWildcard(term) {
+		if term == "*" {
+			if len(fields) == 1 && fields[0] == "*" {
+				return map[string]interface{}{"match_all": map[string]interface{}{"boost": boost}}
+			}
+			return boostQuery(p.eachField(fields, existsQuery), boost)
+		}
+		if p.options.analyzeWildcard {
+			term = strings.ToLower(term)
+		}
+		queryName, value := "wildcard", term
+		if strings.HasSuffix(term, "*") && !hasWildcard(strings.TrimSuffix(term, "*")) {
+			queryName, value = "prefix", unescapeTerm(strings.TrimSuffix(term, "*"))
+		}
+		return p.eachField(fields, func(field string) map[string]interface{} {
+			return map[string]interface{}{queryName: map[string]interface{}{field: map[string]interface{}{"value": value, "boost": boost}}}
+		})
+	}
+	params := p.matchParams(unescapeTerm(term), boost)
+	if len(fuzziness) > 0 {
+		params["fuzziness"] = fuzziness
+	}
+	return p.fullTextQuery("match", params, fields, p.options.multiMatchType)
+}
+
+// Build parameters of full-text query for the text
+func (p *luceneParser) matchParams(text string, boost float64) map[string]interface{} {
+	params := map[string]interface{}{"query": text, "operator": p.options.defaultOperator, "boost": boost, "lenient": p.options.lenient}
+	if len(p.options.analyzer) > 0 {
+		params["analyzer"] = p.options.analyzer
+	}
+	return params
+}
+
+// Build a full-text query. A single field is searched by the query itself, several fields or fields with wildcards
+// and boosts are searched by multi_match query
+func (p *luceneParser) fullTextQuery(queryName string, params map[string]interface{}, fields []string, multiMatchType string) map[string]interface{} {
+	if len(fields) == 1 && !strings.ContainsAny(fields[0], "*^") {
+		return map[string]interface{}{queryName: map[string]interface{}{fields[0]: params}}
+	}
+	var rawFields []interface{}
+	for _, field := range fields {
+		rawFields = append(rawFields, field)
+	}
+	params["fields"] = rawFields
+	params["type"] = multiMatchType
+	if p.options.tieBreaker != nil {
+		params["tie_breaker"] = p.options.tieBreaker
+	}
+	return map[string]interface{}{"multi_match": params}
+}
+
+// Build a range query over the fields
+func (p *luceneParser) rangeQuery(fields []string, params map[string]interface{}) map[string]interface{} {
+	return p.eachField(fields, func(field string) map[string]interface{} {
+		return map[string]interface{}{"range": map[string]interface{}{field: params}}
+	})
+}
+
+// Build a query for each of fields. Wildcards in field names are expanded, boosts of fields are ignored. Queries of
+// several fields are combined so that any of them should match
+func (p *luceneParser) eachField(fields []string, build func(string) map[string]interface{}) map[string]interface{} {
+	var queries []interface{}
+	for _, spec := range fields {
+		name := spec
+		if i := strings.LastIndex(name, "^"); i >= 0 {
+			name = name[:i]
+		}
+		names := []string{name}
+		if strings.Contains(name, "*") {
+			names = matchMappedFields(p.ctx.Mapping, name)
+			if len(names) == 0 && name == "*" {
+				names = []string{name}
+			}
+		}
+		for _, name := range names {
+			queries = append(queries, build(name))
+		}
+	}
+	switch len(queries) {
+	case 0:
+		return matchNoneQuery()
+	case 1:
+		return queries[0].(map[string]interface{})
+	}
+	return boolQuery("should", queries)
+}
+
+// Parse a query in simple_query_string syntax. The syntax is forgiving, invalid parts are treated as terms or ignored
+func (p *luceneParser) parseSimple() map[string]interface{} {
+	query := p.parseSimpleSequence(0)
+	if query == nil {
+		return matchNoneQuery()
+	}
+	return query
+}
+
+// Parse a sequence of simple_query_string clauses. Each clause is combined with previous ones by the operator
+// preceding it or by default operator
+func (p *luceneParser) parseSimpleSequence(depth int) map[string]interface{} {
+	var result map[string]interface{}
+	operator := p.options.defaultOperator
+	negate := false
+loop:
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			break
+		}
+		var query map[string]interface{}
+		switch c := p.peek(); {
+		case c == ')' && depth > 0 && p.options.enabled("PRECEDENCE"):
+			break loop
+		case c == '+' && p.options.enabled("AND"):
+			operator = "and"
+			p.pos++
+			continue
+		case c == '|' && p.options.enabled("OR"):
+			operator = "or"
+			p.pos++
+			continue
+		case c == '-' && p.options.enabled("NOT"):
+			negate = !negate
+			p.pos++
+			continue
+		case c == '(' && p.options.enabled("PRECEDENCE"):
+			p.pos++
+			query = p.parseSimpleSequence(depth + 1)
+			if !p.eof() && p.peek() == ')' {
+				p.pos++
+			}
+		case c == '"' && p.options.enabled("PHRASE"):
+			query = p.parseSimplePhrase()
+		default:
+			query = p.parseSimpleTerm()
+		}
+		if query == nil {
+			continue
+		}
+		if negate {
+			query = boolQuery("must_not", []interface{}{query})
+			negate = false
+		}
+		result = combineQueries(result, query, operator)
+		operator = p.options.defaultOperator
+	}
+	return result
+}
+
+// Parse a phrase of simple_query_string. Missing closing quote ends the phrase at the end of the query
+func (p *luceneParser) parseSimplePhrase() map[string]interface{} {
+	p.pos++
+	var text []rune
+	for ; !p.eof() && p.peek() != '"'; p.pos++ {
+		if p.peek() == '\\' && p.options.enabled("ESCAPE") && p.pos+1 < len(p.input) {
+			p.pos++
+		}
+		text = append(text, p.peek())
+	}
+	if !p.eof() {
+		p.pos++
+	}
+	params := p.matchParams(string(text), 1)
+	params["slop"] = p.options.phraseSlop
+	if !p.eof() && p.peek() == '~' && (p.options.enabled("SLOP") || p.options.enabled("NEAR")) {
+		p.pos++
+		if slop, err := strconv.Atoi(p.readNumber()); err == nil {
+			params["slop"] = slop
+		}
+	}
+	if len(strings.TrimSpace(string(text))) == 0 {
+		return nil
+	}
+	return p.fullTextQuery("match_phrase", params, p.fields, "phrase")
+}
+
+// Parse a term of simple_query_string with optional fuzziness (term~2) or prefix (term*)
+func (p *luceneParser) parseSimpleTerm() map[string]interface{} {
+	start := p.pos
+	var text []rune
+	for !p.eof() {
+		c := p.peek()
+		if c == '\\' && p.options.enabled("ESCAPE") && p.pos+1 < len(p.input) {
+			text = append(text, p.input[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if unicode.IsSpace(c) || p.isSimpleOperator(c) {
+			break
+		}
+		text = append(text, c)
+		p.pos++
+	}
+	if p.pos == start {
+		// Operator which can't be used here is skipped
+		p.pos++
+		return nil
+	}
+	term := string(text)
+	fuzziness := ""
+	if i := strings.LastIndex(term, "~"); i >= 0 && p.options.enabled("FUZZY") {
+		if _, err := strconv.Atoi(term[i+1:]); err == nil || i == len(term)-1 {
+			term, fuzziness = term[:i], term[i+1:]
+			if len(fuzziness) == 0 {
+				fuzziness = p.options.fuzziness
+			}
+		}
+	}
+	if len(term) == 0 {
+		return nil
+	}
+	if strings.HasSuffix(term, "*") && p.options.enabled("PREFIX") {
+		value := strings.TrimSuffix(term, "*")
+		if p.options.analyzeWildcard {
+			value = strings.ToLower(value)
+		}
+		return p.eachField(p.fields, func(field string) map[string]interface{} {
+			return map[string]interface{}{"prefix": map[string]interface{}{field: map[string]interface{}{"value": value}}}
+		})
+	}
+	params := p.matchParams(term, 1)
+	if len(fuzziness) > 0 {
+		params["fuzziness"] = fuzziness
+	}
+	return p.fullTextQuery("match", params, p.fields, p.options.multiMatchType)
+}
+
+// Check if a character is an enabled operator of simple_query_string which ends a term
+func (p *luceneParser) isSimpleOperator(c rune) bool {
+	switch c {
+	case '+':
+		return p.options.enabled("AND")
+	case '|':
+		return p.options.enabled("OR")
+	case '(', ')':
+		return p.options.enabled("PRECEDENCE")
+	case '"':
+		return p.options.enabled("PHRASE")
+	}
+	return false
+}
+
+// Read a term up to a whitespace or a special character. Escape sequences are kept
+func (p *luceneParser) readTerm() string {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == '\\' && p.pos+1 < len(p.input) {
+			p.pos += 2
+			continue
+		}
+		if unicode.IsSpace(c) || strings.ContainsRune("()\"[]{}^~:", c) {
+			break
+		}
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// Read a bound of a range which could be quoted
+func (p *luceneParser) readRangeValue() string {
+	if !p.eof() && p.peek() == '"' {
+		p.pos++
+		var text []rune
+		for ; !p.eof() && p.peek() != '"'; p.pos++ {
+			if p.peek() == '\\' && p.pos+1 < len(p.input) {
+				p.pos++
+			}
+			text = append(text, p.peek())
+		}
+		if !p.eof() {
+			p.pos++
+		}
+		return string(text)
+	}
+	start := p.pos
+	for !p.eof() && !unicode.IsSpace(p.peek()) && !strings.ContainsRune("]}^)", p.peek()) {
+		if p.peek() == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos > len(p.input) {
+		p.pos = len(p.input)
+	}
+	return unescapeTerm(string(p.input[start:p.pos]))
+}
+
+// Read an unsigned decimal number
+func (p *luceneParser) readNumber() string {
+	start := p.pos
+	for !p.eof() && (unicode.IsDigit(p.peek()) || p.peek() == '.') {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// Check if an operator keyword or symbol is at current position. Keywords should be followed by a separator
+func (p *luceneParser) atOperator(keyword, symbol string) bool {
+	rest := string(p.input[p.pos:])
+	if len(symbol) > 0 && strings.HasPrefix(rest, symbol) {
+		return true
+	}
+	if !strings.HasPrefix(rest, keyword) {
+		return false
+	}
+	next := p.pos + len([]rune(keyword))
+	return next == len(p.input) || unicode.IsSpace(p.input[next]) || p.input[next] == '(' || p.input[next] == '"'
+}
+
+// Consume an operator if it is at current position
+func (p *luceneParser) consumeOperator(keyword, symbol string) bool {
+	p.skipSpaces()
+	if len(symbol) > 0 && strings.HasPrefix(string(p.input[p.pos:]), symbol) {
+		p.pos += len([]rune(symbol))
+		return true
+	}
+	if p.atOperator(keyword, "") {
+		p.pos += len([]rune(keyword))
+		return true
+	}
+	return false
+}
+
+func (p *luceneParser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *luceneParser) peek() rune {
+	return p.input[p.pos]
+}
+
+func (p *luceneParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *luceneParser) error() error {
+	return utils.NewIllegalQueryError(fmt.Sprintf("Failed to parse query [%s] at position %d", p.options.query, p.pos))
+}
+
+// Check if a term contains unescaped wildcard characters
+func hasWildcard(term string) bool {
+	escaped := false
+	for _, c := range term {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '*' || c == '?':
+			return true
+		}
+	}
+	return false
+}
+
+// Remove escaping backslashes from a term
+func unescapeTerm(term string) string {
+	var result []rune
+	escaped := false
+	for _, c := range term {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		result = append(result, c)
+	}
+	return string(result)
+}
+
+// Combine two queries with operator. Queries combined by the same operator are flattened into a single bool query
+func combineQueries(left, right map[string]interface{}, operator string) map[string]interface{} {
+	if left == nil {
+		return right
+	}
+	occur := "should"
+	if operator == "and" {
+		occur = "must"
+	}
+	if body, ok := left["bool"].(map[string]interface{}); ok && len(left) == 1 && len(body) == 1 {
+		if queries, ok := body[occur].([]interface{}); ok {
+			body[occur] = append(queries, right)
+			return left
+		}
+	}
+	return boolQuery(occur, []interface{}{left, right})
+}
+
+// Build a bool query with a single list of clauses
+func boolQuery(occur string, queries []interface{}) map[string]interface{} {
+	return map[string]interface{}{"bool": map[string]interface{}{occur: queries}}
+}
+
+// Wrap a query to apply boost
+func boostQuery(query map[string]interface{}, boost float64) map[string]interface{} {
+	if boost == 1 {
+		return query
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"must": []interface{}{query}, "boost": boost}}
+}
+
+// Build an exists query for the field
+func existsQuery(field string) map[string]interface{} {
+	return map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+}
+
+// Build a query which matches no documents
+func matchNoneQuery() map[string]interface{} {
+	return map[string]interface{}{"match_none": map[string]interface{}{}}
+}
@@ -0,0 +1,122 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// Default percents of percentiles aggregation
+var defaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+// Build percentiles aggregation which calculates values below which the given percents of values fall, or
+// percentile_ranks aggregation which calculates percents of values below the given values. Percentiles are
+// interpolated by percentile_cont
+func (b *aggregationBuilder) percentilesAggregation(typeName string, params map[string]interface{}, documents string) (string, error) {
+	field, err := aggregationField(typeName, params)
+	if err != nil {
+		return "", err
+	}
+	points := defaultPercents
+	pointsParam := "percents"
+	if typeName == "percentile_ranks" {
+		points, pointsParam = nil, "values"
+	}
+	keyed := true
+	for k, v := range params {
+		switch k {
+		case pointsParam:
+			rawPoints, ok := v.([]interface{})
+			if !ok {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] must be an array of numbers", k))
+			}
+			points = nil
+			for _, rawPoint := range rawPoints {
+				point, err := parseFloat(rawPoint, k)
+				if err != nil {
+					return "", err
+				}
+				if typeName == "percentiles" && (point < 0 || point > 100) {
+					return "", utils.NewIllegalQueryError(fmt.Sprintf("percent must be in [0,100], got [%s]", utils.FormatFloat(point)))
+				}
+				points = append(points, point)
+			}
+		case "keyed":
+			if keyed, err = parseBool(v, k); err != nil {
+				return "", err
+			}
+		}
+	}
+	if len(points) == 0 {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("[%s] must not be empty for [%s] aggregation", pointsParam, typeName))
+	}
+
+	var results []string
+	for _, point := range points {
+		result := fmt.Sprintf("100.0 * count(*) FILTER (WHERE m.x <= %s) / nullif(count(m.x), 0)", utils.FormatFloat(point))
+		if typeName == "percentiles" {
+			result = fmt.Sprintf("(percentile_cont(%s / 100.0) WITHIN GROUP (ORDER BY m.x))", utils.FormatFloat(point))
+		}
+		key := formatRangeBound(point)
+		if keyed {
+			results = append(results, utils.QuoteLiteral(key), result)
+		} else {
+			results = append(results, fmt.Sprintf("jsonb_build_object('key', %s, 'value', %s)", utils.FormatFloat(point), result))
+		}
+	}
+	values := fmt.Sprintf("jsonb_build_array(%s)", strings.Join(results, ", "))
+	if keyed {
+		values = fmt.Sprintf("jsonb_build_object(%s)", strings.Join(results, ", "))
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('values', %s) FROM (SELECT %s AS x FROM %s AS d, %s) AS m WHERE m.x IS NOT NULL)",
+		values, b.numericValue(field), documents, fieldValues(field)), nil
+}
+
+// Build top_hits aggregation which returns the most relevant documents of a bucket or documents sorted by the given
+// sort. Returned _source could be filtered
+func (b *aggregationBuilder) topHitsAggregation(params map[string]interface{}, documents string) (string, error) {
+	from, size := 0, 3
+	sortFields := DefaultSort()
+	explicitSort := false
+	source := "document"
+	var err error
+	for k, v := range params {
+		switch k {
+		case "from":
+			from, err = parseInt(v, k)
+		case "size":
+			size, err = parseInt(v, k)
+		case "sort":
+			sortFields, err = ParseSort(v)
+			explicitSort = true
+		case "_source":
+			var filter string
+			if filter, err = SourceFilter(v); len(filter) > 0 {
+				source = filter
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if from < 0 || size < 0 {
+		return "", utils.NewIllegalQueryError("[top_hits] from and size cannot be negative")
+	}
+
+	var orders, keys []string
+	for _, field := range sortFields {
+		key := b.ctx.SortExpression(field, "score")
+		orders = append(orders, fmt.Sprintf("%s %s", key, field.SQLOrder()))
+		keys = append(keys, key)
+	}
+	// Documents with equal sort keys are ordered by location to make results stable
+	orders = append(orders, "_index", "_type", "id")
+	hit := "jsonb_build_object('_index', t._index, '_type', t._type, '_id', t.id, '_score', t.score, '_source', t.source)"
+	if explicitSort {
+		hit += " || jsonb_build_object('sort', t.sort)"
+	}
+	return fmt.Sprintf("(SELECT jsonb_build_object('hits', jsonb_build_object('total', count(*), 'max_score', max(t.score), "+
+		"'hits', coalesce(jsonb_agg(%s ORDER BY t.rank) FILTER (WHERE t.rank > %d AND t.rank <= %d), '[]'::jsonb))) "+
+		"FROM (SELECT _index, _type, id, score, %s AS source, jsonb_build_array(%s) AS sort, row_number() OVER (ORDER BY %s) AS rank FROM %s AS d) AS t)",
+		hit, from, from+size, source, strings.Join(keys, ", "), strings.Join(orders, ", "), documents), nil
+}
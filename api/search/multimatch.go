@@ -0,0 +1,273 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// multiMatchField is a field of multi_match query with its boost
+type multiMatchField struct {
+	name  string
+	boost float64
+}
+
+func parseMultiMatchQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	options, err := parseMatchOptions(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	queryType := "best_fields"
+	if value, ok := rawQuery["type"]; ok {
+		queryType = strings.ToLower(fmt.Sprint(value))
+	}
+	tieBreaker := 0.0
+	if value, ok := rawQuery["tie_breaker"]; ok {
+		if tieBreaker, err = parseFloat(value, "tie_breaker"); err != nil {
+			return nil, err
+		}
+	}
+	fields, err := parseMultiMatchFields(rawQuery["fields"], ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Boost of the query is applied to combined score
+	boost := options.boost
+	options.boost = 1
+	var clauses []*Clause
+	switch queryType {
+	case "best_fields", "most_fields":
+		clauses, err = multiMatchFieldClauses(fields, ctx, func(fieldName string) (*Clause, error) {
+			return matchClause(fieldName, options, ctx)
+		})
+		if queryType == "most_fields" {
+			tieBreaker = 1
+		}
+	case "phrase", "phrase_prefix":
+		clauses, err = multiMatchFieldClauses(fields, ctx, func(fieldName string) (*Clause, error) {
+			fieldType := ctx.fieldType(fieldName)
+			if isNumericType(fieldType) || fieldType == "boolean" {
+				return valueClause(fieldName, fieldType, options)
+			}
+			return phraseClause(fieldName, options, ctx, queryType == "phrase_prefix")
+		})
+	case "cross_fields":
+		if options.fuzzy != nil {
+			return nil, utils.NewIllegalQueryError("fuzziness not allowed for type [cross_fields]")
+		}
+		clauses, err = crossFieldsClauses(fields, options, ctx)
+	default:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("No type found for name: %s", queryType))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(clauses) == 0 {
+		return falseClause(), nil
+	}
+	return boostClause(disjunctionMax(clauses, tieBreaker), boost), nil
+}
+
+// Parse fields of multi_match query. Field names could contain wildcards and boosts like "title^2". Wildcards are
+// expanded to mapped fields, "*" means all values of the document if there is no mapped fields
+func parseMultiMatchFields(rawFields interface{}, ctx *QueryContext) ([]multiMatchField, error) {
+	var specs []string
+	switch rawFields := rawFields.(type) {
+	case nil:
+		specs = []string{"*"}
+	case string:
+		specs = []string{rawFields}
+	case []interface{}:
+		for _, field := range rawFields {
+			specs = append(specs, fmt.Sprint(field))
+		}
+	default:
+		return nil, utils.NewIllegalQueryError("[multi_match] fields should be a string or an array of strings")
+	}
+
+	var fields []multiMatchField
+	seen := make(map[string]int)
+	add := func(name string, boost float64) {
+		if i, ok := seen[name]; ok {
+			fields[i].boost *= boost
+			return
+		}
+		seen[name] = len(fields)
+		fields = append(fields, multiMatchField{name, boost})
+	}
+	for _, spec := range specs {
+		name, boost := spec, 1.0
+		if i := strings.LastIndex(spec, "^"); i >= 0 {
+			var err error
+			name = spec[:i]
+			if boost, err = parseFloat(spec[i+1:], "boost"); err != nil {
+				return nil, err
+			}
+		}
+		if !strings.Contains(name, "*") {
+			add(name, boost)
+			continue
+		}
+		matched := matchMappedFields(ctx.Mapping, name)
+		if len(matched) == 0 && name == "*" {
+			add(name, boost)
+		}
+		for _, fieldName := range matched {
+			add(fieldName, boost)
+		}
+	}
+	return fields, nil
+}
+
+// Get names of mapped fields which match the wildcard pattern. Fields of objects are named by dotted paths. Names are
+// sorted to produce stable queries
+func matchMappedFields(mapping map[string]interface{}, pattern string) []string {
+	var result []string
+	for _, name := range mappedFields(mapping, "") {
+		if matchWildcard(pattern, name) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Get dotted names of all leaf fields of the mapping
+func mappedFields(mapping map[string]interface{}, prefix string) []string {
+	properties, _ := mapping["properties"].(map[string]interface{})
+	var result []string
+	for name, config := range properties {
+		config, _ := config.(map[string]interface{})
+		if _, ok := config["properties"]; ok {
+			result = append(result, mappedFields(config, prefix+name+".")...)
+		} else {
+			result = append(result, prefix+name)
+		}
+	}
+	return result
+}
+
+// Check if the name matches the pattern where "*" matches any sequence of characters
+func matchWildcard(pattern, name string) bool {
+	expression := strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1)
+	return regexp.MustCompile("^" + expression + "$").MatchString(name)
+}
+
+// Build clauses for each field and apply field boosts
+func multiMatchFieldClauses(fields []multiMatchField, ctx *QueryContext, build func(string) (*Clause, error)) ([]*Clause, error) {
+	var clauses []*Clause
+	for _, field := range fields {
+		clause, err := build(field.name)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, boostClause(clause, field.boost))
+	}
+	return clauses, nil
+}
+
+// Build clauses of cross_fields query. Fields are grouped by search analyzer and every group is searched as a single
+// field combined from all fields of the group. Non-text fields are searched separately
+func crossFieldsClauses(fields []multiMatchField, options *matchOptions, ctx *QueryContext) ([]*Clause, error) {
+	type fieldGroup struct {
+		vectors []string
+		boosts  []float64
+		fields  []string
+	}
+	var clauses []*Clause
+	var analyzers []string
+	groups := make(map[string]*fieldGroup)
+	for _, field := range fields {
+		fieldType := ctx.fieldType(field.name)
+		if isNumericType(fieldType) || fieldType == "boolean" {
+			clause, err := valueClause(field.name, fieldType, options)
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, boostClause(clause, field.boost))
+			continue
+		}
+		searchAnalyzer, err := ctx.searchAnalyzer(field.name)
+		if err != nil {
+			return nil, err
+		}
+		indexAnalyzer, err := ctx.indexAnalyzer(field.name)
+		if err != nil {
+			return nil, err
+		}
+		// Analyzer of the query puts all fields into a single group
+		analyzerName := searchAnalyzer.Name
+		if len(options.analyzer) > 0 {
+			analyzerName = options.analyzer
+		}
+		group, ok := groups[analyzerName]
+		if !ok {
+			group = &fieldGroup{}
+			groups[analyzerName] = group
+			analyzers = append(analyzers, analyzerName)
+		}
+		vector := indexAnalyzer.Vector(fieldText(field.name))
+		group.fields = append(group.fields, field.name)
+		group.vectors = append(group.vectors, vector)
+		group.boosts = append(group.boosts, field.boost)
+	}
+
+	for _, analyzerName := range analyzers {
+		group := groups[analyzerName]
+		tokens, err := ctx.analyzeQuery(group.fields[0], options)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			if options.zeroTermsQuery == "all" {
+				clauses = append(clauses, matchAllClause(1))
+			}
+			continue
+		}
+		// Missing fields produce NULL vectors which should not reset the combined vector
+		var vectors []string
+		for _, vector := range group.vectors {
+			vectors = append(vectors, fmt.Sprintf("coalesce(%s, ''::tsvector)", vector))
+		}
+		rank := func(tsquery string) string {
+			var ranks []string
+			for i, vector := range group.vectors {
+				rank := fmt.Sprintf("coalesce(%s, 0)", vectorRank(vector)(tsquery))
+				ranks = append(ranks, boostClause(&Clause{Score: rank}, group.boosts[i]).Score)
+			}
+			return strings.Join(ranks, " + ")
+		}
+		clause, err := termsClause(strings.Join(vectors, " || "), distinctTerms(tokens), options, ctx, rank)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
+
+// Combine clauses so that any of them should match. Score is the best score of matching clauses plus scores of other
+// matching clauses multiplied by tie breaker
+func disjunctionMax(clauses []*Clause, tieBreaker float64) *Clause {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	var conditions, scores []string
+	for _, c := range clauses {
+		conditions = append(conditions, c.Condition)
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", c.Condition, c.Score))
+	}
+	best := fmt.Sprintf("greatest(%s)", strings.Join(scores, ", "))
+	sum := strings.Join(scores, " + ")
+	score := best
+	switch {
+	case tieBreaker == 1:
+		score = sum
+	case tieBreaker > 0:
+		score = fmt.Sprintf("%s * %s + (%s) * %s", best, utils.FormatFloat(1-tieBreaker), sum, utils.FormatFloat(tieBreaker))
+	}
+	return &Clause{Condition: joinConditions(conditions, "OR"), Score: score}
+}
@@ -0,0 +1,266 @@
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of nodes of a mustache template
+const (
+	mustacheText = iota
+	mustacheVariable
+	mustacheRawVariable
+	mustacheSection
+	mustacheInverted
+)
+
+// mustacheNode is a text or a tag of a mustache template. Name is a text of text nodes, sections keep source of their
+// content in inner, since toJson and join sections treat it as a name of a parameter
+type mustacheNode struct {
+	kind     int
+	name     string
+	inner    string
+	children []mustacheNode
+}
+
+var joinDelimiterPattern = regexp.MustCompile(`^join\s+delimiter\s*=\s*'([^']*)'$`)
+
+// RenderTemplate renders a mustache template of a search request with the parameters. Values of variables are escaped
+// as contents of JSON strings unless they are put in triple mustaches or & tag. Section toJson renders a parameter as
+// JSON, section join renders items of an array parameter separated by comma or by delimiter='...', section url
+// encodes its content. Default values are given by inverted sections like {{^size}}10{{/size}}
+func RenderTemplate(source string, params map[string]interface{}) (string, error) {
+	nodes, _, _, err := parseMustache(source, 0, "")
+	if err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	if err = renderMustache(nodes, []interface{}{params}, &output); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// Parse a mustache template starting at position pos up to the end of the section. Returns nodes, position of the
+// closing tag of the section and position after it
+func parseMustache(source string, pos int, section string) ([]mustacheNode, int, int, error) {
+	var nodes []mustacheNode
+	for {
+		start := strings.Index(source[pos:], "{{")
+		if start < 0 {
+			if len(section) > 0 {
+				return nil, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("Failed to compile template: section [%s] is not closed", section))
+			}
+			if pos < len(source) {
+				nodes = append(nodes, mustacheNode{kind: mustacheText, name: source[pos:]})
+			}
+			return nodes, len(source), len(source), nil
+		}
+		start += pos
+		if start > pos {
+			nodes = append(nodes, mustacheNode{kind: mustacheText, name: source[pos:start]})
+		}
+		tagStart, closing := start+2, "}}"
+		if strings.HasPrefix(source[tagStart:], "{") {
+			tagStart, closing = tagStart+1, "}}}"
+		}
+		end := strings.Index(source[tagStart:], closing)
+		if end < 0 {
+			return nil, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("Failed to compile template: tag at position %d is not closed", start))
+		}
+		end += tagStart
+		tag := strings.TrimSpace(source[tagStart:end])
+		pos = end + len(closing)
+		if len(tag) == 0 {
+			return nil, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("Failed to compile template: empty tag at position %d", start))
+		}
+		if closing == "}}}" {
+			nodes = append(nodes, mustacheNode{kind: mustacheRawVariable, name: tag})
+			continue
+		}
+		name := strings.TrimSpace(tag[1:])
+		switch tag[0] {
+		case '!':
+		case '&':
+			nodes = append(nodes, mustacheNode{kind: mustacheRawVariable, name: name})
+		case '#', '^':
+			children, innerEnd, next, err := parseMustache(source, pos, name)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			kind := mustacheSection
+			if tag[0] == '^' {
+				kind = mustacheInverted
+			}
+			nodes = append(nodes, mustacheNode{kind: kind, name: name, inner: source[pos:innerEnd], children: children})
+			pos = next
+		case '/':
+			if name != section {
+				return nil, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("Failed to compile template: unexpected closing tag [%s]", name))
+			}
+			return nodes, start, pos, nil
+		case '>', '=':
+			return nil, 0, 0, utils.NewIllegalQueryError(fmt.Sprintf("Failed to compile template: tag [%s] is not supported", tag))
+		default:
+			nodes = append(nodes, mustacheNode{kind: mustacheVariable, name: tag})
+		}
+	}
+}
+
+// Render nodes of a mustache template. Names are looked up in the stack of contexts from the top
+func renderMustache(nodes []mustacheNode, stack []interface{}, output *bytes.Buffer) error {
+	for _, node := range nodes {
+		switch node.kind {
+		case mustacheText:
+			output.WriteString(node.name)
+		case mustacheVariable:
+			output.WriteString(escapeMustacheValue(mustacheString(mustacheLookup(stack, node.name))))
+		case mustacheRawVariable:
+			output.WriteString(mustacheString(mustacheLookup(stack, node.name)))
+		case mustacheInverted:
+			if !mustacheTruthy(mustacheLookup(stack, node.name)) {
+				if err := renderMustache(node.children, stack, output); err != nil {
+					return err
+				}
+			}
+		case mustacheSection:
+			if err := renderMustacheSection(node, stack, output); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Render a section of a mustache template. A list renders the section for every item, other truthy values render it
+// once with the value on top of the stack
+func renderMustacheSection(node mustacheNode, stack []interface{}, output *bytes.Buffer) error {
+	if node.name == "toJson" {
+		value, err := json.Marshal(mustacheLookup(stack, strings.TrimSpace(node.inner)))
+		if err != nil {
+			return utils.NewIllegalQueryError(err.Error())
+		}
+		output.Write(value)
+		return nil
+	}
+	if node.name == "join" || joinDelimiterPattern.MatchString(node.name) {
+		delimiter := ","
+		if match := joinDelimiterPattern.FindStringSubmatch(node.name); match != nil {
+			delimiter = match[1]
+		}
+		value := mustacheLookup(stack, strings.TrimSpace(node.inner))
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		var texts []string
+		for _, item := range items {
+			texts = append(texts, escapeMustacheValue(mustacheString(item)))
+		}
+		output.WriteString(strings.Join(texts, delimiter))
+		return nil
+	}
+	if node.name == "url" {
+		var content bytes.Buffer
+		if err := renderMustache(node.children, stack, &content); err != nil {
+			return err
+		}
+		output.WriteString(url.QueryEscape(content.String()))
+		return nil
+	}
+
+	value := mustacheLookup(stack, node.name)
+	if !mustacheTruthy(value) {
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	for _, item := range items {
+		if err := renderMustache(node.children, append(stack[:len(stack):len(stack)], item), output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Look up a dotted name in the stack of contexts. Items of arrays are referred by their indices
+func mustacheLookup(stack []interface{}, name string) interface{} {
+	if name == "." {
+		return stack[len(stack)-1]
+	}
+	path := strings.Split(name, ".")
+	for i := len(stack) - 1; i >= 0; i-- {
+		value, ok := mustacheChild(stack[i], path[0])
+		if !ok {
+			continue
+		}
+		for _, key := range path[1:] {
+			if value, ok = mustacheChild(value, key); !ok {
+				return nil
+			}
+		}
+		return value
+	}
+	return nil
+}
+
+// Get a field of an object or an item of an array
+func mustacheChild(value interface{}, key string) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		child, ok := value[key]
+		return child, ok
+	case []interface{}:
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(value) {
+			return value[index], true
+		}
+	}
+	return nil, false
+}
+
+// Check if a value renders a section. Missing values, null, false and empty arrays don't
+func mustacheTruthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case []interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+// Convert a value to a text. Objects and arrays are converted to JSON
+func mustacheString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	text, _ := json.Marshal(value)
+	return string(text)
+}
+
+// Escape a text to be put into a JSON string
+func escapeMustacheValue(text string) string {
+	var output bytes.Buffer
+	encoder := json.NewEncoder(&output)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(text)
+	escaped := strings.TrimSpace(output.String())
+	return escaped[1 : len(escaped)-1]
+}
@@ -0,0 +1,143 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// InnerHits describes nested objects returned together with each found document. Condition and Score are SQL over
+// document column of nested documents
+type InnerHits struct {
+	Name      string
+	Path      string
+	Condition string
+	Score     string
+	From      int
+	Size      int
+}
+
+func parseNestedQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	path, ok := rawQuery["path"].(string)
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[nested] requires 'path' field")
+	}
+	rawInner, ok := rawQuery["query"].(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[nested] requires 'query' field")
+	}
+	scoreMode := "avg"
+	if mode, ok := rawQuery["score_mode"]; ok {
+		scoreMode = strings.ToLower(fmt.Sprint(mode))
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	ignoreUnmapped := false
+	if value, ok := rawQuery["ignore_unmapped"]; ok {
+		if ignoreUnmapped, err = parseBool(value, "ignore_unmapped"); err != nil {
+			return nil, err
+		}
+	}
+	// Fields without mapping are treated as nested because documents could be stored without explicit mapping
+	if fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, path); ok && fieldMapping.TypeName != "nested" {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[nested] nested object under path [%s] is not of nested type", path))
+	} else if !ok && ignoreUnmapped {
+		return falseClause(), nil
+	}
+	inner, err := parseQuery(rawInner, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := nestedDocuments(path)
+	clause := &Clause{Condition: fmt.Sprintf("EXISTS (SELECT 1 FROM %s AS nested WHERE %s)", documents, inner.Condition)}
+	switch scoreMode {
+	case "none":
+		clause.Score = "0"
+	case "avg", "max", "min", "sum":
+		clause.Score = fmt.Sprintf("(SELECT coalesce(%s((%s)::float8), 0) FROM %s AS nested WHERE %s)", scoreMode, inner.Score, documents, inner.Condition)
+	default:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[nested] illegal score_mode [%s]", scoreMode))
+	}
+
+	if rawInnerHits, ok := rawQuery["inner_hits"]; ok {
+		innerHits, err := parseInnerHits(rawInnerHits, path, inner)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range ctx.InnerHits {
+			if other.Name == innerHits.Name {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[inner_hits] already contains an entry for key [%s]", innerHits.Name))
+			}
+		}
+		ctx.InnerHits = append(ctx.InnerHits, innerHits)
+	}
+	return boostClause(clause, boost), nil
+}
+
+// Parse inner_hits parameter of a nested query. Inner hits are named by the path by default
+func parseInnerHits(rawInnerHits interface{}, path string, inner *Clause) (*InnerHits, error) {
+	params, ok := rawInnerHits.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[inner_hits] must be an object")
+	}
+	innerHits := &InnerHits{Name: path, Path: path, Condition: inner.Condition, Score: inner.Score, Size: 3}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "name":
+			innerHits.Name = fmt.Sprint(v)
+		case "from":
+			innerHits.From, err = parseInt(v, k)
+		case "size":
+			innerHits.Size, err = parseInt(v, k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return innerHits, nil
+}
+
+// Expression builds jsonb expression of inner hits for a found document
+func (innerHits *InnerHits) Expression() string {
+	hit := fmt.Sprintf("jsonb_build_object('_index', _index, '_type', _type, '_id', id, '_nested', jsonb_build_object('field', %s, 'offset', h.nested_offset), '_score', h.score, '_source', h.nested_source)",
+		utils.QuoteLiteral(innerHits.Path))
+	return fmt.Sprintf("(SELECT jsonb_build_object('hits', jsonb_build_object('total', count(*), 'max_score', max(h.score), 'hits', "+
+		"coalesce(jsonb_agg(%s ORDER BY h.rank) FILTER (WHERE h.rank > %d AND h.rank <= %d), '[]'::jsonb))) "+
+		"FROM (SELECT nested.nested_offset, nested.nested_source, coalesce((%s)::float8, 0) AS score, row_number() OVER (ORDER BY coalesce((%s)::float8, 0) DESC, nested.nested_offset) AS rank "+
+		"FROM %s AS nested WHERE %s) AS h)",
+		hit, innerHits.From, innerHits.From+innerHits.Size, innerHits.Score, innerHits.Score, nestedDocuments(innerHits.Path), innerHits.Condition)
+}
+
+// InnerHitsExpression builds jsonb expression of all inner hits requested by the query. Empty expression means there
+// are no inner hits
+func (ctx *QueryContext) InnerHitsExpression() string {
+	if len(ctx.InnerHits) == 0 {
+		return ""
+	}
+	var args []string
+	for _, innerHits := range ctx.InnerHits {
+		args = append(args, utils.QuoteLiteral(innerHits.Name), innerHits.Expression())
+	}
+	return fmt.Sprintf("jsonb_build_object(%s)", strings.Join(args, ", "))
+}
+
+// Build SQL subquery of nested objects under the path of a document. Each nested object is represented as a document
+// which contains only that object under the same path, so queries with full field names could be applied to it.
+// Columns nested_source and nested_offset contain the object itself and its position
+func nestedDocuments(path string) string {
+	return fmt.Sprintf("(SELECT %s AS document, n.value AS nested_source, n.ordinality - 1 AS nested_offset FROM jsonb_path_query(document, %s) WITH ORDINALITY AS n(value, ordinality))",
+		wrapNested(path, "n.value"), utils.QuoteLiteral(fieldPath(path)))
+}
+
+// Build SQL expression of an object which contains the value under the dotted path
+func wrapNested(path, value string) string {
+	keys := strings.Split(path, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		value = fmt.Sprintf("jsonb_build_object(%s, %s)", utils.QuoteLiteral(keys[i]), value)
+	}
+	return value
+}
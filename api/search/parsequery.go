@@ -2,123 +2,297 @@ package search
 
 import (
 	"fmt"
-	"github.com/asp437/pg_elastic/db"
 	"github.com/asp437/pg_elastic/utils"
+	"math"
+	"strconv"
+	"strings"
 )
 
-// ParseSearchQuery parses a query and convert it into db.Query
-func ParseSearchQuery(rawQuery map[string]interface{}, query *db.Query, mapping map[string]interface{}) {
+// Clause is a SQL representation of a search query. Condition selects matching documents and Score calculates their
+// relevance. Score is meaningful only for documents which match the condition
+type Clause struct {
+	Condition string
+	Score     string
+}
+
+// ParseSearchQuery parses a query and converts it into SQL clause
+func ParseSearchQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	return parseQuery(rawQuery, ctx)
+}
+
+// Parse a query object into SQL clause. All queries of the object should match
+func parseQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	var clauses []*Clause
 	for k, v := range rawQuery {
+		body, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query malformed, no start_object after query name", k))
+		}
+		var clause *Clause
+		var err error
 		switch k {
 		case "match_all":
-			parseMatchAllQuery(v.(map[string]interface{}), query, mapping)
+			clause, err = parseMatchAllQuery(body, ctx)
 		case "match":
-			parseMatchQuery(v.(map[string]interface{}), query, mapping)
+			clause, err = parseMatchQuery(body, ctx)
 		case "match_phrase":
-			parseMatchPhraseQuery(v.(map[string]interface{}), query, mapping)
+			clause, err = parseMatchPhraseQuery(body, ctx)
+		case "match_phrase_prefix":
+			clause, err = parseMatchPhrasePrefixQuery(body, ctx)
+		case "multi_match":
+			clause, err = parseMultiMatchQuery(body, ctx)
+		case "match_none":
+			clause = falseClause()
+		case "query_string":
+			clause, err = parseQueryStringQuery(body, ctx)
+		case "simple_query_string":
+			clause, err = parseSimpleQueryStringQuery(body, ctx)
+		case "term":
+			clause, err = parseTermQuery(body, ctx)
+		case "terms":
+			clause, err = parseTermsQuery(body, ctx)
+		case "range":
+			clause, err = parseRangeQuery(body, ctx)
+		case "exists":
+			clause, err = parseExistsQuery(body, ctx)
+		case "prefix":
+			clause, err = parsePrefixQuery(body, ctx)
+		case "wildcard":
+			clause, err = parseWildcardQuery(body, ctx)
+		case "regexp":
+			clause, err = parseRegexpQuery(body, ctx)
+		case "fuzzy":
+			clause, err = parseFuzzyQuery(body, ctx)
 		case "bool":
-			parseBoolQuery(v.(map[string]interface{}), query, mapping)
+			clause, err = parseBoolQuery(body, ctx)
+		case "nested":
+			clause, err = parseNestedQuery(body, ctx)
+		case "constant_score":
+			clause, err = parseConstantScoreQuery(body, ctx)
+		case "dis_max":
+			clause, err = parseDisMaxQuery(body, ctx)
+		case "boosting":
+			clause, err = parseBoostingQuery(body, ctx)
+		case "function_score":
+			clause, err = parseFunctionScoreQuery(body, ctx)
+		case "script_score":
+			clause, err = parseScriptScoreQuery(body, ctx)
+		case "geo_distance":
+			clause, err = parseGeoDistanceQuery(body, ctx)
+		case "geo_bounding_box":
+			clause, err = parseGeoBoundingBoxQuery(body, ctx)
+		case "geo_polygon":
+			clause, err = parseGeoPolygonQuery(body, ctx)
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("no [query] registered for [%s]", k))
+		}
+		if err != nil {
+			return nil, err
 		}
+		clauses = append(clauses, clause)
 	}
+	if len(clauses) == 0 {
+		return matchAllClause(1), nil
+	}
+	return conjunction(clauses), nil
 }
 
-func parseMatchAllQuery(rawQuery map[string]interface{}, query *db.Query, mapping map[string]interface{}) {
-}
-
-func parseMatchPhraseQuery(rawQuery map[string]interface{}, query *db.Query, mapping map[string]interface{}) {
-	var whereClause string
-	for k, v := range rawQuery {
-		fieldName := k
-		switch v.(type) {
-		case string:
-			fieldMapping, ok := utils.GetFieldMapping(mapping, fieldName)
-			if ok && len(fieldMapping.Analyzer) > 0 {
-				whereClause = fmt.Sprintf("to_tsvector('%s', document->'%s') @@ phraseto_tsquery('%s', '%s')", fieldMapping.Analyzer, fieldName, fieldMapping.Analyzer, v)
-			} else {
-				whereClause = fmt.Sprintf("to_tsvector(document->'%s') @@ phraseto_tsquery('%s')", fieldName, v)
-			}
-			query.Where(whereClause)
-		case map[string]interface{}:
-			var queryString, operator string
-			for kk, vv := range v.(map[string]interface{}) {
-				switch kk {
-				case "query":
-					queryString = vv.(string)
-				case "operator":
-					operator = vv.(string)
-				}
-			}
-			operator = operator // Silent not used variable
-			fieldMapping, ok := utils.GetFieldMapping(mapping, fieldName)
-			if ok && len(fieldMapping.Analyzer) > 0 {
-				whereClause = fmt.Sprintf("to_tsvector('%s', document->'%s') @@ phraseto_tsquery('%s', '%s')", fieldMapping.Analyzer, fieldName, fieldMapping.Analyzer, queryString)
-			} else {
-				whereClause = fmt.Sprintf("to_tsvector(document->'%s') @@ phraseto_tsquery('%s')", fieldName, queryString)
-			}
-			query.Where(whereClause)
+// Parse a list of queries which could be represented as a single query object or as an array of objects
+func parseQueryList(rawQuery interface{}, ctx *QueryContext) ([]*Clause, error) {
+	var rawQueries []interface{}
+	switch rawQuery := rawQuery.(type) {
+	case []interface{}:
+		rawQueries = rawQuery
+	default:
+		rawQueries = []interface{}{rawQuery}
+	}
+	var clauses []*Clause
+	for _, q := range rawQueries {
+		queryMap, ok := q.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("query malformed, must start with start_object")
+		}
+		clause, err := parseQuery(queryMap, ctx)
+		if err != nil {
+			return nil, err
 		}
+		clauses = append(clauses, clause)
 	}
+	return clauses, nil
 }
 
-func parseMatchQuery(rawQuery map[string]interface{}, query *db.Query, mapping map[string]interface{}) {
-	var whereClause string
-	for k, v := range rawQuery {
-		fieldName := k
-		switch v.(type) {
-		case string:
-			fieldMapping, ok := utils.GetFieldMapping(mapping, fieldName)
-			if ok && len(fieldMapping.Analyzer) > 0 {
-				whereClause = fmt.Sprintf("to_tsvector('%s', document->'%s') @@ to_tsquery('%s', '%s')", fieldMapping.Analyzer, fieldName, fieldMapping.Analyzer, v)
-			} else {
-				whereClause = fmt.Sprintf("to_tsvector(document->'%s') @@ to_tsquery('%s')", fieldName, v)
-			}
-			query.Where(whereClause)
-		case map[string]interface{}:
-			var queryString, operator string
-			for kk, vv := range v.(map[string]interface{}) {
-				switch kk {
-				case "query":
-					queryString = vv.(string)
-				case "operator":
-					operator = vv.(string)
-				}
-			}
-			operator = operator // Silent not used variable
-			fieldMapping, ok := utils.GetFieldMapping(mapping, fieldName)
-			if ok && len(fieldMapping.Analyzer) > 0 {
-				whereClause = fmt.Sprintf("to_tsvector('%s', document->'%s') @@ to_tsquery('%s', '%s')", fieldMapping.Analyzer, fieldName, fieldMapping.Analyzer, queryString)
-			} else {
-				whereClause = fmt.Sprintf("to_tsvector(document->'%s') @@ to_tsquery('%s')", fieldName, queryString)
-			}
-			query.Where(whereClause)
-		}
+func parseMatchAllQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
 	}
+	return matchAllClause(boost), nil
 }
 
-func parseBoolQuery(rawQuery map[string]interface{}, query *db.Query, mapping map[string]interface{}) {
+func parseBoolQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	var must, filter, mustNot, should []*Clause
+	var err error
+	minimumShouldMatchSpec := ""
 	for k, v := range rawQuery {
 		switch k {
 		case "must":
-			query.WhereGroup(func(q *db.Query) (*db.Query, error) {
-				ParseSearchQuery(v.(map[string]interface{}), q, mapping)
-				return q, nil
-			})
+			must, err = parseQueryList(v, ctx)
 		case "filter":
-			query.WhereGroup(func(q *db.Query) (*db.Query, error) {
-				ParseSearchQuery(v.(map[string]interface{}), q, mapping)
-				return q, nil
-			})
+			filter, err = parseQueryList(v, ctx)
 		case "must_not":
-			// TODO: must_not query negation
-			query.WhereGroup(func(q *db.Query) (*db.Query, error) {
-				ParseSearchQuery(v.(map[string]interface{}), q, mapping)
-				return q, nil
-			})
+			mustNot, err = parseQueryList(v, ctx)
 		case "should":
-			query.WhereOrGroup(func(q *db.Query) (*db.Query, error) {
-				ParseSearchQuery(v.(map[string]interface{}), q, mapping)
-				return q, nil
-			})
+			should, err = parseQueryList(v, ctx)
+		case "minimum_should_match":
+			minimumShouldMatchSpec = fmt.Sprint(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Should clauses are optional if there are other required clauses
+	requiredShould := 0
+	if len(must) == 0 && len(filter) == 0 && len(should) > 0 {
+		requiredShould = 1
+	}
+	if len(minimumShouldMatchSpec) > 0 {
+		requiredShould, err = minimumShouldMatch(minimumShouldMatchSpec, len(should))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if requiredShould > len(should) {
+		return falseClause(), nil
+	}
+
+	var conditions, scores []string
+	for _, c := range must {
+		conditions = append(conditions, c.Condition)
+		scores = append(scores, c.Score)
+	}
+	for _, c := range filter {
+		conditions = append(conditions, c.Condition)
+	}
+	for _, c := range mustNot {
+		conditions = append(conditions, fmt.Sprintf("NOT coalesce(%s, FALSE)", c.Condition))
+	}
+	var shouldConditions, shouldCounters []string
+	for _, c := range should {
+		shouldConditions = append(shouldConditions, c.Condition)
+		shouldCounters = append(shouldCounters, fmt.Sprintf("coalesce(%s, FALSE)::int", c.Condition))
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", c.Condition, c.Score))
+	}
+	switch {
+	case requiredShould == 1:
+		conditions = append(conditions, joinConditions(shouldConditions, "OR"))
+	case requiredShould > 1:
+		conditions = append(conditions, fmt.Sprintf("(%s) >= %d", strings.Join(shouldCounters, " + "), requiredShould))
+	}
+
+	clause := &Clause{Condition: joinConditions(conditions, "AND"), Score: "0"}
+	if len(scores) > 0 {
+		clause.Score = strings.Join(scores, " + ")
+	}
+	return boostClause(clause, boost), nil
+}
+
+// Build a clause which matches all documents
+func matchAllClause(boost float64) *Clause {
+	return &Clause{Condition: "TRUE", Score: utils.FormatFloat(boost)}
+}
+
+// Build a clause which matches no documents
+func falseClause() *Clause {
+	return &Clause{Condition: "FALSE", Score: "0"}
+}
+
+// Build a clause which requires all clauses to match. Scores of clauses are summed up
+func conjunction(clauses []*Clause) *Clause {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	var conditions, scores []string
+	for _, c := range clauses {
+		conditions = append(conditions, c.Condition)
+		scores = append(scores, c.Score)
+	}
+	return &Clause{Condition: joinConditions(conditions, "AND"), Score: strings.Join(scores, " + ")}
+}
+
+// Multiply score of the clause by boost
+func boostClause(clause *Clause, boost float64) *Clause {
+	if boost == 1 {
+		return clause
+	}
+	return &Clause{Condition: clause.Condition, Score: fmt.Sprintf("(%s) * %s", clause.Score, utils.FormatFloat(boost))}
+}
+
+// Join SQL conditions with logical operator
+func joinConditions(conditions []string, operator string) string {
+	switch len(conditions) {
+	case 0:
+		if operator == "OR" {
+			return "FALSE"
+		}
+		return "TRUE"
+	case 1:
+		return conditions[0]
+	}
+	return "(" + strings.Join(conditions, ") "+operator+" (") + ")"
+}
+
+// Parse optional boost parameter of a query
+func parseBoost(rawQuery map[string]interface{}) (float64, error) {
+	value, ok := rawQuery["boost"]
+	if !ok {
+		return 1, nil
+	}
+	return parseFloat(value, "boost")
+}
+
+// Parse a float parameter of a query. Numbers could be passed as strings, but they should be finite
+func parseFloat(value interface{}, name string) (float64, error) {
+	switch value := value.(type) {
+	case float64:
+		return value, nil
+	case string:
+		result, err := strconv.ParseFloat(value, 64)
+		if err == nil && !math.IsNaN(result) && !math.IsInf(result, 0) {
+			return result, nil
+		}
+	}
+	return 0, utils.NewIllegalQueryError(fmt.Sprintf("[%s] should be a number, got [%v]", name, value))
+}
+
+// Parse an integer parameter of a query. Numbers could be passed as strings
+func parseInt(value interface{}, name string) (int, error) {
+	switch value := value.(type) {
+	case float64:
+		return int(value), nil
+	case string:
+		result, err := strconv.Atoi(value)
+		if err == nil {
+			return result, nil
+		}
+	}
+	return 0, utils.NewIllegalQueryError(fmt.Sprintf("[%s] should be an integer, got [%v]", name, value))
+}
+
+// Parse a boolean parameter of a query. Booleans could be passed as strings
+func parseBool(value interface{}, name string) (bool, error) {
+	switch value := value.(type) {
+	case bool:
+		return value, nil
+	case string:
+		result, err := strconv.ParseBool(value)
+		if err == nil {
+			return result, nil
 		}
 	}
+	return false, utils.NewIllegalQueryError(fmt.Sprintf("[%s] should be a boolean, got [%v]", name, value))
 }
@@ -0,0 +1,145 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// patternOptions contains parameters of prefix, wildcard and regexp queries
+type patternOptions struct {
+	value           string
+	caseInsensitive bool
+	flags           string
+	boost           float64
+}
+
+func parseExistsQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, ok := rawQuery["field"].(string)
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[exists] must be provided with a [field]")
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &Clause{Condition: existsCondition(fieldName), Score: utils.FormatFloat(boost)}, nil
+}
+
+func parsePrefixQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, options, err := parsePatternOptions("prefix", rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	// Prefix of analyzed text matches terms of the field, so tsvector index could be used
+	if ctx.isTextField(fieldName) && len(options.value) > 0 {
+		indexAnalyzer, err := ctx.indexAnalyzer(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		value := options.value
+		if options.caseInsensitive {
+			value = strings.ToLower(value)
+		}
+		tsquery := utils.QuoteLiteral(quoteLexeme(value)+":*") + "::tsquery"
+		condition := fmt.Sprintf("%s @@ %s", indexAnalyzer.Vector(fieldText(fieldName)), tsquery)
+		return &Clause{Condition: condition, Score: utils.FormatFloat(options.boost)}, nil
+	}
+	return patternClause(fieldName, likeOperator(options), utils.QuoteLiteral(escapeLike(options.value)+"%"), options, ctx)
+}
+
+func parseWildcardQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, options, err := parsePatternOptions("wildcard", rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return patternClause(fieldName, likeOperator(options), utils.QuoteLiteral(wildcardToLike(options.value)), options, ctx)
+}
+
+func parseRegexpQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, options, err := parsePatternOptions("regexp", rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := convertRegexp(options.value, parseRegexpFlags(options.flags))
+	if err != nil {
+		return nil, err
+	}
+	operator := "~"
+	if options.caseInsensitive {
+		operator = "~*"
+	}
+	return patternClause(fieldName, operator, utils.QuoteLiteral(pattern), options, ctx)
+}
+
+// Parse parameters of a pattern query. Wildcard query accepts pattern as "wildcard" parameter too
+func parsePatternOptions(name string, rawQuery map[string]interface{}) (string, *patternOptions, error) {
+	var fieldName string
+	var params map[string]interface{}
+	for k, v := range rawQuery {
+		if k == "_name" {
+			continue
+		}
+		fieldName = k
+		if object, ok := v.(map[string]interface{}); ok {
+			params = object
+		} else {
+			params = map[string]interface{}{"value": v}
+		}
+	}
+	if len(fieldName) == 0 || len(rawQuery) > 1 {
+		return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query requires exactly one field", name))
+	}
+	if value, ok := params["wildcard"]; ok && name == "wildcard" {
+		params["value"] = value
+	}
+	options := &patternOptions{boost: 1, flags: "ALL"}
+	value, ok := params["value"].(string)
+	if !ok {
+		return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query requires a string value for field [%s]", name, fieldName))
+	}
+	options.value = value
+	var err error
+	for k, v := range params {
+		switch k {
+		case "boost":
+			options.boost, err = parseFloat(v, k)
+		case "case_insensitive":
+			options.caseInsensitive, err = parseBool(v, k)
+		case "flags":
+			options.flags = fmt.Sprint(v)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return fieldName, options, nil
+}
+
+// Build a clause which matches a string value of the field with a pattern. Values of analyzed text fields are split
+// into terms and any of terms should match. Other fields are matched as a whole, any value of an array should match
+func patternClause(fieldName, operator, pattern string, options *patternOptions, ctx *QueryContext) (*Clause, error) {
+	var condition string
+	switch {
+	case fieldName == "*":
+		condition = fmt.Sprintf("%s %s %s", fieldText(fieldName), operator, pattern)
+	case ctx.isTextField(fieldName):
+		indexAnalyzer, err := ctx.indexAnalyzer(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		vector := indexAnalyzer.Vector(fieldText(fieldName))
+		condition = fmt.Sprintf("EXISTS (SELECT 1 FROM unnest(tsvector_to_array(%s)) AS t(term) WHERE t.term %s %s)", vector, operator, pattern)
+	default:
+		condition = anyValue(fieldName, fmt.Sprintf("v.value #>> '{}' %s %s", operator, pattern))
+	}
+	return &Clause{Condition: condition, Score: utils.FormatFloat(options.boost)}, nil
+}
+
+// Get LIKE operator respecting case sensitivity of the query
+func likeOperator(options *patternOptions) string {
+	if options.caseInsensitive {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
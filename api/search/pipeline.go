@@ -0,0 +1,219 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pipeline aggregations which are calculated over buckets of their parent aggregation
+var pipelineAggregationTypes = map[string]bool{"bucket_sort": true, "bucket_script": true, "derivative": true, "cumulative_sum": true}
+
+// Split sub-aggregations into regular and pipeline ones. A part is nil if there are no such aggregations
+func splitPipelineAggregations(rawAggregations interface{}) (interface{}, map[string]interface{}) {
+	aggregations, ok := rawAggregations.(map[string]interface{})
+	if !ok {
+		return rawAggregations, nil
+	}
+	regular := make(map[string]interface{})
+	var pipelines map[string]interface{}
+	for name, rawBody := range aggregations {
+		body, _ := rawBody.(map[string]interface{})
+		isPipeline := false
+		for k := range body {
+			isPipeline = isPipeline || pipelineAggregationTypes[k]
+		}
+		if !isPipeline {
+			regular[name] = rawBody
+			continue
+		}
+		if pipelines == nil {
+			pipelines = make(map[string]interface{})
+		}
+		pipelines[name] = rawBody
+	}
+	if len(regular) == 0 {
+		return nil, pipelines
+	}
+	return regular, pipelines
+}
+
+// Apply pipeline aggregations to buckets of the parent aggregation. Results of pipelines are added to buckets in the
+// order of names, so they could refer to each other, bucket_sort is applied after all of them
+func (b *aggregationBuilder) pipelineAggregations(pipelines map[string]interface{}, expression string) (string, error) {
+	var names []string
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		sortI, sortJ := pipelines[names[i]].(map[string]interface{})["bucket_sort"] != nil, pipelines[names[j]].(map[string]interface{})["bucket_sort"] != nil
+		if sortI != sortJ {
+			return sortJ
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		for typeName, rawParams := range pipelines[name].(map[string]interface{}) {
+			if typeName == "meta" {
+				continue
+			}
+			if typeName == "aggs" || typeName == "aggregations" {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("Aggregator [%s] of type [%s] cannot accept sub-aggregations", name, typeName))
+			}
+			params, ok := rawParams.(map[string]interface{})
+			if !ok {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("Expected [START_OBJECT] under [%s], but got a value", typeName))
+			}
+			var err error
+			if expression, err = b.pipelineAggregation(name, typeName, params, expression); err != nil {
+				return "", err
+			}
+		}
+	}
+	return expression, nil
+}
+
+// Apply a single pipeline aggregation to buckets of the parent aggregation
+func (b *aggregationBuilder) pipelineAggregation(name, typeName string, params map[string]interface{}, expression string) (string, error) {
+	result := fmt.Sprintf("e.bucket || jsonb_build_object(%s, jsonb_build_object('value', e.value))", utils.QuoteLiteral(name))
+	switch typeName {
+	case "cumulative_sum", "derivative":
+		path, ok := params["buckets_path"].(string)
+		if !ok {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("Missing required field [buckets_path] for %s aggregation [%s]", typeName, name))
+		}
+		value, err := bucketPathValue("e.bucket", path)
+		if err != nil {
+			return "", err
+		}
+		if typeName == "cumulative_sum" {
+			return transformBuckets(expression, fmt.Sprintf("sum(coalesce(%s, 0)) OVER (ORDER BY e.position)", value), result, "TRUE", "e.position"), nil
+		}
+		// The first bucket has no derivative
+		result = fmt.Sprintf("CASE WHEN e.position > 1 THEN %s ELSE e.bucket END", result)
+		return transformBuckets(expression, fmt.Sprintf("%[1]s - lag(%[1]s) OVER (ORDER BY e.position)", value), result, "TRUE", "e.position"), nil
+	case "bucket_script":
+		rawPaths, ok := params["buckets_path"].(map[string]interface{})
+		if !ok {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("Missing required field [buckets_path] for bucket_script aggregation [%s]", name))
+		}
+		variables := make(map[string]string)
+		for variable, rawPath := range rawPaths {
+			value, err := bucketPathValue("e.bucket", fmt.Sprint(rawPath))
+			if err != nil {
+				return "", err
+			}
+			variables[variable] = value
+		}
+		source, scriptParams, err := parseScript(params["script"])
+		if err != nil {
+			return "", err
+		}
+		value, err := compileBucketScript(source, scriptParams, variables, b.ctx)
+		if err != nil {
+			return "", err
+		}
+		return transformBuckets(expression, value, result, "TRUE", "e.position"), nil
+	case "bucket_sort":
+		return bucketSortAggregation(params, expression)
+	}
+	return "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown aggregation type [%s] found in [%s]", typeName, name))
+}
+
+// Build bucket_sort aggregation which sorts buckets of the parent aggregation by bucket paths and truncates them by
+// from and size. Buckets keep their order without sort
+func bucketSortAggregation(params map[string]interface{}, expression string) (string, error) {
+	from, size := 0, -1
+	var sortFields []SortField
+	var err error
+	for k, v := range params {
+		switch k {
+		case "from":
+			from, err = parseInt(v, k)
+		case "size":
+			size, err = parseInt(v, k)
+		case "sort":
+			sortFields, err = ParseSort(v)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	var orders []string
+	for _, field := range sortFields {
+		keys, err := bucketPath(field.Field)
+		if err != nil {
+			return "", err
+		}
+		orders = append(orders, fmt.Sprintf("e.bucket #> %s %s", keys, field.SQLOrder()))
+	}
+	orders = append(orders, "e.position")
+	filter := fmt.Sprintf("e.value > %d", from)
+	if size >= 0 {
+		filter += fmt.Sprintf(" AND e.value <= %d", from+size)
+	}
+	return transformBuckets(expression, fmt.Sprintf("row_number() OVER (ORDER BY %s)", strings.Join(orders, ", ")), "e.bucket", filter, "e.value"), nil
+}
+
+// Build jsonb expression which replaces buckets of the result of an aggregation. Value is SQL expression over bucket
+// and position columns of e relation of buckets, it could be a window function. Result, filter and order of new
+// buckets are SQL over bucket, position and value columns
+func transformBuckets(expression, value, result, filter, order string) string {
+	return fmt.Sprintf("(SELECT r.result || jsonb_build_object('buckets', (SELECT coalesce(jsonb_agg(%s ORDER BY %s), '[]'::jsonb) "+
+		"FROM (SELECT e.bucket, e.position, %s AS value FROM jsonb_array_elements(r.result->'buckets') WITH ORDINALITY AS e(bucket, position)) AS e WHERE %s)) "+
+		"FROM (SELECT %s AS result) AS r)",
+		result, order, value, filter, expression)
+}
+
+// Build SQL expression of a numeric value referred by a buckets path relative to a bucket
+func bucketPathValue(bucket, path string) (string, error) {
+	keys, err := bucketPath(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s #>> %s)::float8", bucket, keys), nil
+}
+
+// Convert a buckets path like "sales", "_count", "_key", "stats.avg", "percentiles[99.0]" or "filtered>sales" into
+// SQL array of keys of the value in a bucket. Single value metrics are referred by name
+func bucketPath(path string) (string, error) {
+	parts := strings.Split(path, ">")
+	keys := parts[:len(parts)-1]
+	last := parts[len(parts)-1]
+	switch {
+	case last == "_count":
+		keys = append(keys, "doc_count")
+	case last == "_key":
+		keys = append(keys, "key")
+	case strings.HasSuffix(last, "]") && strings.Contains(last, "["):
+		i := strings.Index(last, "[")
+		keys = append(keys, last[:i], "values", percentKey(last[i+1:len(last)-1]))
+	case strings.Contains(last, "."):
+		i := strings.Index(last, ".")
+		if _, err := strconv.ParseFloat(last[i+1:], 64); err == nil {
+			keys = append(keys, last[:i], "values", percentKey(last[i+1:]))
+		} else {
+			keys = append(keys, last[:i], last[i+1:])
+		}
+	default:
+		keys = append(keys, last, "value")
+	}
+	var literals []string
+	for _, key := range keys {
+		if len(key) == 0 {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("Invalid buckets path [%s]", path))
+		}
+		literals = append(literals, utils.QuoteLiteral(key))
+	}
+	return fmt.Sprintf("ARRAY[%s]", strings.Join(literals, ", ")), nil
+}
+
+// Format a percent of a buckets path like keys of percentiles aggregation
+func percentKey(text string) string {
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return formatRangeBound(number)
+	}
+	return text
+}
@@ -0,0 +1,141 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// queryStringOptions contains parameters of query_string and simple_query_string queries
+type queryStringOptions struct {
+	query              string
+	fields             []string
+	defaultOperator    string
+	analyzer           string
+	lenient            bool
+	analyzeWildcard    bool
+	minimumShouldMatch string
+	boost              float64
+	fuzziness          string
+	tieBreaker         interface{}
+	multiMatchType     string
+	phraseSlop         int
+	flags              map[string]bool
+}
+
+func parseQueryStringQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	options, err := parseQueryStringOptions("query_string", rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	query, err := newLuceneParser(options, ctx).parse()
+	if err != nil {
+		return nil, err
+	}
+	return parseQuery(options.wrap(query), ctx)
+}
+
+func parseSimpleQueryStringQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	options, err := parseQueryStringOptions("simple_query_string", rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	query := newLuceneParser(options, ctx).parseSimple()
+	return parseQuery(options.wrap(query), ctx)
+}
+
+// Parse parameters of query_string or simple_query_string query
+func parseQueryStringOptions(name string, rawQuery map[string]interface{}) (*queryStringOptions, error) {
+	options := &queryStringOptions{defaultOperator: "or", boost: 1, fuzziness: "AUTO", multiMatchType: "best_fields"}
+	query, ok := rawQuery["query"]
+	if !ok {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] must be provided with a [query]", name))
+	}
+	options.query = fmt.Sprint(query)
+	var err error
+	for k, v := range rawQuery {
+		switch k {
+		case "default_field":
+			if len(options.fields) == 0 {
+				options.fields = []string{fmt.Sprint(v)}
+			}
+		case "fields":
+			values, ok := v.([]interface{})
+			if !ok {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] fields should be an array of strings", name))
+			}
+			options.fields = nil
+			for _, value := range values {
+				options.fields = append(options.fields, fmt.Sprint(value))
+			}
+		case "default_operator":
+			options.defaultOperator = strings.ToLower(fmt.Sprint(v))
+			if options.defaultOperator != "or" && options.defaultOperator != "and" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Unsupported default_operator [%v]", v))
+			}
+		case "analyzer":
+			options.analyzer = fmt.Sprint(v)
+		case "lenient":
+			options.lenient, err = parseBool(v, k)
+		case "analyze_wildcard":
+			options.analyzeWildcard, err = parseBool(v, k)
+		case "minimum_should_match":
+			options.minimumShouldMatch = fmt.Sprint(v)
+		case "boost":
+			options.boost, err = parseFloat(v, k)
+		case "fuzziness":
+			options.fuzziness = fmt.Sprint(v)
+		case "tie_breaker":
+			options.tieBreaker = v
+		case "type":
+			options.multiMatchType = strings.ToLower(fmt.Sprint(v))
+		case "phrase_slop":
+			options.phraseSlop, err = parseInt(v, k)
+		case "flags":
+			options.flags = parseSimpleQueryFlags(fmt.Sprint(v))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.fields) == 0 {
+		options.fields = []string{"*"}
+	}
+	return options, nil
+}
+
+// Parse flags of simple_query_string like "AND|OR|PREFIX". Unknown flags are ignored
+func parseSimpleQueryFlags(spec string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, flag := range strings.Split(strings.ToUpper(spec), "|") {
+		switch flag = strings.TrimSpace(flag); flag {
+		case "ALL":
+			return nil
+		case "NONE":
+		default:
+			flags[flag] = true
+		}
+	}
+	return flags
+}
+
+// Check if an operator of simple_query_string is enabled by flags
+func (options *queryStringOptions) enabled(flag string) bool {
+	return options.flags == nil || options.flags[flag]
+}
+
+// Apply minimum_should_match and boost of the query to parsed query
+func (options *queryStringOptions) wrap(query map[string]interface{}) map[string]interface{} {
+	if len(options.minimumShouldMatch) > 0 {
+		if body, ok := query["bool"].(map[string]interface{}); ok && body["should"] != nil {
+			body["minimum_should_match"] = options.minimumShouldMatch
+		}
+	}
+	if options.boost != 1 {
+		query = map[string]interface{}{"bool": map[string]interface{}{
+			"must":  []interface{}{query},
+			"boost": options.boost,
+		}}
+	}
+	return query
+}
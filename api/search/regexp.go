@@ -0,0 +1,192 @@
+package search
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Optional operators of ElasticSearch regular expressions
+var regexpOperators = []string{"INTERSECTION", "COMPLEMENT", "EMPTY", "ANYSTRING", "INTERVAL"}
+
+var intervalPattern = regexp.MustCompile(`^<(\d+)-(\d+)>`)
+
+// Parse flags of regexp query like "INTERVAL|ANYSTRING". Result contains enabled optional operators
+func parseRegexpFlags(spec string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, flag := range strings.Split(strings.ToUpper(spec), "|") {
+		switch flag = strings.TrimSpace(flag); flag {
+		case "ALL", "":
+			for _, operator := range regexpOperators {
+				flags[operator] = true
+			}
+		case "NONE":
+		default:
+			flags[flag] = true
+		}
+	}
+	return flags
+}
+
+// Convert ElasticSearch (Lucene) regular expression into PostgreSQL regular expression which matches the whole value.
+// Lucene expressions are always anchored, have no character class escapes like \d and support optional operators:
+// @ (any string), # (empty language), <n-m> (numeric interval), ~ (complement) and & (intersection). Complement and
+// intersection can't be expressed in PostgreSQL
+func convertRegexp(pattern string, flags map[string]bool) (string, error) {
+	var result bytes.Buffer
+	input := []rune(pattern)
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '\\':
+			if i+1 < len(input) {
+				i++
+				result.WriteString(escapeRegexpRune(input[i]))
+			}
+		case c == '"':
+			// Quoted string is a literal
+			for i++; i < len(input) && input[i] != '"'; i++ {
+				result.WriteString(escapeRegexpRune(input[i]))
+			}
+		case c == '[':
+			end, class := convertRegexpClass(input, i)
+			result.WriteString(class)
+			i = end
+		case c == '@' && flags["ANYSTRING"]:
+			result.WriteString(".*")
+		case c == '#' && flags["EMPTY"]:
+			result.WriteString("(?!x)x")
+		case c == '<' && flags["INTERVAL"] && intervalPattern.MatchString(string(input[i:])):
+			match := intervalPattern.FindStringSubmatch(string(input[i:]))
+			low, err := strconv.Atoi(match[1])
+			if err != nil {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("invalid interval [%s] in regexp [%s]", match[0], pattern))
+			}
+			high, err := strconv.Atoi(match[2])
+			if err != nil {
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("invalid interval [%s] in regexp [%s]", match[0], pattern))
+			}
+			if low > high {
+				low, high = high, low
+			}
+			result.WriteString(numberRangeRegexp(low, high))
+			i += len([]rune(match[0])) - 1
+		case c == '~' && flags["COMPLEMENT"], c == '&' && flags["INTERSECTION"]:
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("operator [%c] of regexp [%s] is not supported", c, pattern))
+		case strings.ContainsRune(".?+*{}()|", c):
+			result.WriteRune(c)
+		default:
+			result.WriteString(escapeRegexpRune(c))
+		}
+	}
+	return "^(?:" + result.String() + ")$", nil
+}
+
+// Convert a character class starting at position start. Returns position of the closing bracket and converted class
+func convertRegexpClass(input []rune, start int) (int, string) {
+	var result bytes.Buffer
+	result.WriteRune('[')
+	i := start + 1
+	if i < len(input) && input[i] == '^' {
+		result.WriteRune('^')
+		i++
+	}
+	for ; i < len(input) && (input[i] != ']' || i == start+1); i++ {
+		c := input[i]
+		switch {
+		case c == '\\' && i+1 < len(input):
+			i++
+			result.WriteString(escapeRegexpRune(input[i]))
+		case c == '-':
+			result.WriteRune(c)
+		default:
+			result.WriteString(escapeRegexpRune(c))
+		}
+	}
+	result.WriteRune(']')
+	return i, result.String()
+}
+
+// Escape a character which should be matched literally. Letters and digits are not escaped because escapes like \d
+// have special meaning in PostgreSQL
+func escapeRegexpRune(c rune) string {
+	if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c > unicode.MaxASCII {
+		return string(c)
+	}
+	return "\\" + string(c)
+}
+
+// Build a regular expression which matches decimal numbers of the interval. Leading zeros are allowed
+func numberRangeRegexp(low, high int) string {
+	var parts []string
+	start := low
+	for _, stop := range splitNumberRange(low, high) {
+		parts = append(parts, digitRangeRegexp(strconv.Itoa(start), strconv.Itoa(stop)))
+		start = stop + 1
+	}
+	return "0*(?:" + strings.Join(parts, "|") + ")"
+}
+
+// Split an interval into subintervals which bounds have the same number of digits and differ only in a tail of
+// digits, like [5-9], [10-99], [100-139]. Returns upper bounds of subintervals
+func splitNumberRange(low, high int) []int {
+	stops := map[int]bool{high: true}
+	for nines := 1; ; nines++ {
+		stop := fillByNines(low, nines)
+		if stop < low || stop >= high {
+			break
+		}
+		stops[stop] = true
+	}
+	for zeros := 1; ; zeros++ {
+		stop := fillByZeros(high+1, zeros) - 1
+		if stop <= low || stop > high {
+			break
+		}
+		stops[stop] = true
+	}
+	var result []int
+	for stop := range stops {
+		result = append(result, stop)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// Replace count of last digits of a number by nines. Number is padded by nines if it is shorter
+func fillByNines(number, count int) int {
+	digits := strconv.Itoa(number)
+	prefix := ""
+	if count < len(digits) {
+		prefix = digits[:len(digits)-count]
+	}
+	result, _ := strconv.Atoi(prefix + strings.Repeat("9", count))
+	return result
+}
+
+// Replace count of last digits of a number by zeros
+func fillByZeros(number, count int) int {
+	power := 1
+	for i := 0; i < count; i++ {
+		power *= 10
+	}
+	return number - number%power
+}
+
+// Build a regular expression for numbers between bounds of the same length, like 100-139 -> 1[0-3][0-9]
+func digitRangeRegexp(start, stop string) string {
+	var result bytes.Buffer
+	for i := range start {
+		if start[i] == stop[i] {
+			result.WriteByte(start[i])
+		} else {
+			result.WriteString(fmt.Sprintf("[%c-%c]", start[i], stop[i]))
+		}
+	}
+	return result.String()
+}
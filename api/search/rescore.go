@@ -0,0 +1,101 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// Rescorer describes a query which recalculates scores of the top WindowSize hits of a search. Score of a hit is
+// combined with the score of the rescore query by ScoreMode after multiplication by their weights
+type Rescorer struct {
+	WindowSize         int
+	Query              map[string]interface{}
+	QueryWeight        float64
+	RescoreQueryWeight float64
+	ScoreMode          string
+}
+
+// ParseRescore parses rescore of a search request. It is a rescorer like
+// {"window_size": 50, "query": {"rescore_query": {...}, "query_weight": 0.7}} or an array of them applied one after
+// another
+func ParseRescore(rawRescore interface{}) ([]Rescorer, error) {
+	rawRescorers, ok := rawRescore.([]interface{})
+	if !ok {
+		rawRescorers = []interface{}{rawRescore}
+	}
+	var rescorers []Rescorer
+	for _, rawRescorer := range rawRescorers {
+		rescorer, err := parseRescorer(rawRescorer)
+		if err != nil {
+			return nil, err
+		}
+		rescorers = append(rescorers, *rescorer)
+	}
+	return rescorers, nil
+}
+
+// Parse a single rescorer. Only query rescorer is supported
+func parseRescorer(rawRescorer interface{}) (*Rescorer, error) {
+	params, ok := rawRescorer.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[rescore] malformed, must start with start_object")
+	}
+	rescorer := &Rescorer{WindowSize: 10, QueryWeight: 1, RescoreQueryWeight: 1, ScoreMode: "total"}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "window_size":
+			rescorer.WindowSize, err = parseInt(v, k)
+		case "query":
+			err = rescorer.parseQuery(v)
+		default:
+			err = utils.NewIllegalQueryError(fmt.Sprintf("[rescore] unknown rescorer [%s]", k))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rescorer.Query == nil {
+		return nil, utils.NewIllegalQueryError("[rescore] requires 'query' to be specified")
+	}
+	if rescorer.WindowSize < 0 {
+		return nil, utils.NewIllegalQueryError("[rescore] window_size cannot be negative")
+	}
+	return rescorer, nil
+}
+
+// Parse the query rescorer with the rescore query, weights and score mode
+func (rescorer *Rescorer) parseQuery(rawQuery interface{}) error {
+	params, ok := rawQuery.(map[string]interface{})
+	if !ok {
+		return utils.NewIllegalQueryError("[query] malformed, must start with start_object")
+	}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "rescore_query":
+			if rescorer.Query, ok = v.(map[string]interface{}); !ok {
+				return utils.NewIllegalQueryError("[rescore_query] malformed, must start with start_object")
+			}
+		case "query_weight":
+			rescorer.QueryWeight, err = parseFloat(v, k)
+		case "rescore_query_weight":
+			rescorer.RescoreQueryWeight, err = parseFloat(v, k)
+		case "score_mode":
+			rescorer.ScoreMode = strings.ToLower(fmt.Sprint(v))
+			switch rescorer.ScoreMode {
+			case "total", "multiply", "avg", "max", "min":
+			default:
+				err = utils.NewIllegalQueryError(fmt.Sprintf("[rescore] illegal score_mode [%s]", rescorer.ScoreMode))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rescorer.Query == nil {
+		return utils.NewIllegalQueryError("[rescore] requires 'rescore_query' to be specified")
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// scoreScript converts an arithmetic expression of score script into SQL. It supports numbers, numeric params,
+// _score, Math functions and vector functions over dense_vector fields. Variables are SQL expressions of params of
+// bucket scripts, division by zero gives NULL in such scripts
+type scoreScript struct {
+	source    string
+	tokens    []string
+	pos       int
+	params    map[string]interface{}
+	variables map[string]string
+	score     string
+	ctx       *QueryContext
+}
+
+// SQL functions of vector functions of scripts
+var scriptVectorFunctions = map[string]string{
+	"cosineSimilarity": "pg_elastic_cosine_similarity",
+	"dotProduct":       "pg_elastic_dot_product",
+	"l1norm":           "pg_elastic_l1_distance",
+	"l2norm":           "pg_elastic_l2_distance",
+}
+
+// SQL functions of Math functions of scripts
+var scriptMathFunctions = map[string]string{
+	"Math.abs":   "abs",
+	"Math.sqrt":  "sqrt",
+	"Math.log":   "ln",
+	"Math.log10": "log",
+	"Math.exp":   "exp",
+	"Math.pow":   "power",
+	"Math.max":   "greatest",
+	"Math.min":   "least",
+}
+
+// Compile a score script into SQL expression. Score is SQL expression of _score variable
+func compileScoreScript(source string, params map[string]interface{}, score string, ctx *QueryContext) (string, error) {
+	return compileScript(&scoreScript{source: source, params: params, score: score, ctx: ctx})
+}
+
+// Compile a script of bucket_script aggregation into SQL expression. Variables are SQL expressions of values of
+// bucket paths referred as params
+func compileBucketScript(source string, params map[string]interface{}, variables map[string]string, ctx *QueryContext) (string, error) {
+	return compileScript(&scoreScript{source: source, params: params, variables: variables, score: "NULL::float8", ctx: ctx})
+}
+
+// Compile a script into SQL expression
+func compileScript(script *scoreScript) (string, error) {
+	var err error
+	if script.tokens, err = tokenizeScript(script.source); err != nil {
+		return "", err
+	}
+	// Painless scripts could contain a single return statement
+	if len(script.tokens) > 0 && script.tokens[0] == "return" {
+		script.pos++
+	}
+	expression, err := script.expression()
+	if err != nil {
+		return "", err
+	}
+	if script.peek() == ";" {
+		script.pos++
+	}
+	if script.pos < len(script.tokens) {
+		return "", script.error(fmt.Sprintf("unexpected token [%s]", script.peek()))
+	}
+	return expression, nil
+}
+
+// Split a script into numbers, identifiers, string literals and operators
+func tokenizeScript(source string) ([]string, error) {
+	var tokens []string
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case unicode.IsDigit(c) || c == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				(runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E')) {
+				i++
+			}
+			// Java suffixes of number literals are ignored
+			if i < len(runes) && strings.ContainsRune("dDfFlL", runes[i]) {
+				tokens = append(tokens, string(runes[start:i]))
+				i++
+				continue
+			}
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+		case c == '\'' || c == '"':
+			i++
+			for i < len(runes) && runes[i] != c {
+				i++
+			}
+			if i == len(runes) {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("compile error: unterminated string in script [%s]", source))
+			}
+			i++
+		case strings.ContainsRune("+-*/(),;[]", c):
+			i++
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("compile error: unexpected character [%c] in script [%s]", c, source))
+		}
+		tokens = append(tokens, string(runes[start:i]))
+	}
+	return tokens, nil
+}
+
+// Get the current token or empty string at the end of script
+func (s *scoreScript) peek() string {
+	if s.pos < len(s.tokens) {
+		return s.tokens[s.pos]
+	}
+	return ""
+}
+
+// Consume the expected token
+func (s *scoreScript) expect(token string) error {
+	if s.peek() != token {
+		return s.error(fmt.Sprintf("expected [%s] but found [%s]", token, s.peek()))
+	}
+	s.pos++
+	return nil
+}
+
+// Build an error of script compilation
+func (s *scoreScript) error(message string) error {
+	return utils.NewIllegalQueryError(fmt.Sprintf("compile error: %s in script [%s]", message, s.source))
+}
+
+// Parse sum or difference of terms
+func (s *scoreScript) expression() (string, error) {
+	result, err := s.term()
+	if err != nil {
+		return "", err
+	}
+	for s.peek() == "+" || s.peek() == "-" {
+		operator := s.peek()
+		s.pos++
+		operand, err := s.term()
+		if err != nil {
+			return "", err
+		}
+		result = fmt.Sprintf("%s %s %s", result, operator, operand)
+	}
+	return result, nil
+}
+
+// Parse product or quotient of factors. Division is always done on floating point numbers
+func (s *scoreScript) term() (string, error) {
+	result, err := s.factor()
+	if err != nil {
+		return "", err
+	}
+	for s.peek() == "*" || s.peek() == "/" {
+		operator := s.peek()
+		s.pos++
+		operand, err := s.factor()
+		if err != nil {
+			return "", err
+		}
+		if operator == "/" && s.variables != nil {
+			result = fmt.Sprintf("(%s)::float8 / nullif(%s, 0)", result, operand)
+		} else if operator == "/" {
+			result = fmt.Sprintf("(%s)::float8 / %s", result, operand)
+		} else {
+			result = fmt.Sprintf("%s * %s", result, operand)
+		}
+	}
+	return result, nil
+}
+
+// Parse a number, a variable, a function call or an expression in parentheses, optionally negated
+func (s *scoreScript) factor() (string, error) {
+	token := s.peek()
+	s.pos++
+	switch {
+	case token == "-":
+		operand, err := s.factor()
+		if err != nil {
+			return "", err
+		}
+		return "-(" + operand + ")", nil
+	case token == "(":
+		expression, err := s.expression()
+		if err != nil {
+			return "", err
+		}
+		return "(" + expression + ")", s.expect(")")
+	case token == "_score":
+		return fmt.Sprintf("(%s)", s.score), nil
+	case strings.HasPrefix(token, "params.") && len(s.variables[strings.TrimPrefix(token, "params.")]) > 0:
+		return fmt.Sprintf("(%s)", s.variables[strings.TrimPrefix(token, "params.")]), nil
+	case strings.HasPrefix(token, "params."):
+		value, err := parseFloat(s.params[strings.TrimPrefix(token, "params.")], token)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s)", utils.FormatFloat(value)), nil
+	case len(token) > 0 && (unicode.IsDigit(rune(token[0])) || token[0] == '.'):
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return "", s.error(fmt.Sprintf("illegal number [%s]", token))
+		}
+		return utils.FormatFloat(value), nil
+	}
+	if function, ok := scriptVectorFunctions[token]; ok {
+		return s.vectorFunction(token, function)
+	}
+	if function, ok := scriptMathFunctions[token]; ok {
+		args, err := s.arguments()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s)", function, strings.Join(args, ", ")), nil
+	}
+	if len(token) == 0 {
+		return "", s.error("unexpected end of script")
+	}
+	return "", s.error(fmt.Sprintf("unsupported token [%s]", token))
+}
+
+// Parse arguments of a function call
+func (s *scoreScript) arguments() ([]string, error) {
+	if err := s.expect("("); err != nil {
+		return nil, err
+	}
+	var args []string
+	for s.peek() != ")" {
+		if len(args) > 0 {
+			if err := s.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := s.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	s.pos++
+	return args, nil
+}
+
+// Parse a call of vector function like cosineSimilarity(params.query_vector, 'field'). Field could be given as
+// doc['field'] too
+func (s *scoreScript) vectorFunction(name, function string) (string, error) {
+	if err := s.expect("("); err != nil {
+		return "", err
+	}
+	param := s.peek()
+	if !strings.HasPrefix(param, "params.") {
+		return "", s.error(fmt.Sprintf("[%s] requires a query vector from params", name))
+	}
+	s.pos++
+	if err := s.expect(","); err != nil {
+		return "", err
+	}
+	docAccess := s.peek() == "doc"
+	if docAccess {
+		s.pos++
+		if err := s.expect("["); err != nil {
+			return "", err
+		}
+	}
+	fieldName := s.peek()
+	if len(fieldName) < 2 || fieldName[0] != '\'' && fieldName[0] != '"' {
+		return "", s.error(fmt.Sprintf("[%s] requires a field name", name))
+	}
+	s.pos++
+	field, err := s.ctx.vectorField(fieldName[1 : len(fieldName)-1])
+	if err != nil {
+		return "", err
+	}
+	vector, err := field.parseVector(s.params[strings.TrimPrefix(param, "params.")])
+	if err != nil {
+		return "", err
+	}
+	if docAccess {
+		if err := s.expect("]"); err != nil {
+			return "", err
+		}
+	}
+	if err := s.expect(")"); err != nil {
+		return "", err
+	}
+	return field.similarity(function, vector), nil
+}
@@ -0,0 +1,154 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// SortField is a key of search results ordering. Missing is "_last", "_first" or a value used for documents without
+// the field. Mode selects a value of multi-valued fields: min, max, sum, avg or median
+type SortField struct {
+	Field    string
+	Order    string
+	Missing  interface{}
+	Mode     string
+	geoField string
+	points   []*geoPoint
+	unit     string
+}
+
+// ParseSort parses sort of a search request. Sort could be a field name, an object {field: order},
+// an object {field: {order: order, missing: missing}} or an array of them
+func ParseSort(rawSort interface{}) ([]SortField, error) {
+	var rawFields []interface{}
+	switch rawSort := rawSort.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		rawFields = rawSort
+	default:
+		rawFields = []interface{}{rawSort}
+	}
+	var fields []SortField
+	for _, rawField := range rawFields {
+		switch rawField := rawField.(type) {
+		case string:
+			fields = append(fields, newSortField(rawField))
+		case map[string]interface{}:
+			for k, v := range rawField {
+				if k == "_geo_distance" {
+					field, err := parseGeoDistanceSort(v)
+					if err != nil {
+						return nil, err
+					}
+					fields = append(fields, field)
+					continue
+				}
+				field := newSortField(k)
+				switch v := v.(type) {
+				case string:
+					field.Order = strings.ToLower(v)
+				case map[string]interface{}:
+					if order, ok := v["order"]; ok {
+						field.Order = strings.ToLower(fmt.Sprint(order))
+					}
+					if missing, ok := v["missing"]; ok {
+						field.Missing = missing
+					}
+					if mode, ok := v["mode"]; ok {
+						field.Mode = strings.ToLower(fmt.Sprint(mode))
+					}
+				}
+				if field.Order != "asc" && field.Order != "desc" {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sort] unknown order [%s] for field [%s]", field.Order, k))
+				}
+				switch field.Mode {
+				case "", "min", "max", "sum", "avg", "median":
+				default:
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sort] unknown mode [%s] for field [%s]", field.Mode, k))
+				}
+				fields = append(fields, field)
+			}
+		default:
+			return nil, utils.NewIllegalQueryError("[sort] malformed, expected a field name or an object")
+		}
+	}
+	return fields, nil
+}
+
+// ParseURISort converts sort parameter of URI search like "date:desc,_score" into sort of a search request
+func ParseURISort(spec string) []interface{} {
+	var rawSort []interface{}
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); len(field) == 0 {
+			continue
+		}
+		if i := strings.LastIndex(field, ":"); i >= 0 {
+			rawSort = append(rawSort, map[string]interface{}{field[:i]: field[i+1:]})
+		} else {
+			rawSort = append(rawSort, field)
+		}
+	}
+	return rawSort
+}
+
+// DefaultSort returns sort of search results which don't specify it, they are sorted by relevance
+func DefaultSort() []SortField {
+	return []SortField{newSortField("_score")}
+}
+
+// Create a sort field with default order. Score is sorted in descending order, other fields in ascending
+func newSortField(name string) SortField {
+	field := SortField{Field: name, Order: "asc", Missing: "_last"}
+	if name == "_score" {
+		field.Order = "desc"
+	}
+	return field
+}
+
+// SQLOrder returns SQL ordering of the field
+func (field SortField) SQLOrder() string {
+	order := strings.ToUpper(field.Order)
+	if field.Missing == "_first" {
+		return order + " NULLS FIRST"
+	}
+	return order + " NULLS LAST"
+}
+
+// SortExpression builds jsonb expression of sort key for documents of the context. Score is SQL expression of document
+// relevance. Dates are sorted as milliseconds since epoch. Multi-valued fields are sorted by the minimal value in
+// ascending order and by the maximal value in descending order unless mode is specified
+func (ctx *QueryContext) SortExpression(field SortField, score string) string {
+	switch field.Field {
+	case "_score":
+		return fmt.Sprintf("to_jsonb(coalesce((%s)::float8, 0))", score)
+	case "_id":
+		return "to_jsonb(id)"
+	case "_doc":
+		return "NULL"
+	case "_geo_distance":
+		return field.geoDistanceExpression()
+	}
+	value := "nullif(v.value, 'null'::jsonb)"
+	if ctx.fieldType(field.Field) == "date" {
+		value = "to_jsonb(extract(epoch FROM pg_elastic_timestamp(v.value)) * 1000)"
+	}
+	var expression string
+	switch field.Mode {
+	case "sum", "avg":
+		expression = fmt.Sprintf("(SELECT to_jsonb(%s((v.value)::numeric)) FROM %s WHERE jsonb_typeof(v.value) = 'number')", field.Mode, fieldValues(field.Field))
+	case "median":
+		expression = fmt.Sprintf("(SELECT to_jsonb(percentile_cont(0.5) WITHIN GROUP (ORDER BY (v.value)::float8)) FROM %s WHERE jsonb_typeof(v.value) = 'number')", fieldValues(field.Field))
+	default:
+		order := "ASC"
+		if field.Mode == "max" || field.Mode == "" && field.Order == "desc" {
+			order = "DESC"
+		}
+		expression = fmt.Sprintf("(SELECT %[1]s FROM %[2]s WHERE %[1]s IS NOT NULL ORDER BY 1 %[3]s LIMIT 1)", value, fieldValues(field.Field), order)
+	}
+	if field.Missing != "_first" && field.Missing != "_last" && field.Missing != nil {
+		expression = fmt.Sprintf("coalesce(%s, %s)", expression, quoteJSON(field.Missing))
+	}
+	return expression
+}
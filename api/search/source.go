@@ -0,0 +1,103 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"net/url"
+	"strings"
+)
+
+// SourceFilter builds SQL expression of returned document for _source parameter of a search request. Source could be
+// a boolean, a list of field patterns or an object with includes and excludes patterns. Patterns are dotted paths with
+// wildcards. Empty expression means the whole document
+func SourceFilter(rawSource interface{}) (string, error) {
+	var includes, excludes []string
+	switch rawSource := rawSource.(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if rawSource {
+			return "", nil
+		}
+		return "NULL::jsonb", nil
+	case string, []interface{}:
+		includes = stringList(rawSource)
+	case map[string]interface{}:
+		for k, v := range rawSource {
+			switch k {
+			case "includes", "include":
+				includes = stringList(v)
+			case "excludes", "exclude":
+				excludes = stringList(v)
+			default:
+				return "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown key for a START_OBJECT in [_source]: [%s]", k))
+			}
+		}
+	default:
+		return "", utils.NewIllegalQueryError("[_source] should be a boolean, a string, an array of strings or an object")
+	}
+	if len(includes) == 0 && len(excludes) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("pg_elastic_filter_source(document, %s, %s)", likePatterns(includes), likePatterns(excludes)), nil
+}
+
+// ParseURISource converts _source parameter of URI search into _source of a search request
+func ParseURISource(spec string) interface{} {
+	switch strings.ToLower(spec) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return uriList(spec)
+}
+
+// URISource combines _source, _source_includes and _source_excludes parameters of a request into _source of a
+// request. Source is used if there are no parameters
+func URISource(params url.Values, source interface{}) interface{} {
+	if spec := params.Get("_source"); len(spec) > 0 {
+		source = ParseURISource(spec)
+	}
+	includes, excludes := params.Get("_source_includes"), params.Get("_source_excludes")
+	if len(includes) == 0 {
+		includes = params.Get("_source_include")
+	}
+	if len(excludes) == 0 {
+		excludes = params.Get("_source_exclude")
+	}
+	if len(includes) == 0 && len(excludes) == 0 {
+		return source
+	}
+	filter := make(map[string]interface{})
+	if patterns, ok := source.([]interface{}); ok {
+		filter["includes"] = patterns
+	}
+	if len(includes) > 0 {
+		filter["includes"] = uriList(includes)
+	}
+	if len(excludes) > 0 {
+		filter["excludes"] = uriList(excludes)
+	}
+	return filter
+}
+
+// Split a comma separated list of URI parameter
+func uriList(spec string) []interface{} {
+	var result []interface{}
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// SQL literal of array of LIKE patterns converted from wildcard patterns
+func likePatterns(patterns []string) string {
+	var literals []string
+	for _, pattern := range patterns {
+		literals = append(literals, utils.QuoteLiteral(wildcardToLike(pattern)))
+	}
+	return fmt.Sprintf("ARRAY[%s]::text[]", strings.Join(literals, ", "))
+}
@@ -0,0 +1,12 @@
+package search
+
+import (
+	"encoding/json"
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// Quote a value as SQL literal of JSONB type
+func quoteJSON(value interface{}) string {
+	encoded, _ := json.Marshal(value)
+	return utils.QuoteLiteral(string(encoded)) + "::jsonb"
+}
@@ -0,0 +1,647 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"strconv"
+	"strings"
+)
+
+// SQLSelect is a parsed SELECT statement of SQL endpoint. From is a pattern of searched indices. Limit is negative if
+// the statement has no LIMIT clause
+type SQLSelect struct {
+	Distinct bool
+	Items    []SQLSelectItem
+	From     string
+	Where    *sqlNode
+	GroupBy  []*sqlNode
+	Having   *sqlNode
+	OrderBy  []sqlOrder
+	Limit    int
+}
+
+// SQLSelectItem is an expression of the select list. Name is the alias of the expression or its text
+type SQLSelectItem struct {
+	Name       string
+	expression *sqlNode
+	aliased    bool
+}
+
+// Key of results ordering of a SQL statement. NullsFirst is nil if the default nulls ordering is used
+type sqlOrder struct {
+	expression *sqlNode
+	descending bool
+	nullsFirst *bool
+}
+
+// Node of a SQL expression. Name is a field name of field nodes, an operator of unary and binary nodes and a function
+// name of function nodes, value is text of literals. Args are operands of the node, Not negates predicates
+type sqlNode struct {
+	kind     string
+	name     string
+	value    string
+	args     []*sqlNode
+	not      bool
+	distinct bool
+}
+
+// Kinds of SQL expression nodes
+const (
+	sqlFieldNode    = "field"
+	sqlStringNode   = "string"
+	sqlNumberNode   = "number"
+	sqlBooleanNode  = "boolean"
+	sqlNullNode     = "null"
+	sqlStarNode     = "star"
+	sqlUnaryNode    = "unary"
+	sqlBinaryNode   = "binary"
+	sqlFunctionNode = "function"
+	sqlIsNullNode   = "is_null"
+	sqlInNode       = "in"
+	sqlBetweenNode  = "between"
+	sqlLikeNode     = "like"
+)
+
+// Token of a SQL statement. Text of quoted identifiers and strings is unquoted
+type sqlToken struct {
+	kind  string
+	text  string
+	start int
+	end   int
+}
+
+// Kinds of SQL tokens
+const (
+	sqlIdentifierToken = "identifier"
+	sqlQuotedToken     = "quoted"
+	sqlNumberToken     = "number"
+	sqlStringToken     = "string"
+	sqlSymbolToken     = "symbol"
+	sqlEndToken        = "end"
+)
+
+// Keywords which could not be used as unquoted names of fields
+var sqlReservedWords = map[string]bool{
+	"ALL": true, "AND": true, "AS": true, "ASC": true, "BETWEEN": true, "BY": true, "DESC": true, "DISTINCT": true,
+	"FALSE": true, "FROM": true, "GROUP": true, "HAVING": true, "IN": true, "IS": true, "LIKE": true, "LIMIT": true,
+	"NOT": true, "NULL": true, "NULLS": true, "OR": true, "ORDER": true, "SELECT": true, "TRUE": true, "WHERE": true,
+}
+
+// Symbols of SQL statements, longer symbols go first
+var sqlSymbols = []string{"<>", "!=", "<=", ">=", "||", "(", ")", ",", "*", "+", "-", "/", "%", "=", "<", ">", ";"}
+
+// Parser of SQL statements
+type sqlParser struct {
+	query    string
+	tokens   []sqlToken
+	position int
+}
+
+// ParseSQL parses a SELECT statement of SQL endpoint. Only a single SELECT over indices is allowed, so the statement
+// could not refer to anything but fields of documents
+func ParseSQL(query string) (*SQLSelect, error) {
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{query: query, tokens: tokens}
+	statement, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != sqlEndToken {
+		return nil, p.unexpected()
+	}
+	return statement, nil
+}
+
+// SelectsAll checks if the select list has star, which selects all fields
+func (statement *SQLSelect) SelectsAll() bool {
+	for _, item := range statement.Items {
+		if item.expression.kind == sqlStarNode {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a SQL statement into tokens
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case isSQLNameChar(c) && c != '.' && (c < '0' || c > '9'):
+			start := i
+			for i < len(query) && isSQLNameChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlIdentifierToken, query[start:i], start, i})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			start := i
+			for i < len(query) && (query[i] >= '0' && query[i] <= '9' || query[i] == '.') {
+				i++
+			}
+			if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+				i++
+				if i < len(query) && (query[i] == '+' || query[i] == '-') {
+					i++
+				}
+				for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+					i++
+				}
+			}
+			if _, err := strconv.ParseFloat(query[start:i], 64); err != nil {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] malformed number [%s]", query[start:i]))
+			}
+			tokens = append(tokens, sqlToken{sqlNumberToken, query[start:i], start, i})
+		case c == '\'' || c == '"' || c == '`':
+			start := i
+			var text []byte
+			for i++; ; i++ {
+				if i >= len(query) {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] unterminated quoted text at position %d", start))
+				}
+				if query[i] == c {
+					// Quote characters are escaped by doubling them
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+				text = append(text, query[i])
+			}
+			i++
+			kind := sqlQuotedToken
+			if c == '\'' {
+				kind = sqlStringToken
+			}
+			tokens = append(tokens, sqlToken{kind, string(text), start, i})
+		default:
+			symbol := ""
+			for _, s := range sqlSymbols {
+				if strings.HasPrefix(query[i:], s) {
+					symbol = s
+					break
+				}
+			}
+			if len(symbol) == 0 {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] unexpected character [%c] at position %d", c, i))
+			}
+			tokens = append(tokens, sqlToken{sqlSymbolToken, symbol, i, i + len(symbol)})
+			i += len(symbol)
+		}
+	}
+	return append(tokens, sqlToken{sqlEndToken, "", len(query), len(query)}), nil
+}
+
+// Check if the character could be a part of an unquoted name. Dots separate names of object fields
+func isSQLNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '@' || c == '.'
+}
+
+// Parse SELECT statement
+func (p *sqlParser) parseSelect() (*SQLSelect, error) {
+	statement := &SQLSelect{Limit: -1}
+	if !p.acceptKeyword("SELECT") {
+		return nil, utils.NewIllegalQueryError("[sql] only SELECT statements are supported")
+	}
+	if p.acceptKeyword("DISTINCT") {
+		statement.Distinct = true
+	} else {
+		p.acceptKeyword("ALL")
+	}
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		statement.Items = append(statement.Items, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if !p.acceptKeyword("FROM") {
+		return nil, p.unexpected()
+	}
+	from, err := p.parseIndexPattern()
+	if err != nil {
+		return nil, err
+	}
+	statement.From = from
+	if p.acceptKeyword("WHERE") {
+		if statement.Where, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeywords("GROUP", "BY") {
+		if statement.GroupBy, err = p.parseExpressionList(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("HAVING") {
+		if statement.Having, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeywords("ORDER", "BY") {
+		for {
+			order, err := p.parseOrder()
+			if err != nil {
+				return nil, err
+			}
+			statement.OrderBy = append(statement.OrderBy, order)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		token := p.next()
+		limit, err := strconv.Atoi(token.text)
+		if token.kind != sqlNumberToken || err != nil {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] LIMIT requires a non-negative integer, got [%s]", token.text))
+		}
+		statement.Limit = limit
+	}
+	return statement, nil
+}
+
+// Parse an expression of the select list with its optional alias
+func (p *sqlParser) parseSelectItem() (SQLSelectItem, error) {
+	start := p.peek().start
+	if p.acceptSymbol("*") {
+		return SQLSelectItem{Name: "*", expression: &sqlNode{kind: sqlStarNode}}, nil
+	}
+	expression, err := p.parseExpression()
+	if err != nil {
+		return SQLSelectItem{}, err
+	}
+	item := SQLSelectItem{Name: p.query[start:p.tokens[p.position-1].end], expression: expression}
+	if expression.kind == sqlFieldNode {
+		item.Name = expression.name
+	}
+	explicit := p.acceptKeyword("AS")
+	if token := p.peek(); token.kind == sqlQuotedToken || token.kind == sqlIdentifierToken && !isReservedSQLWord(token.text) {
+		item.Name = p.next().text
+		item.aliased = true
+	} else if explicit {
+		return SQLSelectItem{}, p.unexpected()
+	}
+	return item, nil
+}
+
+// Parse a pattern of indices in FROM clause. Unquoted patterns could contain wildcards
+func (p *sqlParser) parseIndexPattern() (string, error) {
+	token := p.peek()
+	switch {
+	case token.kind == sqlQuotedToken:
+		p.position++
+		return token.text, nil
+	case token.kind == sqlIdentifierToken && !isReservedSQLWord(token.text), token.kind == sqlSymbolToken && token.text == "*":
+		pattern := ""
+		end := token.start
+		for token = p.peek(); token.start == end && (token.kind == sqlIdentifierToken || token.kind == sqlSymbolToken && (token.text == "*" || token.text == "-")); token = p.peek() {
+			pattern += token.text
+			end = token.end
+			p.position++
+		}
+		return pattern, nil
+	}
+	return "", p.unexpected()
+}
+
+// Parse a key of ordering: expression [ASC | DESC] [NULLS FIRST | NULLS LAST]
+func (p *sqlParser) parseOrder() (sqlOrder, error) {
+	expression, err := p.parseExpression()
+	if err != nil {
+		return sqlOrder{}, err
+	}
+	order := sqlOrder{expression: expression}
+	if p.acceptKeyword("DESC") {
+		order.descending = true
+	} else {
+		p.acceptKeyword("ASC")
+	}
+	if p.acceptKeyword("NULLS") {
+		var first bool
+		switch {
+		case p.acceptKeyword("FIRST"):
+			first = true
+		case p.acceptKeyword("LAST"):
+		default:
+			return sqlOrder{}, p.unexpected()
+		}
+		order.nullsFirst = &first
+	}
+	return order, nil
+}
+
+// Parse a comma separated list of expressions
+func (p *sqlParser) parseExpressionList() ([]*sqlNode, error) {
+	var list []*sqlNode
+	for {
+		expression, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, expression)
+		if !p.acceptSymbol(",") {
+			return list, nil
+		}
+	}
+}
+
+// Parse an expression. OR has the lowest precedence
+func (p *sqlParser) parseExpression() (*sqlNode, error) {
+	left, err := p.parseConjunction()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseConjunction()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlNode{kind: sqlBinaryNode, name: "OR", args: []*sqlNode{left, right}}
+	}
+	return left, nil
+}
+
+// Parse expressions joined by AND
+func (p *sqlParser) parseConjunction() (*sqlNode, error) {
+	left, err := p.parseNegation()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNegation()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlNode{kind: sqlBinaryNode, name: "AND", args: []*sqlNode{left, right}}
+	}
+	return left, nil
+}
+
+// Parse an expression negated by NOT
+func (p *sqlParser) parseNegation() (*sqlNode, error) {
+	if p.acceptKeyword("NOT") {
+		operand, err := p.parseNegation()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlNode{kind: sqlUnaryNode, name: "NOT", args: []*sqlNode{operand}}, nil
+	}
+	return p.parsePredicate()
+}
+
+// Parse a comparison or a predicate: IS [NOT] NULL, [NOT] IN, [NOT] BETWEEN, [NOT] LIKE
+func (p *sqlParser) parsePredicate() (*sqlNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind == sqlSymbolToken {
+		switch token.text {
+		case "=", "<>", "!=", "<", "<=", ">", ">=":
+			p.position++
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			operator := token.text
+			if operator == "!=" {
+				operator = "<>"
+			}
+			return &sqlNode{kind: sqlBinaryNode, name: operator, args: []*sqlNode{left, right}}, nil
+		}
+	}
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") {
+			return nil, p.unexpected()
+		}
+		return &sqlNode{kind: sqlIsNullNode, args: []*sqlNode{left}, not: not}, nil
+	}
+	not := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("IN"):
+		if !p.acceptSymbol("(") {
+			return nil, p.unexpected()
+		}
+		list, err := p.parseExpressionList()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptSymbol(")") {
+			return nil, p.unexpected()
+		}
+		return &sqlNode{kind: sqlInNode, args: append([]*sqlNode{left}, list...), not: not}, nil
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptKeyword("AND") {
+			return nil, p.unexpected()
+		}
+		high, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlNode{kind: sqlBetweenNode, args: []*sqlNode{left, low, high}, not: not}, nil
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlNode{kind: sqlLikeNode, args: []*sqlNode{left, pattern}, not: not}, nil
+	case not:
+		return nil, p.unexpected()
+	}
+	return left, nil
+}
+
+// Parse operands joined by +, - and ||
+func (p *sqlParser) parseAdditive() (*sqlNode, error) {
+	return p.parseBinary([]string{"+", "-", "||"}, p.parseMultiplicative)
+}
+
+// Parse operands joined by *, / and %
+func (p *sqlParser) parseMultiplicative() (*sqlNode, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+// Parse left-associative binary operators of the same precedence
+func (p *sqlParser) parseBinary(operators []string, parseOperand func() (*sqlNode, error)) (*sqlNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := ""
+		for _, o := range operators {
+			if p.acceptSymbol(o) {
+				operator = o
+				break
+			}
+		}
+		if len(operator) == 0 {
+			return left, nil
+		}
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlNode{kind: sqlBinaryNode, name: operator, args: []*sqlNode{left, right}}
+	}
+}
+
+// Parse an operand with unary sign
+func (p *sqlParser) parseUnary() (*sqlNode, error) {
+	for _, sign := range []string{"-", "+"} {
+		if p.acceptSymbol(sign) {
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &sqlNode{kind: sqlUnaryNode, name: sign, args: []*sqlNode{operand}}, nil
+		}
+	}
+	return p.parsePrimary()
+}
+
+// Parse a literal, a field, a function call or a parenthesized expression
+func (p *sqlParser) parsePrimary() (*sqlNode, error) {
+	token := p.peek()
+	switch token.kind {
+	case sqlNumberToken:
+		p.position++
+		return &sqlNode{kind: sqlNumberNode, value: token.text}, nil
+	case sqlStringToken:
+		p.position++
+		return &sqlNode{kind: sqlStringNode, value: token.text}, nil
+	case sqlQuotedToken:
+		p.position++
+		return &sqlNode{kind: sqlFieldNode, name: token.text}, nil
+	case sqlSymbolToken:
+		if p.acceptSymbol("(") {
+			expression, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if !p.acceptSymbol(")") {
+				return nil, p.unexpected()
+			}
+			return expression, nil
+		}
+	case sqlIdentifierToken:
+		switch strings.ToUpper(token.text) {
+		case "TRUE", "FALSE":
+			p.position++
+			return &sqlNode{kind: sqlBooleanNode, value: strings.ToLower(token.text)}, nil
+		case "NULL":
+			p.position++
+			return &sqlNode{kind: sqlNullNode}, nil
+		}
+		if isReservedSQLWord(token.text) {
+			break
+		}
+		p.position++
+		if !p.acceptSymbol("(") {
+			return &sqlNode{kind: sqlFieldNode, name: token.text}, nil
+		}
+		return p.parseFunctionArguments(strings.ToUpper(token.text))
+	}
+	return nil, p.unexpected()
+}
+
+// Parse arguments of a function call after opening parenthesis
+func (p *sqlParser) parseFunctionArguments(name string) (*sqlNode, error) {
+	function := &sqlNode{kind: sqlFunctionNode, name: name}
+	if p.acceptSymbol(")") {
+		return function, nil
+	}
+	if p.acceptSymbol("*") {
+		function.args = []*sqlNode{{kind: sqlStarNode}}
+	} else {
+		function.distinct = p.acceptKeyword("DISTINCT")
+		args, err := p.parseExpressionList()
+		if err != nil {
+			return nil, err
+		}
+		function.args = args
+	}
+	if !p.acceptSymbol(")") {
+		return nil, p.unexpected()
+	}
+	return function, nil
+}
+
+// Get the current token
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.position]
+}
+
+// Get the current token and move to the next one
+func (p *sqlParser) next() sqlToken {
+	token := p.tokens[p.position]
+	if token.kind != sqlEndToken {
+		p.position++
+	}
+	return token
+}
+
+// Skip the current token if it is the symbol
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if token := p.peek(); token.kind == sqlSymbolToken && token.text == symbol {
+		p.position++
+		return true
+	}
+	return false
+}
+
+// Skip the current token if it is the keyword
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if token := p.peek(); token.kind == sqlIdentifierToken && strings.EqualFold(token.text, keyword) {
+		p.position++
+		return true
+	}
+	return false
+}
+
+// Skip the sequence of keywords if all of them are the next tokens
+func (p *sqlParser) acceptKeywords(keywords ...string) bool {
+	position := p.position
+	for _, keyword := range keywords {
+		if !p.acceptKeyword(keyword) {
+			p.position = position
+			return false
+		}
+	}
+	return true
+}
+
+// Build an error about unexpected current token
+func (p *sqlParser) unexpected() error {
+	token := p.peek()
+	if token.kind == sqlEndToken {
+		return utils.NewIllegalQueryError("[sql] unexpected end of statement")
+	}
+	return utils.NewIllegalQueryError(fmt.Sprintf("[sql] unexpected [%s] at position %d", p.query[token.start:token.end], token.start))
+}
+
+// Check if the word is a reserved keyword
+func isReservedSQLWord(word string) bool {
+	return sqlReservedWords[strings.ToUpper(word)]
+}
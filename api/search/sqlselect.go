@@ -0,0 +1,540 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"strconv"
+	"strings"
+)
+
+// SQLColumn is a column of results of SQL query
+type SQLColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Translated SQL expression. Type is a mapping type, "datetime", "null" or empty for values of unmapped fields, which
+// are kept as jsonb. Typed values of fields are calculated from their raw jsonb values, so fields grouped by their raw
+// values could be used in any expression of grouped statement
+type sqlValue struct {
+	expression string
+	typeName   string
+}
+
+// Translator of SQL statements. Where is set while the WHERE clause is translated, aggregate is set inside of
+// aggregate functions
+type sqlTranslator struct {
+	ctx        *QueryContext
+	items      []SQLSelectItem
+	aggregated bool
+	where      bool
+	aggregate  bool
+}
+
+// Format of datetime values in results of SQL queries
+const sqlDatetimeFormat = `YYYY-MM-DD"T"HH24:MI:SS.MS"Z"`
+
+// TranslateSQL converts a SELECT statement into a query over documents of the context. Star of the select list is
+// expanded into the fields. Sources, offset and limit of the query are not set
+func (ctx *QueryContext) TranslateSQL(statement *SQLSelect, fields []string) (*db.SQLQuery, []SQLColumn, error) {
+	t := &sqlTranslator{ctx: ctx}
+	for _, item := range statement.Items {
+		if item.expression.kind != sqlStarNode {
+			t.items = append(t.items, item)
+			continue
+		}
+		for _, field := range fields {
+			t.items = append(t.items, SQLSelectItem{Name: field, expression: &sqlNode{kind: sqlFieldNode, name: field}})
+		}
+	}
+	if len(t.items) == 0 {
+		return nil, nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] no fields to select from [%s]", statement.From))
+	}
+	query := &db.SQLQuery{Distinct: statement.Distinct, Limit: -1}
+	var columns []SQLColumn
+	for _, item := range t.items {
+		value, err := t.translate(item.expression)
+		if err != nil {
+			return nil, nil, err
+		}
+		query.Columns = append(query.Columns, value.output())
+		columns = append(columns, SQLColumn{Name: item.Name, Type: sqlColumnType(value.typeName)})
+	}
+	if statement.Where != nil {
+		t.where = true
+		condition, err := t.translate(statement.Where)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.where = false
+		query.Condition = condition.as("boolean")
+	}
+	for _, node := range statement.GroupBy {
+		key, err := t.groupKey(node)
+		if err != nil {
+			return nil, nil, err
+		}
+		query.GroupBy = append(query.GroupBy, key)
+	}
+	if statement.Having != nil {
+		condition, err := t.translate(statement.Having)
+		if err != nil {
+			return nil, nil, err
+		}
+		query.Having = condition.as("boolean")
+	}
+	ordered := make(map[int]bool)
+	for _, order := range statement.OrderBy {
+		expression, position, err := t.orderKey(order.expression, query.Columns)
+		if err != nil {
+			return nil, nil, err
+		}
+		ordered[position] = true
+		direction := "ASC"
+		if order.descending {
+			direction = "DESC"
+		}
+		nulls := ""
+		if order.nullsFirst != nil && *order.nullsFirst {
+			nulls = " NULLS FIRST"
+		} else if order.nullsFirst != nil {
+			nulls = " NULLS LAST"
+		}
+		query.Order = append(query.Order, expression+" "+direction+nulls)
+	}
+	// Pages of results are selected by offset, so rows should be ordered completely
+	if statement.Distinct || t.aggregated || len(statement.GroupBy) > 0 {
+		for i := range query.Columns {
+			if !ordered[i] {
+				query.Order = append(query.Order, strconv.Itoa(i+1))
+			}
+		}
+	} else {
+		query.Order = append(query.Order, "_index", "_type", "id")
+	}
+	return query, columns, nil
+}
+
+// Translate a key of grouping. Fields are grouped by their raw values, other expressions by their typed values
+func (t *sqlTranslator) groupKey(node *sqlNode) (string, error) {
+	if position, ok, err := t.itemPosition(node); err != nil {
+		return "", err
+	} else if ok {
+		node = t.items[position].expression
+	}
+	if node.kind == sqlFieldNode {
+		return t.field(node.name, true).expression, nil
+	}
+	value, err := t.translate(node)
+	if err != nil {
+		return "", err
+	}
+	return value.expression, nil
+}
+
+// Translate a key of ordering. Keys equal to columns refer to them by position, which is returned too. Position is
+// negative for other keys
+func (t *sqlTranslator) orderKey(node *sqlNode, columns []string) (string, int, error) {
+	position, ok, err := t.itemPosition(node)
+	if err != nil {
+		return "", -1, err
+	}
+	if ok {
+		return strconv.Itoa(position + 1), position, nil
+	}
+	value, err := t.translate(node)
+	if err != nil {
+		return "", -1, err
+	}
+	for i, column := range columns {
+		if column == value.output() {
+			return strconv.Itoa(i + 1), i, nil
+		}
+	}
+	return value.expression, -1, nil
+}
+
+// Find an item of the select list referred by the node by its position or its alias
+func (t *sqlTranslator) itemPosition(node *sqlNode) (int, bool, error) {
+	switch node.kind {
+	case sqlNumberNode:
+		position, err := strconv.Atoi(node.value)
+		if err != nil || position < 1 || position > len(t.items) {
+			return -1, false, utils.NewIllegalQueryError(fmt.Sprintf("[sql] position [%s] is not in select list", node.value))
+		}
+		return position - 1, true, nil
+	case sqlFieldNode:
+		for i, item := range t.items {
+			if item.aliased && item.Name == node.name {
+				return i, true, nil
+			}
+		}
+	}
+	return -1, false, nil
+}
+
+// Translate an expression node
+func (t *sqlTranslator) translate(node *sqlNode) (sqlValue, error) {
+	switch node.kind {
+	case sqlFieldNode:
+		return t.field(node.name, false), nil
+	case sqlStringNode:
+		return sqlValue{utils.QuoteLiteral(node.value), "keyword"}, nil
+	case sqlNumberNode:
+		if strings.ContainsAny(node.value, ".eE") {
+			return sqlValue{node.value, "double"}, nil
+		}
+		return sqlValue{node.value, "long"}, nil
+	case sqlBooleanNode:
+		return sqlValue{node.value, "boolean"}, nil
+	case sqlNullNode:
+		return sqlValue{"NULL", "null"}, nil
+	case sqlStarNode:
+		return sqlValue{}, utils.NewIllegalQueryError("[sql] [*] is allowed only in select list and COUNT(*)")
+	case sqlFunctionNode:
+		return t.function(node)
+	}
+	args, err := t.translateAll(node.args)
+	if err != nil {
+		return sqlValue{}, err
+	}
+	not := ""
+	if node.not {
+		not = "NOT "
+	}
+	switch node.kind {
+	case sqlUnaryNode:
+		if node.name == "NOT" {
+			return sqlValue{fmt.Sprintf("(NOT %s)", args[0].as("boolean")), "boolean"}, nil
+		}
+		return sqlValue{fmt.Sprintf("(%s%s)", node.name, args[0].as("numeric")), numericType(args[0])}, nil
+	case sqlBinaryNode:
+		return t.binary(node.name, args[0], args[1]), nil
+	case sqlIsNullNode:
+		category := sqlCategory(args[0].typeName)
+		if category == "" {
+			category = "text"
+		}
+		return sqlValue{fmt.Sprintf("(%s IS %sNULL)", args[0].as(category), not), "boolean"}, nil
+	case sqlInNode:
+		category := commonCategory(args)
+		var list []string
+		for _, arg := range args[1:] {
+			list = append(list, arg.as(category))
+		}
+		return sqlValue{fmt.Sprintf("(%s %sIN (%s))", args[0].as(category), not, strings.Join(list, ", ")), "boolean"}, nil
+	case sqlBetweenNode:
+		category := commonCategory(args)
+		return sqlValue{fmt.Sprintf("(%s %sBETWEEN %s AND %s)", args[0].as(category), not, args[1].as(category), args[2].as(category)), "boolean"}, nil
+	case sqlLikeNode:
+		return sqlValue{fmt.Sprintf("(%s %sLIKE %s)", args[0].as("text"), not, args[1].as("text")), "boolean"}, nil
+	}
+	return sqlValue{}, utils.NewInternalError(fmt.Sprintf("unknown SQL expression [%s]", node.kind))
+}
+
+// Translate all nodes of the list
+func (t *sqlTranslator) translateAll(nodes []*sqlNode) ([]sqlValue, error) {
+	var values []sqlValue
+	for _, node := range nodes {
+		value, err := t.translate(node)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Translate a field. Meta fields are columns of documents relation. Raw value of a field is its jsonb value, otherwise
+// the value is converted to the type of the field mapping
+func (t *sqlTranslator) field(name string, raw bool) sqlValue {
+	switch name {
+	case "_id":
+		return sqlValue{"id", "keyword"}
+	case "_index", "_type":
+		return sqlValue{name, "keyword"}
+	}
+	value := "(document"
+	for _, key := range strings.Split(name, ".") {
+		value += " -> " + utils.QuoteLiteral(key)
+	}
+	value += ")"
+	fieldMapping, ok := utils.GetFieldMapping(t.ctx.Mapping, name)
+	if raw || !ok || len(fieldMapping.TypeName) == 0 {
+		return sqlValue{value, ""}
+	}
+	typeName := fieldMapping.TypeName
+	switch {
+	case typeName == "date" || typeName == "date_nanos":
+		typeName = "datetime"
+	case typeName == "object" || typeName == "nested":
+		return sqlValue{value, ""}
+	}
+	return sqlValue{value, ""}.convert(sqlCategory(typeName), typeName)
+}
+
+// Translate a binary operator
+func (t *sqlTranslator) binary(operator string, left, right sqlValue) sqlValue {
+	switch operator {
+	case "AND", "OR":
+		return sqlValue{fmt.Sprintf("(%s %s %s)", left.as("boolean"), operator, right.as("boolean")), "boolean"}
+	case "||":
+		return sqlValue{fmt.Sprintf("((%s)::text || (%s)::text)", left.as("text"), right.as("text")), "keyword"}
+	case "+", "-", "*", "/", "%":
+		typeName := "double"
+		if operator != "/" && isIntegerType(numericType(left)) && isIntegerType(numericType(right)) {
+			typeName = "long"
+		}
+		return sqlValue{fmt.Sprintf("(%s %s %s)", left.as("numeric"), operator, right.as("numeric")), typeName}
+	}
+	category := commonCategory([]sqlValue{left, right})
+	return sqlValue{fmt.Sprintf("(%s %s %s)", left.as(category), operator, right.as(category)), "boolean"}
+}
+
+// Translate a function call. Aggregate functions are not allowed in WHERE clause and inside of other aggregates
+func (t *sqlTranslator) function(node *sqlNode) (sqlValue, error) {
+	switch node.name {
+	case "COUNT", "SUM", "AVG", "MIN", "MAX":
+		if t.where || t.aggregate {
+			return sqlValue{}, utils.NewIllegalQueryError(fmt.Sprintf("[sql] aggregate function [%s] is not allowed here", node.name))
+		}
+		if len(node.args) != 1 {
+			return sqlValue{}, sqlArgumentsError(node.name, "1")
+		}
+		t.aggregated = true
+		if node.args[0].kind == sqlStarNode {
+			if node.name != "COUNT" {
+				return sqlValue{}, utils.NewIllegalQueryError(fmt.Sprintf("[sql] [*] is not allowed in [%s]", node.name))
+			}
+			return sqlValue{"count(*)", "long"}, nil
+		}
+		t.aggregate = true
+		arg, err := t.translate(node.args[0])
+		t.aggregate = false
+		if err != nil {
+			return sqlValue{}, err
+		}
+		distinct := ""
+		if node.distinct {
+			distinct = "DISTINCT "
+		}
+		switch node.name {
+		case "COUNT":
+			if sqlCategory(arg.typeName) == "" {
+				return sqlValue{fmt.Sprintf("count(%snullif(%s, 'null'::jsonb))", distinct, arg.expression), "long"}, nil
+			}
+			return sqlValue{fmt.Sprintf("count(%s%s)", distinct, arg.expression), "long"}, nil
+		case "SUM":
+			typeName := "double"
+			if isIntegerType(numericType(arg)) {
+				typeName = "long"
+			}
+			return sqlValue{fmt.Sprintf("sum(%s%s)", distinct, arg.as("numeric")), typeName}, nil
+		case "AVG":
+			return sqlValue{fmt.Sprintf("avg(%s%s)", distinct, arg.as("numeric")), "double"}, nil
+		}
+		if category := sqlCategory(arg.typeName); category == "" || category == "null" {
+			arg = sqlValue{arg.as("numeric"), "double"}
+		}
+		return sqlValue{fmt.Sprintf("%s(%s%s)", strings.ToLower(node.name), distinct, arg.expression), arg.typeName}, nil
+	case "MATCH", "QUERY":
+		return t.fullTextFunction(node)
+	}
+	if node.distinct {
+		return sqlValue{}, utils.NewIllegalQueryError(fmt.Sprintf("[sql] DISTINCT is not allowed in [%s]", node.name))
+	}
+	args, err := t.translateAll(node.args)
+	if err != nil {
+		return sqlValue{}, err
+	}
+	switch node.name {
+	case "LOWER", "UPPER", "LENGTH":
+		if len(args) != 1 {
+			return sqlValue{}, sqlArgumentsError(node.name, "1")
+		}
+		if node.name == "LENGTH" {
+			return sqlValue{fmt.Sprintf("length(%s)", args[0].as("text")), "integer"}, nil
+		}
+		return sqlValue{fmt.Sprintf("%s(%s)", strings.ToLower(node.name), args[0].as("text")), "keyword"}, nil
+	case "ABS":
+		if len(args) != 1 {
+			return sqlValue{}, sqlArgumentsError(node.name, "1")
+		}
+		return sqlValue{fmt.Sprintf("abs(%s)", args[0].as("numeric")), numericType(args[0])}, nil
+	case "ROUND", "FLOOR", "CEIL", "CEILING":
+		if len(args) == 2 && node.name == "ROUND" {
+			return sqlValue{fmt.Sprintf("round(%s, (%s)::integer)", args[0].as("numeric"), args[1].as("numeric")), "double"}, nil
+		}
+		if len(args) != 1 {
+			return sqlValue{}, sqlArgumentsError(node.name, "1")
+		}
+		return sqlValue{fmt.Sprintf("%s(%s)", strings.ToLower(node.name), args[0].as("numeric")), "long"}, nil
+	case "COALESCE":
+		if len(args) == 0 {
+			return sqlValue{}, sqlArgumentsError(node.name, "at least 1")
+		}
+		category := commonCategory(args)
+		typeName := ""
+		var list []string
+		for _, arg := range args {
+			list = append(list, arg.as(category))
+			if len(typeName) == 0 && sqlCategory(arg.typeName) == category {
+				typeName = arg.typeName
+			}
+		}
+		return sqlValue{fmt.Sprintf("coalesce(%s)", strings.Join(list, ", ")), typeName}, nil
+	case "CONCAT":
+		var list []string
+		for _, arg := range args {
+			list = append(list, fmt.Sprintf("(%s)::text", arg.as("text")))
+		}
+		return sqlValue{fmt.Sprintf("concat(%s)", strings.Join(list, ", ")), "keyword"}, nil
+	case "YEAR", "MONTH", "DAY", "HOUR", "MINUTE":
+		if len(args) != 1 {
+			return sqlValue{}, sqlArgumentsError(node.name, "1")
+		}
+		return sqlValue{fmt.Sprintf("extract(%s FROM (%s) AT TIME ZONE 'UTC')::integer", strings.ToLower(node.name), args[0].as("datetime")), "integer"}, nil
+	}
+	return sqlValue{}, utils.NewIllegalQueryError(fmt.Sprintf("[sql] unknown function [%s]", node.name))
+}
+
+// Translate full-text search function. MATCH(fields, text) is converted into match query or into multi_match query if
+// several comma separated fields are given, QUERY(text) is converted into query_string query
+func (t *sqlTranslator) fullTextFunction(node *sqlNode) (sqlValue, error) {
+	var rawQuery map[string]interface{}
+	if node.name == "QUERY" {
+		if len(node.args) != 1 || node.args[0].kind != sqlStringNode {
+			return sqlValue{}, utils.NewIllegalQueryError("[sql] QUERY requires a query string")
+		}
+		rawQuery = map[string]interface{}{"query_string": map[string]interface{}{"query": node.args[0].value}}
+	} else {
+		if len(node.args) != 2 || node.args[1].kind != sqlStringNode {
+			return sqlValue{}, utils.NewIllegalQueryError("[sql] MATCH requires fields and a text")
+		}
+		var fields []interface{}
+		switch field := node.args[0]; field.kind {
+		case sqlFieldNode:
+			fields = append(fields, field.name)
+		case sqlStringNode:
+			for _, name := range strings.Split(field.value, ",") {
+				fields = append(fields, strings.TrimSpace(name))
+			}
+		default:
+			return sqlValue{}, utils.NewIllegalQueryError("[sql] MATCH requires a field or a list of fields")
+		}
+		text := node.args[1].value
+		if len(fields) == 1 {
+			rawQuery = map[string]interface{}{"match": map[string]interface{}{fields[0].(string): map[string]interface{}{"query": text}}}
+		} else {
+			rawQuery = map[string]interface{}{"multi_match": map[string]interface{}{"query": text, "fields": fields}}
+		}
+	}
+	clause, err := parseQuery(rawQuery, t.ctx)
+	if err != nil {
+		return sqlValue{}, err
+	}
+	return sqlValue{fmt.Sprintf("(%s)", clause.Condition), "boolean"}, nil
+}
+
+// Get SQL expression of the value converted to the category
+func (v sqlValue) as(category string) string {
+	current := sqlCategory(v.typeName)
+	switch {
+	case current == category || category == "" || current == "null":
+		return v.expression
+	case current == "":
+		return v.convert(category, "").expression
+	case category == "datetime":
+		// Values are converted to dates like values of date fields
+		return fmt.Sprintf("pg_elastic_timestamp(%s)", v.output())
+	}
+	return v.expression
+}
+
+// Convert jsonb value to the category. Values of other JSON types are treated as nulls
+func (v sqlValue) convert(category, typeName string) sqlValue {
+	switch category {
+	case "numeric":
+		return sqlValue{fmt.Sprintf("CASE WHEN jsonb_typeof(%[1]s) = 'number' THEN (%[1]s #>> '{}')::numeric END", v.expression), typeName}
+	case "boolean":
+		return sqlValue{fmt.Sprintf("CASE WHEN jsonb_typeof(%[1]s) = 'boolean' THEN (%[1]s #>> '{}')::boolean END", v.expression), typeName}
+	case "datetime":
+		return sqlValue{fmt.Sprintf("pg_elastic_timestamp(%s)", v.expression), typeName}
+	}
+	return sqlValue{fmt.Sprintf("(%s #>> '{}')", v.expression), typeName}
+}
+
+// Get jsonb expression of the value used in results. Dates are formatted in UTC
+func (v sqlValue) output() string {
+	switch sqlCategory(v.typeName) {
+	case "":
+		return v.expression
+	case "null":
+		return "NULL::jsonb"
+	case "numeric":
+		return fmt.Sprintf("to_jsonb((%s)::numeric)", v.expression)
+	case "boolean":
+		return fmt.Sprintf("to_jsonb((%s)::boolean)", v.expression)
+	case "datetime":
+		return fmt.Sprintf("to_jsonb(to_char((%s) AT TIME ZONE 'UTC', %s))", v.expression, utils.QuoteLiteral(sqlDatetimeFormat))
+	}
+	return fmt.Sprintf("to_jsonb((%s)::text)", v.expression)
+}
+
+// Get a category of the type which values of the type are compared as: numeric, text, boolean, datetime, null or
+// empty for jsonb values
+func sqlCategory(typeName string) string {
+	switch {
+	case typeName == "" || typeName == "null" || typeName == "boolean" || typeName == "datetime":
+		return typeName
+	case isNumericType(typeName):
+		return "numeric"
+	}
+	return "text"
+}
+
+// Get a category which values are compared as. Dates are preferred to numbers, numbers to booleans and booleans to
+// text. Values of unmapped fields are compared as jsonb if there is no other category
+func commonCategory(values []sqlValue) string {
+	categories := make(map[string]bool)
+	for _, value := range values {
+		categories[sqlCategory(value.typeName)] = true
+	}
+	for _, category := range []string{"datetime", "numeric", "boolean", "text"} {
+		if categories[category] {
+			return category
+		}
+	}
+	return ""
+}
+
+// Get a numeric type of the value. Values of unmapped fields are treated as doubles
+func numericType(value sqlValue) string {
+	if sqlCategory(value.typeName) == "numeric" {
+		return value.typeName
+	}
+	return "double"
+}
+
+// Check if mapping type is an integer type
+func isIntegerType(typeName string) bool {
+	switch typeName {
+	case "long", "integer", "short", "byte", "unsigned_long":
+		return true
+	}
+	return false
+}
+
+// Get a type of a column of results. Values of unmapped fields are reported as text
+func sqlColumnType(typeName string) string {
+	if len(typeName) == 0 {
+		return "text"
+	}
+	return typeName
+}
+
+// Build an error about wrong number of arguments of a function
+func sqlArgumentsError(function, expected string) error {
+	return utils.NewIllegalQueryError(fmt.Sprintf("[sql] function [%s] expects %s argument(s)", function, expected))
+}
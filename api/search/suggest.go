@@ -0,0 +1,639 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SuggestEntry is a suggestion for a term or a text of a suggest request. Offset and length locate the term in the
+// text in characters
+type SuggestEntry struct {
+	Text    string        `json:"text"`
+	Offset  int           `json:"offset"`
+	Length  int           `json:"length"`
+	Options []interface{} `json:"options"`
+}
+
+type termSuggestOption struct {
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+	Freq  int     `json:"freq"`
+}
+
+type phraseSuggestOption struct {
+	Text        string  `json:"text"`
+	Highlighted string  `json:"highlighted,omitempty"`
+	Score       float64 `json:"score"`
+}
+
+type completionSuggestOption struct {
+	Text     string      `json:"text"`
+	Index    string      `json:"_index"`
+	Type     string      `json:"_type"`
+	ID       string      `json:"_id"`
+	Score    float64     `json:"_score"`
+	Document interface{} `json:"_source,omitempty"`
+}
+
+// termSuggestOptions are parameters of term suggester and of direct generator of phrase suggester. Accuracy is the
+// minimal trigram similarity of a suggested word
+type termSuggestOptions struct {
+	field         string
+	analyzer      string
+	size          int
+	sort          string
+	suggestMode   string
+	maxEdits      int
+	prefixLength  int
+	minWordLength int
+	minDocFreq    float64
+	accuracy      float64
+}
+
+// suggestToken is an analyzed term of a suggest text with location of its word in the text
+type suggestToken struct {
+	term   string
+	offset int
+	length int
+}
+
+// suggestCandidate is a word of the field vocabulary suggested as a correction of a term
+type suggestCandidate struct {
+	word  string
+	score float64
+	freq  int
+}
+
+// termCorrections are corrections of terms of a suggest text. Frequencies are document frequencies of the terms
+// themselves, documents is a number of all documents of the type
+type termCorrections struct {
+	candidates  [][]suggestCandidate
+	frequencies []int
+	documents   int
+}
+
+// Words of a suggest text. Positions of analyzed terms are positions of these words
+var suggestWordPattern = regexp.MustCompile(`[\pL\pN_]+`)
+
+// Suggest parses suggest section of a search request and calculates suggestions over documents of the type. Source is
+// SQL expression of documents returned by completion suggestions
+func (ctx *QueryContext) Suggest(rawSuggest interface{}, source string) (map[string][]SuggestEntry, error) {
+	params, ok := rawSuggest.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[suggest] must be an object")
+	}
+	globalText, _ := params["text"].(string)
+	result := make(map[string][]SuggestEntry)
+	for name, rawSuggestion := range params {
+		if name == "text" {
+			continue
+		}
+		suggestion, ok := rawSuggestion.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] suggestion [%s] must be an object", name))
+		}
+		text, kind, regex := globalText, "", false
+		var options map[string]interface{}
+		for k, v := range suggestion {
+			switch k {
+			case "text", "prefix", "regex":
+				if text, ok = v.(string); !ok {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] [%s] of suggestion [%s] must be a string", k, name))
+				}
+				regex = k == "regex"
+			case "term", "phrase", "completion":
+				if len(kind) > 0 {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] suggestion [%s] must have a single suggester", name))
+				}
+				if options, ok = v.(map[string]interface{}); !ok {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] [%s] suggester must be an object", k))
+				}
+				kind = k
+			default:
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] unknown field [%s] of suggestion [%s]", k, name))
+			}
+		}
+		var entries []SuggestEntry
+		var err error
+		switch kind {
+		case "term":
+			entries, err = ctx.termSuggest(text, options)
+		case "phrase":
+			entries, err = ctx.phraseSuggest(text, options)
+		case "completion":
+			entries, err = ctx.completionSuggest(text, regex, options, source)
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[suggest] suggestion [%s] requires term, phrase or completion suggester", name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[name] = entries
+	}
+	return result, nil
+}
+
+// Suggest corrections of each term of the text
+func (ctx *QueryContext) termSuggest(text string, params map[string]interface{}) ([]SuggestEntry, error) {
+	options, err := parseTermSuggestOptions(params, "missing")
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := ctx.suggestTokens(options.field, options.analyzer, text)
+	if err != nil {
+		return nil, err
+	}
+	corrections, err := ctx.correctTerms(tokens, options)
+	if err != nil {
+		return nil, err
+	}
+	entries := []SuggestEntry{}
+	for i, token := range tokens {
+		entry := SuggestEntry{Text: token.term, Offset: token.offset, Length: token.length, Options: []interface{}{}}
+		for _, candidate := range corrections.candidates[i] {
+			entry.Options = append(entry.Options, termSuggestOption{Text: candidate.word, Score: candidate.score, Freq: candidate.freq})
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Suggest corrections of the whole text. Terms are corrected by candidates of the direct generator, phrases are
+// scored by noisy channel model: a term of the vocabulary is correct with probability real_word_error_likelihood, other
+// terms are rarely correct. A term is replaced with the remaining probability weighted by similarity of the candidate.
+// Probability of a word is its smoothed document frequency
+func (ctx *QueryContext) phraseSuggest(text string, params map[string]interface{}) ([]SuggestEntry, error) {
+	var field, analyzer string
+	size, maxErrors, confidence, realWordErrorLikelihood := 5, 1.0, 1.0, 0.95
+	preTag, postTag := "", ""
+	var generator map[string]interface{}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "field":
+			field, _ = v.(string)
+		case "analyzer":
+			analyzer, _ = v.(string)
+		case "size":
+			size, err = parseInt(v, k)
+		case "max_errors":
+			maxErrors, err = parseFloat(v, k)
+		case "confidence":
+			confidence, err = parseFloat(v, k)
+		case "real_word_error_likelihood":
+			realWordErrorLikelihood, err = parseFloat(v, k)
+		case "highlight":
+			highlight, _ := v.(map[string]interface{})
+			preTag, _ = highlight["pre_tag"].(string)
+			postTag, _ = highlight["post_tag"].(string)
+		case "direct_generator":
+			// Candidates are taken from the first generator
+			generators, _ := v.([]interface{})
+			if len(generators) > 0 {
+				generator, _ = generators[0].(map[string]interface{})
+			}
+		case "gram_size", "separator", "token_limit", "shard_size", "force_unigrams", "smoothing":
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[phrase] suggester doesn't support field [%s]", k))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(field) == 0 {
+		return nil, utils.NewIllegalQueryError("the required field option [field] is missing")
+	}
+	if generator == nil {
+		generator = map[string]interface{}{"field": field}
+	}
+	options, err := parseTermSuggestOptions(generator, "always")
+	if err != nil {
+		return nil, err
+	}
+	if len(options.analyzer) == 0 {
+		options.analyzer = analyzer
+	}
+	tokens, err := ctx.suggestTokens(field, options.analyzer, text)
+	if err != nil {
+		return nil, err
+	}
+	entry := SuggestEntry{Text: text, Length: utf8.RuneCountInString(text), Options: []interface{}{}}
+	if len(tokens) == 0 {
+		return []SuggestEntry{entry}, nil
+	}
+	corrections, err := ctx.correctTerms(tokens, options)
+	if err != nil {
+		return nil, err
+	}
+	errors := int(maxErrors)
+	if maxErrors < 1 {
+		errors = int(math.Max(1, math.Floor(maxErrors*float64(len(tokens)))))
+	}
+	probability := func(freq int) float64 {
+		return float64(freq+1) / float64(corrections.documents+1)
+	}
+	correct := make([]float64, len(tokens))
+	for i := range tokens {
+		correct[i] = realWordErrorLikelihood
+		if corrections.frequencies[i] == 0 {
+			correct[i] = 1 - realWordErrorLikelihood
+		}
+	}
+
+	// Enumerate phrases with at most errors corrected terms
+	type phrase struct {
+		words []string
+		score float64
+	}
+	originalScore := 1.0
+	for i := range tokens {
+		originalScore *= correct[i] * probability(corrections.frequencies[i])
+	}
+	var phrases []phrase
+	var enumerate func(i, errorsLeft int, words []string, score float64)
+	enumerate = func(i, errorsLeft int, words []string, score float64) {
+		if i == len(tokens) {
+			if errorsLeft < errors && score > originalScore*confidence {
+				phrases = append(phrases, phrase{append([]string(nil), words...), score})
+			}
+			return
+		}
+		enumerate(i+1, errorsLeft, append(words, ""), score*correct[i]*probability(corrections.frequencies[i]))
+		if errorsLeft == 0 {
+			return
+		}
+		for _, candidate := range corrections.candidates[i] {
+			enumerate(i+1, errorsLeft-1, append(words, candidate.word), score*(1-correct[i])*candidate.score*probability(candidate.freq))
+		}
+	}
+	enumerate(0, errors, nil, 1)
+	sort.SliceStable(phrases, func(a, b int) bool { return phrases[a].score > phrases[b].score })
+	if len(phrases) > size {
+		phrases = phrases[:size]
+	}
+	for _, p := range phrases {
+		option := phraseSuggestOption{Text: replaceTokens(text, tokens, p.words, "", ""), Score: p.score}
+		if len(preTag) > 0 || len(postTag) > 0 {
+			option.Highlighted = replaceTokens(text, tokens, p.words, preTag, postTag)
+		}
+		entry.Options = append(entry.Options, option)
+	}
+	return []SuggestEntry{entry}, nil
+}
+
+// Suggest inputs of a completion field starting with the prefix or matching the regular expression
+func (ctx *QueryContext) completionSuggest(text string, regex bool, params map[string]interface{}, source string) ([]SuggestEntry, error) {
+	fieldName, ok := params["field"].(string)
+	if !ok {
+		return nil, utils.NewIllegalQueryError("the required field option [field] is missing")
+	}
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, fieldName)
+	if !ok || fieldMapping.TypeName != "completion" {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("Field [%s] is not a completion suggest field", fieldName))
+	}
+	query := &db.CompletionQuery{Index: ctx.Index, Type: ctx.Type, Field: fieldName, Score: "weight", Source: source, Size: 5}
+	var fuzzy *fuzzyOptions
+	minLength := 3
+	var conditions []string
+	var err error
+	for k, v := range params {
+		switch k {
+		case "size":
+			query.Size, err = parseInt(v, k)
+		case "skip_duplicates":
+			query.SkipDuplicates, err = parseBool(v, k)
+		case "fuzzy":
+			fuzzy = newFuzzyOptions("AUTO")
+			fuzzy.prefixLength = 1
+			if fuzzyParams, ok := v.(map[string]interface{}); ok {
+				for key, value := range fuzzyParams {
+					switch key {
+					case "fuzziness":
+						fuzzy.fuzziness = fmt.Sprint(value)
+					case "prefix_length":
+						fuzzy.prefixLength, err = parseInt(value, key)
+					case "min_length":
+						minLength, err = parseInt(value, key)
+					case "transpositions", "unicode_aware":
+					default:
+						return nil, utils.NewIllegalQueryError(fmt.Sprintf("[fuzzy] unknown field [%s]", key))
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else if enabled, _ := v.(bool); !enabled {
+				fuzzy = nil
+			}
+		case "contexts":
+			var boost string
+			conditions, boost, err = completionContexts(v, fieldName, fieldMapping)
+			if len(boost) > 0 {
+				query.Score = fmt.Sprintf("weight * %s", boost)
+			}
+		case "field", "analyzer", "regex":
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[completion] unknown field [%s]", k))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := strings.ToLower(text)
+	length := utf8.RuneCountInString(prefix)
+	switch {
+	case regex:
+		var flags map[string]bool
+		if regexParams, ok := params["regex"].(map[string]interface{}); ok {
+			flags = parseRegexpFlags(fmt.Sprint(regexParams["flags"]))
+		}
+		pattern, err := convertRegexp("("+text+").*", flags)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, fmt.Sprintf("lower(input) ~ %s", utils.QuoteLiteral(pattern)))
+	case fuzzy != nil && length >= minLength:
+		distance, err := fuzzy.distance(prefix)
+		if err != nil {
+			return nil, err
+		}
+		exact := []rune(prefix)
+		if fuzzy.prefixLength < len(exact) {
+			exact = exact[:fuzzy.prefixLength]
+		}
+		conditions = append(conditions,
+			fmt.Sprintf("lower(input) LIKE %s", utils.QuoteLiteral(escapeLike(string(exact))+"%")),
+			fmt.Sprintf("pg_elastic_prefix_distance(left(lower(input), %d), %s) <= %d", length+distance, utils.QuoteLiteral(prefix), distance))
+	default:
+		conditions = append(conditions, fmt.Sprintf("lower(input) LIKE %s", utils.QuoteLiteral(escapeLike(prefix)+"%")))
+	}
+	query.Condition = joinConditions(conditions, "AND")
+	completions, err := ctx.client.ProcessCompletion(query)
+	if err != nil {
+		return nil, err
+	}
+	entry := SuggestEntry{Text: text, Length: utf8.RuneCountInString(text), Options: []interface{}{}}
+	for _, completion := range completions {
+		entry.Options = append(entry.Options, completionSuggestOption{
+			Text:     completion.Text,
+			Index:    ctx.Index,
+			Type:     ctx.Type,
+			ID:       completion.ID,
+			Score:    completion.Score,
+			Document: completion.Document,
+		})
+	}
+	return []SuggestEntry{entry}, nil
+}
+
+// Build conditions of contexts of a completion suggestion and SQL expression of their boost. Each queried context
+// should match any of its values, values could be strings or objects with context, boost and prefix
+func completionContexts(rawContexts interface{}, fieldName string, fieldMapping *utils.FieldMapping) ([]string, string, error) {
+	contexts, ok := rawContexts.(map[string]interface{})
+	if !ok {
+		return nil, "", utils.NewIllegalQueryError("[contexts] must be an object")
+	}
+	var names []string
+	for name := range contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var conditions, boosts []string
+	for _, name := range names {
+		var contextMapping *utils.ContextMapping
+		for i := range fieldMapping.Contexts {
+			if fieldMapping.Contexts[i].Name == name {
+				contextMapping = &fieldMapping.Contexts[i]
+			}
+		}
+		if contextMapping == nil {
+			return nil, "", utils.NewIllegalQueryError(fmt.Sprintf("Unknown context name [%s] of field [%s]", name, fieldName))
+		}
+		rawValues, ok := contexts[name].([]interface{})
+		if !ok {
+			rawValues = []interface{}{contexts[name]}
+		}
+		var matches []string
+		for _, rawValue := range rawValues {
+			value, boost, prefix := "", 1.0, false
+			switch rawValue := rawValue.(type) {
+			case string:
+				value = rawValue
+			case map[string]interface{}:
+				var err error
+				value = fmt.Sprint(rawValue["context"])
+				if rawBoost, ok := rawValue["boost"]; ok {
+					if boost, err = parseFloat(rawBoost, "boost"); err != nil {
+						return nil, "", err
+					}
+				}
+				if rawPrefix, ok := rawValue["prefix"]; ok {
+					if prefix, err = parseBool(rawPrefix, "prefix"); err != nil {
+						return nil, "", err
+					}
+				}
+			default:
+				return nil, "", utils.NewIllegalQueryError(fmt.Sprintf("context [%s] must be a string or an object", name))
+			}
+			filter := "@ == " + jsonPathValue(value)
+			if prefix {
+				filter = "@ starts with " + jsonPathValue(value)
+			}
+			// Values of contexts with path are taken from the document
+			match := fmt.Sprintf("jsonb_path_exists(contexts, %s)", utils.QuoteLiteral(fmt.Sprintf("%s ? (%s)", fieldPath(name), filter)))
+			if len(contextMapping.Path) > 0 {
+				match = anyValueMatches(contextMapping.Path, filter)
+			}
+			matches = append(matches, match)
+			if boost != 1 {
+				boosts = append(boosts, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 1 END", match, utils.FormatFloat(boost)))
+			}
+		}
+		conditions = append(conditions, joinConditions(matches, "OR"))
+	}
+	var boost string
+	if len(boosts) > 0 {
+		boost = fmt.Sprintf("greatest(%s)", strings.Join(boosts, ", "))
+	}
+	return conditions, boost, nil
+}
+
+// Parse parameters of term suggester. Suggest mode of term suggester is missing, phrase suggester uses always
+func parseTermSuggestOptions(params map[string]interface{}, suggestMode string) (*termSuggestOptions, error) {
+	options := &termSuggestOptions{size: 5, sort: "score", suggestMode: suggestMode, maxEdits: 2, prefixLength: 1, minWordLength: 4, accuracy: 0.3}
+	var err error
+	for k, v := range params {
+		switch k {
+		case "field":
+			options.field, _ = v.(string)
+		case "analyzer":
+			options.analyzer, _ = v.(string)
+		case "size":
+			options.size, err = parseInt(v, k)
+		case "sort":
+			options.sort = fmt.Sprint(v)
+			if options.sort != "score" && options.sort != "frequency" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Illegal suggest sort [%s]", options.sort))
+			}
+		case "suggest_mode":
+			options.suggestMode = fmt.Sprint(v)
+			if options.suggestMode != "missing" && options.suggestMode != "popular" && options.suggestMode != "always" {
+				return nil, utils.NewIllegalQueryError(fmt.Sprintf("Illegal suggest mode [%s]", options.suggestMode))
+			}
+		case "max_edits":
+			options.maxEdits, err = parseInt(v, k)
+			if err == nil && (options.maxEdits < 1 || options.maxEdits > 2) {
+				return nil, utils.NewIllegalQueryError("Illegal max_edits value, must be 1 or 2")
+			}
+		case "prefix_length", "prefix_len":
+			options.prefixLength, err = parseInt(v, k)
+		case "min_word_length", "min_word_len":
+			options.minWordLength, err = parseInt(v, k)
+		case "min_doc_freq":
+			options.minDocFreq, err = parseFloat(v, k)
+		case "accuracy":
+			options.accuracy, err = parseFloat(v, k)
+		case "shard_size", "max_inspections", "max_term_freq", "string_distance", "lowercase_terms", "pre_filter", "post_filter":
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("suggester doesn't support field [%s]", k))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.field) == 0 {
+		return nil, utils.NewIllegalQueryError("the required field option [field] is missing")
+	}
+	return options, nil
+}
+
+// Analyze a suggest text by the search analyzer of the field or by the analyzer. Words of terms are located by their
+// positions, terms sharing a position are skipped
+func (ctx *QueryContext) suggestTokens(fieldName, analyzerName, text string) ([]suggestToken, error) {
+	analyzer, err := ctx.searchAnalyzer(fieldName)
+	if len(analyzerName) > 0 {
+		analyzer, err = ctx.Analyzers.Lookup(analyzerName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := ctx.analyze(analyzer, text)
+	if err != nil {
+		return nil, err
+	}
+	words := suggestWordPattern.FindAllStringIndex(text, -1)
+	var result []suggestToken
+	position, end := -1, 0
+	for _, token := range tokens {
+		if token.Position == position {
+			continue
+		}
+		position = token.Position
+		suggestToken := suggestToken{term: token.Term, offset: end}
+		if position >= 1 && position <= len(words) {
+			word := words[position-1]
+			suggestToken.offset = utf8.RuneCountInString(text[:word[0]])
+			suggestToken.length = utf8.RuneCountInString(text[word[0]:word[1]])
+		}
+		end = suggestToken.offset + suggestToken.length
+		result = append(result, suggestToken)
+	}
+	return result, nil
+}
+
+// Find corrections of terms in the vocabulary of the field. Candidates are similar words filtered by suggest mode,
+// edit distance, common prefix and document frequency, they are ordered by sort option
+func (ctx *QueryContext) correctTerms(tokens []suggestToken, options *termSuggestOptions) (*termCorrections, error) {
+	result := &termCorrections{candidates: make([][]suggestCandidate, len(tokens)), frequencies: make([]int, len(tokens))}
+	var terms []string
+	for _, token := range tokens {
+		if utf8.RuneCountInString(token.term) >= options.minWordLength {
+			terms = append(terms, token.term)
+		}
+	}
+	if len(terms) == 0 {
+		return result, nil
+	}
+	analyzer, err := ctx.indexAnalyzer(options.field)
+	if err != nil {
+		return nil, err
+	}
+	similarTerms, err := ctx.client.SimilarTerms(ctx.Index, ctx.Type, analyzer.Vector(fieldText(options.field)), terms, options.accuracy)
+	if err != nil {
+		return nil, err
+	}
+	frequencies := make(map[string]int)
+	for _, similar := range similarTerms {
+		result.documents = similar.Documents
+		if similar.Word == similar.Term {
+			frequencies[similar.Term] = similar.Ndoc
+		}
+	}
+	// Document frequency below 1 is a fraction of all documents
+	minDocFreq := options.minDocFreq
+	if minDocFreq > 0 && minDocFreq < 1 {
+		minDocFreq *= float64(result.documents)
+	}
+	for i, token := range tokens {
+		term := token.term
+		result.frequencies[i] = frequencies[term]
+		if utf8.RuneCountInString(term) < options.minWordLength || options.suggestMode == "missing" && frequencies[term] > 0 {
+			continue
+		}
+		var candidates []suggestCandidate
+		for _, similar := range similarTerms {
+			if similar.Term != term || similar.Word == term || float64(similar.Ndoc) < minDocFreq {
+				continue
+			}
+			if options.suggestMode == "popular" && similar.Ndoc <= frequencies[term] {
+				continue
+			}
+			if !hasCommonPrefix(similar.Word, term, options.prefixLength) || editDistance(term, similar.Word, true) > options.maxEdits {
+				continue
+			}
+			candidates = append(candidates, suggestCandidate{word: similar.Word, score: similar.Similarity, freq: similar.Ndoc})
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			first, second := candidates[a], candidates[b]
+			if options.sort == "frequency" && first.freq != second.freq {
+				return first.freq > second.freq
+			}
+			if first.score != second.score {
+				return first.score > second.score
+			}
+			if first.freq != second.freq {
+				return first.freq > second.freq
+			}
+			return first.word < second.word
+		})
+		if len(candidates) > options.size {
+			candidates = candidates[:options.size]
+		}
+		result.candidates[i] = candidates
+	}
+	return result, nil
+}
+
+// Replace words of tokens in the text by corrected words. Empty words are kept as is, replaced words are wrapped by
+// tags
+func replaceTokens(text string, tokens []suggestToken, words []string, preTag, postTag string) string {
+	runes := []rune(text)
+	var result []rune
+	end := 0
+	for i, token := range tokens {
+		if len(words[i]) == 0 || token.offset < end || token.offset+token.length > len(runes) {
+			continue
+		}
+		result = append(result, runes[end:token.offset]...)
+		result = append(result, []rune(preTag+words[i]+postTag)...)
+		end = token.offset + token.length
+	}
+	return string(append(result, runes[end:]...))
+}
@@ -0,0 +1,338 @@
+package search
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func parseTermQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, params, err := parseSingleFieldQuery("term", rawQuery, "value")
+	if err != nil {
+		return nil, err
+	}
+	boost, err := parseBoost(params)
+	if err != nil {
+		return nil, err
+	}
+	clause, err := termClause(fieldName, params["value"], ctx)
+	if err != nil {
+		return nil, err
+	}
+	return boostClause(clause, boost), nil
+}
+
+func parseTermsQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	var clauses []*Clause
+	for k, v := range rawQuery {
+		if k == "boost" || k == "_name" {
+			continue
+		}
+		values, ok := v.([]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[terms] query does not support [%s] with values of this type", k))
+		}
+		var conditions []string
+		for _, value := range values {
+			clause, err := termClause(k, value, ctx)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, clause.Condition)
+		}
+		clauses = append(clauses, &Clause{Condition: joinConditions(conditions, "OR"), Score: "1"})
+	}
+	if len(clauses) != 1 {
+		return nil, utils.NewIllegalQueryError("[terms] query requires exactly one field")
+	}
+	return boostClause(clauses[0], boost), nil
+}
+
+func parseRangeQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, params, err := parseSingleFieldQuery("range", rawQuery, "")
+	if err != nil {
+		return nil, err
+	}
+	boost, err := parseBoost(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Legacy from/to parameters are translated into gt(e)/lt(e)
+	bounds := make(map[string]interface{})
+	includeLower, includeUpper := true, true
+	for k, v := range params {
+		switch k {
+		case "gt", "gte", "lt", "lte":
+			if v != nil {
+				bounds[k] = v
+			}
+		case "include_lower":
+			if includeLower, err = parseBool(v, k); err != nil {
+				return nil, err
+			}
+		case "include_upper":
+			if includeUpper, err = parseBool(v, k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if from, ok := params["from"]; ok && from != nil {
+		if includeLower {
+			bounds["gte"] = from
+		} else {
+			bounds["gt"] = from
+		}
+	}
+	if to, ok := params["to"]; ok && to != nil {
+		if includeUpper {
+			bounds["lte"] = to
+		} else {
+			bounds["lt"] = to
+		}
+	}
+
+	// All bounds should be satisfied by a single value of the field
+	operators := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+	fieldType := ctx.fieldType(fieldName)
+	isDate := fieldType == "date"
+	for _, bound := range bounds {
+		isDate = isDate || isDateMath(bound)
+	}
+	var conditions []string
+	for _, k := range []string{"gt", "gte", "lt", "lte"} {
+		bound, ok := bounds[k]
+		if !ok {
+			continue
+		}
+		if isDate {
+			value, err := dateMath(bound, k == "gt" || k == "lte")
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, fmt.Sprintf("pg_elastic_timestamp(v.value) %s %s", operators[k], value))
+		} else {
+			value, err := rangeValue(fieldName, fieldType, bound)
+			if err != nil {
+				return nil, err
+			}
+			// JSON values of different types are not comparable, so such values don't match
+			conditions = append(conditions, fmt.Sprintf("@ %s %s", operators[k], jsonPathValue(value)))
+		}
+	}
+	var condition string
+	switch {
+	case len(conditions) == 0:
+		condition = existsCondition(fieldName)
+	case isDate:
+		condition = anyValue(fieldName, strings.Join(conditions, " AND "))
+	default:
+		condition = anyValueMatches(fieldName, strings.Join(conditions, " && "))
+	}
+	return &Clause{Condition: condition, Score: utils.FormatFloat(boost)}, nil
+}
+
+func parseFuzzyQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, params, err := parseSingleFieldQuery("fuzzy", rawQuery, "value")
+	if err != nil {
+		return nil, err
+	}
+	options := &matchOptions{operator: "or", boost: 1}
+	if options.boost, err = parseBoost(params); err != nil {
+		return nil, err
+	}
+	if _, ok := params["fuzziness"]; !ok {
+		params["fuzziness"] = "AUTO"
+	}
+	if options.fuzzy, err = parseFuzzyOptions(params); err != nil {
+		return nil, err
+	}
+	indexAnalyzer, err := ctx.indexAnalyzer(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	vector := indexAnalyzer.Vector(fieldText(fieldName))
+	clause, err := termsClause(vector, []string{fmt.Sprint(params["value"])}, options, ctx, vectorRank(vector))
+	if err != nil {
+		return nil, err
+	}
+	return boostClause(clause, options.boost), nil
+}
+
+// Parse a query which is specified as {field: value} or {field: {valueKey: value, ...}}. Short form is converted into
+// parameters with valueKey
+func parseSingleFieldQuery(name string, rawQuery map[string]interface{}, valueKey string) (string, map[string]interface{}, error) {
+	var fieldName string
+	var params map[string]interface{}
+	for k, v := range rawQuery {
+		if k == "_name" {
+			continue
+		}
+		if len(fieldName) > 0 {
+			return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query doesn't support multiple fields, found [%s] and [%s]", name, fieldName, k))
+		}
+		fieldName = k
+		if object, ok := v.(map[string]interface{}); ok {
+			params = object
+		} else {
+			params = map[string]interface{}{valueKey: v}
+		}
+	}
+	if len(fieldName) == 0 {
+		return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query doesn't contain a field", name))
+	}
+	if _, ok := params[valueKey]; len(valueKey) > 0 && !ok {
+		return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("[%s] query doesn't contain a value for field [%s]", name, fieldName))
+	}
+	return fieldName, params, nil
+}
+
+// Build a clause which matches exact value of the field. Fields mapped as text are matched by terms of their vectors,
+// other fields are compared with the value converted into the field type
+func termClause(fieldName string, value interface{}, ctx *QueryContext) (*Clause, error) {
+	if ctx.isTextField(fieldName) {
+		indexAnalyzer, err := ctx.indexAnalyzer(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		vector := indexAnalyzer.Vector(fieldText(fieldName))
+		tsquery := utils.QuoteLiteral(quoteLexeme(fmt.Sprint(value))) + "::tsquery"
+		return &Clause{Condition: fmt.Sprintf("%s @@ %s", vector, tsquery), Score: vectorRank(vector)(tsquery)}, nil
+	}
+	fieldType := ctx.fieldType(fieldName)
+	switch value.(type) {
+	case []interface{}, map[string]interface{}:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[term] query doesn't support values of this type for field [%s]", fieldName))
+	}
+	if isNumericType(fieldType) || fieldType == "boolean" {
+		var err error
+		if value, err = rangeValue(fieldName, fieldType, value); err != nil {
+			return nil, err
+		}
+	}
+	return &Clause{Condition: valueCondition(fieldName, value), Score: "1"}, nil
+}
+
+// Convert a bound of range or a term value into JSON value of the field type. Values of fields without mapping
+// are compared as numbers if they look like numbers
+func rangeValue(fieldName, fieldType string, value interface{}) (interface{}, error) {
+	text := strings.TrimSpace(fmt.Sprint(value))
+	switch {
+	case isNumericType(fieldType):
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("failed to create query: field [%s] of type [%s] can't parse value [%v]", fieldName, fieldType, value))
+		}
+		return number, nil
+	case fieldType == "boolean":
+		result, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("failed to create query: field [%s] of type [%s] can't parse value [%v]", fieldName, fieldType, value))
+		}
+		return result, nil
+	case fieldType == "keyword":
+		return fmt.Sprint(value), nil
+	}
+	if _, ok := value.(string); ok {
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return number, nil
+		}
+	}
+	return value, nil
+}
+
+// Escape special characters of LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// Convert a wildcard pattern where "*" matches any sequence and "?" matches any character into LIKE pattern.
+// Backslash escapes the next character
+func wildcardToLike(pattern string) string {
+	var result bytes.Buffer
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			result.WriteString(escapeLike(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '*':
+			result.WriteRune('%')
+		case c == '?':
+			result.WriteRune('_')
+		default:
+			result.WriteString(escapeLike(string(c)))
+		}
+	}
+	return result.String()
+}
+
+var dateMathPattern = regexp.MustCompile(`([+-]\d*|/)([yMwdhHms])`)
+
+var dateMathUnits = map[string]string{
+	"y": "year", "M": "month", "w": "week", "d": "day", "h": "hour", "H": "hour", "m": "minute", "s": "second",
+}
+
+// Check if a value is a date math expression like "now-1d/d" or "2015-01-01||+1M"
+func isDateMath(value interface{}) bool {
+	text, ok := value.(string)
+	return ok && (strings.HasPrefix(text, "now") || strings.Contains(text, "||"))
+}
+
+// Build SQL expression of timestamp for a date or date math expression. Rounded dates are rounded up to the end of
+// the unit if roundUp is set
+func dateMath(value interface{}, roundUp bool) (string, error) {
+	var anchor, expression string
+	switch value := value.(type) {
+	case float64:
+		return fmt.Sprintf("to_timestamp(%s / 1000.0)", utils.FormatFloat(value)), nil
+	case string:
+		switch {
+		case strings.HasPrefix(value, "now"):
+			anchor, expression = "now()", strings.TrimPrefix(value, "now")
+		case strings.Contains(value, "||"):
+			parts := strings.SplitN(value, "||", 2)
+			anchor, expression = fmt.Sprintf("pg_elastic_timestamp(%s)", quoteJSON(parts[0])), parts[1]
+		default:
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				return fmt.Sprintf("to_timestamp(%s::float8 / 1000.0)", utils.QuoteLiteral(value)), nil
+			}
+			anchor = fmt.Sprintf("pg_elastic_timestamp(%s)", quoteJSON(value))
+		}
+	default:
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("failed to parse date field [%v]", value))
+	}
+
+	result := anchor
+	rest := expression
+	for len(rest) > 0 {
+		match := dateMathPattern.FindStringSubmatchIndex(rest)
+		if match == nil || match[0] != 0 {
+			return "", utils.NewIllegalQueryError(fmt.Sprintf("failed to parse date math [%v]", value))
+		}
+		operation, unit := rest[match[2]:match[3]], dateMathUnits[rest[match[4]:match[5]]]
+		if operation == "/" {
+			result = fmt.Sprintf("date_trunc('%s', %s)", unit, result)
+			if roundUp {
+				result = fmt.Sprintf("(%s + interval '1 %s' - interval '1 millisecond')", result, unit)
+			}
+		} else {
+			amount := operation[1:]
+			if len(amount) == 0 {
+				amount = "1"
+			}
+			result = fmt.Sprintf("(%s %c interval '%s %s')", result, operation[0], amount, unit)
+		}
+		rest = rest[match[1]:]
+	}
+	return result, nil
+}
@@ -0,0 +1,265 @@
+package search
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/utils"
+	"strings"
+)
+
+// vectorField is a dense_vector field used by a query. Column is SQL name of its float8[] column
+type vectorField struct {
+	name    string
+	column  string
+	mapping *utils.FieldMapping
+}
+
+// ParseKnnSearch parses knn section of a search request and combines it with a clause of the query. Query is nil if
+// the request has no query. Documents matching any of them are found, scores are summed up
+func ParseKnnSearch(rawKnn interface{}, query *Clause, ctx *QueryContext) (*Clause, error) {
+	var rawSearches []interface{}
+	if list, ok := rawKnn.([]interface{}); ok {
+		rawSearches = list
+	} else {
+		rawSearches = []interface{}{rawKnn}
+	}
+	var clauses []*Clause
+	if query != nil {
+		clauses = append(clauses, query)
+	}
+	for _, rawSearch := range rawSearches {
+		params, ok := rawSearch.(map[string]interface{})
+		if !ok {
+			return nil, utils.NewIllegalQueryError("[knn] malformed, must be an object or an array of objects")
+		}
+		clause, err := parseKnn(params, ctx)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	var conditions, scores []string
+	for _, c := range clauses {
+		conditions = append(conditions, c.Condition)
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", c.Condition, c.Score))
+	}
+	return &Clause{Condition: joinConditions(conditions, "OR"), Score: strings.Join(scores, " + ")}, nil
+}
+
+// Parse a single kNN search. It matches k documents nearest to the query vector among documents matching the filter
+func parseKnn(params map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	fieldName, ok := params["field"].(string)
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[knn] requires 'field' to be specified")
+	}
+	field, err := ctx.vectorField(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	vector, err := field.parseVector(params["query_vector"])
+	if err != nil {
+		return nil, err
+	}
+	k, numCandidates := 10, 0
+	boost := 1.0
+	var filters []*Clause
+	var similarity *float64
+	for key, v := range params {
+		switch key {
+		case "k":
+			k, err = parseInt(v, key)
+		case "num_candidates":
+			numCandidates, err = parseInt(v, key)
+		case "boost":
+			boost, err = parseFloat(v, key)
+		case "similarity":
+			var value float64
+			value, err = parseFloat(v, key)
+			similarity = &value
+		case "filter":
+			// Inner hits of filters are not returned and their terms are not highlighted
+			filterCtx := *ctx
+			filterCtx.highlightTerms = nil
+			filters, err = parseQueryList(v, &filterCtx)
+		case "field", "query_vector":
+		default:
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[knn] unknown field [%s]", key))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if k < 1 {
+		return nil, utils.NewIllegalQueryError("[k] must be greater than 0")
+	}
+	if numCandidates != 0 && numCandidates < k {
+		return nil, utils.NewIllegalQueryError("[num_candidates] cannot be less than [k]")
+	}
+
+	conditions := []string{field.column + " IS NOT NULL"}
+	for _, filter := range filters {
+		conditions = append(conditions, filter.Condition)
+	}
+	if similarity != nil {
+		conditions = append(conditions, field.similarityCondition(vector, *similarity))
+	}
+	condition := fmt.Sprintf("id IN (SELECT id FROM %s WHERE %s ORDER BY %s LIMIT %d)",
+		db.TableName(ctx.Index, ctx.Type), joinConditions(conditions, "AND"), field.distanceOrder(vector, ctx.hasExtension("vector")), k)
+	return boostClause(&Clause{Condition: condition, Score: field.score(vector)}, boost), nil
+}
+
+func parseScriptScoreQuery(rawQuery map[string]interface{}, ctx *QueryContext) (*Clause, error) {
+	rawInner, ok := rawQuery["query"].(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[script_score] requires 'query' field")
+	}
+	inner, err := parseQuery(rawInner, ctx)
+	if err != nil {
+		return nil, err
+	}
+	source, params, err := parseScript(rawQuery["script"])
+	if err != nil {
+		return nil, err
+	}
+	score, err := compileScoreScript(source, params, inner.Score, ctx)
+	if err != nil {
+		return nil, err
+	}
+	clause := &Clause{Condition: inner.Condition, Score: score}
+	if rawMinScore, ok := rawQuery["min_score"]; ok {
+		minScore, err := parseFloat(rawMinScore, "min_score")
+		if err != nil {
+			return nil, err
+		}
+		clause.Condition = joinConditions([]string{inner.Condition, fmt.Sprintf("(%s) >= %s", score, utils.FormatFloat(minScore))}, "AND")
+	}
+	boost, err := parseBoost(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return boostClause(clause, boost), nil
+}
+
+// Parse a script given as a source string or as an object with source and params. Only inline scripts are supported
+func parseScript(rawScript interface{}) (string, map[string]interface{}, error) {
+	switch rawScript := rawScript.(type) {
+	case string:
+		return rawScript, nil, nil
+	case map[string]interface{}:
+		if lang, ok := rawScript["lang"]; ok && lang != "painless" {
+			return "", nil, utils.NewIllegalQueryError(fmt.Sprintf("script_lang not supported [%v]", lang))
+		}
+		source, ok := rawScript["source"].(string)
+		if !ok {
+			if source, ok = rawScript["inline"].(string); !ok {
+				return "", nil, utils.NewIllegalQueryError("[script] requires an inline 'source'")
+			}
+		}
+		params, _ := rawScript["params"].(map[string]interface{})
+		return source, params, nil
+	}
+	return "", nil, utils.NewIllegalQueryError("[script] must be a string or an object")
+}
+
+// Get a dense_vector field of the mapping
+func (ctx *QueryContext) vectorField(name string) (*vectorField, error) {
+	fieldMapping, ok := utils.GetFieldMapping(ctx.Mapping, name)
+	if !ok || fieldMapping.TypeName != "dense_vector" {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("field [%s] is not a dense_vector field", name))
+	}
+	return &vectorField{name: name, column: db.VectorColumn(name), mapping: fieldMapping}, nil
+}
+
+// Check if the extension is installed in the database
+func (ctx *QueryContext) hasExtension(name string) bool {
+	return ctx.client != nil && ctx.client.Features().HasExtension(name)
+}
+
+// Parse a query vector and check that it has dimensions of the field
+func (field *vectorField) parseVector(rawVector interface{}) ([]float64, error) {
+	values, ok := rawVector.([]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("query vector for field [%s] must be an array of numbers", field.name))
+	}
+	var vector []float64
+	for _, v := range values {
+		number, err := parseFloat(v, "query_vector")
+		if err != nil {
+			return nil, err
+		}
+		vector = append(vector, number)
+	}
+	if len(vector) != field.mapping.Dims {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("The query vector has a different number of dimensions [%d] than the document vectors [%d].",
+			len(vector), field.mapping.Dims))
+	}
+	return vector, nil
+}
+
+// SQL expression of similarity of the field and a vector calculated by function of exact similarity
+func (field *vectorField) similarity(function string, vector []float64) string {
+	return fmt.Sprintf("%s(%s, %s)", function, field.column, vectorArray(vector))
+}
+
+// SQL expression of kNN score of a document. Score is positive and greater for more similar vectors
+func (field *vectorField) score(vector []float64) string {
+	switch field.mapping.Similarity {
+	case "l2_norm":
+		return fmt.Sprintf("1 / (1 + power(%s, 2))", field.similarity("pg_elastic_l2_distance", vector))
+	case "dot_product":
+		return fmt.Sprintf("(1 + %s) / 2", field.similarity("pg_elastic_dot_product", vector))
+	case "max_inner_product":
+		return fmt.Sprintf("(SELECT CASE WHEN s.dot < 0 THEN 1 / (1 - s.dot) ELSE s.dot + 1 END FROM (SELECT %s AS dot) AS s)",
+			field.similarity("pg_elastic_dot_product", vector))
+	}
+	return fmt.Sprintf("(1 + %s) / 2", field.similarity("pg_elastic_cosine_similarity", vector))
+}
+
+// SQL condition on the raw similarity of a document. Similarity of l2_norm is a maximal distance
+func (field *vectorField) similarityCondition(vector []float64, similarity float64) string {
+	switch field.mapping.Similarity {
+	case "l2_norm":
+		return fmt.Sprintf("%s <= %s", field.similarity("pg_elastic_l2_distance", vector), utils.FormatFloat(similarity))
+	case "dot_product", "max_inner_product":
+		return fmt.Sprintf("%s >= %s", field.similarity("pg_elastic_dot_product", vector), utils.FormatFloat(similarity))
+	}
+	return fmt.Sprintf("%s >= %s", field.similarity("pg_elastic_cosine_similarity", vector), utils.FormatFloat(similarity))
+}
+
+// SQL expression which orders documents from the nearest to the vector. Operators of pgvector use HNSW index of the
+// field, otherwise exact distance is calculated for each document
+func (field *vectorField) distanceOrder(vector []float64, pgvector bool) string {
+	if pgvector {
+		operator := "<=>"
+		switch field.mapping.Similarity {
+		case "l2_norm":
+			operator = "<->"
+		case "dot_product", "max_inner_product":
+			operator = "<#>"
+		}
+		var values []string
+		for _, v := range vector {
+			values = append(values, utils.FormatFloat(v))
+		}
+		return fmt.Sprintf("%s::vector(%d) %s '[%s]'::vector(%d)", field.column, field.mapping.Dims, operator, strings.Join(values, ","), field.mapping.Dims)
+	}
+	switch field.mapping.Similarity {
+	case "l2_norm":
+		return field.similarity("pg_elastic_l2_distance", vector)
+	case "dot_product", "max_inner_product":
+		return "-" + field.similarity("pg_elastic_dot_product", vector)
+	}
+	return "-" + field.similarity("pg_elastic_cosine_similarity", vector)
+}
+
+// SQL literal of a vector as float8[]
+func vectorArray(vector []float64) string {
+	var values []string
+	for _, v := range vector {
+		values = append(values, utils.FormatFloat(v))
+	}
+	return fmt.Sprintf("ARRAY[%s]::float8[]", strings.Join(values, ", "))
+}
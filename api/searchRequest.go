@@ -0,0 +1,669 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchRequest is a search request combined from request body and URI parameters. Query is nil if the request has
+// only kNN search. TrackTotalHits has meaning of db.SearchQuery field, TotalHitsAsInt selects legacy integer format
+// of hits.total instead of an object with value and relation. ExplainSQL requests SQL statement and its plan.
+// SearchAfter has sort values of the last document of the previous page, Pit is a point in time of the search.
+// PostFilter filters hits after aggregations, Collapse groups hits by a field, MinScore excludes documents with lower
+// score, TerminateAfter limits number of matching documents, Timeout cancels long searches and Rescore recalculates
+// scores of the top hits
+type searchRequest struct {
+	Query          map[string]interface{}
+	Knn            interface{}
+	Sort           []search.SortField
+	Source         interface{}
+	Aggregations   interface{}
+	Highlight      interface{}
+	Suggest        interface{}
+	Fields         []interface{}
+	From           int
+	Size           int
+	TrackTotalHits int
+	TotalHitsAsInt bool
+	ExplainSQL     bool
+	SearchAfter    []interface{}
+	Pit            *pitRequest
+	PostFilter     map[string]interface{}
+	Collapse       *search.Collapse
+	MinScore       *float64
+	TerminateAfter int
+	Timeout        time.Duration
+	Rescore        []search.Rescorer
+}
+
+// pitRequest is a point in time of a search request. KeepAlive extends its life if it is positive
+type pitRequest struct {
+	ID        string
+	KeepAlive time.Duration
+}
+
+// Number of matches counted by default if hits.total is returned as an object
+const defaultTrackTotalHits = 10000
+
+// Parse a search request. Query of q parameter replaces query of the body, from, size and _source parameters
+// override the body, sort, stored_fields and docvalue_fields parameters are appended to the body. Stored fields
+// disable _source unless it is requested explicitly
+func parseSearchRequest(r *http.Request) (*searchRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	return parseSearchBody(body, r.URL.Query(), r.Header.Get("Accept"))
+}
+
+// Parse a search request from its body, URI parameters and Accept header
+func parseSearchBody(body []byte, params url.Values, accept string) (*searchRequest, error) {
+	var err error
+	request := &searchRequest{Query: map[string]interface{}{"match_all": map[string]interface{}{}}, Size: 10}
+	var rawSort, rawTrackTotalHits []interface{}
+	hasQuery, hasSource, hasStoredFields := false, false, false
+	if len(bytes.TrimSpace(body)) > 0 {
+		var rawBody map[string]interface{}
+		err = json.Unmarshal(body, &rawBody)
+		if err != nil {
+			return nil, utils.NewJSONWrongFormatError(err.Error())
+		}
+		for k, v := range rawBody {
+			switch k {
+			case "query":
+				query, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, utils.NewIllegalQueryError("[query] malformed, must start with start_object")
+				}
+				request.Query = query
+				hasQuery = true
+			case "knn":
+				request.Knn = v
+			case "from":
+				request.From, err = intParameter(k, v)
+			case "size":
+				request.Size, err = intParameter(k, v)
+			case "sort":
+				if sort, ok := v.([]interface{}); ok {
+					rawSort = sort
+				} else {
+					rawSort = []interface{}{v}
+				}
+			case "_source":
+				request.Source = v
+				hasSource = true
+			case "fields", "docvalue_fields":
+				request.Fields = append(request.Fields, listParameter(v)...)
+			case "stored_fields":
+				request.Fields = append(request.Fields, listParameter(v)...)
+				hasStoredFields = true
+			case "aggs", "aggregations":
+				request.Aggregations = v
+			case "highlight":
+				request.Highlight = v
+			case "suggest":
+				request.Suggest = v
+			case "track_total_hits":
+				rawTrackTotalHits = []interface{}{v}
+			case "search_after":
+				searchAfter, ok := v.([]interface{})
+				if !ok || len(searchAfter) == 0 {
+					return nil, utils.NewIllegalQueryError("[search_after] must be a non empty array of sort values")
+				}
+				request.SearchAfter = searchAfter
+			case "pit":
+				request.Pit, err = parsePitRequest(v)
+			case "post_filter":
+				postFilter, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, utils.NewIllegalQueryError("[post_filter] malformed, must start with start_object")
+				}
+				request.PostFilter = postFilter
+			case "collapse":
+				request.Collapse, err = search.ParseCollapse(v)
+			case "min_score":
+				minScore, ok := v.(float64)
+				if !ok {
+					return nil, utils.NewIllegalQueryError(fmt.Sprintf("[min_score] should be a number, got [%v]", v))
+				}
+				request.MinScore = &minScore
+			case "terminate_after":
+				request.TerminateAfter, err = intParameter(k, v)
+			case "timeout":
+				request.Timeout, err = search.ParseDuration(v)
+			case "rescore":
+				request.Rescore, err = search.ParseRescore(v)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if q := params.Get("q"); len(q) > 0 {
+		queryString := map[string]interface{}{"query": q}
+		uriOptions := map[string]string{
+			"df":               "default_field",
+			"default_operator": "default_operator",
+			"analyzer":         "analyzer",
+			"analyze_wildcard": "analyze_wildcard",
+			"lenient":          "lenient",
+		}
+		for param, option := range uriOptions {
+			if value := params.Get(param); len(value) > 0 {
+				queryString[option] = value
+			}
+		}
+		request.Query = map[string]interface{}{"query_string": queryString}
+		hasQuery = true
+	}
+	if request.Knn != nil && !hasQuery {
+		request.Query = nil
+	}
+	if from := params.Get("from"); len(from) > 0 {
+		if request.From, err = intParameter("from", from); err != nil {
+			return nil, err
+		}
+	}
+	if size := params.Get("size"); len(size) > 0 {
+		if request.Size, err = intParameter("size", size); err != nil {
+			return nil, err
+		}
+	}
+	if sort := params.Get("sort"); len(sort) > 0 {
+		rawSort = append(rawSort, search.ParseURISort(sort)...)
+	}
+	if terminateAfter := params.Get("terminate_after"); len(terminateAfter) > 0 {
+		if request.TerminateAfter, err = intParameter("terminate_after", terminateAfter); err != nil {
+			return nil, err
+		}
+	}
+	if timeout := params.Get("timeout"); len(timeout) > 0 {
+		if request.Timeout, err = search.ParseDuration(timeout); err != nil {
+			return nil, err
+		}
+	}
+	for _, param := range []string{"stored_fields", "docvalue_fields"} {
+		if fields := params.Get(param); len(fields) > 0 {
+			request.Fields = append(request.Fields, listParameter(fields)...)
+			hasStoredFields = hasStoredFields || param == "stored_fields"
+		}
+	}
+	for _, param := range []string{"_source", "_source_includes", "_source_include", "_source_excludes", "_source_exclude"} {
+		hasSource = hasSource || len(params.Get(param)) > 0
+	}
+	request.Source = search.URISource(params, request.Source)
+	if hasStoredFields && !hasSource {
+		request.Source = false
+	}
+	if request.From < 0 || request.Size < 0 {
+		return nil, utils.NewIllegalQueryError("[from] and [size] parameters cannot be negative")
+	}
+	if explain := params.Get("explain_sql"); len(explain) > 0 {
+		if request.ExplainSQL, err = strconv.ParseBool(explain); err != nil {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("[explain_sql] should be a boolean, got [%s]", explain))
+		}
+	}
+	if track := params.Get("track_total_hits"); len(track) > 0 {
+		rawTrackTotalHits = []interface{}{track}
+	}
+	if err = request.parseTotalHits(rawTrackTotalHits, params.Get("rest_total_hits_as_int"), accept); err != nil {
+		return nil, err
+	}
+	if len(rawSort) > 0 {
+		request.Sort, err = search.ParseSort(rawSort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = request.checkOptions(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Check that options of a search request could be used together. Rescored hits are sorted by score only, collapsed
+// and rescored hits could not be paged by search after
+func (request *searchRequest) checkOptions() error {
+	if request.TerminateAfter < 0 {
+		return utils.NewIllegalQueryError("[terminate_after] parameter cannot be negative")
+	}
+	if request.Timeout < 0 {
+		return utils.NewIllegalQueryError("[timeout] parameter cannot be negative")
+	}
+	if len(request.Rescore) > 0 {
+		for _, field := range request.Sort {
+			if field.Field != "_score" || field.Order != "desc" {
+				return utils.NewIllegalQueryError("Cannot use [sort] option in conjunction with [rescore].")
+			}
+		}
+		if request.Collapse != nil {
+			return utils.NewIllegalQueryError("cannot use `collapse` in conjunction with `rescore`")
+		}
+		if len(request.SearchAfter) > 0 {
+			return utils.NewIllegalQueryError("Cannot use [search_after] option in conjunction with [rescore].")
+		}
+	}
+	if request.Collapse != nil && len(request.SearchAfter) > 0 {
+		return utils.NewIllegalQueryError("cannot use `collapse` in conjunction with `search_after`")
+	}
+	return nil
+}
+
+// Parse point in time of a search request like {"id": "...", "keep_alive": "1m"}
+func parsePitRequest(rawPit interface{}) (*pitRequest, error) {
+	body, ok := rawPit.(map[string]interface{})
+	if !ok {
+		return nil, utils.NewIllegalQueryError("[pit] malformed, must start with start_object")
+	}
+	id, ok := body["id"].(string)
+	if !ok || len(id) == 0 {
+		return nil, utils.NewIllegalQueryError("[pit] requires 'id' to be specified")
+	}
+	pit := &pitRequest{ID: id}
+	if keepAlive, ok := body["keep_alive"]; ok {
+		var err error
+		if pit.KeepAlive, err = parsePitKeepAlive(keepAlive); err != nil {
+			return nil, err
+		}
+	}
+	return pit, nil
+}
+
+// Parse tracking of total hits and format of hits.total. Total is returned as an integer unless tracking is
+// requested, rest_total_hits_as_int is false or the client asks for compatibility with version 7 or later. Integer
+// total is always counted exactly
+func (request *searchRequest) parseTotalHits(rawTrackTotalHits []interface{}, asInt, accept string) error {
+	request.TotalHitsAsInt = true
+	if len(asInt) > 0 {
+		value, err := strconv.ParseBool(asInt)
+		if err != nil {
+			return utils.NewIllegalQueryError(fmt.Sprintf("[rest_total_hits_as_int] should be a boolean, got [%s]", asInt))
+		}
+		request.TotalHitsAsInt = value
+	} else if len(rawTrackTotalHits) > 0 || compatibleVersion(accept) >= 7 {
+		request.TotalHitsAsInt = false
+	}
+	if len(rawTrackTotalHits) == 0 {
+		if !request.TotalHitsAsInt {
+			request.TrackTotalHits = defaultTrackTotalHits
+		}
+		return nil
+	}
+	value := rawTrackTotalHits[0]
+	if text, ok := value.(string); ok && (text == "true" || text == "false") {
+		value = text == "true"
+	}
+	if track, ok := value.(bool); ok {
+		request.TrackTotalHits = trackTotalHits(track)
+	} else {
+		limit, err := intParameter("track_total_hits", value)
+		if err != nil {
+			return err
+		}
+		if limit < -1 {
+			return utils.NewIllegalQueryError("[track_total_hits] parameter must be positive or equals to -1")
+		}
+		// Counting up to zero matches is the same as no counting
+		request.TrackTotalHits = limit
+		if limit <= 0 {
+			request.TrackTotalHits = -1
+		}
+	}
+	if request.TotalHitsAsInt && request.TrackTotalHits != 0 {
+		return utils.NewIllegalQueryError("[rest_total_hits_as_int] cannot be used if the tracking of total hits is not accurate")
+	}
+	return nil
+}
+
+// Convert boolean track_total_hits to the limit of counting
+func trackTotalHits(track bool) int {
+	if track {
+		return 0
+	}
+	return -1
+}
+
+// Get major version from compatible-with parameter of Accept header like
+// "application/vnd.elasticsearch+json; compatible-with=7"
+func compatibleVersion(accept string) int {
+	for _, param := range strings.Split(accept, ";") {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "compatible-with=") {
+			if version, err := strconv.Atoi(strings.TrimPrefix(param, "compatible-with=")); err == nil {
+				return version
+			}
+		}
+	}
+	return 0
+}
+
+// Format total number of matches as hits.total of a search response
+func formatTotalHits(total *db.TotalHits, asInt bool) interface{} {
+	if asInt {
+		if total == nil {
+			return -1
+		}
+		return total.Value
+	}
+	if total == nil {
+		return nil
+	}
+	return totalHits{Value: total.Value, Relation: total.Relation}
+}
+
+// Search for documents of types matching the patterns. Search with a point in time is executed over its snapshot of
+// its indices
+func executeSearch(indexPattern, typePattern string, request *searchRequest, s server.PGElasticServer) (*searchResponse, error) {
+	client := s.GetDBClient()
+	if request.Pit == nil {
+		return searchDocuments(indexPattern, typePattern, request, client)
+	}
+	if indexPattern != "*" {
+		return nil, utils.NewIllegalQueryError("[indices] cannot be used with point in time")
+	}
+	pitIndices, err := client.PointInTimeIndices(request.Pit.ID)
+	if err != nil {
+		return nil, err
+	}
+	var response *searchResponse
+	err = client.WithPointInTime(request.Pit.ID, request.Pit.KeepAlive, func(snapshot *db.Client) error {
+		response, err = searchDocuments(pitIndices, typePattern, request, snapshot)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.PitID = request.Pit.ID
+	return response, nil
+}
+
+// Search for documents of types matching the patterns with the client. Search with a timeout returns no hits if its
+// statements are canceled
+func searchDocuments(indexPattern, typePattern string, request *searchRequest, client *db.Client) (*searchResponse, error) {
+	if request.Timeout == 0 {
+		return searchTimedDocuments(indexPattern, typePattern, request, client)
+	}
+	var response *searchResponse
+	timedOut, err := client.WithStatementTimeout(request.Timeout, func(timed *db.Client) (err error) {
+		response, err = searchTimedDocuments(indexPattern, typePattern, request, timed)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if timedOut {
+		response = &searchResponse{
+			TimedOut: true,
+			Shards:   shardInfo{1, 0, 1},
+			Hits:     searchHits{Hits: []documentSearchResponse{}},
+		}
+		if request.TrackTotalHits >= 0 {
+			response.Hits.Total = formatTotalHits(&db.TotalHits{Value: 0, Relation: "gte"}, request.TotalHitsAsInt)
+		}
+	}
+	return response, nil
+}
+
+// Search for documents of types matching the patterns with the client without the timeout
+func searchTimedDocuments(indexPattern, typePattern string, request *searchRequest, client *db.Client) (*searchResponse, error) {
+	query, firstContext, err := buildSearchQuery(indexPattern, typePattern, request, client)
+	if err != nil {
+		return nil, err
+	}
+	hits, total, err := client.ProcessSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	response := &searchResponse{
+		TimedOut: false,
+		Shards:   shardInfo{1, 0, 1},
+		Hits: searchHits{
+			MaxScore: 0,
+			Total:    formatTotalHits(total, request.TotalHitsAsInt),
+			Hits:     []documentSearchResponse{},
+		},
+	}
+	if request.TerminateAfter > 0 {
+		terminated := total != nil && total.Value >= request.TerminateAfter
+		response.TerminatedEarly = &terminated
+	}
+	if request.ExplainSQL {
+		statement, plan, err := client.ExplainSearchQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		response.ExplainSQL = &sqlExplanation{SQL: statement, Plan: plan}
+	}
+	if request.Aggregations != nil && firstContext != nil {
+		aggregations, err := search.ParseAggregations(request.Aggregations, db.AggregationDocuments, firstContext)
+		if err != nil {
+			return nil, err
+		}
+		if response.Aggregations, err = client.ProcessAggregations(query, aggregations); err != nil {
+			return nil, err
+		}
+	}
+	if request.Suggest != nil && firstContext != nil {
+		if response.Suggest, err = firstContext.Suggest(request.Suggest, query.Source); err != nil {
+			return nil, err
+		}
+	}
+	for _, hit := range hits {
+		docResponse := formatDocumentSearchResponse(hit)
+		if len(request.Sort) > 0 || request.Pit != nil {
+			docResponse.Sort = hit.Sort
+		}
+		docResponse.InnerHits = hit.InnerHits
+		docResponse.Highlight = hit.Highlight
+		docResponse.Fields = hit.Fields
+		response.Hits.Hits = append(response.Hits.Hits, docResponse)
+		if response.Hits.MaxScore < docResponse.Score {
+			response.Hits.MaxScore = docResponse.Score
+		}
+	}
+	return response, nil
+}
+
+// Build a search query over types matching the patterns. Aggregations and suggestions are calculated with mapping of
+// the first type, its context is returned too
+func buildSearchQuery(indexPattern, typePattern string, request *searchRequest, client *db.Client) (*db.SearchQuery, *search.QueryContext, error) {
+	source, err := search.SourceFilter(request.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	query := &db.SearchQuery{Source: source, From: request.From, Size: request.Size, TrackTotalHits: request.TrackTotalHits}
+	sortFields := request.Sort
+	if len(sortFields) == 0 {
+		sortFields = search.DefaultSort()
+	}
+	for _, field := range sortFields {
+		query.Order = append(query.Order, field.SQLOrder())
+	}
+	if len(request.SearchAfter) > 0 {
+		if query.SearchAfter, err = parseSearchAfter(request, len(sortFields)); err != nil {
+			return nil, nil, err
+		}
+	}
+	query.Tiebreaker = request.Pit != nil
+	query.MinScore = request.MinScore
+	query.TerminateAfter = request.TerminateAfter
+	for _, rescorer := range request.Rescore {
+		query.Rescore = append(query.Rescore, db.Rescorer{
+			WindowSize:         rescorer.WindowSize,
+			QueryWeight:        rescorer.QueryWeight,
+			RescoreQueryWeight: rescorer.RescoreQueryWeight,
+			ScoreMode:          rescorer.ScoreMode,
+		})
+	}
+	if request.Collapse != nil {
+		query.Collapsed = true
+		for _, innerHits := range request.Collapse.InnerHits {
+			collapseHits := db.CollapseInnerHits{Name: innerHits.Name, From: innerHits.From, Size: innerHits.Size}
+			for _, field := range innerHits.Sort {
+				collapseHits.Order = append(collapseHits.Order, field.SQLOrder())
+			}
+			query.CollapseInnerHits = append(query.CollapseInnerHits, collapseHits)
+		}
+	}
+
+	indices, err := client.FindIndices(indexPattern)
+	if err != nil {
+		return nil, nil, utils.NewInternalError(err.Error())
+	}
+	var firstContext *search.QueryContext
+	for _, index := range indices {
+		types, err := client.FindTypes(index, typePattern)
+		if err != nil {
+			return nil, nil, utils.NewInternalError(err.Error())
+		}
+		// Get type mapping and analysis settings from system records
+		indexRecord, err := client.GetIndex(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, typeName := range types {
+			docType, err := client.GetType(index, typeName)
+			if err != nil {
+				return nil, nil, err
+			}
+			ctx, err := search.NewQueryContext(indexRecord, docType, client)
+			if err != nil {
+				return nil, nil, err
+			}
+			var clause *search.Clause
+			if request.Query != nil {
+				if clause, err = search.ParseSearchQuery(request.Query, ctx); err != nil {
+					return nil, nil, err
+				}
+			}
+			if request.Knn != nil {
+				if clause, err = search.ParseKnnSearch(request.Knn, clause, ctx); err != nil {
+					return nil, nil, err
+				}
+			}
+			highlight, err := ctx.HighlightExpression(request.Highlight)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields, err := ctx.FieldsExpression(request.Fields)
+			if err != nil {
+				return nil, nil, err
+			}
+			var sortKeys []string
+			for _, field := range sortFields {
+				sortKeys = append(sortKeys, ctx.SortExpression(field, clause.Score))
+			}
+			searchSource := db.SearchSource{
+				Index:     index,
+				Type:      typeName,
+				Condition: clause.Condition,
+				Score:     clause.Score,
+				Sort:      sortKeys,
+				InnerHits: ctx.InnerHitsExpression(),
+				Highlight: highlight,
+				Fields:    fields,
+			}
+			if err = addSearchOptions(&searchSource, request, ctx); err != nil {
+				return nil, nil, err
+			}
+			query.Sources = append(query.Sources, searchSource)
+			if firstContext == nil {
+				firstContext = ctx
+			}
+		}
+	}
+
+	return query, firstContext, nil
+}
+
+// Add post filter, collapse and rescore queries of a search request to a searched source
+func addSearchOptions(source *db.SearchSource, request *searchRequest, ctx *search.QueryContext) error {
+	if request.PostFilter != nil {
+		postFilter, err := search.ParseSearchQuery(request.PostFilter, ctx)
+		if err != nil {
+			return err
+		}
+		source.PostFilter = postFilter.Condition
+	}
+	if request.Collapse != nil {
+		var err error
+		if source.Collapse, err = ctx.CollapseExpression(request.Collapse.Field); err != nil {
+			return err
+		}
+		for _, innerHits := range request.Collapse.InnerHits {
+			var sortKeys []string
+			for _, field := range innerHits.Sort {
+				sortKeys = append(sortKeys, ctx.SortExpression(field, source.Score))
+			}
+			source.CollapseSort = append(source.CollapseSort, sortKeys)
+		}
+	}
+	for _, rescorer := range request.Rescore {
+		rescore, err := search.ParseSearchQuery(rescorer.Query, ctx)
+		if err != nil {
+			return err
+		}
+		source.Rescore = append(source.Rescore, db.RescoreQuery{Condition: rescore.Condition, Score: rescore.Score})
+	}
+	return nil
+}
+
+// Check sort values of search after. They could be followed by a tiebreaker which is returned as the last sort value
+// of searches with a point in time
+func parseSearchAfter(request *searchRequest, sortKeys int) ([]interface{}, error) {
+	if request.From > 0 {
+		return nil, utils.NewIllegalQueryError("[from] parameter must be set to 0 when [search_after] is used")
+	}
+	searchAfter := request.SearchAfter
+	if len(searchAfter) == sortKeys+1 {
+		location, ok := searchAfter[sortKeys].([]interface{})
+		if !ok || len(location) != 3 {
+			return nil, utils.NewIllegalQueryError("[search_after] tiebreaker must be an array of index, type and id")
+		}
+	} else if len(searchAfter) != sortKeys {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("search_after has %d value(s) but sort has %d", len(searchAfter), sortKeys))
+	}
+	return searchAfter, nil
+}
+
+// Parse a list parameter of a request given as an array or as a comma separated string
+func listParameter(value interface{}) []interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		return value
+	case string:
+		var result []interface{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return []interface{}{value}
+}
+
+// Parse an integer parameter of a request. Numbers could be passed as strings
+func intParameter(name string, value interface{}) (int, error) {
+	if number, ok := value.(float64); ok {
+		return int(number), nil
+	}
+	if text, ok := value.(string); ok {
+		if number, err := strconv.Atoi(text); err == nil {
+			return number, nil
+		}
+	}
+	return 0, utils.NewIllegalQueryError(fmt.Sprintf("[%s] should be an integer, got [%v]", name, value))
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/db"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// sqlRequest is a request of SQL endpoint. Query is a SELECT statement, Filter is a query which limits searched
+// documents. Cursor continues results of a previous request instead of the query
+type sqlRequest struct {
+	Query     string                 `json:"query"`
+	Filter    map[string]interface{} `json:"filter"`
+	FetchSize int                    `json:"fetch_size"`
+	Cursor    string                 `json:"cursor"`
+}
+
+// sqlCursor is a state of paging through results of a SQL query. Cursors are stateless, the query is executed again
+// for each page
+type sqlCursor struct {
+	Query     string                 `json:"query"`
+	Filter    map[string]interface{} `json:"filter,omitempty"`
+	FetchSize int                    `json:"fetch_size"`
+	Offset    int                    `json:"offset"`
+}
+
+type sqlResponse struct {
+	Columns []search.SQLColumn `json:"columns,omitempty"`
+	Rows    [][]interface{}    `json:"rows"`
+	Cursor  string             `json:"cursor,omitempty"`
+}
+
+type sqlCloseResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// Number of rows of a page of SQL results returned by default
+const defaultSQLFetchSize = 1000
+
+// SQLHandler handles a SELECT statement over indices. Rows are returned by pages in json, txt or csv format, columns
+// are described on the first page only. Cursor of the next page is returned in the body of json response and in
+// Cursor header of text responses
+func SQLHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "txt", "csv":
+	default:
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("[sql] unknown format [%s]", format))
+	}
+	request, err := parseSQLRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	cursor := sqlCursor{Query: request.Query, Filter: request.Filter, FetchSize: request.FetchSize}
+	if len(request.Cursor) > 0 {
+		if cursor, err = decodeSQLCursor(request.Cursor); err != nil {
+			return nil, err
+		}
+	} else if len(strings.TrimSpace(request.Query)) == 0 {
+		return nil, utils.NewIllegalQueryError("[sql] query is required")
+	}
+	switch {
+	case cursor.FetchSize < 0:
+		return nil, utils.NewIllegalQueryError("[sql] fetch_size must be positive")
+	case cursor.FetchSize == 0:
+		cursor.FetchSize = defaultSQLFetchSize
+	}
+	columns, rows, next, err := executeSQL(cursor, s.GetDBClient())
+	if err != nil {
+		return nil, err
+	}
+	firstPage := len(request.Cursor) == 0
+	headers := make(map[string]string)
+	if len(next) > 0 {
+		headers["Cursor"] = next
+	}
+	switch format {
+	case "txt":
+		return server.TextOutput{ContentType: "text/plain; charset=UTF-8", Headers: headers, Text: formatSQLText(columns, rows, firstPage)}, nil
+	case "csv":
+		return server.TextOutput{ContentType: "text/csv; charset=UTF-8", Headers: headers, Text: formatSQLCSV(columns, rows, firstPage)}, nil
+	}
+	response := sqlResponse{Rows: rows, Cursor: next}
+	if firstPage {
+		response.Columns = columns
+	}
+	return response, nil
+}
+
+// SQLCloseHandler handles request to close a cursor of SQL results. Cursors don't hold any resources, so the cursor
+// is only validated
+func SQLCloseHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	request, err := parseSQLRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Cursor) == 0 {
+		return nil, utils.NewIllegalQueryError("[sql] cursor is required")
+	}
+	if _, err = decodeSQLCursor(request.Cursor); err != nil {
+		return nil, err
+	}
+	return sqlCloseResponse{Succeeded: true}, nil
+}
+
+// Parse a request of SQL endpoint from its body
+func parseSQLRequest(r *http.Request) (*sqlRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	var request sqlRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		return nil, utils.NewJSONWrongFormatError(err.Error())
+	}
+	return &request, nil
+}
+
+// Decode a cursor of SQL results
+func decodeSQLCursor(encoded string) (sqlCursor, error) {
+	var cursor sqlCursor
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(decoded, &cursor)
+	}
+	if err != nil || len(cursor.Query) == 0 || cursor.FetchSize <= 0 || cursor.Offset < 0 {
+		return cursor, utils.NewIllegalQueryError("[sql] invalid cursor")
+	}
+	return cursor, nil
+}
+
+// Encode a cursor of SQL results
+func encodeSQLCursor(cursor sqlCursor) (string, error) {
+	encoded, err := json.Marshal(cursor)
+	if err != nil {
+		return "", utils.NewInternalError(err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// Execute a page of a SQL query. Documents of all types of indices matching FROM clause are selected, fields are
+// resolved with mapping of the first type. Returns columns, rows and a cursor of the next page if there is one
+func executeSQL(cursor sqlCursor, client *db.Client) ([]search.SQLColumn, [][]interface{}, string, error) {
+	statement, err := search.ParseSQL(cursor.Query)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	indices, err := client.FindIndices(statement.From)
+	if err != nil {
+		return nil, nil, "", utils.NewInternalError(err.Error())
+	}
+	if len(indices) == 0 {
+		return nil, nil, "", utils.NewIllegalQueryError(fmt.Sprintf("[sql] unknown index [%s]", statement.From))
+	}
+	var sources []db.SearchSource
+	var firstContext *search.QueryContext
+	for _, index := range indices {
+		types, err := client.FindTypes(index, "*")
+		if err != nil {
+			return nil, nil, "", utils.NewInternalError(err.Error())
+		}
+		indexRecord, err := client.GetIndex(index)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, typeName := range types {
+			docType, err := client.GetType(index, typeName)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			ctx, err := search.NewQueryContext(indexRecord, docType, client)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			source := db.SearchSource{Index: index, Type: typeName, Condition: "TRUE"}
+			if cursor.Filter != nil {
+				clause, err := search.ParseSearchQuery(cursor.Filter, ctx)
+				if err != nil {
+					return nil, nil, "", err
+				}
+				source.Condition = clause.Condition
+			}
+			sources = append(sources, source)
+			if firstContext == nil {
+				firstContext = ctx
+			}
+		}
+	}
+	if firstContext == nil {
+		if firstContext, err = search.NewQueryContext(nil, nil, client); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	var fields []string
+	if statement.SelectsAll() {
+		if fields, err = selectedFields(firstContext, sources, client); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	query, columns, err := firstContext.TranslateSQL(statement, fields)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	query.Sources = sources
+	query.Offset = cursor.Offset
+	// One more row is selected to find out if there is the next page
+	query.Limit = cursor.FetchSize + 1
+	if statement.Limit >= 0 && statement.Limit-cursor.Offset <= cursor.FetchSize {
+		query.Limit = statement.Limit - cursor.Offset
+		if query.Limit < 0 {
+			query.Limit = 0
+		}
+	}
+	rows, err := client.ProcessSQLQuery(query)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	next := ""
+	if len(rows) > cursor.FetchSize {
+		rows = rows[:cursor.FetchSize]
+		nextCursor := cursor
+		nextCursor.Offset += cursor.FetchSize
+		if next, err = encodeSQLCursor(nextCursor); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return columns, rows, next, nil
+}
+
+// Get fields selected by star. Mapped fields are selected if there are any, otherwise all keys of documents
+func selectedFields(ctx *search.QueryContext, sources []db.SearchSource, client *db.Client) ([]string, error) {
+	var fields []string
+	for field := range utils.MappedFields(ctx.Mapping) {
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return client.DocumentKeys(sources)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// Format rows of SQL results as a text table
+func formatSQLText(columns []search.SQLColumn, rows [][]interface{}, header bool) string {
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		if header {
+			widths[i] = utf8.RuneCountInString(column.Name)
+		}
+		for _, row := range rows {
+			if width := utf8.RuneCountInString(formatSQLValue(row[i], "null")); width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	writeLine := func(values []string) {
+		for i, value := range values {
+			if i > 0 {
+				buffer.WriteString("|")
+			}
+			buffer.WriteString(value + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value)))
+		}
+		buffer.WriteString("\n")
+	}
+	if header {
+		var names, separators []string
+		for i, column := range columns {
+			names = append(names, column.Name)
+			separators = append(separators, strings.Repeat("-", widths[i]))
+		}
+		writeLine(names)
+		buffer.WriteString(strings.Join(separators, "+") + "\n")
+	}
+	for _, row := range rows {
+		var values []string
+		for _, value := range row {
+			values = append(values, formatSQLValue(value, "null"))
+		}
+		writeLine(values)
+	}
+	return buffer.String()
+}
+
+// Format rows of SQL results as CSV. Nulls are empty values
+func formatSQLCSV(columns []search.SQLColumn, rows [][]interface{}, header bool) string {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if header {
+		var names []string
+		for _, column := range columns {
+			names = append(names, column.Name)
+		}
+		writer.Write(names)
+	}
+	for _, row := range rows {
+		var values []string
+		for _, value := range row {
+			values = append(values, formatSQLValue(value, ""))
+		}
+		writer.Write(values)
+	}
+	writer.Flush()
+	return buffer.String()
+}
+
+// Format a value of SQL results as text. Strings are not quoted
+func formatSQLValue(value interface{}, null string) string {
+	switch value := value.(type) {
+	case nil:
+		return null
+	case string:
+		return value
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
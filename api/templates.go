@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/api/search"
+	"github.com/asp437/pg_elastic/server"
+	"github.com/asp437/pg_elastic/utils"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type scriptBody struct {
+	Lang   string      `json:"lang"`
+	Source interface{} `json:"source"`
+}
+
+type scriptGetResponse struct {
+	ID     string      `json:"_id"`
+	Found  bool        `json:"found"`
+	Script *scriptBody `json:"script,omitempty"`
+}
+
+type scriptPutResponse struct {
+	Acknowledged bool `json:"acknowledged"`
+}
+
+type renderTemplateResponse struct {
+	TemplateOutput interface{} `json:"template_output"`
+}
+
+// searchTemplateRequest is a body of search template request. Template is given by ID of a stored script or by its
+// source which is a string or a JSON object
+type searchTemplateRequest struct {
+	ID     string                 `json:"id"`
+	Source interface{}            `json:"source"`
+	Params map[string]interface{} `json:"params"`
+}
+
+var scriptHandlerPattern = regexp.MustCompile("^/_scripts/(?P<id>[^/]+)")
+var renderTemplateHandlerPattern = regexp.MustCompile("^/_render/template/(?P<id>[^/]+)")
+
+// PutScriptHandler handles request to store a script. Source of a script could be a JSON object, it is stored as text
+func PutScriptHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	id := scriptHandlerPattern.ReplaceAllString(endpoint, "${id}")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	var request struct {
+		Script *scriptBody `json:"script"`
+	}
+	if err = json.Unmarshal(body, &request); err != nil {
+		return nil, utils.NewJSONWrongFormatError(err.Error())
+	}
+	if request.Script == nil {
+		return nil, utils.NewIllegalQueryError("[script] must be specified for stored script")
+	}
+	if len(request.Script.Lang) == 0 {
+		return nil, utils.NewIllegalQueryError("must specify lang for stored script")
+	}
+	source, err := templateSource(request.Script.Source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.GetDBClient().PutScript(id, request.Script.Lang, source); err != nil {
+		return nil, err
+	}
+	return scriptPutResponse{true}, nil
+}
+
+// GetScriptHandler handles request to get a stored script
+func GetScriptHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	id := scriptHandlerPattern.ReplaceAllString(endpoint, "${id}")
+	script, err := s.GetDBClient().GetScript(id)
+	if err != nil {
+		return nil, err
+	}
+	response := scriptGetResponse{ID: id, Found: script != nil}
+	if script != nil {
+		response.Script = &scriptBody{Lang: script.Lang, Source: script.Source}
+	}
+	return response, nil
+}
+
+// DeleteScriptHandler handles request to delete a stored script
+func DeleteScriptHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	id := scriptHandlerPattern.ReplaceAllString(endpoint, "${id}")
+	found, err := s.GetDBClient().DeleteScript(id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, utils.NewIllegalQueryError(fmt.Sprintf("stored script [%s] does not exist", id))
+	}
+	return scriptPutResponse{true}, nil
+}
+
+// SearchTemplateDocumentHandler handles request to search documents with a query rendered from a mustache template
+func SearchTemplateDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	startTime := time.Now()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	rendered, err := renderSearchTemplate(body, s)
+	if err != nil {
+		return nil, err
+	}
+	request, err := parseSearchBody(rendered, r.URL.Query(), r.Header.Get("Accept"))
+	if err != nil {
+		return nil, err
+	}
+	result, err := executeSearch(indexPattern, typePattern, request, s)
+	if err != nil {
+		return nil, err
+	}
+	result.Took = (int)(time.Since(startTime).Nanoseconds() / 1000000.0)
+	return result, nil
+}
+
+// SearchTemplateIndexDocumentHandler handles search template request over documents of any type
+func SearchTemplateIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_search/template")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return SearchTemplateDocumentHandler(indexName, "*", endpoint, r, s)
+}
+
+// SearchTemplateAllDocumentHandler handles search template request over documents of any index
+func SearchTemplateAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return SearchTemplateDocumentHandler("*", "*", endpoint, r, s)
+}
+
+// MultiSearchTemplateDocumentHandler handles request to execute several searches with queries rendered from templates
+func MultiSearchTemplateDocumentHandler(indexPattern, typePattern, endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	return multiSearch(indexPattern, typePattern, r, s, true)
+}
+
+// MultiSearchTemplateIndexDocumentHandler handles multi search template request over documents of the index
+func MultiSearchTemplateIndexDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	var indexHandlerPattern = regexp.MustCompile("^/(?P<index>\\w+)/_msearch/template")
+	indexName := indexHandlerPattern.ReplaceAllString(endpoint, "${index}")
+	return MultiSearchTemplateDocumentHandler(indexName, "*", endpoint, r, s)
+}
+
+// MultiSearchTemplateAllDocumentHandler handles multi search template request over documents of any index
+func MultiSearchTemplateAllDocumentHandler(endpoint string, r *http.Request, s server.PGElasticServer) (response interface{}, err error) {
+	return MultiSearchTemplateDocumentHandler("*", "*", endpoint, r, s)
+}
+
+// RenderTemplateHandler handles request to render a search template without execution. ID of a stored template could
+// be given in the path
+func RenderTemplateHandler(endpoint string, r *http.Request, s server.PGElasticServer) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utils.NewInternalIOError(err.Error())
+	}
+	if renderTemplateHandlerPattern.MatchString(endpoint) {
+		var request map[string]interface{}
+		if err = json.Unmarshal(body, &request); err != nil {
+			return nil, utils.NewJSONWrongFormatError(err.Error())
+		}
+		if request == nil {
+			request = make(map[string]interface{})
+		}
+		request["id"] = renderTemplateHandlerPattern.ReplaceAllString(endpoint, "${id}")
+		if body, err = json.Marshal(request); err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+	}
+	rendered, err := renderSearchTemplate(body, s)
+	if err != nil {
+		return nil, err
+	}
+	var output interface{}
+	if err = json.Unmarshal(rendered, &output); err != nil {
+		return nil, utils.NewJSONWrongFormatError(fmt.Sprintf("rendered template is not valid JSON: %s", err.Error()))
+	}
+	return renderTemplateResponse{output}, nil
+}
+
+// Render a search template request into a search request body
+func renderSearchTemplate(body []byte, s server.PGElasticServer) ([]byte, error) {
+	var request searchTemplateRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, utils.NewJSONWrongFormatError(err.Error())
+	}
+	var source string
+	if len(request.ID) > 0 {
+		script, err := s.GetDBClient().GetScript(request.ID)
+		if err != nil {
+			return nil, err
+		}
+		if script == nil {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("unable to find script [%s]", request.ID))
+		}
+		if script.Lang != "mustache" {
+			return nil, utils.NewIllegalQueryError(fmt.Sprintf("stored script [%s] is not a mustache template", request.ID))
+		}
+		source = script.Source
+	} else {
+		var err error
+		if source, err = templateSource(request.Source); err != nil {
+			return nil, err
+		}
+	}
+	rendered, err := search.RenderTemplate(source, request.Params)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(rendered), nil
+}
+
+// Get text of a template given as a string or as a JSON object
+func templateSource(source interface{}) (string, error) {
+	switch source := source.(type) {
+	case string:
+		return source, nil
+	case map[string]interface{}:
+		text, err := json.Marshal(source)
+		if err != nil {
+			return "", utils.NewInternalError(err.Error())
+		}
+		return string(text), nil
+	}
+	return "", utils.NewIllegalQueryError("[source] of a template must be a string or an object")
+}
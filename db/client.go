@@ -5,17 +5,21 @@ import (
 	"github.com/asp437/pg_elastic/utils"
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
+	"github.com/go-pg/pg/types"
+	"regexp"
 	"strings"
+	"time"
 )
 
-// Client is a database client connection
+// Client is a database client connection. Queries are executed by connection, which is the pool of connections or a
+// transaction of a point in time
 type Client struct {
-	connection *pg.DB
+	connection orm.DB
+	pool       *pg.DB
+	features   Features
+	pits       *pointsInTime
 }
 
-// Query is alias for orm.Query type. Used to implement other packages of the project without linking it to pg/orm
-type Query = orm.Query
-
 // IndexRecord contains information about index stored in database
 type IndexRecord struct {
 	Name    string
@@ -36,6 +40,19 @@ type ElasticSearchDocument struct {
 	Version  int
 }
 
+// TermStatistic contains statistics of a term in documents of a type
+type TermStatistic struct {
+	Word   string
+	Ndoc   int
+	Nentry int
+}
+
+// Token is a term produced by text analysis
+type Token struct {
+	Term     string
+	Position int
+}
+
 /*
  * General Client API
  */
@@ -44,51 +61,106 @@ type ElasticSearchDocument struct {
 // Doesn't check connection to DB server
 func CreateClient(config utils.PostgresConnectionConfig) (result *Client) {
 	result = new(Client)
-	result.connection = pg.Connect(&pg.Options{
+	options := pg.Options{
 		User:     config.User,
 		Addr:     config.ServerAddress,
 		Password: config.Password,
 		Database: config.DBName,
-	})
+	}
+	// Points in time hold their connections for a long time, so they use a separate pool
+	pitOptions := options
+	pitOptions.PoolSize = MaxOpenPointsInTime
+	result.pool = pg.Connect(&options)
+	result.connection = result.pool
+	result.pits = &pointsInTime{pool: pg.Connect(&pitOptions), pits: make(map[string]*pointInTime)}
 	return result
 }
 
 // InitializeSchema initializes system tables used by pg_elastic
 // Doesn't affect existing tables
 func (dbc *Client) InitializeSchema() error {
-	for _, model := range []interface{}{&IndexRecord{}, &TypeRecord{}} {
-		err := dbc.connection.CreateTable(model, &orm.CreateTableOptions{IfNotExists: true})
+	for _, model := range []interface{}{&IndexRecord{}, &TypeRecord{}, &ScriptRecord{}} {
+		err := orm.CreateTable(dbc.connection, model, &orm.CreateTableOptions{IfNotExists: true})
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	// Definitions of some functions depend on installed extensions
+	err := dbc.loadFeatures()
+	if err != nil {
+		return err
+	}
+	return dbc.createFunctions()
 }
 
-// NewQuery creates  Query instance for specified index and type
-func (dbc *Client) NewQuery(indexName, typeName string) *Query {
-	tableName := fmt.Sprintf("%s_%s", indexName, typeName)
-	return dbc.connection.Model().Table(tableName)
+// PoolSize returns maximal number of connections to DB server opened by the client
+func (dbc *Client) PoolSize() int {
+	return dbc.pool.Options().PoolSize
 }
 
-// ProcessSearchQuery does a processing of ElasticSearch-format query
-func (dbc *Client) ProcessSearchQuery(indexName, typeName string, query *Query) ([]ElasticSearchDocument, error) {
-	var documentObject []ElasticSearchDocument
+// WithStatementTimeout calls function with a client whose statements are canceled after the timeout. Statements are
+// executed in a transaction unless the client already uses one. Returns true if a statement was canceled
+func (dbc *Client) WithStatementTimeout(timeout time.Duration, function func(*Client) error) (bool, error) {
+	milliseconds := int64(timeout / time.Millisecond)
+	if milliseconds < 1 {
+		milliseconds = 1
+	}
+	err := dbc.withTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d;", milliseconds)); err != nil {
+			return utils.NewDBQueryError(err.Error())
+		}
+		client := *dbc
+		client.connection = tx
+		return function(&client)
+	})
+	// Statements canceled by the timeout fail with query_canceled error
+	if err != nil && strings.Contains(err.Error(), "#57014") {
+		return true, nil
+	}
+	return false, err
+}
 
-	c, err := query.Count()
+// Call function with a transaction of the client. A new transaction is rolled back, so the function should not
+// change anything
+func (dbc *Client) withTransaction(function func(*pg.Tx) error) error {
+	if tx, ok := dbc.connection.(*pg.Tx); ok {
+		return function(tx)
+	}
+	tx, err := dbc.pool.Begin()
 	if err != nil {
-		return nil, utils.NewDBQueryError(err.Error())
+		return utils.NewDBQueryError(err.Error())
 	}
-	if c == 0 {
-		return nil, nil
+	defer tx.Rollback()
+	return function(tx)
+}
+
+// Analyze evaluates SQL expression of tsvector type and returns its terms ordered by positions
+func (dbc *Client) Analyze(vector string) ([]Token, error) {
+	var tokens []Token
+	queryString := fmt.Sprintf("SELECT t.lexeme AS term, p.position FROM unnest(%s) AS t, unnest(coalesce(t.positions, '{0}')) AS p(position) ORDER BY 2, 1;", vector)
+	_, err := dbc.connection.Query(&tokens, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
 	}
+	return tokens, nil
+}
 
-	err = query.Select(&documentObject)
+// TermStatistics collects statistics of terms produced by tsvector expression over all documents of the type.
+// Terms are filtered by SQL condition over word column
+func (dbc *Client) TermStatistics(indexName, typeName, vector, condition string) ([]TermStatistic, error) {
+	var statistics []TermStatistic
+	documentsQuery := fmt.Sprintf("SELECT %s FROM %s", vector, TableName(indexName, typeName))
+	queryString := fmt.Sprintf("SELECT word, ndoc, nentry FROM ts_stat(%s) WHERE %s;", types.AppendString(nil, documentsQuery, 1), condition)
+	_, err := dbc.connection.Query(&statistics, queryString)
 	if err != nil {
 		return nil, utils.NewDBQueryError(err.Error())
 	}
+	return statistics, nil
+}
 
-	return documentObject, nil
+// TableName returns a name of the table which stores documents of the type
+func TableName(indexName, typeName string) string {
+	return fmt.Sprintf("%s_%s", indexName, typeName)
 }
 
 /*
@@ -174,6 +246,14 @@ func (dbc *Client) CreateType(indexName, typeName, options string) (*TypeRecord,
 		if err != nil {
 			return nil, utils.NewDBQueryError(err.Error())
 		}
+		err = dbc.createVectorColumns(indexName, typeName)
+		if err != nil {
+			return nil, err
+		}
+		err = dbc.createCompletionTables(indexName, typeName)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		return nil, utils.NewIllegalQueryError("Type already exists")
 	}
@@ -205,6 +285,14 @@ func (dbc *Client) UpdateTypeOptions(indexName, typeName, options string) (*Type
 	if err != nil {
 		return nil, utils.NewDBQueryError(err.Error())
 	}
+	err = dbc.createVectorColumns(indexName, typeName)
+	if err != nil {
+		return nil, err
+	}
+	err = dbc.createCompletionTables(indexName, typeName)
+	if err != nil {
+		return nil, err
+	}
 	return dbc.GetType(indexName, typeName)
 }
 
@@ -225,6 +313,44 @@ func (dbc *Client) FindTypes(index, typePattern string) ([]string, error) {
 	return results, nil
 }
 
+// FieldType is a field of documents of a type with a mapping type inferred from its values
+type FieldType struct {
+	Path string
+	Type string
+}
+
+// Number of documents which types of fields are inferred from
+const inferenceSampleSize = 1000
+
+// InferFieldTypes infers mapping types of leaf fields of a sample of documents of the type like dynamic mapping does.
+// Strings are inferred as text, integers as long, other numbers as float. Values of arrays are treated as values of
+// the field itself
+func (dbc *Client) InferFieldTypes(indexName, typeName string) ([]FieldType, error) {
+	var fields []FieldType
+	queryString := fmt.Sprintf(`WITH RECURSIVE fields(path, value) AS (
+		SELECT NULL::text, d.document FROM (SELECT document FROM %s LIMIT %d) AS d
+		UNION ALL
+		SELECT coalesce(f.path || '.' || c.key, c.key, f.path), c.value FROM fields AS f, LATERAL (
+			SELECT e.key, e.value FROM jsonb_each(CASE WHEN jsonb_typeof(f.value) = 'object' THEN f.value ELSE '{}' END) AS e
+			UNION ALL
+			SELECT NULL, e.value FROM jsonb_array_elements(CASE WHEN jsonb_typeof(f.value) = 'array' THEN f.value ELSE '[]' END) AS e
+		) AS c
+	)
+	SELECT path, CASE
+		WHEN bool_or(jsonb_typeof(value) = 'string') THEN 'text'
+		WHEN bool_or(jsonb_typeof(value) = 'number') THEN
+			CASE WHEN bool_and(jsonb_typeof(value) <> 'number' OR (value #>> '{}')::numeric = trunc((value #>> '{}')::numeric)) THEN 'long' ELSE 'float' END
+		ELSE 'boolean'
+	END AS type
+	FROM fields WHERE path IS NOT NULL AND jsonb_typeof(value) IN ('string', 'number', 'boolean') GROUP BY path ORDER BY path;`,
+		TableName(indexName, typeName), inferenceSampleSize)
+	_, err := dbc.connection.Query(&fields, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return fields, nil
+}
+
 /*
  * Documents API
  */
@@ -275,7 +401,7 @@ func (dbc *Client) GetDocument(indexName, typeName string, documentID string) (*
 	var documentObject ElasticSearchDocument
 
 	tableName := fmt.Sprintf("%s_%s", indexName, typeName)
-	query := dbc.connection.Model().TableExpr(tableName).Where("id = ?", documentID)
+	query := dbc.connection.Model().TableExpr(tableName).Column("id", "document", "version").Where("id = ?", documentID)
 
 	c, err := query.Count()
 	if err != nil {
@@ -360,6 +486,139 @@ func (dbc *Client) createDataTable(indexName, typeName string) error {
 	return nil
 }
 
+// VectorColumn returns SQL name of the column which stores values of a dense_vector field as float8[]
+func VectorColumn(fieldName string) string {
+	return `"` + vectorColumnName(fieldName) + `"`
+}
+
+// Get unquoted name of the column of a dense_vector field
+func vectorColumnName(fieldName string) string {
+	return "vector_" + fieldNamePattern.ReplaceAllString(strings.ToLower(fieldName), "_")
+}
+
+// CompletionTable returns SQL name of the table which stores inputs of a completion field of the type. It has id,
+// input, weight and contexts columns
+func CompletionTable(indexName, typeName, fieldName string) string {
+	return `"` + completionTableName(indexName, typeName, fieldName) + `"`
+}
+
+// Get unquoted name of the table of a completion field
+func completionTableName(indexName, typeName, fieldName string) string {
+	return TableName(indexName, typeName) + "_completion_" + fieldNamePattern.ReplaceAllString(strings.ToLower(fieldName), "_")
+}
+
+var fieldNamePattern = regexp.MustCompile("[^a-z0-9_]")
+
+// ValidateMapping checks that fields of a type mapping could be stored. It should be called before the mapping is
+// saved, since columns and tables of fields are created after that
+func ValidateMapping(mapping map[string]interface{}) error {
+	for _, field := range utils.FindFieldsOfType(mapping, "dense_vector") {
+		fieldMapping, _ := utils.GetFieldMapping(mapping, field)
+		if fieldMapping.Dims <= 0 {
+			return utils.NewIllegalQueryError(fmt.Sprintf("The [dims] property must be specified for field [%s]", field))
+		}
+		if _, ok := vectorOperatorClasses[fieldMapping.Similarity]; !ok {
+			return utils.NewIllegalQueryError(fmt.Sprintf("Unknown similarity [%s] of field [%s]", fieldMapping.Similarity, field))
+		}
+	}
+	for _, field := range utils.FindFieldsOfType(mapping, "completion") {
+		fieldMapping, _ := utils.GetFieldMapping(mapping, field)
+		for _, context := range fieldMapping.Contexts {
+			if context.Type != "category" {
+				return utils.NewIllegalQueryError(fmt.Sprintf("Unsupported context type [%s] of field [%s], only category contexts are supported", context.Type, field))
+			}
+		}
+	}
+	return nil
+}
+
+// Add columns of dense_vector fields of the type mapping. Columns are generated from documents, so they are filled on
+// insert and update. Vectors are indexed by HNSW index of pgvector if the extension is installed
+func (dbc *Client) createVectorColumns(indexName, typeName string) error {
+	mapping, err := dbc.typeMapping(indexName, typeName)
+	if err != nil {
+		return err
+	}
+	tableName := TableName(indexName, typeName)
+	for _, field := range utils.FindFieldsOfType(mapping, "dense_vector") {
+		fieldMapping, _ := utils.GetFieldMapping(mapping, field)
+		operatorClass := vectorOperatorClasses[fieldMapping.Similarity]
+		column := VectorColumn(field)
+		path := "{" + strings.Join(strings.Split(field, "."), ",") + "}"
+		queryString := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s float8[] GENERATED ALWAYS AS (pg_elastic_vector(document #> '%s')) STORED CHECK (cardinality(%s) = %d);",
+			tableName, column, strings.Replace(path, "'", "''", -1), column, fieldMapping.Dims)
+		if _, err = dbc.connection.Exec(queryString); err != nil {
+			return utils.NewDBQueryError(err.Error())
+		}
+		if !fieldMapping.Indexed || !dbc.features.HasExtension("vector") {
+			continue
+		}
+		queryString = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_%s_idx" ON %s USING hnsw ((%s::vector(%d)) %s);`,
+			tableName, vectorColumnName(field), tableName, column, fieldMapping.Dims, operatorClass)
+		if _, err = dbc.connection.Exec(queryString); err != nil {
+			return utils.NewDBQueryError(err.Error())
+		}
+	}
+	return nil
+}
+
+// Create tables of completion fields of the type mapping. Inputs are kept in sync with documents by a trigger and
+// indexed for prefix search. Tables are refilled from existing documents, so they could be created for a type with data
+func (dbc *Client) createCompletionTables(indexName, typeName string) error {
+	mapping, err := dbc.typeMapping(indexName, typeName)
+	if err != nil {
+		return err
+	}
+	tableName := TableName(indexName, typeName)
+	for _, field := range utils.FindFieldsOfType(mapping, "completion") {
+		name := completionTableName(indexName, typeName, field)
+		path := strings.Replace("{"+strings.Join(strings.Split(field, "."), ",")+"}", "'", "''", -1)
+		queries := []string{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (id VARCHAR(128) NOT NULL REFERENCES %s (id) ON DELETE CASCADE ON UPDATE CASCADE, `+
+				"input text NOT NULL, weight integer NOT NULL, contexts jsonb NOT NULL);", name, tableName),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_input_idx" ON "%s" (lower(input) text_pattern_ops);`, name, name),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_id_idx" ON "%s" (id);`, name, name),
+			fmt.Sprintf(`DROP TRIGGER IF EXISTS "%s_trigger" ON %s;`, name, tableName),
+			fmt.Sprintf(`CREATE TRIGGER "%s_trigger" AFTER INSERT OR UPDATE OF document ON %s FOR EACH ROW EXECUTE FUNCTION pg_elastic_completion_trigger('%s', '%s');`,
+				name, tableName, name, path),
+			fmt.Sprintf(`DELETE FROM "%s";`, name),
+			fmt.Sprintf(`INSERT INTO "%s" (id, input, weight, contexts) SELECT id, e.input, e.weight, e.contexts FROM %s, pg_elastic_completion_entries(document #> '%s') AS e;`,
+				name, tableName, path),
+		}
+		for _, queryString := range queries {
+			if _, err = dbc.connection.Exec(queryString); err != nil {
+				return utils.NewDBQueryError(err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Get mapping of the type from its options or from mappings section of its index
+func (dbc *Client) typeMapping(indexName, typeName string) (map[string]interface{}, error) {
+	typeRecord, err := dbc.GetType(indexName, typeName)
+	if err != nil || typeRecord == nil {
+		return nil, err
+	}
+	typeOptions, err := utils.ParseOptions(typeRecord.Options)
+	if err != nil {
+		return nil, err
+	}
+	if mapping, ok := utils.ExtractTypeMapping(typeOptions, typeName); ok {
+		return mapping, nil
+	}
+	indexRecord, err := dbc.GetIndex(indexName)
+	if err != nil || indexRecord == nil {
+		return nil, err
+	}
+	indexOptions, err := utils.ParseOptions(indexRecord.Options)
+	if err != nil {
+		return nil, err
+	}
+	mapping, _ := utils.ExtractTypeMapping(indexOptions, typeName)
+	return mapping, nil
+}
+
 // Insert a new document with default ID
 func (dbc *Client) insertDocument(indexName, typeName, document string) (*ElasticSearchDocument, error) {
 	documentObject := &ElasticSearchDocument{Document: document, Version: 1}
@@ -373,7 +632,7 @@ func (dbc *Client) insertDocument(indexName, typeName, document string) (*Elasti
 
 // Insert a new document with specified ID
 func (dbc *Client) insertDocumentID(indexName, typeName, document, documentID string) (*ElasticSearchDocument, error) {
-	documentObject := &ElasticSearchDocument{documentID, document, 1}
+	documentObject := &ElasticSearchDocument{ID: documentID, Document: document, Version: 1}
 	queryString := fmt.Sprintf("INSERT INTO %s_%s (id, document, version) VALUES(%s, '%s', %d);", indexName, typeName, documentID, document, 1)
 	_, err := dbc.connection.Exec(queryString)
 	if err != nil {
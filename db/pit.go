@@ -0,0 +1,166 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"github.com/go-pg/pg"
+	"sync"
+	"time"
+)
+
+// pointInTime is a snapshot of the database exported by a REPEATABLE READ transaction. The transaction is held open
+// until the point in time is closed or its keep alive expires. Importers is a number of searches which are importing
+// the snapshot, the transaction of a closed point in time is finished only when all of them are done
+type pointInTime struct {
+	tx           *pg.Tx
+	snapshot     string
+	indexPattern string
+	timer        *time.Timer
+	importers    int
+	closed       bool
+}
+
+// pointsInTime is a registry of open points in time shared by all clients of the pool. Transactions of points in time
+// are held by connections of a separate pool, so they never exhaust connections of requests. Opening is a number of
+// points in time which are being opened
+type pointsInTime struct {
+	sync.Mutex
+	pool    *pg.DB
+	pits    map[string]*pointInTime
+	opening int
+}
+
+// MaxOpenPointsInTime is the maximal number of points in time opened at the same time
+const MaxOpenPointsInTime = 16
+
+// MaxPointInTimeKeepAlive is the maximal time a point in time is kept alive without searches
+const MaxPointInTimeKeepAlive = 24 * time.Hour
+
+// OpenPointInTime exports a snapshot of the database for searches over indices matching the pattern. Returns ID of
+// the point in time, it is closed automatically if it is not used for keepAlive. Opening is rejected if there are too
+// many open points in time
+func (dbc *Client) OpenPointInTime(indexPattern string, keepAlive time.Duration) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", utils.NewInternalError(err.Error())
+	}
+	id := base64.RawURLEncoding.EncodeToString(random)
+	dbc.pits.Lock()
+	if len(dbc.pits.pits)+dbc.pits.opening >= MaxOpenPointsInTime {
+		dbc.pits.Unlock()
+		return "", utils.NewRejectedExecutionError(fmt.Sprintf("Trying to create too many point in time contexts. Must be less than or equal to: [%d]", MaxOpenPointsInTime))
+	}
+	dbc.pits.opening++
+	dbc.pits.Unlock()
+	pit, err := dbc.beginPointInTime(indexPattern)
+	dbc.pits.Lock()
+	defer dbc.pits.Unlock()
+	dbc.pits.opening--
+	if err != nil {
+		return "", err
+	}
+	pit.timer = time.AfterFunc(keepAlive, func() { dbc.ClosePointInTime(id) })
+	dbc.pits.pits[id] = pit
+	return id, nil
+}
+
+// Begin a transaction of a point in time on a connection of the pool of points in time and export its snapshot
+func (dbc *Client) beginPointInTime(indexPattern string) (*pointInTime, error) {
+	tx, err := dbc.pits.pool.Begin()
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	pit := &pointInTime{tx: tx, indexPattern: indexPattern}
+	if _, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY;"); err == nil {
+		_, err = tx.QueryOne(pg.Scan(&pit.snapshot), "SELECT pg_export_snapshot();")
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return pit, nil
+}
+
+// ClosePointInTime releases the snapshot of a point in time. Returns false if there is no point in time with the ID
+func (dbc *Client) ClosePointInTime(id string) (bool, error) {
+	dbc.pits.Lock()
+	pit, ok := dbc.pits.pits[id]
+	delete(dbc.pits.pits, id)
+	if ok {
+		pit.closed = true
+	}
+	importing := ok && pit.importers > 0
+	dbc.pits.Unlock()
+	if !ok {
+		return false, nil
+	}
+	pit.timer.Stop()
+	if importing {
+		return true, nil
+	}
+	if err := pit.tx.Rollback(); err != nil {
+		return true, utils.NewDBQueryError(err.Error())
+	}
+	return true, nil
+}
+
+// PointInTimeIndices returns the pattern of indices searched by a point in time
+func (dbc *Client) PointInTimeIndices(id string) (string, error) {
+	dbc.pits.Lock()
+	defer dbc.pits.Unlock()
+	pit, ok := dbc.pits.pits[id]
+	if !ok {
+		return "", utils.NewIllegalQueryError(fmt.Sprintf("No search context found for id [%s]", id))
+	}
+	return pit.indexPattern, nil
+}
+
+// WithPointInTime calls function with a client which sees the database as of the point in time. Queries of the
+// client are executed in a separate transaction importing the snapshot, so several searches could use the same point
+// in time concurrently. Keep alive of the point in time is extended if it is positive
+func (dbc *Client) WithPointInTime(id string, keepAlive time.Duration, function func(*Client) error) error {
+	dbc.pits.Lock()
+	pit, ok := dbc.pits.pits[id]
+	if ok {
+		pit.importers++
+		if keepAlive > 0 {
+			pit.timer.Reset(keepAlive)
+		}
+	}
+	dbc.pits.Unlock()
+	if !ok {
+		return utils.NewIllegalQueryError(fmt.Sprintf("No search context found for id [%s]", id))
+	}
+	tx, err := dbc.pool.Begin()
+	if err != nil {
+		dbc.releasePointInTime(pit)
+		return utils.NewDBQueryError(err.Error())
+	}
+	// Nothing is changed by searches
+	defer tx.Rollback()
+	if _, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY;"); err == nil {
+		_, err = tx.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT %s;", utils.QuoteLiteral(pit.snapshot)))
+	}
+	// The imported snapshot is kept by the transaction of the search, so the point in time could be closed now
+	dbc.releasePointInTime(pit)
+	if err != nil {
+		return utils.NewDBQueryError(err.Error())
+	}
+	client := *dbc
+	client.connection = tx
+	return function(&client)
+}
+
+// Finish import of the snapshot of a point in time. The transaction of the point in time is finished if it was closed
+// during the import
+func (dbc *Client) releasePointInTime(pit *pointInTime) {
+	dbc.pits.Lock()
+	pit.importers--
+	finished := pit.closed && pit.importers == 0
+	dbc.pits.Unlock()
+	if finished {
+		pit.tx.Rollback()
+	}
+}
@@ -0,0 +1,371 @@
+package db
+
+import (
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// Features describes optional capabilities of PostgreSQL server used by pg_elastic
+type Features struct {
+	TextSearchConfigs map[string]bool
+	Extensions        map[string]bool
+}
+
+// HasTextSearchConfig checks if text search configuration is available on the server
+func (f *Features) HasTextSearchConfig(name string) bool {
+	return f.TextSearchConfigs[name]
+}
+
+// HasExtension checks if the extension is installed in the database
+func (f *Features) HasExtension(name string) bool {
+	return f.Extensions[name]
+}
+
+// SQL functions used by generated queries. Each definition should be idempotent
+var schemaFunctions = []string{
+	// Extracts a text from JSON value. Values of arrays and objects are concatenated with space as separator
+	`CREATE OR REPLACE FUNCTION pg_elastic_text(value jsonb) RETURNS text AS $$
+		SELECT CASE
+			WHEN jsonb_typeof(value) IN ('array', 'object') THEN (
+				SELECT string_agg(e #>> '{}', ' ')
+				FROM jsonb_path_query(value, 'strict $.**') AS e
+				WHERE jsonb_typeof(e) IN ('string', 'number', 'boolean'))
+			WHEN jsonb_typeof(value) = 'null' THEN NULL
+			ELSE value #>> '{}'
+		END
+	$$ LANGUAGE SQL IMMUTABLE`,
+	// Builds a tsvector from array of tokens preserving positions. Empty tokens are skipped but still occupy a position
+	`CREATE OR REPLACE FUNCTION pg_elastic_tsvector(tokens text[]) RETURNS tsvector AS $$
+		SELECT coalesce(string_agg('''' || replace(replace(t.token, '\', '\\'), '''', '''''') || ''':' || least(t.position, 16383), ' '), '')::tsvector
+		FROM unnest(tokens) WITH ORDINALITY AS t(token, position)
+		WHERE t.token <> '' AND octet_length(t.token) < 2047
+	$$ LANGUAGE SQL IMMUTABLE`,
+	// Converts JSON value of a date field into timestamp. Numbers are milliseconds since epoch, strings without time
+	// zone are treated as UTC. Values which are not dates produce NULL
+	`CREATE OR REPLACE FUNCTION pg_elastic_timestamp(value jsonb) RETURNS timestamptz AS $$
+	BEGIN
+		CASE jsonb_typeof(value)
+			WHEN 'number' THEN RETURN to_timestamp((value #>> '{}')::float8 / 1000);
+			WHEN 'string' THEN RETURN (value #>> '{}')::timestamptz;
+			ELSE RETURN NULL;
+		END CASE;
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE SET TimeZone = 'UTC'`,
+	// Decodes a geohash into the center of its cell. Points are represented as (lon, lat)
+	`CREATE OR REPLACE FUNCTION pg_elastic_geohash_decode(hash text) RETURNS point AS $$
+	DECLARE
+		base32 CONSTANT text := '0123456789bcdefghjkmnpqrstuvwxyz';
+		min_lat float8 := -90;
+		max_lat float8 := 90;
+		min_lon float8 := -180;
+		max_lon float8 := 180;
+		even boolean := true;
+		bits int;
+	BEGIN
+		IF length(hash) = 0 THEN
+			RETURN NULL;
+		END IF;
+		FOR i IN 1..length(hash) LOOP
+			bits := strpos(base32, substr(lower(hash), i, 1)) - 1;
+			IF bits < 0 THEN
+				RETURN NULL;
+			END IF;
+			FOR j IN REVERSE 4..0 LOOP
+				IF even THEN
+					IF (bits >> j) & 1 = 1 THEN
+						min_lon := (min_lon + max_lon) / 2;
+					ELSE
+						max_lon := (min_lon + max_lon) / 2;
+					END IF;
+				ELSE
+					IF (bits >> j) & 1 = 1 THEN
+						min_lat := (min_lat + max_lat) / 2;
+					ELSE
+						max_lat := (min_lat + max_lat) / 2;
+					END IF;
+				END IF;
+				even := NOT even;
+			END LOOP;
+		END LOOP;
+		RETURN point((min_lon + max_lon) / 2, (min_lat + max_lat) / 2);
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE STRICT`,
+	// Encodes a point into a geohash of the precision
+	`CREATE OR REPLACE FUNCTION pg_elastic_geohash(location point, precision int) RETURNS text AS $$
+	DECLARE
+		base32 CONSTANT text := '0123456789bcdefghjkmnpqrstuvwxyz';
+		min_lat float8 := -90;
+		max_lat float8 := 90;
+		min_lon float8 := -180;
+		max_lon float8 := 180;
+		even boolean := true;
+		bit int := 0;
+		ch int := 0;
+		result text := '';
+	BEGIN
+		WHILE length(result) < precision LOOP
+			IF even THEN
+				IF location[0] >= (min_lon + max_lon) / 2 THEN
+					ch := ch * 2 + 1;
+					min_lon := (min_lon + max_lon) / 2;
+				ELSE
+					ch := ch * 2;
+					max_lon := (min_lon + max_lon) / 2;
+				END IF;
+			ELSE
+				IF location[1] >= (min_lat + max_lat) / 2 THEN
+					ch := ch * 2 + 1;
+					min_lat := (min_lat + max_lat) / 2;
+				ELSE
+					ch := ch * 2;
+					max_lat := (min_lat + max_lat) / 2;
+				END IF;
+			END IF;
+			even := NOT even;
+			bit := bit + 1;
+			IF bit = 5 THEN
+				result := result || substr(base32, ch + 1, 1);
+				bit := 0;
+				ch := 0;
+			END IF;
+		END LOOP;
+		RETURN result;
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE STRICT`,
+	// Converts JSON value of a geo_point field into a point (lon, lat). Accepts objects with lat and lon, GeoJSON
+	// points, arrays [lon, lat], strings "lat,lon", WKT points and geohashes. Invalid values produce NULL
+	`CREATE OR REPLACE FUNCTION pg_elastic_geo_point(value jsonb) RETURNS point AS $$
+	DECLARE
+		text_value text;
+		parts text[];
+		result point;
+	BEGIN
+		CASE jsonb_typeof(value)
+			WHEN 'object' THEN
+				IF value ? 'coordinates' THEN
+					result := pg_elastic_geo_point(value->'coordinates');
+				ELSE
+					result := point((value->>'lon')::float8, (value->>'lat')::float8);
+				END IF;
+			WHEN 'array' THEN
+				result := point((value->>0)::float8, (value->>1)::float8);
+			WHEN 'string' THEN
+				text_value := trim(value #>> '{}');
+				IF upper(text_value) LIKE 'POINT%' THEN
+					parts := regexp_match(text_value, '^POINT\s*\(\s*(\S+)\s+(\S+)\s*\)$', 'i');
+					result := point(parts[1]::float8, parts[2]::float8);
+				ELSIF strpos(text_value, ',') > 0 THEN
+					parts := string_to_array(text_value, ',');
+					result := point(trim(parts[2])::float8, trim(parts[1])::float8);
+				ELSE
+					result := pg_elastic_geohash_decode(text_value);
+				END IF;
+			ELSE
+				RETURN NULL;
+		END CASE;
+		IF abs(result[1]) > 90 OR abs(result[0]) > 180 THEN
+			RETURN NULL;
+		END IF;
+		RETURN result;
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE`,
+	// Converts JSON value of a geo_point field into a set of points. Value could be a single point or an array of
+	// points, array of two numbers is a single point
+	`CREATE OR REPLACE FUNCTION pg_elastic_geo_points(value jsonb) RETURNS SETOF point AS $$
+		SELECT p FROM (
+			SELECT pg_elastic_geo_point(value) WHERE jsonb_typeof(value) <> 'array' OR jsonb_typeof(value->0) = 'number'
+			UNION ALL
+			SELECT pg_elastic_geo_point(e) FROM jsonb_array_elements(CASE
+				WHEN jsonb_typeof(value) = 'array' AND jsonb_typeof(value->0) <> 'number' THEN value
+				ELSE '[]'
+			END) AS e
+		) AS t(p)
+		WHERE p IS NOT NULL
+	$$ LANGUAGE SQL IMMUTABLE`,
+	// Filters a document by LIKE patterns of dotted field paths. Fields matching includes are kept with all their
+	// subfields, fields matching excludes are removed. Empty includes keep all fields. Objects without matching fields
+	// are removed, arrays of objects are filtered element-wise
+	`CREATE OR REPLACE FUNCTION pg_elastic_filter_source(value jsonb, includes text[], excludes text[], path text DEFAULT '') RETURNS jsonb AS $$
+	DECLARE
+		result jsonb := '{}';
+		field text;
+		item jsonb;
+		name text;
+	BEGIN
+		CASE jsonb_typeof(value)
+			WHEN 'array' THEN
+				SELECT coalesce(jsonb_agg(t.item ORDER BY t.position), '[]') INTO result FROM (
+					SELECT pg_elastic_filter_source(e, includes, excludes, path) AS item, n AS position
+					FROM jsonb_array_elements(value) WITH ORDINALITY AS a(e, n)
+				) AS t
+				WHERE t.item IS NOT NULL;
+				RETURN result;
+			WHEN 'object' THEN
+				NULL;
+			ELSE
+				RETURN CASE WHEN cardinality(includes) = 0 OR path LIKE ANY(includes) THEN value END;
+		END CASE;
+		FOR field, item IN SELECT * FROM jsonb_each(value) LOOP
+			name := CASE WHEN path = '' THEN field ELSE path || '.' || field END;
+			CONTINUE WHEN name LIKE ANY(excludes);
+			IF cardinality(includes) = 0 OR name LIKE ANY(includes) THEN
+				item := pg_elastic_filter_source(item, '{}', excludes, name);
+			ELSIF jsonb_typeof(item) IN ('object', 'array') THEN
+				item := pg_elastic_filter_source(item, includes, excludes, name);
+				CONTINUE WHEN item IN ('{}', '[]');
+			ELSE
+				CONTINUE;
+			END IF;
+			result := result || jsonb_build_object(field, item);
+		END LOOP;
+		RETURN result;
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE`,
+	// Converts JSON array of a dense_vector field into an array of numbers
+	`CREATE OR REPLACE FUNCTION pg_elastic_vector(value jsonb) RETURNS float8[] AS $$
+		SELECT CASE WHEN jsonb_typeof(value) = 'array' THEN
+			ARRAY(SELECT e::float8 FROM jsonb_array_elements_text(value) WITH ORDINALITY AS t(e, n) ORDER BY n)
+		END
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	// Exact similarities and distances of vectors of equal dimensions
+	`CREATE OR REPLACE FUNCTION pg_elastic_dot_product(a float8[], b float8[]) RETURNS float8 AS $$
+		SELECT sum(x * y) FROM unnest(a, b) AS t(x, y)
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	`CREATE OR REPLACE FUNCTION pg_elastic_cosine_similarity(a float8[], b float8[]) RETURNS float8 AS $$
+		SELECT sum(x * y) / nullif(sqrt(sum(x * x)) * sqrt(sum(y * y)), 0) FROM unnest(a, b) AS t(x, y)
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	`CREATE OR REPLACE FUNCTION pg_elastic_l1_distance(a float8[], b float8[]) RETURNS float8 AS $$
+		SELECT sum(abs(x - y)) FROM unnest(a, b) AS t(x, y)
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	`CREATE OR REPLACE FUNCTION pg_elastic_l2_distance(a float8[], b float8[]) RETURNS float8 AS $$
+		SELECT sqrt(sum((x - y) * (x - y))) FROM unnest(a, b) AS t(x, y)
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	// Minimal edit distance between the prefix and any prefix of the value. Transposition of adjacent characters
+	// counts as one edit
+	`CREATE OR REPLACE FUNCTION pg_elastic_prefix_distance(value text, prefix text) RETURNS integer AS $$
+	DECLARE
+		before integer[];
+		previous integer[] := ARRAY(SELECT generate_series(0, length(value)));
+		current integer[];
+		cost integer;
+	BEGIN
+		FOR i IN 1..length(prefix) LOOP
+			current := ARRAY[i];
+			FOR j IN 1..length(value) LOOP
+				cost := CASE WHEN substr(prefix, i, 1) = substr(value, j, 1) THEN 0 ELSE 1 END;
+				current := current || least(previous[j + 1] + 1, current[j] + 1, previous[j] + cost);
+				IF i > 1 AND j > 1 AND substr(prefix, i, 1) = substr(value, j - 1, 1) AND substr(prefix, i - 1, 1) = substr(value, j, 1) THEN
+					current[j + 1] := least(current[j + 1], before[j - 1] + 1);
+				END IF;
+			END LOOP;
+			before := previous;
+			previous := current;
+		END LOOP;
+		RETURN (SELECT min(d) FROM unnest(previous) AS d);
+	END
+	$$ LANGUAGE plpgsql IMMUTABLE STRICT`,
+	// Splits a value of a completion field into inputs with their weights and contexts. Value could be a string, an
+	// object with input, weight and contexts or an array of them
+	`CREATE OR REPLACE FUNCTION pg_elastic_completion_entries(value jsonb) RETURNS TABLE(input text, weight integer, contexts jsonb) AS $$
+		SELECT i.value #>> '{}', coalesce((e.item->>'weight')::integer, 1), coalesce(e.item->'contexts', '{}')
+		FROM jsonb_array_elements(CASE WHEN jsonb_typeof(value) = 'array' THEN value ELSE jsonb_build_array(value) END) AS e(item),
+			jsonb_array_elements(CASE
+				WHEN jsonb_typeof(e.item) <> 'object' THEN jsonb_build_array(e.item)
+				WHEN jsonb_typeof(e.item->'input') = 'array' THEN e.item->'input'
+				ELSE jsonb_build_array(e.item->'input')
+			END) AS i(value)
+		WHERE jsonb_typeof(i.value) = 'string'
+	$$ LANGUAGE SQL IMMUTABLE`,
+	// Keeps a completion table of a field in sync with documents. Arguments are the name of the table and the path of
+	// the field, rows of deleted documents are removed by foreign key
+	`CREATE OR REPLACE FUNCTION pg_elastic_completion_trigger() RETURNS trigger AS $$
+	BEGIN
+		EXECUTE format('DELETE FROM %I WHERE id = $1', TG_ARGV[0]) USING NEW.id;
+		EXECUTE format('INSERT INTO %I (id, input, weight, contexts) SELECT $1, e.input, e.weight, e.contexts FROM pg_elastic_completion_entries($2 #> $3::text[]) AS e',
+			TG_ARGV[0]) USING NEW.id, NEW.document, TG_ARGV[1];
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`,
+}
+
+// Operator classes of pgvector indexes for similarities of dense_vector fields
+var vectorOperatorClasses = map[string]string{
+	"cosine":            "vector_cosine_ops",
+	"dot_product":       "vector_ip_ops",
+	"max_inner_product": "vector_ip_ops",
+	"l2_norm":           "vector_l2_ops",
+}
+
+// Calculates distance in meters between points (lon, lat). Operator of earthdistance extension is used if it is
+// installed, otherwise distance is calculated by haversine formula with mean radius of the Earth
+var geoDistanceFunctions = map[bool]string{
+	true: `CREATE OR REPLACE FUNCTION pg_elastic_geo_distance(a point, b point) RETURNS float8 AS $$
+		SELECT (a <@> b) * 1609.344
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	false: `CREATE OR REPLACE FUNCTION pg_elastic_geo_distance(a point, b point) RETURNS float8 AS $$
+		SELECT 2 * 6371008.7714 * asin(least(1, sqrt(
+			power(sin(radians(b[1] - a[1]) / 2), 2) +
+			cos(radians(a[1])) * cos(radians(b[1])) * power(sin(radians(b[0] - a[0]) / 2), 2))))
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+}
+
+// Calculates trigram similarity of texts. Function of pg_trgm extension is used if it is installed, otherwise
+// trigrams of words are compared in the same way
+var similarityFunctions = map[bool]string{
+	true: `CREATE OR REPLACE FUNCTION pg_elastic_similarity(a text, b text) RETURNS float8 AS $$
+		SELECT similarity(a, b)::float8
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+	false: `CREATE OR REPLACE FUNCTION pg_elastic_similarity(a text, b text) RETURNS float8 AS $$
+		SELECT coalesce(count(*) FILTER (WHERE g.sources = 2)::float8 / nullif(count(*), 0), 0) FROM (
+			SELECT substr(w.word, i, 3) AS trigram, count(DISTINCT s.source) AS sources
+			FROM (VALUES (1, a), (2, b)) AS s(source, value),
+				LATERAL (SELECT '  ' || t || ' ' AS word FROM regexp_split_to_table(lower(s.value), '[^[:alnum:]]+') AS t WHERE t <> '') AS w,
+				generate_series(1, length(w.word) - 2) AS i
+			GROUP BY 1
+		) AS g
+	$$ LANGUAGE SQL IMMUTABLE STRICT`,
+}
+
+// Create SQL functions used by generated queries
+func (dbc *Client) createFunctions() error {
+	functions := append(schemaFunctions, geoDistanceFunctions[dbc.features.HasExtension("earthdistance")],
+		similarityFunctions[dbc.features.HasExtension("pg_trgm")])
+	for _, function := range functions {
+		_, err := dbc.connection.Exec(function)
+		if err != nil {
+			return utils.NewDBQueryError(err.Error())
+		}
+	}
+	return nil
+}
+
+// Detect optional capabilities of the server
+func (dbc *Client) loadFeatures() error {
+	var configs []string
+	_, err := dbc.connection.Query(&configs, "SELECT cfgname FROM pg_ts_config")
+	if err != nil {
+		return utils.NewDBQueryError(err.Error())
+	}
+	dbc.features.TextSearchConfigs = make(map[string]bool)
+	for _, config := range configs {
+		dbc.features.TextSearchConfigs[config] = true
+	}
+	var extensions []string
+	_, err = dbc.connection.Query(&extensions, "SELECT extname FROM pg_extension")
+	if err != nil {
+		return utils.NewDBQueryError(err.Error())
+	}
+	dbc.features.Extensions = make(map[string]bool)
+	for _, extension := range extensions {
+		dbc.features.Extensions[extension] = true
+	}
+	return nil
+}
+
+// Features returns optional capabilities of the server detected during schema initialization
+func (dbc *Client) Features() *Features {
+	return &dbc.features
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"github.com/asp437/pg_elastic/utils"
+)
+
+// ScriptRecord contains a stored script. Source of mustache templates is a text of the template
+type ScriptRecord struct {
+	ID     string
+	Lang   string
+	Source string
+}
+
+// PutScript creates a stored script or replaces the existing one with the same ID
+func (dbc *Client) PutScript(id, lang, source string) (*ScriptRecord, error) {
+	scriptRecord := &ScriptRecord{ID: id, Lang: lang, Source: source}
+	_, err := dbc.connection.Model(scriptRecord).OnConflict("(id) DO UPDATE").Set("lang = EXCLUDED.lang, source = EXCLUDED.source").Insert()
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return scriptRecord, nil
+}
+
+// GetScript gets a stored script. Returns nil if there is no script with the ID
+func (dbc *Client) GetScript(id string) (*ScriptRecord, error) {
+	var scriptRecords []ScriptRecord
+	err := dbc.connection.Model(&scriptRecords).Where("id = ?", id).Select()
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	if len(scriptRecords) == 0 {
+		return nil, nil
+	}
+	return &scriptRecords[0], nil
+}
+
+// DeleteScript deletes a stored script. Returns false if there is no script with the ID
+func (dbc *Client) DeleteScript(id string) (bool, error) {
+	result, err := dbc.connection.Model(&ScriptRecord{}).Where("id = ?", id).Delete()
+	if err != nil {
+		return false, utils.NewDBQueryError(err.Error())
+	}
+	return result.RowsAffected() > 0, nil
+}
@@ -0,0 +1,510 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"github.com/go-pg/pg"
+	"strings"
+)
+
+// AggregationDocuments is a name of relation of matching documents used by SQL expressions of aggregations. It has
+// _index, _type, id, root, document and score columns, root is the whole document
+const AggregationDocuments = "docs"
+
+// AggregationBackground is a name of relation of all documents of searched types with the same columns. It is the
+// background set of significant terms
+const AggregationBackground = "background_docs"
+
+// SearchSource is a table of a type searched by a query. Condition selects matching documents, Score calculates their
+// relevance and Sort contains jsonb expressions of sort keys. InnerHits and Highlight are jsonb expressions of inner
+// hits, highlighted fragments and requested fields of a found document, they could refer to _index, _type, id and
+// score columns. PostFilter filters hits after aggregations, Collapse is jsonb expression of the key which hits are
+// collapsed by and CollapseSort contains sort keys of each inner hits of collapsed groups. Rescore contains queries of
+// rescorers of the search. All expressions are SQL over document column
+type SearchSource struct {
+	Index        string
+	Type         string
+	Condition    string
+	Score        string
+	Sort         []string
+	InnerHits    string
+	Highlight    string
+	Fields       string
+	PostFilter   string
+	Collapse     string
+	CollapseSort [][]string
+	Rescore      []RescoreQuery
+}
+
+// RescoreQuery is a query of a rescorer over documents of a source
+type RescoreQuery struct {
+	Condition string
+	Score     string
+}
+
+// Rescorer recalculates scores of the top WindowSize hits. Score of a hit matching the rescore query is combined with
+// the score of that query by ScoreMode: total, multiply, avg, max or min. Scores are multiplied by their weights first
+type Rescorer struct {
+	WindowSize         int
+	QueryWeight        float64
+	RescoreQueryWeight float64
+	ScoreMode          string
+}
+
+// CollapseInnerHits describes documents of a collapsed group returned together with its top document. Order contains
+// direction and nulls ordering of each sort key
+type CollapseInnerHits struct {
+	Name  string
+	From  int
+	Size  int
+	Order []string
+}
+
+// SearchQuery describes a search over several types. Order contains direction and nulls ordering of each sort key
+// like "DESC NULLS LAST". Source is SQL expression of returned document. TrackTotalHits limits counting of matches:
+// zero counts all of them, a positive number counts up to that number and a negative number disables counting.
+// SearchAfter contains sort values of the last document of the previous page, the page starts after it. Sort values
+// could be followed by a tiebreaker [_index, _type, id], it is returned as the last sort value if Tiebreaker is set.
+// MinScore excludes documents with lower score, TerminateAfter limits number of matching documents. Hits are
+// collapsed by Collapse keys of sources if Collapsed is set. Rescore is applied to the top hits sorted by score
+type SearchQuery struct {
+	Sources           []SearchSource
+	Order             []string
+	Source            string
+	From              int
+	Size              int
+	TrackTotalHits    int
+	SearchAfter       []interface{}
+	Tiebreaker        bool
+	MinScore          *float64
+	TerminateAfter    int
+	Collapsed         bool
+	CollapseInnerHits []CollapseInnerHits
+	Rescore           []Rescorer
+}
+
+// SearchHit is a document found by a search query
+type SearchHit struct {
+	ElasticSearchDocument
+	Index     string `sql:"_index"`
+	Type      string `sql:"_type"`
+	Score     float64
+	Sort      interface{}
+	InnerHits interface{}
+	Highlight interface{}
+	Fields    interface{}
+	Total     int
+}
+
+// TotalHits is a number of documents matching a search query. Relation is "gte" if matches were counted up to the
+// limit and there are more of them, otherwise it is "eq"
+type TotalHits struct {
+	Value    int
+	Relation string
+}
+
+// ProcessSearchQuery executes a search query and returns a page of found documents with total number of matches.
+// Total is nil if counting is disabled
+func (dbc *Client) ProcessSearchQuery(query *SearchQuery) ([]SearchHit, *TotalHits, error) {
+	var hits []SearchHit
+	if len(query.Sources) == 0 {
+		return hits, query.emptyTotal(), nil
+	}
+	_, err := dbc.connection.Query(&hits, query.SQL())
+	if err != nil {
+		return nil, nil, utils.NewDBQueryError(err.Error())
+	}
+	switch {
+	case query.TrackTotalHits < 0:
+		return hits, nil, nil
+	case query.TrackTotalHits == 0 && len(hits) > 0:
+		return hits, &TotalHits{Value: hits[0].Total, Relation: "eq"}, nil
+	case len(query.SearchAfter) == 0 && !query.Collapsed && (len(hits) > 0 || query.From == 0) && len(hits) < query.Size:
+		// The page is the last one, so total is known without counting
+		return hits, limitTotal(query.From+len(hits), query.TrackTotalHits), nil
+	}
+	count, err := dbc.countMatches(query, query.TrackTotalHits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hits, limitTotal(count, query.TrackTotalHits), nil
+}
+
+// SQL builds a statement which selects a page of documents matching the query
+func (query *SearchQuery) SQL() string {
+	var orders []string
+	for i, order := range query.Order {
+		orders = append(orders, fmt.Sprintf("sort_%d %s", i, order))
+	}
+	var sortKeys []string
+	for i := range query.Order {
+		sortKeys = append(sortKeys, fmt.Sprintf("sort_%d", i))
+	}
+	if len(query.Rescore) > 0 {
+		// Rescored hits of the window precede other ones
+		orders = []string{"rescore_window DESC", "score DESC"}
+		sortKeys = []string{"to_jsonb(score)"}
+	}
+	// Documents with equal sort keys are ordered by location to make pages stable
+	orders = append(orders, "_index", "_type", "id")
+	if query.Tiebreaker {
+		sortKeys = append(sortKeys, "jsonb_build_array(_index, _type, id)")
+	}
+	source := query.Source
+	if len(source) == 0 {
+		source = "document"
+	}
+	// All matches are counted along with the page if exact total is required, otherwise they are counted separately
+	total := "0"
+	if query.TrackTotalHits == 0 {
+		total = "count(*) OVER ()"
+	}
+	matches := fmt.Sprintf("SELECT *, %s AS total FROM (%s) AS hits", total, query.hitsQuery(true))
+	if len(query.Rescore) > 0 {
+		matches = query.rescoreQuery(matches)
+	}
+	if query.Collapsed {
+		// The top document of each group represents it, all documents of groups are counted
+		matches = fmt.Sprintf("SELECT * FROM (SELECT DISTINCT ON (collapse) * FROM (%s) AS hits ORDER BY collapse, %s) AS hits", matches, strings.Join(orders, ", "))
+	}
+	if len(query.SearchAfter) > 0 {
+		// Documents of previous pages are still counted
+		matches = fmt.Sprintf("SELECT * FROM (%s) AS hits WHERE %s", matches, query.searchAfterCondition())
+	}
+	// Returned document, inner hits, highlights and fields are calculated for the page only
+	innerHits := query.sourceColumn(func(s SearchSource) string { return s.InnerHits })
+	if query.Collapsed && len(query.CollapseInnerHits) > 0 {
+		innerHits = fmt.Sprintf("nullif(coalesce(%s, '{}'::jsonb) || %s, '{}'::jsonb)", innerHits, query.collapseInnerHits(source))
+	}
+	highlight := query.sourceColumn(func(s SearchSource) string { return s.Highlight })
+	fields := query.sourceColumn(func(s SearchSource) string { return s.Fields })
+	return fmt.Sprintf("SELECT _index, _type, id, %s AS document, version, score, jsonb_build_array(%s) AS sort, %s AS inner_hits, %s AS highlight, %s AS fields, total FROM "+
+		"(%s ORDER BY %s LIMIT %d OFFSET %d) AS hits ORDER BY %s;",
+		source, strings.Join(sortKeys, ", "), innerHits, highlight, fields, matches, strings.Join(orders, ", "), query.Size, query.From, strings.Join(orders, ", "))
+}
+
+// Build SQL query which recalculates scores of matches by rescorers one after another. Matches have score of the query
+// in score_0 column, each rescorer ranks hits by the previous score and adds the next one. Hits inside the window of
+// the first rescorer are marked by rescore_window column
+func (query *SearchQuery) rescoreQuery(matches string) string {
+	window := fmt.Sprintf("rescore_rank_0 <= %d", query.Rescore[0].WindowSize)
+	for i, rescorer := range query.Rescore {
+		order := fmt.Sprintf("score_%d DESC, _index, _type, id", i)
+		if i > 0 {
+			order = fmt.Sprintf("%s DESC, %s", window, order)
+		}
+		weighted := fmt.Sprintf("%s * score_%d", utils.FormatFloat(rescorer.QueryWeight), i)
+		rescored := fmt.Sprintf("%s * rescore_%d_score", utils.FormatFloat(rescorer.RescoreQueryWeight), i)
+		var combined string
+		switch rescorer.ScoreMode {
+		case "multiply":
+			combined = fmt.Sprintf("%s * %s", weighted, rescored)
+		case "avg":
+			combined = fmt.Sprintf("(%s + %s) / 2", weighted, rescored)
+		case "max":
+			combined = fmt.Sprintf("greatest(%s, %s)", weighted, rescored)
+		case "min":
+			combined = fmt.Sprintf("least(%s, %s)", weighted, rescored)
+		default:
+			combined = fmt.Sprintf("%s + %s", weighted, rescored)
+		}
+		matches = fmt.Sprintf("SELECT *, CASE WHEN rescore_rank_%[1]d > %[2]d THEN score_%[1]d WHEN rescore_%[1]d_match THEN %[3]s ELSE %[4]s END AS score_%[5]d "+
+			"FROM (SELECT *, row_number() OVER (ORDER BY %[6]s) AS rescore_rank_%[1]d FROM (%[7]s) AS hits) AS hits",
+			i, rescorer.WindowSize, combined, weighted, i+1, order, matches)
+	}
+	return fmt.Sprintf("SELECT *, score_%d AS score, %s AS rescore_window FROM (%s) AS hits", len(query.Rescore), window, matches)
+}
+
+// Build jsonb expression of inner hits of the collapsed group of a hit. Documents of the group are selected from all
+// matches by collapse key of the hit
+func (query *SearchQuery) collapseInnerHits(source string) string {
+	var args []string
+	for i, innerHits := range query.CollapseInnerHits {
+		group := query.matchesQuery(true, func(s SearchSource) []string {
+			columns := append(baseColumns(s, "score"), "document", fmt.Sprintf("(%s)::jsonb AS collapse", s.Collapse))
+			for j, key := range s.CollapseSort[i] {
+				columns = append(columns, fmt.Sprintf("(%s)::jsonb AS sort_%d", key, j))
+			}
+			return columns
+		})
+		var orders []string
+		for j, order := range innerHits.Order {
+			orders = append(orders, fmt.Sprintf("sort_%d %s", j, order))
+		}
+		orders = append(orders, "_index", "_type", "id")
+		hit := fmt.Sprintf("jsonb_build_object('_index', _index, '_type', _type, '_id', id, '_version', version, '_score', score, '_source', %s)", source)
+		expression := fmt.Sprintf("(SELECT jsonb_build_object('hits', jsonb_build_object('total', count(*), 'max_score', max(score), 'hits', "+
+			"coalesce(jsonb_agg(%s ORDER BY rank) FILTER (WHERE rank > %d AND rank <= %d), '[]'::jsonb))) "+
+			"FROM (SELECT *, row_number() OVER (ORDER BY %s) AS rank FROM (%s) AS g WHERE g.collapse IS NOT DISTINCT FROM hits.collapse) AS g)",
+			hit, innerHits.From, innerHits.From+innerHits.Size, strings.Join(orders, ", "), group)
+		args = append(args, utils.QuoteLiteral(innerHits.Name), expression)
+	}
+	return fmt.Sprintf("jsonb_build_object(%s)", strings.Join(args, ", "))
+}
+
+// Build keyset condition selecting documents which follow sort values of search after in the order of the query
+func (query *SearchQuery) searchAfterCondition() string {
+	var equal, disjuncts []string
+	for i, value := range query.SearchAfter {
+		if i >= len(query.Order) {
+			// Documents with equal sort values are ordered by location
+			var location []string
+			for _, part := range value.([]interface{}) {
+				location = append(location, utils.QuoteLiteral(fmt.Sprint(part)))
+			}
+			after := fmt.Sprintf("(_index, _type, id) > (%s)", strings.Join(location, ", "))
+			disjuncts = append(disjuncts, strings.Join(append(equal, after), " AND "))
+			break
+		}
+		after, same := keysetPredicates(fmt.Sprintf("sort_%d", i), query.Order[i], value)
+		disjuncts = append(disjuncts, strings.Join(append(equal[:len(equal):len(equal)], after), " AND "))
+		equal = append(equal, same)
+	}
+	return "(" + strings.Join(disjuncts, " OR ") + ")"
+}
+
+// Build predicates of a sort key which select keys following the value and keys equal to it. Null value is a missing
+// key
+func keysetPredicates(column, order string, value interface{}) (string, string) {
+	nullsFirst := strings.HasSuffix(order, "NULLS FIRST")
+	if value == nil {
+		if nullsFirst {
+			return column + " IS NOT NULL", column + " IS NULL"
+		}
+		return "false", column + " IS NULL"
+	}
+	encoded, _ := json.Marshal(value)
+	literal := utils.QuoteLiteral(string(encoded)) + "::jsonb"
+	operator := ">"
+	if strings.HasPrefix(order, "DESC") {
+		operator = "<"
+	}
+	after := fmt.Sprintf("%s %s %s", column, operator, literal)
+	if !nullsFirst {
+		after = fmt.Sprintf("(%s OR %s IS NULL)", after, column)
+	}
+	return after, fmt.Sprintf("%s = %s", column, literal)
+}
+
+// ExplainSearchQuery returns SQL statement of a search query and its execution plan
+func (dbc *Client) ExplainSearchQuery(query *SearchQuery) (string, interface{}, error) {
+	if len(query.Sources) == 0 {
+		return "", nil, nil
+	}
+	queryString := query.SQL()
+	plan, err := dbc.ExplainSQL(queryString)
+	return queryString, plan, err
+}
+
+// ExplainSQL returns execution plan of SQL statement in JSON format. Planning fails if the statement is invalid, so it
+// is validated without execution
+func (dbc *Client) ExplainSQL(queryString string) (interface{}, error) {
+	var plan string
+	_, err := dbc.connection.QueryOne(pg.Scan(&plan), "EXPLAIN (FORMAT JSON) "+strings.TrimSuffix(queryString, ";"))
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	var result interface{}
+	if err = json.Unmarshal([]byte(plan), &result); err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	return result, nil
+}
+
+// SQL builds a statement which selects IDs and scores of matching documents of the source
+func (s *SearchSource) SQL() string {
+	return fmt.Sprintf("SELECT id, coalesce((%s)::float8, 0) AS score FROM %s WHERE %s;", s.Score, TableName(s.Index, s.Type), s.Condition)
+}
+
+// EvaluateDocument calculates SQL expressions over a document. Returns nil if there is no document with the ID
+func (dbc *Client) EvaluateDocument(indexName, typeName, id string, expressions []string) ([]interface{}, error) {
+	docType, err := dbc.GetType(indexName, typeName)
+	if err != nil || docType == nil {
+		return nil, err
+	}
+	var values []string
+	queryString := fmt.Sprintf("SELECT jsonb_build_array(%s)::text FROM %s WHERE id = %s;",
+		strings.Join(expressions, ", "), TableName(indexName, typeName), utils.QuoteLiteral(id))
+	_, err = dbc.connection.Query(&values, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	var result []interface{}
+	if err = json.Unmarshal([]byte(values[0]), &result); err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	return result, nil
+}
+
+// CountSearchQuery counts documents matching a search query
+func (dbc *Client) CountSearchQuery(query *SearchQuery) (int, error) {
+	if len(query.Sources) == 0 {
+		return 0, nil
+	}
+	return dbc.countMatches(query, 0)
+}
+
+// Count documents matching the query. Counting stops after limit + 1 documents if limit is positive
+func (dbc *Client) countMatches(query *SearchQuery, limit int) (int, error) {
+	matches := query.matchesQuery(true, func(SearchSource) []string { return []string{"1"} })
+	if limit > 0 {
+		matches = fmt.Sprintf("SELECT 1 FROM (%s) AS hits LIMIT %d", matches, limit+1)
+	}
+	var count int
+	_, err := dbc.connection.QueryOne(pg.Scan(&count), fmt.Sprintf("SELECT count(*) FROM (%s) AS hits;", matches))
+	if err != nil {
+		return 0, utils.NewDBQueryError(err.Error())
+	}
+	return count, nil
+}
+
+// Get total of a query without sources
+func (query *SearchQuery) emptyTotal() *TotalHits {
+	if query.TrackTotalHits < 0 {
+		return nil
+	}
+	return &TotalHits{Value: 0, Relation: "eq"}
+}
+
+// Build total of matches counted up to the limit
+func limitTotal(count, limit int) *TotalHits {
+	if limit > 0 && count > limit {
+		return &TotalHits{Value: limit, Relation: "gte"}
+	}
+	return &TotalHits{Value: count, Relation: "eq"}
+}
+
+// ProcessAggregations calculates aggregations over all documents matching the query. Aggregations is SQL expression
+// of jsonb object over AggregationDocuments and AggregationBackground relations
+func (dbc *Client) ProcessAggregations(query *SearchQuery, aggregations string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if len(query.Sources) == 0 {
+		return result, nil
+	}
+	var encoded string
+	var background []string
+	for _, s := range query.Sources {
+		background = append(background, fmt.Sprintf("SELECT %s AS _index, %s AS _type, id, document AS root, document, 0::float8 AS score FROM %s",
+			utils.QuoteLiteral(s.Index), utils.QuoteLiteral(s.Type), TableName(s.Index, s.Type)))
+	}
+	// Relations which are not referred by aggregations are not evaluated
+	queryString := fmt.Sprintf("WITH %s AS (SELECT _index, _type, id, document AS root, document, score FROM (%s) AS hits), %s AS (%s) SELECT (%s)::text;",
+		AggregationDocuments, query.hitsQuery(false), AggregationBackground, strings.Join(background, " UNION ALL "), aggregations)
+	_, err := dbc.connection.QueryOne(pg.Scan(&encoded), queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	if err = json.Unmarshal([]byte(encoded), &result); err != nil {
+		return nil, utils.NewInternalError(err.Error())
+	}
+	return result, nil
+}
+
+// GetDocuments gets documents of a type by their IDs in a single query. Source and fields are SQL expressions of
+// returned document and of its requested fields like in a search query. Missing documents are not returned
+func (dbc *Client) GetDocuments(indexName, typeName string, ids []string, source, fields string) ([]SearchHit, error) {
+	var hits []SearchHit
+	if len(ids) == 0 {
+		return hits, nil
+	}
+	docType, err := dbc.GetType(indexName, typeName)
+	if err != nil || docType == nil {
+		return hits, err
+	}
+	if len(source) == 0 {
+		source = "document"
+	}
+	if len(fields) == 0 {
+		fields = "NULL::jsonb"
+	}
+	var literals []string
+	for _, id := range ids {
+		literals = append(literals, utils.QuoteLiteral(id))
+	}
+	queryString := fmt.Sprintf("SELECT %s AS _index, %s AS _type, id, %s AS document, version, %s AS fields FROM %s WHERE id IN (%s);",
+		utils.QuoteLiteral(indexName), utils.QuoteLiteral(typeName), source, fields, TableName(indexName, typeName), strings.Join(literals, ", "))
+	_, err = dbc.connection.Query(&hits, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return hits, nil
+}
+
+// Build SQL query which selects matching documents of all sources. Hits of a page have sort keys, collapse key and
+// scores of rescore queries, aggregations are calculated over documents without them. Score of rescored hits is put
+// into score_0 column
+func (query *SearchQuery) hitsQuery(hits bool) string {
+	return query.matchesQuery(hits, func(s SearchSource) []string {
+		score := "score"
+		if hits && len(query.Rescore) > 0 {
+			score = "score_0"
+		}
+		columns := append(baseColumns(s, score), "document")
+		if !hits {
+			return columns
+		}
+		for i, key := range s.Sort {
+			columns = append(columns, fmt.Sprintf("(%s)::jsonb AS sort_%d", key, i))
+		}
+		if query.Collapsed {
+			columns = append(columns, fmt.Sprintf("(%s)::jsonb AS collapse", s.Collapse))
+		}
+		for i, rescore := range s.Rescore {
+			columns = append(columns,
+				fmt.Sprintf("coalesce((%s)::boolean, false) AS rescore_%d_match", rescore.Condition, i),
+				fmt.Sprintf("coalesce((%s)::float8, 0) AS rescore_%d_score", rescore.Score, i))
+		}
+		return columns
+	})
+}
+
+// Build columns of location, version and score of matching documents of the source. Score column is named by score
+func baseColumns(s SearchSource, score string) []string {
+	return []string{
+		fmt.Sprintf("%s AS _index", utils.QuoteLiteral(s.Index)),
+		fmt.Sprintf("%s AS _type", utils.QuoteLiteral(s.Type)),
+		"id",
+		"version",
+		fmt.Sprintf("coalesce((%s)::float8, 0) AS %s", s.Score, score),
+	}
+}
+
+// Build SQL query which selects columns of documents matching the query from all sources. Post filter is applied to
+// hits only, minimal score and terminate after limit are applied to all matches
+func (query *SearchQuery) matchesQuery(hits bool, columns func(SearchSource) []string) string {
+	var selects []string
+	for _, s := range query.Sources {
+		conditions := []string{fmt.Sprintf("(%s)", s.Condition)}
+		if hits && len(s.PostFilter) > 0 {
+			conditions = append(conditions, fmt.Sprintf("(%s)", s.PostFilter))
+		}
+		if query.MinScore != nil {
+			conditions = append(conditions, fmt.Sprintf("coalesce((%s)::float8, 0) >= %s", s.Score, utils.FormatFloat(*query.MinScore)))
+		}
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+			strings.Join(columns(s), ", "), TableName(s.Index, s.Type), strings.Join(conditions, " AND ")))
+	}
+	matches := strings.Join(selects, " UNION ALL ")
+	if query.TerminateAfter > 0 {
+		matches = fmt.Sprintf("SELECT * FROM (%s) AS hits LIMIT %d", matches, query.TerminateAfter)
+	}
+	return matches
+}
+
+// Build SQL expression of a jsonb column of found documents which is calculated by expressions of their sources
+func (query *SearchQuery) sourceColumn(expression func(SearchSource) string) string {
+	var cases []string
+	for _, s := range query.Sources {
+		if len(expression(s)) > 0 {
+			cases = append(cases, fmt.Sprintf("WHEN _index = %s AND _type = %s THEN %s", utils.QuoteLiteral(s.Index), utils.QuoteLiteral(s.Type), expression(s)))
+		}
+	}
+	if len(cases) == 0 {
+		return "NULL::jsonb"
+	}
+	return fmt.Sprintf("CASE %s END", strings.Join(cases, " "))
+}
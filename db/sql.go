@@ -0,0 +1,109 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"github.com/go-pg/pg"
+	"strconv"
+	"strings"
+)
+
+// SQLQuery is a SELECT statement of SQL endpoint over documents of sources. Columns, conditions and orders are SQL
+// expressions over documents relation with _index, _type, id, version and document columns. Columns should be of
+// jsonb type, orders could refer to them by position. Limit is negative if rows are not limited
+type SQLQuery struct {
+	Sources   []SearchSource
+	Distinct  bool
+	Columns   []string
+	Condition string
+	GroupBy   []string
+	Having    string
+	Order     []string
+	Offset    int
+	Limit     int
+}
+
+// ProcessSQLQuery executes a SQL query in a read only transaction. Returns values of columns of selected rows
+func (dbc *Client) ProcessSQLQuery(query *SQLQuery) ([][]interface{}, error) {
+	var encoded []string
+	err := dbc.withTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SET TRANSACTION READ ONLY;"); err != nil {
+			return err
+		}
+		_, err := tx.Query(&encoded, query.SQL())
+		return err
+	})
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	rows := [][]interface{}{}
+	for _, value := range encoded {
+		var row []interface{}
+		if err = json.Unmarshal([]byte(value), &row); err != nil {
+			return nil, utils.NewInternalError(err.Error())
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// DocumentKeys returns sorted keys of top-level fields of all documents of the sources
+func (dbc *Client) DocumentKeys(sources []SearchSource) ([]string, error) {
+	var keys []string
+	if len(sources) == 0 {
+		return keys, nil
+	}
+	var selects []string
+	for _, s := range sources {
+		selects = append(selects, fmt.Sprintf("SELECT jsonb_object_keys(document) AS key FROM %s WHERE jsonb_typeof(document) = 'object' AND %s",
+			TableName(s.Index, s.Type), s.Condition))
+	}
+	_, err := dbc.connection.Query(&keys, fmt.Sprintf("SELECT DISTINCT key FROM (%s) AS keys ORDER BY 1;", strings.Join(selects, " UNION ALL ")))
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return keys, nil
+}
+
+// SQL builds a statement which selects rows of the query as jsonb arrays
+func (query *SQLQuery) SQL() string {
+	var sources []string
+	for _, s := range query.Sources {
+		sources = append(sources, fmt.Sprintf("SELECT %s AS _index, %s AS _type, id, version, document FROM %s WHERE %s",
+			utils.QuoteLiteral(s.Index), utils.QuoteLiteral(s.Type), TableName(s.Index, s.Type), s.Condition))
+	}
+	if len(sources) == 0 {
+		sources = append(sources, "SELECT NULL::text AS _index, NULL::text AS _type, NULL::varchar AS id, NULL::integer AS version, NULL::jsonb AS document WHERE false")
+	}
+	var columns, values []string
+	for i, column := range query.Columns {
+		columns = append(columns, fmt.Sprintf("(%s)::jsonb AS c_%d", column, i))
+		values = append(values, "c_"+strconv.Itoa(i))
+	}
+	statement := "SELECT "
+	if query.Distinct {
+		statement += "DISTINCT "
+	}
+	statement += fmt.Sprintf("%s FROM (%s) AS docs", strings.Join(columns, ", "), strings.Join(sources, " UNION ALL "))
+	if len(query.Condition) > 0 {
+		statement += fmt.Sprintf(" WHERE %s", query.Condition)
+	}
+	if len(query.GroupBy) > 0 {
+		statement += fmt.Sprintf(" GROUP BY %s", strings.Join(query.GroupBy, ", "))
+	}
+	if len(query.Having) > 0 {
+		statement += fmt.Sprintf(" HAVING %s", query.Having)
+	}
+	if len(query.Order) > 0 {
+		statement += fmt.Sprintf(" ORDER BY %s", strings.Join(query.Order, ", "))
+	}
+	if query.Limit >= 0 {
+		statement += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	if query.Offset > 0 {
+		statement += fmt.Sprintf(" OFFSET %d", query.Offset)
+	}
+	// Rows keep the order of the subquery
+	return fmt.Sprintf("SELECT jsonb_build_array(%s)::text FROM (%s) AS result;", strings.Join(values, ", "), statement)
+}
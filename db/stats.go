@@ -0,0 +1,145 @@
+package db
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"github.com/go-pg/pg"
+	"time"
+)
+
+// TableStatistics contains storage statistics of the table of a type. Documents are estimated by planner statistics
+// of the table, live tuples are counted instead if the table has never been analyzed. Size includes indexes and TOAST
+type TableStatistics struct {
+	Documents        int64
+	DeletedDocuments int64
+	Size             int64
+}
+
+// GetTableStatistics returns storage statistics of the table of the type
+func (dbc *Client) GetTableStatistics(indexName, typeName string) (*TableStatistics, error) {
+	var statistics []TableStatistics
+	queryString := fmt.Sprintf(`SELECT
+		CASE WHEN c.relpages > 0 AND c.reltuples >= 0 THEN c.reltuples::bigint ELSE coalesce(s.n_live_tup, 0) END AS documents,
+		coalesce(s.n_dead_tup, 0) AS deleted_documents,
+		pg_total_relation_size(c.oid) AS size
+	FROM pg_class AS c LEFT JOIN pg_stat_user_tables AS s ON s.relid = c.oid
+	WHERE c.oid = to_regclass(%s);`, utils.QuoteLiteral(TableName(indexName, typeName)))
+	_, err := dbc.connection.Query(&statistics, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	if len(statistics) == 0 {
+		return &TableStatistics{}, nil
+	}
+	return &statistics[0], nil
+}
+
+// ReplicationStatus describes replication of the database. Replicas are standby servers connected to the primary,
+// inactive slots are replication slots of disconnected standby servers. Receiving is set on a standby server which
+// streams changes from its primary
+type ReplicationStatus struct {
+	InRecovery        bool
+	Replicas          int
+	StreamingReplicas int
+	InactiveSlots     int
+	Receiving         bool
+}
+
+// PoolStatistics describes usage of connections of the client
+type PoolStatistics struct {
+	Size       int
+	Total      int
+	Idle       int
+	Hits       int64
+	Misses     int64
+	Timeouts   int64
+	StaleConns int64
+}
+
+// DatabaseStatistics contains activity statistics of the database from pg_stat_database and its settings
+type DatabaseStatistics struct {
+	Name           string
+	Version        string
+	MaxConnections int
+	Backends       int
+	Commits        int64
+	Rollbacks      int64
+	BlocksRead     int64
+	BlocksHit      int64
+	TuplesReturned int64
+	TuplesFetched  int64
+	TuplesInserted int64
+	TuplesUpdated  int64
+	TuplesDeleted  int64
+	Conflicts      int64
+	Deadlocks      int64
+	Size           int64
+	StatsReset     *time.Time
+}
+
+// Ping checks that the database accepts queries
+func (dbc *Client) Ping() error {
+	var result int
+	_, err := dbc.connection.QueryOne(pg.Scan(&result), "SELECT 1;")
+	if err != nil {
+		return utils.NewDBQueryError(err.Error())
+	}
+	return nil
+}
+
+// GetReplicationStatus returns status of replication of the database
+func (dbc *Client) GetReplicationStatus() (*ReplicationStatus, error) {
+	var status ReplicationStatus
+	_, err := dbc.connection.QueryOne(&status, `SELECT
+		pg_is_in_recovery() AS in_recovery,
+		(SELECT count(*) FROM pg_stat_replication) AS replicas,
+		(SELECT count(*) FROM pg_stat_replication WHERE state = 'streaming') AS streaming_replicas,
+		(SELECT count(*) FROM pg_replication_slots WHERE slot_type = 'physical' AND NOT active) AS inactive_slots,
+		EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') AS receiving;`)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return &status, nil
+}
+
+// GetPoolStatistics returns statistics of the pool of connections of the client
+func (dbc *Client) GetPoolStatistics() PoolStatistics {
+	stats := dbc.pool.PoolStats()
+	return PoolStatistics{
+		Size:       dbc.PoolSize(),
+		Total:      int(stats.TotalConns),
+		Idle:       int(stats.IdleConns),
+		Hits:       int64(stats.Hits),
+		Misses:     int64(stats.Misses),
+		Timeouts:   int64(stats.Timeouts),
+		StaleConns: int64(stats.StaleConns),
+	}
+}
+
+// GetDatabaseStatistics returns activity statistics of the current database
+func (dbc *Client) GetDatabaseStatistics() (*DatabaseStatistics, error) {
+	var statistics DatabaseStatistics
+	_, err := dbc.connection.QueryOne(&statistics, `SELECT
+		datname AS name,
+		current_setting('server_version') AS version,
+		current_setting('max_connections')::int AS max_connections,
+		numbackends AS backends,
+		xact_commit AS commits,
+		xact_rollback AS rollbacks,
+		blks_read AS blocks_read,
+		blks_hit AS blocks_hit,
+		tup_returned AS tuples_returned,
+		tup_fetched AS tuples_fetched,
+		tup_inserted AS tuples_inserted,
+		tup_updated AS tuples_updated,
+		tup_deleted AS tuples_deleted,
+		conflicts,
+		deadlocks,
+		pg_database_size(datid) AS size,
+		stats_reset
+	FROM pg_stat_database WHERE datname = current_database();`)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return &statistics, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"fmt"
+	"github.com/asp437/pg_elastic/utils"
+	"github.com/go-pg/pg/types"
+	"strconv"
+	"strings"
+)
+
+// SimilarTerm is a word of a type vocabulary which is similar to a term of a suggest request. Ndoc is a number of
+// documents containing the word, Documents is a number of all documents of the type
+type SimilarTerm struct {
+	Term       string
+	Word       string
+	Ndoc       int
+	Similarity float64
+	Documents  int
+}
+
+// CompletionQuery describes a completion suggestion over a completion field of a type. Condition and Score are SQL
+// expressions over input, weight and contexts columns of the completion table and document column of the type table.
+// Source is SQL expression of returned document. Inputs with equal text are returned once if SkipDuplicates is set
+type CompletionQuery struct {
+	Index          string
+	Type           string
+	Field          string
+	Condition      string
+	Score          string
+	Source         string
+	SkipDuplicates bool
+	Size           int
+}
+
+// CompletionOption is an input of a completion field suggested with its document
+type CompletionOption struct {
+	ElasticSearchDocument
+	Text  string
+	Score float64
+}
+
+// SimilarTerms finds words of vocabulary of tsvector expression over all documents of the type which trigram
+// similarity with any of terms is not less than minSimilarity. Words equal to terms are returned too, so frequencies
+// of terms are known
+func (dbc *Client) SimilarTerms(indexName, typeName, vector string, terms []string, minSimilarity float64) ([]SimilarTerm, error) {
+	var result []SimilarTerm
+	if len(terms) == 0 {
+		return result, nil
+	}
+	var literals []string
+	for _, term := range terms {
+		literals = append(literals, utils.QuoteLiteral(term))
+	}
+	documentsQuery := fmt.Sprintf("SELECT %s FROM %s", vector, TableName(indexName, typeName))
+	queryString := fmt.Sprintf("SELECT *, (SELECT count(*) FROM %s) AS documents FROM "+
+		"(SELECT t.term, s.word, s.ndoc, pg_elastic_similarity(s.word, t.term) AS similarity FROM ts_stat(%s) AS s, unnest(ARRAY[%s]::text[]) AS t(term)) AS c "+
+		"WHERE c.word = c.term OR c.similarity >= %s;",
+		TableName(indexName, typeName), types.AppendString(nil, documentsQuery, 1), strings.Join(literals, ", "), strconv.FormatFloat(minSimilarity, 'g', -1, 64))
+	_, err := dbc.connection.Query(&result, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return result, nil
+}
+
+// ProcessCompletion finds inputs of a completion field matching the query ordered by score
+func (dbc *Client) ProcessCompletion(query *CompletionQuery) ([]CompletionOption, error) {
+	var options []CompletionOption
+	docType, err := dbc.GetType(query.Index, query.Type)
+	if err != nil || docType == nil {
+		return options, err
+	}
+	source := query.Source
+	if len(source) == 0 {
+		source = "document"
+	}
+	tableName := TableName(query.Index, query.Type)
+	matches := fmt.Sprintf("SELECT input AS text, id, (%s)::float8 AS score FROM %s AS c JOIN %s USING (id) WHERE %s",
+		query.Score, CompletionTable(query.Index, query.Type, query.Field), tableName, query.Condition)
+	if query.SkipDuplicates {
+		matches = fmt.Sprintf("SELECT DISTINCT ON (m.text) * FROM (%s) AS m ORDER BY m.text, m.score DESC, m.id", matches)
+	}
+	// Returned document is calculated for the suggested inputs only
+	queryString := fmt.Sprintf("SELECT s.text, id, %s AS document, version, s.score FROM "+
+		"(SELECT * FROM (%s) AS m ORDER BY m.score DESC, m.text, m.id LIMIT %d) AS s JOIN %s USING (id) ORDER BY s.score DESC, s.text, id;",
+		source, matches, query.Size, tableName)
+	_, err = dbc.connection.Query(&options, queryString)
+	if err != nil {
+		return nil, utils.NewDBQueryError(err.Error())
+	}
+	return options, nil
+}
@@ -56,6 +56,10 @@ func (s *PGElasticServerProto) Start() {
 // Configuration of all handlers of the server
 func (s *PGElasticServerProto) configureHandler() {
 	s.handler.HandleFunc(regexp.MustCompile("^/_cluster/health"), api.HealthHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cluster/stats"), api.ClusterStatsHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cluster/state"), api.ClusterStateHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_nodes(/_local|/_all)?/stats"), api.NodesStatsHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_nodes"), api.NodesHandler, []string{"GET"})
 	s.handler.HandleFunc(regexp.MustCompile("^/_bulk"), api.BulkHandler, []string{"POST"})
 
 	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_mapping/[\\d\\w]+"), api.PutTypeMapping, []string{"PUT"})
@@ -63,8 +67,55 @@ func (s *PGElasticServerProto) configureHandler() {
 	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*"), api.PutIndexHandler, []string{"PUT"})
 	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*"), api.HeadIndexHandler, []string{"HEAD"})
 
-	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_search"), api.FindIndexDocumentHandler, []string{"GET"})
-	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_search"), api.FindDocumentHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_scripts/[^/]+"), api.PutScriptHandler, []string{"PUT", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_scripts/[^/]+"), api.GetScriptHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_scripts/[^/]+"), api.DeleteScriptHandler, []string{"DELETE"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_render/template"), api.RenderTemplateHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_field_caps"), api.FieldCapsAllHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w*,]*/_field_caps"), api.FieldCapsIndexHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/indices"), api.CatIndicesHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/count"), api.CatCountHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/health"), api.CatHealthHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/aliases"), api.CatAliasesHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/templates"), api.CatTemplatesHandler, []string{"GET"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_cat/?$"), api.CatHandler, []string{"GET"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_sql/close"), api.SQLCloseHandler, []string{"POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_sql"), api.SQLHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_search/template"), api.SearchTemplateAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_search/template"), api.SearchTemplateIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_search/template"), api.SearchTemplateDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_msearch/template"), api.MultiSearchTemplateAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_msearch/template"), api.MultiSearchTemplateIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_msearch/template"), api.MultiSearchTemplateDocumentHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_search"), api.FindAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_search"), api.FindIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_search"), api.FindDocumentHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_count"), api.CountAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_count"), api.CountIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_count"), api.CountDocumentHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_msearch"), api.MultiSearchAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_msearch"), api.MultiSearchIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_msearch"), api.MultiSearchDocumentHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_validate/query"), api.ValidateQueryAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_validate/query"), api.ValidateQueryIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_validate/query"), api.ValidateQueryDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_explain/[^/]+"), api.ExplainIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^[^/]+/_explain$"), api.ExplainDocumentHandler, []string{"GET", "POST"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w*]*/_pit"), api.OpenPointInTimeHandler, []string{"POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/_pit"), api.ClosePointInTimeHandler, []string{"DELETE"})
+
+	s.handler.HandleFunc(regexp.MustCompile("^/_mget"), api.MultiGetAllDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFunc(regexp.MustCompile("^/[^_][\\d\\w]*/_mget"), api.MultiGetIndexDocumentHandler, []string{"GET", "POST"})
+	s.handler.HandleFuncEndpoint(regexp.MustCompile("^_mget"), api.MultiGetDocumentHandler, []string{"GET", "POST"})
 
 	s.handler.HandleFuncEndpoint(regexp.MustCompile("^[\\d\\w]*"), api.PutDocumentHandler, []string{"PUT", "POST"})
 	s.handler.HandleFuncEndpoint(regexp.MustCompile("^[\\d\\w]+"), api.GetDocumentHandler, []string{"GET"})
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/asp437/pg_elastic/utils"
+	"io"
 	"net/http"
 	"os"
 	"regexp"
@@ -16,6 +17,20 @@ type ElasticEndpointRequestHandler func(string, string, string, *http.Request, P
 // ElasticRequestHandler is a handler function for any request
 type ElasticRequestHandler func(string, *http.Request, PGElasticServer) (interface{}, error)
 
+// TextOutput is an output of a request which is written as plain text instead of JSON. Headers are added to the
+// response
+type TextOutput struct {
+	ContentType string
+	Headers     map[string]string
+	Text        string
+}
+
+// StatusOutput is an output of a request which is written with a status code other than 200
+type StatusOutput struct {
+	StatusCode int
+	Output     interface{}
+}
+
 type regexpRoute struct {
 	pattern *regexp.Regexp
 	handler ElasticRequestHandler
@@ -40,7 +55,7 @@ type ElasticHandler struct {
 func NewElasticHandler(s PGElasticServer) (result *ElasticHandler) {
 	result = new(ElasticHandler)
 	result.server = s
-	result.endpointPattern = regexp.MustCompile("/(?P<index>\\w+)/(?P<type>[^_]\\w+)/(?P<endpoint>.*)")
+	result.endpointPattern = regexp.MustCompile("/(?P<index>[^_]\\w*)/(?P<type>[^_]\\w+)/(?P<endpoint>.*)")
 	return result
 }
 
@@ -93,8 +108,23 @@ func (h *ElasticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Print output structure in JSON format to ResponseWriter
+// Print output structure in JSON format to ResponseWriter. Text output is written as is
 func (h *ElasticHandler) writeOutput(w http.ResponseWriter, r *http.Request, output interface{}) {
+	statusCode := http.StatusOK
+	if status, ok := output.(StatusOutput); ok {
+		statusCode, output = status.StatusCode, status.Output
+	}
+	if text, ok := output.(TextOutput); ok {
+		w.Header().Set("Content-Type", text.ContentType)
+		for name, value := range text.Headers {
+			w.Header().Set(name, value)
+		}
+		if statusCode != http.StatusOK {
+			w.WriteHeader(statusCode)
+		}
+		io.WriteString(w, text.Text)
+		return
+	}
 	var err error
 	var b []byte
 	if strings.Compare(r.URL.Query().Get("pretty"), "true") == 0 || strings.Compare(r.URL.Query().Get("pretty"), "") == 0 {
@@ -105,16 +135,20 @@ func (h *ElasticHandler) writeOutput(w http.ResponseWriter, r *http.Request, out
 	if err != nil {
 		panic(err)
 	}
+	if statusCode != http.StatusOK {
+		w.WriteHeader(statusCode)
+	}
 	w.Write(b)
 }
 
 // Process output of request processing with respect to errors
 func (h *ElasticHandler) processRequestOutput(w http.ResponseWriter, r *http.Request, output interface{}, err error) {
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		if _, ok := err.(utils.ElasticError); ok {
+			w.WriteHeader((err.(utils.ElasticError)).Status())
 			output = (err.(utils.ElasticError)).FormatErrorResponse()
 		} else {
+			w.WriteHeader(http.StatusInternalServerError)
 			panic(err)
 		}
 	}
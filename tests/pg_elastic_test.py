@@ -54,6 +54,586 @@ class TestBasic:
         response = s.execute()
         assert(response.hits.total == 0)
 
+    def test_search_operator(self):
+        s = Search(index="twitter") \
+            .query("match", message={"query": "trying elastic", "operator": "or"})
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("match", message={"query": "trying elastic", "operator": "and"})
+        response = s.execute()
+        assert(response.hits.total == 0)
+
+        s = Search(index="twitter") \
+            .query("match", message={"query": "trying elastic", "minimum_should_match": "50%"})
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+    def test_custom_analyzer(self):
+        es = connections.get_connection()
+        settings = {"analysis": {"analyzer": {"folded": {"tokenizer": "whitespace", "filter": ["lowercase"]}}}}
+        try:
+            es.indices.create(index="shelf", body={"settings": settings, "mappings": {"book": {"properties": {
+                "title": {"type": "text", "analyzer": "unknown"}}}}})
+            assert(False)
+        except elasticsearch.exceptions.TransportError as e:
+            assert(e.status_code == 400 and e.error == 'mapper_parsing_exception')
+        es.indices.create(index="folded_library", body={"settings": settings, "mappings": {"book": {"properties": {
+            "title": {"type": "text", "analyzer": "folded"}}}}})
+        try:
+            es.indices.put_mapping(index="folded_library", doc_type="magazine", body={"properties": {
+                "title": {"type": "text", "analyzer": "unknown"}}})
+            assert(False)
+        except elasticsearch.exceptions.TransportError as e:
+            assert(e.status_code == 400 and e.error == 'mapper_parsing_exception')
+        es.index(index="folded_library", doc_type="book", id=1, refresh=True, body={"title": "Hello-World Stories"})
+        response = es.search(index="folded_library", body={"query": {"match": {"title": "HELLO-WORLD"}}})
+        assert(response['hits']['total'] == 1)
+        response = es.search(index="folded_library", body={"query": {"match": {"title": "world"}}})
+        assert(response['hits']['total'] == 0)
+
+    def test_search_multi_match(self):
+        s = Search(index="twitter") \
+            .query("multi_match", query="kimchy trying", fields=["message^2", "user"])
+        response = s.execute()
+        assert(response.hits.total == 1)
+        assert(response.hits.max_score > 0)
+
+        s = Search(index="twitter") \
+            .query("multi_match", query="kimchy elasticsearch", fields=["message", "user"], type="cross_fields", operator="and", analyzer="standard")
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("multi_match", query="kimchy trying", fields=["message", "user"], operator="and")
+        response = s.execute()
+        assert(response.hits.total == 0)
+
+        for boost in ["NaN", "Inf", "+Infinity"]:
+            try:
+                body = {"query": {"multi_match": {"query": "kimchy", "fields": ["user"], "boost": boost}}}
+                connections.get_connection().search(index="twitter", body=body)
+                assert(False)
+            except elasticsearch.exceptions.TransportError as e:
+                assert(e.status_code == 400)
+
+    def test_search_query_string(self):
+        s = Search(index="twitter") \
+            .query("query_string", query="user:kimchy AND message:trying")
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("query_string", query="user:kimchy -message:elasticsearch")
+        response = s.execute()
+        assert(response.hits.total == 0)
+
+        s = Search(index="twitter") \
+            .query("simple_query_string", query="kimch* | unknown", fields=["user"])
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+    def test_search_pattern(self):
+        s = Search(index="twitter") \
+            .query("exists", field="post_date")
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("prefix", user="kim")
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("wildcard", user={"value": "K?M*Y", "case_insensitive": True})
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("regexp", user="kim[a-z]{2}")
+        response = s.execute()
+        assert(response.hits.total == 1)
+
+        s = Search(index="twitter") \
+            .query("regexp", user="kim")
+        response = s.execute()
+        assert(response.hits.total == 0)
+
+    def test_search_paths(self):
+        es = connections.get_connection()
+        es.index(index="library", doc_type="book", id=1, refresh=True, body={
+            "title": "Dune", "tags": ["sf", "classic"], "authors": [{"name": "Herbert", "born": 1920}]})
+        es.index(index="library", doc_type="book", id=2, refresh=True, body={
+            "title": "Solaris", "tags": "sf", "authors": [{"name": "Lem", "born": 1921}]})
+
+        response = es.search(index="library", body={"query": {"term": {"tags": "classic"}}})
+        assert(response['hits']['total'] == 1)
+
+        response = es.search(index="library", body={"query": {"range": {"authors.born": {"gt": 1920}}}})
+        assert(response['hits']['total'] == 1)
+        assert(response['hits']['hits'][0]['_id'] == '2')
+
+        response = es.search(index="library", body={"query": {"match": {"authors.name": "lem"}}})
+        assert(response['hits']['total'] == 1)
+
+        response = es.search(index="library", body={"sort": [{"authors.born": "desc"}]})
+        assert(response['hits']['hits'][0]['_id'] == '2')
+
+    def test_search_nested(self):
+        es = connections.get_connection()
+        es.indices.create(index="shop", body={"mappings": {"order": {"properties": {
+            "line_items": {"type": "nested", "properties": {"sku": {"type": "keyword"}, "qty": {"type": "long"}}}}}}})
+        es.index(index="shop", doc_type="order", id=1, refresh=True, body={
+            "line_items": [{"sku": "A", "qty": 1}, {"sku": "B", "qty": 5}]})
+        es.index(index="shop", doc_type="order", id=2, refresh=True, body={
+            "line_items": [{"sku": "A", "qty": 5}]})
+
+        query = {"nested": {"path": "line_items", "inner_hits": {}, "query": {"bool": {"must": [
+            {"term": {"line_items.sku": "A"}}, {"range": {"line_items.qty": {"gte": 5}}}]}}}}
+        response = es.search(index="shop", body={"query": query})
+        assert(response['hits']['total'] == 1)
+        hit = response['hits']['hits'][0]
+        assert(hit['_id'] == '2')
+        assert(hit['inner_hits']['line_items']['hits']['hits'][0]['_source']['sku'] == 'A')
+
+        aggs = {"items": {"nested": {"path": "line_items"}, "aggs": {
+            "skus": {"terms": {"field": "line_items.sku"}, "aggs": {"qty": {"sum": {"field": "line_items.qty"}}}}}}}
+        response = es.search(index="shop", body={"size": 0, "aggs": aggs})
+        items = response['aggregations']['items']
+        assert(items['doc_count'] == 3)
+        assert(items['skus']['buckets'][0]['key'] == 'A')
+        assert(items['skus']['buckets'][0]['doc_count'] == 2)
+        assert(items['skus']['buckets'][0]['qty']['value'] == 6)
+
+    def test_search_scoring(self):
+        es = connections.get_connection()
+        query = {"constant_score": {"filter": {"term": {"tags": "sf"}}, "boost": 2}}
+        response = es.search(index="library", body={"query": query})
+        assert(response['hits']['total'] == 2)
+        assert(response['hits']['max_score'] == 2)
+
+        query = {"boosting": {"positive": {"term": {"tags": "sf"}}, "negative": {"term": {"tags": "classic"}}, "negative_boost": 0.5}}
+        response = es.search(index="library", body={"query": query})
+        assert(response['hits']['hits'][0]['_id'] == '2')
+
+        query = {"function_score": {"field_value_factor": {"field": "authors.born"}, "boost_mode": "replace"}}
+        response = es.search(index="library", body={"query": query})
+        assert(response['hits']['hits'][0]['_id'] == '2')
+        assert(response['hits']['max_score'] == 1921)
+
+        query = {"dis_max": {"queries": [{"term": {"tags": "classic"}}, {"match": {"title": "solaris"}}]}}
+        response = es.search(index="library", body={"query": query})
+        assert(response['hits']['total'] == 2)
+
+    def test_search_geo(self):
+        es = connections.get_connection()
+        es.indices.create(index="stores", body={"mappings": {"store": {"properties": {"location": {"type": "geo_point"}}}}})
+        es.index(index="stores", doc_type="store", id=1, refresh=True, body={"name": "Amsterdam", "location": "52.374, 4.912"})
+        es.index(index="stores", doc_type="store", id=2, refresh=True, body={"name": "Antwerp", "location": [4.405, 51.222]})
+        es.index(index="stores", doc_type="store", id=3, refresh=True, body={"name": "Paris", "location": {"lat": 48.861, "lon": 2.336}})
+
+        query = {"geo_distance": {"distance": "200km", "location": {"lat": 52.376, "lon": 4.894}}}
+        response = es.search(index="stores", body={"query": query})
+        assert(response['hits']['total'] == 2)
+
+        query = {"geo_bounding_box": {"location": {"top_left": "53, 4", "bottom_right": "51, 5"}}}
+        response = es.search(index="stores", body={"query": query})
+        assert(response['hits']['total'] == 2)
+
+        query = {"geo_polygon": {"location": {"points": [[2, 48], [3, 48], [3, 49], [2, 49]]}}}
+        response = es.search(index="stores", body={"query": query})
+        assert(response['hits']['hits'][0]['_id'] == '3')
+
+        sort = [{"_geo_distance": {"location": "48.8, 2.3", "order": "asc", "unit": "km"}}]
+        response = es.search(index="stores", body={"sort": sort})
+        assert(response['hits']['hits'][0]['_id'] == '3')
+        assert(response['hits']['hits'][2]['_id'] == '1')
+
+        aggs = {"rings": {"geo_distance": {"field": "location", "origin": "52.376, 4.894", "unit": "km",
+                                           "ranges": [{"to": 100}, {"from": 100, "to": 300}, {"from": 300}]}},
+                "cells": {"geohash_grid": {"field": "location", "precision": 1}}}
+        response = es.search(index="stores", body={"size": 0, "aggs": aggs})
+        buckets = response['aggregations']['rings']['buckets']
+        assert([bucket['doc_count'] for bucket in buckets] == [1, 1, 1])
+        assert(buckets[0]['key'] == '*-100.0')
+        assert(response['aggregations']['cells']['buckets'][0]['key'] == 'u')
+
+    def test_search_vector(self):
+        es = connections.get_connection()
+        for embedding in [{"type": "dense_vector"}, {"type": "dense_vector", "dims": 3, "similarity": "unknown"}]:
+            try:
+                es.indices.create(index="broken_vectors", body={"mappings": {"doc": {"properties": {"embedding": embedding}}}})
+                assert(False)
+            except elasticsearch.exceptions.TransportError as e:
+                assert(e.status_code == 400)
+            assert(not es.indices.exists(index="broken_vectors"))
+        es.indices.create(index="vectors", body={"mappings": {"doc": {"properties": {
+            "embedding": {"type": "dense_vector", "dims": 3, "similarity": "cosine"}}}}})
+        es.index(index="vectors", doc_type="doc", id=1, refresh=True, body={"color": "red", "embedding": [1, 0, 0]})
+        es.index(index="vectors", doc_type="doc", id=2, refresh=True, body={"color": "green", "embedding": [0, 1, 0]})
+        es.index(index="vectors", doc_type="doc", id=3, refresh=True, body={"color": "orange", "embedding": [0.8, 0.6, 0]})
+
+        knn = {"field": "embedding", "query_vector": [1, 0.1, 0], "k": 2, "num_candidates": 10}
+        response = es.search(index="vectors", body={"knn": knn})
+        assert(response['hits']['total'] == 2)
+        assert(response['hits']['hits'][0]['_id'] == '1')
+        assert(response['hits']['hits'][1]['_id'] == '3')
+
+        knn["filter"] = {"term": {"color": "green"}}
+        response = es.search(index="vectors", body={"knn": knn, "query": {"term": {"color": "red"}}})
+        assert(response['hits']['total'] == 2)
+
+        script = {"source": "cosineSimilarity(params.query_vector, 'embedding') + 1.0", "params": {"query_vector": [0, 1, 0]}}
+        query = {"script_score": {"query": {"match_all": {}}, "script": script}}
+        response = es.search(index="vectors", body={"query": query})
+        assert(response['hits']['hits'][0]['_id'] == '2')
+        assert(response['hits']['max_score'] == 2)
+
+    def test_search_suggest(self):
+        es = connections.get_connection()
+        try:
+            es.indices.create(index="broken_music", body={"mappings": {"song": {"properties": {
+                "suggest": {"type": "completion", "contexts": [{"name": "place", "type": "geo"}]}}}}})
+            assert(False)
+        except elasticsearch.exceptions.TransportError as e:
+            assert(e.status_code == 400)
+        assert(not es.indices.exists(index="broken_music"))
+        es.indices.create(index="music", body={"mappings": {"song": {"properties": {
+            "title": {"type": "text", "analyzer": "simple"},
+            "suggest": {"type": "completion", "contexts": [{"name": "genre", "type": "category"}]}}}}})
+        es.index(index="music", doc_type="song", id=1, refresh=True, body={"title": "nevermind", "suggest": {
+            "input": ["Nevermind", "Nirvana"], "weight": 34, "contexts": {"genre": ["grunge"]}}})
+        es.index(index="music", doc_type="song", id=2, refresh=True, body={"title": "nirvana unplugged", "suggest": {
+            "input": "Nirvana Unplugged", "weight": 10, "contexts": {"genre": ["live"]}}})
+
+        suggest = {"song": {"prefix": "nir", "completion": {"field": "suggest"}}}
+        response = es.search(index="music", body={"suggest": suggest})
+        options = response['suggest']['song'][0]['options']
+        assert([option['text'] for option in options] == ['Nirvana', 'Nirvana Unplugged'])
+        assert(options[0]['_id'] == '1' and options[0]['_score'] == 34)
+
+        suggest["song"]["completion"]["contexts"] = {"genre": ["live"]}
+        response = es.search(index="music", body={"suggest": suggest})
+        assert([option['_id'] for option in response['suggest']['song'][0]['options']] == ['2'])
+
+        suggest = {"song": {"prefix": "nirw", "completion": {"field": "suggest", "fuzzy": {"fuzziness": 1}}}}
+        response = es.search(index="music", body={"suggest": suggest})
+        assert(len(response['suggest']['song'][0]['options']) == 2)
+
+        suggest = {"text": "nirvana unpluged",
+                   "words": {"term": {"field": "title"}},
+                   "phrase": {"phrase": {"field": "title", "highlight": {"pre_tag": "<em>", "post_tag": "</em>"}}}}
+        response = es.search(index="music", body={"suggest": suggest})
+        words = response['suggest']['words']
+        assert(words[0]['options'] == [] and words[1]['offset'] == 8)
+        assert(words[1]['options'][0]['text'] == 'unplugged')
+        option = response['suggest']['phrase'][0]['options'][0]
+        assert(option['text'] == 'nirvana unplugged')
+        assert(option['highlighted'] == 'nirvana <em>unplugged</em>')
+
+    def test_search_highlight(self):
+        es = connections.get_connection()
+        body = {"query": {"match": {"message": "elasticsearch"}},
+                "highlight": {"pre_tags": ["<b>"], "post_tags": ["</b>"], "fields": {"message": {}}}}
+        response = es.search(index="twitter", body=body)
+        hit = response['hits']['hits'][0]
+        assert(hit['highlight']['message'] == ['trying out <b>Elasticsearch</b>'])
+
+        body["highlight"]["fields"] = {"user": {}}
+        response = es.search(index="twitter", body=body)
+        assert('highlight' not in response['hits']['hits'][0])
+
+    def test_search_uri(self):
+        es = connections.get_connection()
+        response = es.search(index="twitter", q="user:kimchy", sort="post_date:desc", size=5)
+        assert(response['hits']['total'] == 1)
+        assert(response['hits']['hits'][0]['_source']['user'] == 'kimchy')
+
+        response = es.search(index="twitter", q="user:nobody")
+        assert(response['hits']['total'] == 0)
+
+        response = es.search(index="twitter", q="user:kimchy", _source="false")
+        assert('_source' not in response['hits']['hits'][0])
+
+    def test_count(self):
+        es = connections.get_connection()
+        assert(es.count(index="twitter")['count'] == 1)
+        assert(es.count(index="twitter", q="user:nobody")['count'] == 0)
+        assert(es.count(index="twitter", doc_type="tweet", body={"query": {"match": {"user": "kimchy"}}})['count'] == 1)
+
+        response = es.search(index="twitter", body={"track_total_hits": True})
+        assert(response['hits']['total'] == {'value': 1, 'relation': 'eq'})
+
+        response = es.search(index="twitter", body={"track_total_hits": False})
+        assert('total' not in response['hits'])
+
+    def test_msearch(self):
+        es = connections.get_connection()
+        body = [{"index": "twitter"}, {"query": {"match": {"user": "kimchy"}}},
+                {}, {"query": {"unknown_query": {}}},
+                {"index": "twitter", "type": "tweet"}, {"query": {"match": {"user": "nobody"}}, "size": 0}]
+        responses = es.msearch(body=body, max_concurrent_searches=2)['responses']
+        assert(len(responses) == 3)
+        assert(responses[0]['status'] == 200 and responses[0]['hits']['total'] == 1)
+        assert('error' in responses[1])
+        assert(responses[2]['hits']['total'] == 0)
+
+        responses = es.msearch(index="twitter", body=[{}, {"query": {"match_all": {}}}])['responses']
+        assert(responses[0]['hits']['hits'][0]['_id'] == '1')
+
+    def test_search_template(self):
+        es = connections.get_connection()
+        source = '{"query": {"match": {"{{field}}": "{{value}}"}}, "size": {{size}}{{^size}}10{{/size}}}'
+        es.put_script(id="by_field", body={"script": {"lang": "mustache", "source": source}})
+        assert(es.get_script(id="by_field")['script']['source'] == source)
+
+        response = es.search_template(index="twitter", body={"id": "by_field", "params": {"field": "user", "value": "kimchy"}})
+        assert(response['hits']['total'] == 1)
+
+        response = es.render_search_template(body={"source": '{"query": {"terms": {"user": {{#toJson}}users{{/toJson}}}}}',
+                                                   "params": {"users": ["kimchy", "bob"]}})
+        assert(response['template_output'] == {"query": {"terms": {"user": ["kimchy", "bob"]}}})
+
+        response = es.render_search_template(id="by_field", body={"params": {"field": "user", "value": 'say "hi"', "size": 1}})
+        assert(response['template_output']['query']['match']['user'] == 'say "hi"')
+        assert(response['template_output']['size'] == 1)
+
+        body = [{"index": "twitter"}, {"id": "by_field", "params": {"field": "user", "value": "nobody"}},
+                {"index": "twitter"}, {"id": "missing", "params": {}}]
+        responses = es.msearch_template(body=body)['responses']
+        assert(responses[0]['hits']['total'] == 0 and 'error' in responses[1])
+
+        es.delete_script(id="by_field")
+        assert(not es.get_script(id="by_field")['found'])
+
+    def test_explain(self):
+        es = connections.get_connection()
+        response = es.indices.validate_query(index="twitter", explain=True, body={"query": {"match": {"user": "kimchy"}}})
+        assert(response['valid'] and 'twitter_tweet' in response['explanations'][0]['explanation'])
+        response = es.indices.validate_query(index="twitter", body={"query": {"unknown_query": {}}})
+        assert(not response['valid'])
+
+        query = {"bool": {"must": [{"match": {"user": "kimchy"}}], "should": [{"term": {"user": "bob"}}]}}
+        response = es.explain(index="twitter", doc_type="tweet", id=1, body={"query": query})
+        assert(response['matched'])
+        details = response['explanation']['details']
+        assert(details[0]['value'] > 0 and details[1]['value'] == 0)
+
+        response = es.search(index="twitter", q="user:kimchy", params={"explain_sql": "true"})
+        assert('twitter_tweet' in response['explain_sql']['sql'] and response['explain_sql']['plan'])
+
+    def test_search_after(self):
+        es = connections.get_connection()
+        for i in range(5):
+            es.index(index="pages", doc_type="page", id=i, refresh=True, body={"number": i % 3})
+        body = {"size": 2, "sort": [{"number": "desc"}, {"_id": "asc"}]}
+        response = es.search(index="pages", body=body)
+        assert([hit['_id'] for hit in response['hits']['hits']] == ['2', '1'])
+        body["search_after"] = response['hits']['hits'][-1]['sort']
+        response = es.search(index="pages", body=body)
+        assert([hit['_id'] for hit in response['hits']['hits']] == ['4', '0'])
+        assert(response['hits']['total'] == 5)
+
+        pit = es.transport.perform_request('POST', '/pages/_pit', params={"keep_alive": "1m"})['id']
+        es.index(index="pages", doc_type="page", id=5, refresh=True, body={"number": 3})
+        body = {"size": 3, "sort": [{"number": "desc"}], "pit": {"id": pit, "keep_alive": "1m"}}
+        response = es.search(body=body)
+        assert(response['pit_id'] == pit)
+        assert([hit['_id'] for hit in response['hits']['hits']] == ['2', '1', '4'])
+        body["search_after"] = response['hits']['hits'][-1]['sort']
+        response = es.search(body=body)
+        assert([hit['_id'] for hit in response['hits']['hits']] == ['0', '3'])
+        response = es.transport.perform_request('DELETE', '/_pit', body={"id": pit})
+        assert(response['num_freed'] == 1)
+
+    def test_point_in_time_limits(self):
+        es = connections.get_connection()
+        es.index(index="snapshots", doc_type="page", id=1, refresh=True, body={"number": 1})
+        try:
+            es.transport.perform_request('POST', '/snapshots/_pit', params={"keep_alive": "2d"})
+            assert(False)
+        except elasticsearch.exceptions.TransportError as e:
+            assert(e.status_code == 400)
+        pits = []
+        try:
+            for i in range(16):
+                pits.append(es.transport.perform_request('POST', '/snapshots/_pit', params={"keep_alive": "1m"})['id'])
+            try:
+                es.transport.perform_request('POST', '/snapshots/_pit', params={"keep_alive": "1m"})
+                assert(False)
+            except elasticsearch.exceptions.TransportError as e:
+                assert(e.status_code == 429)
+            assert(es.search(index="snapshots")['hits']['total'] == 1)
+        finally:
+            for pit in pits:
+                es.transport.perform_request('DELETE', '/_pit', body={"id": pit})
+        pit = es.transport.perform_request('POST', '/snapshots/_pit', params={"keep_alive": "1m"})['id']
+        es.transport.perform_request('DELETE', '/_pit', body={"id": pit})
+
+    def test_search_options(self):
+        es = connections.get_connection()
+        for i in range(6):
+            body = {"color": ["red", "blue", "green"][i % 3], "price": i, "text": "cheap" if i < 3 else "expensive"}
+            es.index(index="shop", doc_type="item", id=i, refresh=True, body=body)
+        body = {"post_filter": {"term": {"color": "red"}}, "aggs": {"colors": {"terms": {"field": "color"}}}}
+        response = es.search(index="shop", body=body)
+        assert(sorted(hit['_id'] for hit in response['hits']['hits']) == ['0', '3'])
+        assert(len(response['aggregations']['colors']['buckets']) == 3)
+
+        body = {"collapse": {"field": "color", "inner_hits": {"name": "cheapest", "size": 1, "sort": [{"price": "asc"}]}},
+                "sort": [{"price": "desc"}]}
+        response = es.search(index="shop", body=body)
+        assert([hit['_id'] for hit in response['hits']['hits']] == ['5', '4', '3'])
+        assert(response['hits']['hits'][0]['inner_hits']['cheapest']['hits']['hits'][0]['_id'] == '2')
+
+        body = {"query": {"match": {"text": "cheap"}}, "min_score": 0.0001, "terminate_after": 2}
+        response = es.search(index="shop", body=body)
+        assert(response['terminated_early'])
+        assert(len(response['hits']['hits']) == 2)
+
+        body = {"query": {"match_all": {}}, "timeout": "10s",
+                "rescore": {"window_size": 6, "query": {"rescore_query": {"term": {"color": "green"}}, "rescore_query_weight": 5}}}
+        response = es.search(index="shop", body=body)
+        assert(not response['timed_out'])
+        assert(sorted(hit['_id'] for hit in response['hits']['hits'][:2]) == ['2', '5'])
+
+    def test_advanced_aggregations(self):
+        es = connections.get_connection()
+        for i in range(6):
+            body = {"color": ["red", "blue", "green"][i % 3], "price": i * 10}
+            es.index(index="sales", doc_type="sale", id=i, refresh=True, body=body)
+        body = {"size": 0, "aggs": {
+            "colors": {"terms": {"field": "color"}, "aggs": {
+                "top": {"top_hits": {"size": 1, "sort": [{"price": "desc"}]}},
+                "total": {"sum": {"field": "price"}},
+                "running": {"cumulative_sum": {"buckets_path": "total"}},
+                "average": {"bucket_script": {"buckets_path": {"sum": "total", "count": "_count"}, "script": "params.sum / params.count"}},
+                "best": {"bucket_sort": {"sort": [{"total": "desc"}], "size": 2}}}},
+            "median": {"percentiles": {"field": "price", "percents": [50]}},
+            "spread": {"extended_stats": {"field": "price"}},
+            "cheap": {"filter": {"range": {"price": {"lt": 30}}}},
+            "groups": {"filters": {"filters": {"red": {"term": {"color": "red"}}}, "other_bucket": True}},
+            "no_color": {"missing": {"field": "color"}}}}
+        response = es.search(index="sales", body=body)
+        aggregations = response['aggregations']
+        buckets = aggregations['colors']['buckets']
+        assert([bucket['key'] for bucket in buckets] == ['green', 'blue'])
+        assert(buckets[0]['top']['hits']['hits'][0]['_id'] == '5')
+        assert(buckets[0]['average']['value'] == 35)
+        assert(aggregations['median']['values']['50.0'] == 25)
+        assert(aggregations['spread']['count'] == 6)
+        assert(aggregations['cheap']['doc_count'] == 3)
+        assert(aggregations['groups']['buckets']['_other_']['doc_count'] == 4)
+        assert(aggregations['no_color']['doc_count'] == 0)
+
+        body = {"size": 0, "aggs": {"pages": {"composite": {"size": 2, "sources": [{"color": {"terms": {"field": "color"}}}]}}}}
+        response = es.search(index="sales", body=body)
+        assert([bucket['key']['color'] for bucket in response['aggregations']['pages']['buckets']] == ['blue', 'green'])
+        body['aggs']['pages']['composite']['after'] = response['aggregations']['pages']['after_key']
+        response = es.search(index="sales", body=body)
+        assert([bucket['key']['color'] for bucket in response['aggregations']['pages']['buckets']] == ['red'])
+
+    def test_sql(self):
+        es = connections.get_connection()
+        for i in range(5):
+            body = {"name": "item%d" % i, "kind": ["tool", "toy"][i % 2], "price": i * 10}
+            es.index(index="catalog", doc_type="product", id=i, refresh=True, body=body)
+        body = {"query": "SELECT kind, COUNT(*) AS n, SUM(price) FROM catalog GROUP BY kind ORDER BY n DESC"}
+        response = es.transport.perform_request('POST', '/_sql', body=body)
+        assert([column['name'] for column in response['columns']] == ['kind', 'n', 'SUM(price)'])
+        assert(response['rows'] == [['tool', 3, 60], ['toy', 2, 40]])
+
+        body = {"query": "SELECT name FROM catalog WHERE price >= 10 ORDER BY price", "fetch_size": 3}
+        response = es.transport.perform_request('POST', '/_sql', body=body)
+        assert(response['rows'] == [['item1'], ['item2'], ['item3']])
+        response = es.transport.perform_request('POST', '/_sql', body={"cursor": response['cursor']})
+        assert(response['rows'] == [['item4']] and 'cursor' not in response)
+
+        body = {"query": "SELECT name FROM catalog WHERE kind = 'toy' ORDER BY name"}
+        response = es.transport.perform_request('POST', '/_sql', params={"format": "txt"}, body=body)
+        assert(response == "name \n-----\nitem1\nitem3\n")
+
+        for statement in ["DELETE FROM catalog", "SELECT name FROM catalog; DROP TABLE catalog_product",
+                          "SELECT * FROM pg_catalog.pg_tables", "SELECT pg_sleep(1) FROM catalog"]:
+            try:
+                es.transport.perform_request('POST', '/_sql', body={"query": statement})
+                assert(False)
+            except elasticsearch.exceptions.TransportError:
+                pass
+
+    def test_field_caps(self):
+        es = connections.get_connection()
+        es.indices.create(index="metrics1", body={"mappings": {"point": {"properties": {
+            "host": {"type": "keyword"}, "value": {"type": "long"}, "note": {"type": "text", "index": False}}}}})
+        es.index(index="metrics1", doc_type="point", id=1, refresh=True, body={"host": "a", "value": 1, "note": "x"})
+        es.index(index="metrics2", doc_type="point", id=1, refresh=True, body={"host": "b", "value": 1.5, "up": True})
+        response = es.transport.perform_request('GET', '/metrics*/_field_caps', params={"fields": "host,value,up,_id"})
+        fields = response['fields']
+        assert(response['indices'] == ['metrics1', 'metrics2'])
+        assert(sorted(fields['host'].keys()) == ['keyword', 'text'])
+        assert(fields['host']['keyword']['aggregatable'] and fields['host']['keyword']['indices'] == ['metrics1'])
+        assert(not fields['host']['text']['aggregatable'])
+        assert(fields['value']['float']['indices'] == ['metrics2'])
+        assert(fields['up']['boolean']['searchable'] and 'indices' not in fields['up']['boolean'])
+        assert(fields['_id']['_id']['metadata_field'])
+        response = es.transport.perform_request('GET', '/metrics1/_field_caps', params={"fields": "n*"})
+        assert(not response['fields']['note']['text']['searchable'])
+
+    def test_cat(self):
+        es = connections.get_connection()
+        es.index(index="logs1", doc_type="entry", id=1, refresh=True, body={"message": "a"})
+        es.index(index="logs2", doc_type="entry", id=1, refresh=True, body={"message": "b"})
+        response = es.transport.perform_request('GET', '/_cat/indices/logs*', params={"v": "true", "h": "i,pri,rep"})
+        assert(response == "index pri rep\nlogs1    1   0\nlogs2    1   0\n")
+        response = es.transport.perform_request('GET', '/_cat/indices/logs*',
+                                                params={"format": "json", "s": "index:desc", "bytes": "b"})
+        assert([row['index'] for row in response] == ['logs2', 'logs1'])
+        assert(all(int(row['store.size']) > 0 for row in response))
+        response = es.transport.perform_request('GET', '/_cat/health', params={"format": "json", "h": "cluster"})
+        assert(response == [{"cluster": "pg_elastic_cluster"}])
+        response = es.transport.perform_request('GET', '/_cat/templates', params={"format": "json"})
+        assert(response == [])
+        try:
+            es.transport.perform_request('GET', '/_cat/indices', params={"h": "unknown"})
+            assert(False)
+        except elasticsearch.exceptions.TransportError:
+            pass
+
+    def test_cluster_health(self):
+        es = connections.get_connection()
+        es.index(index="events", doc_type="event", id=1, refresh=True, body={"name": "a"})
+        response = es.cluster.health(level="indices")
+        assert(response['status'] in ['green', 'yellow'] and response['number_of_data_nodes'] == 1)
+        assert(response['indices']['events']['active_primary_shards'] == 1)
+        response = es.cluster.health(index="events", wait_for_status="yellow", timeout="1s")
+        assert(not response['timed_out'] and response['active_primary_shards'] == 1)
+        response = es.cluster.stats()
+        assert(response['indices']['count'] >= 1 and response['postgres']['xact_commit'] > 0)
+        response = es.nodes.stats()
+        node = list(response['nodes'].values())[0]
+        assert(response['_nodes']['total'] == 1 and node['runtime']['goroutines'] > 0)
+        response = es.cluster.state(metric="metadata", index="events")
+        assert(list(response['metadata']['indices'].keys()) == ['events'])
+
+    def test_source_filtering(self):
+        es = connections.get_connection()
+        response = es.search(index="twitter", q="user:kimchy", _source_includes="user")
+        assert(response['hits']['hits'][0]['_source'] == {'user': 'kimchy'})
+
+        body = {"query": {"match": {"user": "kimchy"}}, "_source": {"excludes": ["post_*"]}, "fields": ["user"]}
+        response = es.search(index="twitter", body=body)
+        hit = response['hits']['hits'][0]
+        assert('post_date' not in hit['_source'] and 'message' in hit['_source'])
+        assert(hit['fields'] == {'user': ['kimchy']})
+
+        response = es.get(index="twitter", doc_type="tweet", id=1, stored_fields="user")
+        assert('_source' not in response and response['fields'] == {'user': ['kimchy']})
+
+        response = es.mget(index="twitter", doc_type="tweet", body={"ids": ["1", "404"]}, _source_includes="message")
+        assert(response['docs'][0]['_source'] == {'message': 'trying out Elasticsearch'})
+        assert(not response['docs'][1]['found'])
+
     def test_health(self):
         health = connections.get_connection().cluster.health()
         assert(health['status'] == 'yellow' or health['status'] == 'green')
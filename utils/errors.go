@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"net/http"
 )
 
 // ElasticError is a basic interface for any kind of errors produced by pg-elastic and can be represented as a JSON error report
@@ -9,6 +10,7 @@ type ElasticError interface {
 	error
 	Type() string
 	Reason() string
+	Status() int
 	FormatErrorResponse() interface{}
 }
 
@@ -16,6 +18,7 @@ type ElasticError interface {
 type ElasticErrorGeneral struct {
 	TypeVal   string `json:"type"`
 	ReasonVal string `json:"reason"`
+	StatusVal int    `json:"-"`
 }
 
 // ElasticErrorGeneralResponse represents a response format for JSON error report
@@ -57,6 +60,16 @@ type IllegalQueryError struct {
 	ElasticErrorGeneral
 }
 
+// MapperParsingError is error caused by wrong type mapping
+type MapperParsingError struct {
+	ElasticErrorGeneral
+}
+
+// RejectedExecutionError is error caused by exceeding a limit of resources held by requests
+type RejectedExecutionError struct {
+	ElasticErrorGeneral
+}
+
 func (err *ElasticErrorGeneral) Error() string {
 	return fmt.Sprintf("Error type: %s, Reason: %s", err.Type(), err.Reason())
 }
@@ -71,15 +84,23 @@ func (err *ElasticErrorGeneral) Reason() string {
 	return err.ReasonVal
 }
 
+// Status returns HTTP status code of the error. Errors without status are internal errors
+func (err *ElasticErrorGeneral) Status() int {
+	if err.StatusVal == 0 {
+		return http.StatusInternalServerError
+	}
+	return err.StatusVal
+}
+
 // FormatErrorResponse generates an JSON output for an error
 func (err *ElasticErrorGeneral) FormatErrorResponse() interface{} {
 	output := make(map[string]interface{})
 	errorDesc := ElasticErrorGeneralResponse{}
-	errorDesc.RootCause = []ElasticErrorGeneral{{err.Type(), err.Reason()}}
+	errorDesc.RootCause = []ElasticErrorGeneral{{err.Type(), err.Reason(), err.Status()}}
 	errorDesc.ReasonVal = err.Reason()
 	errorDesc.TypeVal = err.Type()
 	output["error"] = errorDesc
-	output["status"] = 500
+	output["status"] = err.Status()
 	return output
 }
 
@@ -92,27 +113,37 @@ func (err *ElasticErrorBulk) FormatErrorResponse() interface{} {
 
 // NewJSONWrongFormatError creates a new instance of JSONWrongFormatError
 func NewJSONWrongFormatError(reason string) *JSONWrongFormatError {
-	return &JSONWrongFormatError{ElasticErrorGeneral{"json_parse_exception", reason}}
+	return &JSONWrongFormatError{ElasticErrorGeneral{"json_parse_exception", reason, http.StatusBadRequest}}
 }
 
 // NewDBQueryError creates a new instance of DBQueryError
 func NewDBQueryError(reason string) *DBQueryError {
-	return &DBQueryError{ElasticErrorGeneral{"db_query_exception", reason}}
+	return &DBQueryError{ElasticErrorGeneral{"db_query_exception", reason, http.StatusInternalServerError}}
 }
 
 // NewInternalIOError creates a new instance of InternalIOError
 func NewInternalIOError(reason string) *InternalIOError {
-	return &InternalIOError{ElasticErrorGeneral{"internal_io_exception", reason}}
+	return &InternalIOError{ElasticErrorGeneral{"internal_io_exception", reason, http.StatusInternalServerError}}
 }
 
 // NewInternalError creates a new instance of InternalError
 func NewInternalError(reason string) *InternalError {
-	return &InternalError{ElasticErrorGeneral{"internal_exception", reason}}
+	return &InternalError{ElasticErrorGeneral{"internal_exception", reason, http.StatusInternalServerError}}
 }
 
 // NewIllegalQueryError creates a new instance of IllegalQueryError
 func NewIllegalQueryError(reason string) *IllegalQueryError {
-	return &IllegalQueryError{ElasticErrorGeneral{"illegal_query_exception", reason}}
+	return &IllegalQueryError{ElasticErrorGeneral{"illegal_query_exception", reason, http.StatusBadRequest}}
+}
+
+// NewMapperParsingError creates a new instance of MapperParsingError
+func NewMapperParsingError(reason string) *MapperParsingError {
+	return &MapperParsingError{ElasticErrorGeneral{"mapper_parsing_exception", reason, http.StatusBadRequest}}
+}
+
+// NewRejectedExecutionError creates a new instance of RejectedExecutionError
+func NewRejectedExecutionError(reason string) *RejectedExecutionError {
+	return &RejectedExecutionError{ElasticErrorGeneral{"rejected_execution_exception", reason, http.StatusTooManyRequests}}
 }
 
 // NewElasticErrorBulk creates a new instance of ElasticErrorBulk
@@ -123,5 +154,6 @@ func NewElasticErrorBulk(err ElasticError, index, shard, indexUUID string) *Elas
 	output.Shard = shard
 	output.ReasonVal = err.Reason()
 	output.TypeVal = err.Type()
+	output.StatusVal = err.Status()
 	return output
 }
@@ -1,23 +1,185 @@
 package utils
 
-// FieldMapping represents a processing mapping for a field
+import (
+	"encoding/json"
+)
+
+// FieldMapping represents a processing mapping for a field. Dims, Similarity and Indexed describe dense_vector fields,
+// Contexts describe completion fields
 type FieldMapping struct {
-	TypeName string `json:"type"`
-	Analyzer string `json:"analyzer"`
+	TypeName       string           `json:"type"`
+	Analyzer       string           `json:"analyzer"`
+	SearchAnalyzer string           `json:"search_analyzer"`
+	Dims           int              `json:"dims"`
+	Similarity     string           `json:"similarity"`
+	Indexed        bool             `json:"index"`
+	Contexts       []ContextMapping `json:"contexts"`
+}
+
+// ContextMapping is a context of a completion field. Values of a context with path are taken from the field of a
+// document instead of contexts of completion inputs
+type ContextMapping struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Path string `json:"path"`
 }
 
-// GetFieldMapping extracts field mapping from type mapping object
+// GetFieldMapping extracts field mapping from type mapping object. Dotted names are resolved through properties of
+// object fields
 func GetFieldMapping(mapping map[string]interface{}, fieldName string) (*FieldMapping, bool) {
-	if propertiesRaw, ok := mapping["properties"]; ok {
-		properties := propertiesRaw.(map[string]interface{})
-		if config, ok := properties[fieldName]; ok {
-			configMap := config.(map[string]interface{})
-			var fieldMapping FieldMapping
-			fieldMapping.TypeName, _ = configMap["type"].(string)
-			fieldMapping.Analyzer, _ = configMap["analyzer"].(string)
-			return &fieldMapping, true
+	config, ok := lookupField(mapping, fieldName)
+	if !ok {
+		return nil, false
+	}
+	var fieldMapping FieldMapping
+	fieldMapping.TypeName, _ = config["type"].(string)
+	fieldMapping.Analyzer, _ = config["analyzer"].(string)
+	fieldMapping.SearchAnalyzer, _ = config["search_analyzer"].(string)
+	if dims, ok := config["dims"].(float64); ok {
+		fieldMapping.Dims = int(dims)
+	}
+	fieldMapping.Similarity, _ = config["similarity"].(string)
+	if len(fieldMapping.Similarity) == 0 {
+		fieldMapping.Similarity = "cosine"
+	}
+	fieldMapping.Indexed = config["index"] != false
+	contexts, _ := config["contexts"].([]interface{})
+	for _, rawContext := range contexts {
+		if context, ok := rawContext.(map[string]interface{}); ok {
+			var contextMapping ContextMapping
+			contextMapping.Name, _ = context["name"].(string)
+			contextMapping.Type, _ = context["type"].(string)
+			contextMapping.Path, _ = context["path"].(string)
+			fieldMapping.Contexts = append(fieldMapping.Contexts, contextMapping)
+		}
+	}
+	return &fieldMapping, true
+}
+
+// FindFieldsOfType returns dotted names of fields of the mapping with the type. Objects of nested fields are skipped
+func FindFieldsOfType(mapping map[string]interface{}, typeName string) []string {
+	var result []string
+	properties, _ := mapping["properties"].(map[string]interface{})
+	for name, rawConfig := range properties {
+		config, ok := rawConfig.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fieldType, _ := config["type"].(string)
+		switch {
+		case fieldType == typeName:
+			result = append(result, name)
+		case fieldType == "" || fieldType == "object":
+			for _, field := range FindFieldsOfType(config, typeName) {
+				result = append(result, name+"."+field)
+			}
+		}
+	}
+	return result
+}
+
+// MappedFields returns types of all fields of the mapping by their dotted names. Object and nested fields are not
+// returned, their properties are
+func MappedFields(mapping map[string]interface{}) map[string]string {
+	result := make(map[string]string)
+	properties, _ := mapping["properties"].(map[string]interface{})
+	for name, rawConfig := range properties {
+		config, ok := rawConfig.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fieldType, _ := config["type"].(string)
+		if _, ok := config["properties"]; ok && (fieldType == "" || fieldType == "object" || fieldType == "nested") {
+			for field, typeName := range MappedFields(config) {
+				result[name+"."+field] = typeName
+			}
+		} else if len(fieldType) > 0 {
+			result[name] = fieldType
+		}
+	}
+	return result
+}
+
+// Find configuration of the field in properties of the mapping. Names containing dots are looked up as a whole first,
+// then as paths into object fields
+func lookupField(mapping map[string]interface{}, fieldName string) (map[string]interface{}, bool) {
+	properties, _ := mapping["properties"].(map[string]interface{})
+	if config, ok := properties[fieldName].(map[string]interface{}); ok {
+		return config, true
+	}
+	for i := range fieldName {
+		if fieldName[i] != '.' {
+			continue
+		}
+		if config, ok := properties[fieldName[:i]].(map[string]interface{}); ok {
+			if result, ok := lookupField(config, fieldName[i+1:]); ok {
+				return result, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ParseOptions parses JSON options of an index or a type. Empty options are treated as an empty object
+func ParseOptions(options string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if len(options) == 0 {
+		return result, nil
+	}
+	err := json.Unmarshal([]byte(options), &result)
+	if err != nil {
+		return nil, NewJSONWrongFormatError(err.Error())
+	}
+	if result == nil {
+		result = make(map[string]interface{})
+	}
+	return result, nil
+}
+
+// ExtractTypeMapping extracts a mapping of the type from options object. Options could be a plain mapping, a mapping
+// wrapped by type name or a full index definition with "mappings" section
+func ExtractTypeMapping(options map[string]interface{}, typeName string) (map[string]interface{}, bool) {
+	if _, ok := options["properties"]; ok {
+		return options, true
+	}
+	if mappings, ok := options["mappings"].(map[string]interface{}); ok {
+		if mapping, ok := mappings[typeName].(map[string]interface{}); ok {
+			return mapping, true
+		}
+		if mapping, ok := mappings["_default_"].(map[string]interface{}); ok {
+			return mapping, true
 		}
 		return nil, false
 	}
+	if mapping, ok := options[typeName].(map[string]interface{}); ok {
+		return mapping, true
+	}
 	return nil, false
 }
+
+// ExtractTypeMappings extracts mappings of all types from "mappings" section of index options
+func ExtractTypeMappings(options map[string]interface{}) map[string]map[string]interface{} {
+	result := make(map[string]map[string]interface{})
+	if mappings, ok := options["mappings"].(map[string]interface{}); ok {
+		for typeName, mapping := range mappings {
+			if mappingMap, ok := mapping.(map[string]interface{}); ok {
+				result[typeName] = mappingMap
+			}
+		}
+	}
+	return result
+}
+
+// ExtractIndexSettings extracts settings object from index options. Settings could be wrapped by "index" key
+func ExtractIndexSettings(options map[string]interface{}) map[string]interface{} {
+	settings, ok := options["settings"].(map[string]interface{})
+	if !ok {
+		return make(map[string]interface{})
+	}
+	if indexSettings, ok := settings["index"].(map[string]interface{}); ok {
+		if _, ok := settings["analysis"]; !ok {
+			return indexSettings
+		}
+	}
+	return settings
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// QuoteLiteral quotes a string as SQL string literal. NUL characters are not allowed in PostgreSQL strings, so they
+// are removed
+func QuoteLiteral(value string) string {
+	value = strings.Replace(value, "\000", "", -1)
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// FormatFloat formats a float number as SQL literal
+func FormatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}